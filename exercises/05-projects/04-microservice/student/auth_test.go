@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestService(t *testing.T) *UserService {
+	t.Helper()
+	return newTestServiceWith(t, func(*Config) {})
+}
+
+// newTestServiceWith lets a test adjust the configuration before the
+// service is built.
+func newTestServiceWith(t *testing.T, configure func(*Config)) *UserService {
+	t.Helper()
+	config := &Config{
+		ServiceName: "user-service",
+		DatabaseURL: "file::memory:",
+		LogLevel:    "warn",
+		JWTSecret:   testSecret,
+	}
+	configure(config)
+	service, err := NewUserService(config)
+	if err != nil {
+		t.Fatalf("NewUserService: %v", err)
+	}
+	t.Cleanup(func() { service.Shutdown(context.Background()) })
+	return service
+}
+
+// testSecret is the JWT secret of test services; testToken signs with it.
+const testSecret = "test-secret"
+
+func testToken(t *testing.T, claims *Claims) string {
+	t.Helper()
+	token, err := signClaims([]byte(testSecret), claims)
+	if err != nil {
+		t.Fatalf("signClaims: %v", err)
+	}
+	return token
+}
+
+func TestAuthorization(t *testing.T) {
+	service := newTestService(t)
+	for _, name := range []string{"Alice", "Bob"} {
+		body := `{"name":"` + name + `","email":"` + strings.ToLower(name) + `@example.com"}`
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, httptest.NewRequest("POST", "/api/users", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: expected 201, got %d", name, rec.Code)
+		}
+	}
+
+	alice := testToken(t, &Claims{UserID: 1, Username: "alice", Roles: []Role{RoleUser}})
+	admin := testToken(t, &Claims{UserID: 99, Username: "root", Roles: []Role{RoleAdmin}})
+	readOnly := testToken(t, &Claims{UserID: 2, Username: "bob", Scopes: []Permission{PermUsersRead}})
+	expired := testToken(t, &Claims{UserID: 1, Roles: []Role{RoleUser}, IssuedAt: 1, ExpiresAt: 2})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"anonymous read", "GET", "/api/users/1", "", http.StatusUnauthorized},
+		{"expired token", "GET", "/api/users/1", expired, http.StatusUnauthorized},
+		{"forged token", "GET", "/api/users/1", alice + "x", http.StatusUnauthorized},
+		{"user reads other", "GET", "/api/users/2", alice, http.StatusOK},
+		{"user updates self", "PUT", "/api/users/1", alice, http.StatusOK},
+		{"user updates other", "PUT", "/api/users/2", alice, http.StatusForbidden},
+		{"scope without write", "PUT", "/api/users/2", readOnly, http.StatusForbidden},
+		{"admin updates other", "PUT", "/api/users/2", admin, http.StatusOK},
+		{"user deletes other", "DELETE", "/api/users/2", alice, http.StatusForbidden},
+		{"admin deletes other", "DELETE", "/api/users/2", admin, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name":"Renamed","email":"renamed` + path.Base(tt.path) + `@example.com"}`
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			service.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
+
+// TestTokenKeyWithoutSecret checks that a service without a JWT secret
+// signs with a key of its own rather than one shared with every other
+// unconfigured instance, and that production refuses to start without one.
+func TestTokenKeyWithoutSecret(t *testing.T) {
+	first := newTestServiceWith(t, func(c *Config) { c.JWTSecret = "" })
+	second := newTestServiceWith(t, func(c *Config) { c.JWTSecret = "" })
+
+	token, err := signClaims(first.tokenKey, &Claims{UserID: 1, Roles: []Role{RoleUser}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(first.tokenKey, token); err != nil {
+		t.Errorf("expected the signing service to accept its token, got %v", err)
+	}
+	if _, err := validateToken(second.tokenKey, token); err != ErrInvalidToken {
+		t.Errorf("expected another service to reject the token, got %v", err)
+	}
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("ENVIRONMENT", "production")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("expected production without JWT_SECRET to fail")
+	}
+	t.Setenv("ENVIRONMENT", "development")
+	if config, err := LoadConfig(); err != nil || config.JWTSecret != "" {
+		t.Errorf("expected development to load without a secret, got %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Paths the orchestrator probes. They must stay registered in routes.
+const (
+	livenessPath  = "/livez"
+	readinessPath = "/readyz"
+)
+
+// DeploySpec is everything the deployment artifacts are rendered from.
+type DeploySpec struct {
+	Config *Config
+	Image  string
+	// Replicas is the Kubernetes replica count: 0 or 1, since the SQLite
+	// database and queue log cannot be shared between pods.
+	Replicas int
+	// StorageSize is the size of the volume claimed for the data.
+	StorageSize string
+	// Package is the Go package built into the image, relative to the
+	// module root, which is also the Docker build context.
+	Package string
+	// Context is the module root relative to the output directory, used
+	// as the compose build context, and Dockerfile is the generated
+	// Dockerfile relative to the module root.
+	Context    string
+	Dockerfile string
+	// Components are the service's lifecycle components. Their stop
+	// deadlines decide how long the orchestrator waits before killing it.
+	Components []stopDeadline
+}
+
+// envVar is one setting passed to the container.
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// configEnv lists the environment variables LoadConfig reads, with the
+// values from cfg. Each name is the upper-cased JSON name of its field;
+// fields without one, such as the JWT secret, are never rendered in plain
+// text.
+func configEnv(cfg *Config) []envVar {
+	var vars []envVar
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		vars = append(vars, envVar{Name: strings.ToUpper(name), Value: fmt.Sprint(v.Field(i).Interface())})
+	}
+	return vars
+}
+
+// ShutdownGracePeriod is how long the orchestrator should wait between
+// SIGTERM and SIGKILL: the deadline main gives the shutdown, plus a little
+// slack for the process to exit.
+func (d *DeploySpec) ShutdownGracePeriod() time.Duration {
+	var total time.Duration
+	for _, c := range d.Components {
+		total += c.Timeout
+	}
+	return total + 5*time.Second
+}
+
+func (d *DeploySpec) Env() []envVar { return configEnv(d.Config) }
+
+func (d *DeploySpec) Name() string { return d.Config.ServiceName }
+
+// OTLPCollector reports whether traces go to an OTLP endpoint, in which
+// case compose also runs the bundled collector.
+func (d *DeploySpec) OTLPCollector() bool {
+	return strings.HasPrefix(d.Config.TraceExporter, "http://") || strings.HasPrefix(d.Config.TraceExporter, "https://")
+}
+
+// ComponentNames lists the components in registration order.
+func (d *DeploySpec) ComponentNames() string {
+	var names []string
+	for _, c := range d.Components {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+var deployFuncs = template.FuncMap{
+	"quote":   strconv.Quote,
+	"seconds": func(d time.Duration) int { return int((d + time.Second - 1) / time.Second) },
+}
+
+var deployTemplates = map[string]*template.Template{
+	"Dockerfile": template.Must(template.New("Dockerfile").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+# Build context: the module root.
+
+FROM golang:1.24-bookworm AS build
+WORKDIR /src
+COPY go.mod go.sum ./
+RUN go mod download
+COPY . .
+# go-sqlite3 needs cgo, so the binary links against glibc.
+RUN CGO_ENABLED=1 go build -trimpath -ldflags="-s -w" -o /out/{{.Name}} ./{{.Package}}
+
+FROM gcr.io/distroless/base-debian12:nonroot
+COPY --from=build /out/{{.Name}} /usr/local/bin/{{.Name}}
+# Relative file paths in DATABASE_URL and QUEUE_URL land in the data volume.
+WORKDIR /data
+VOLUME /data
+EXPOSE {{.Config.Port}}
+STOPSIGNAL SIGTERM
+ENTRYPOINT ["/usr/local/bin/{{.Name}}"]
+`)),
+
+	"docker-compose.yml": template.Must(template.New("compose").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+services:
+  {{.Name}}:
+    build:
+      context: {{quote .Context}}
+      dockerfile: {{quote .Dockerfile}}
+    image: {{quote .Image}}
+    ports:
+      - "{{.Config.Port}}:{{.Config.Port}}"
+    environment:
+{{- range .Env}}
+      {{.Name}}: {{quote .Value}}
+{{- end}}
+      JWT_SECRET: ${JWT_SECRET:?set JWT_SECRET}
+    volumes:
+      - data:/data
+    healthcheck:
+      test: ["CMD", "/usr/local/bin/{{.Name}}", "probe", "http://127.0.0.1:{{.Config.Port}}{{.ReadinessPath}}"]
+      interval: 10s
+      timeout: 3s
+      retries: 3
+      start_period: 5s
+    stop_grace_period: {{seconds .ShutdownGracePeriod}}s
+{{- if .OTLPCollector}}
+    depends_on:
+      - collector
+
+  collector:
+    image: {{quote .Image}}
+    command: ["collector"]
+    environment:
+      COLLECTOR_FILE: "/data/traces.jsonl"
+    volumes:
+      - data:/data
+{{- end}}
+
+volumes:
+  data:
+`)),
+
+	"k8s/configmap.yaml": template.Must(template.New("configmap").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Name}}-config
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+data:
+{{- range .Env}}
+  {{.Name}}: {{quote .Value}}
+{{- end}}
+`)),
+
+	"k8s/deployment.yaml": template.Must(template.New("deployment").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+# JWT_SECRET is read from the {{.Name}}-secrets Secret, which is not generated.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Name}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  replicas: {{.Replicas}}
+  # The data volume can be mounted by one pod at a time, so the old pod
+  # must stop before its replacement starts.
+  strategy:
+    type: Recreate
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: {{.Name}}
+    spec:
+      # Components, stopped in reverse on shutdown: {{.ComponentNames}}.
+      terminationGracePeriodSeconds: {{seconds .ShutdownGracePeriod}}
+      containers:
+        - name: {{.Name}}
+          image: {{quote .Image}}
+          ports:
+            - name: http
+              containerPort: {{.Config.Port}}
+          envFrom:
+            - configMapRef:
+                name: {{.Name}}-config
+          env:
+            - name: JWT_SECRET
+              valueFrom:
+                secretKeyRef:
+                  name: {{.Name}}-secrets
+                  key: jwt-secret
+          startupProbe:
+            httpGet:
+              path: {{.LivenessPath}}
+              port: http
+            periodSeconds: 2
+            failureThreshold: 15
+          livenessProbe:
+            httpGet:
+              path: {{.LivenessPath}}
+              port: http
+            periodSeconds: 10
+            failureThreshold: 3
+          readinessProbe:
+            httpGet:
+              path: {{.ReadinessPath}}
+              port: http
+            periodSeconds: 5
+            failureThreshold: 3
+          volumeMounts:
+            - name: data
+              mountPath: /data
+      volumes:
+        # The SQLite database and queue log outlive the pod.
+        - name: data
+          persistentVolumeClaim:
+            claimName: {{.Name}}-data
+`)),
+
+	"k8s/pvc.yaml": template.Must(template.New("pvc").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{.Name}}-data
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  accessModes:
+    - ReadWriteOnce
+  resources:
+    requests:
+      storage: {{.StorageSize}}
+`)),
+
+	"k8s/service.yaml": template.Must(template.New("service").Funcs(deployFuncs).Parse(`# Generated by "deploy gen". Do not edit.
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  selector:
+    app.kubernetes.io/name: {{.Name}}
+  ports:
+    - name: http
+      port: 80
+      targetPort: http
+`)),
+}
+
+func (d *DeploySpec) LivenessPath() string  { return livenessPath }
+func (d *DeploySpec) ReadinessPath() string { return readinessPath }
+
+// RenderDeploy renders every artifact, keyed by its path relative to the
+// output directory.
+func RenderDeploy(spec *DeploySpec) (map[string][]byte, error) {
+	if spec.Replicas > 1 {
+		return nil, fmt.Errorf("cannot run %d replicas: each would keep its own SQLite database and queue log behind one Service", spec.Replicas)
+	}
+	files := make(map[string][]byte, len(deployTemplates))
+	for name, tmpl := range deployTemplates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, spec); err != nil {
+			return nil, fmt.Errorf("rendering %s: %w", name, err)
+		}
+		files[name] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// runDeploy implements "deploy gen": it loads the configuration from the
+// environment, as the service itself would, and writes the artifacts.
+func runDeploy(args []string) error {
+	if len(args) == 0 || args[0] != "gen" {
+		return errors.New("usage: deploy gen [flags]")
+	}
+
+	fs := flag.NewFlagSet("deploy gen", flag.ContinueOnError)
+	out := fs.String("out", "deploy", "directory to write the artifacts to")
+	image := fs.String("image", "", "container image (default <service name>:latest)")
+	replicas := fs.Int("replicas", 1, "Kubernetes replica count, at most 1 while the storage is SQLite")
+	storage := fs.String("storage", "1Gi", "size of the data volume claim")
+	environment := fs.String("environment", "", "ENVIRONMENT to deploy with (default from the environment)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	// JWT_SECRET is supplied at deploy time, so the configuration is
+	// read without LoadConfig's checks and never rendered with a secret.
+	config := configFromEnv()
+	config.JWTSecret = ""
+	config.Environment = cmp.Or(*environment, config.Environment)
+
+	spec := &DeploySpec{
+		Config:      config,
+		Image:       cmp.Or(*image, config.ServiceName+":latest"),
+		Replicas:    *replicas,
+		StorageSize: *storage,
+		Components:  stopDeadlines(config),
+	}
+	var err error
+	if spec.Package, spec.Context, spec.Dockerfile, err = buildPaths(*out); err != nil {
+		return err
+	}
+
+	files, err := RenderDeploy(spec)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		path := filepath.Join(*out, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			return err
+		}
+		fmt.Println("wrote", path)
+	}
+	return nil
+}
+
+// buildPaths locates the module root above the working directory and
+// returns the package and Dockerfile paths relative to it, and the root
+// relative to out.
+func buildPaths(out string) (pkg, buildContext, dockerfile string, err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", "", "", err
+	}
+	root := wd
+	for {
+		if _, err := os.Stat(filepath.Join(root, "go.mod")); err == nil {
+			break
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return "", "", "", errors.New("go.mod not found above the working directory")
+		}
+		root = parent
+	}
+
+	absOut, err := filepath.Abs(out)
+	if err != nil {
+		return "", "", "", err
+	}
+	if pkg, err = filepath.Rel(root, wd); err != nil {
+		return "", "", "", err
+	}
+	if buildContext, err = filepath.Rel(absOut, root); err != nil {
+		return "", "", "", err
+	}
+	if dockerfile, err = filepath.Rel(root, filepath.Join(absOut, "Dockerfile")); err != nil {
+		return "", "", "", err
+	}
+	return filepath.ToSlash(pkg), filepath.ToSlash(buildContext), filepath.ToSlash(dockerfile), nil
+}
+
+// runProbe requests url and fails unless it answers 2xx. It serves as the
+// container health check, since the runtime image has no shell or curl.
+func runProbe(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: probe <url>")
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(args[0])
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s %s", args[0], resp.Status, body.Status)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestRenderDeployGolden(t *testing.T) {
+	base := Config{
+		ServiceName:            "user-service",
+		Port:                   8080,
+		DatabaseURL:            "file:users.db?_foreign_keys=on",
+		LogLevel:               "info",
+		LogFormat:              "json",
+		Environment:            "production",
+		JWTSecret:              "must-not-leak",
+		DrainDelay:             5 * time.Second,
+		RequestTimeout:         5 * time.Second,
+		QueueURL:               "file:queue.log",
+		QueueVisibilityTimeout: 30 * time.Second,
+		QueueMaxDeliveries:     5,
+		IdempotencyStore:       "memory",
+		IdempotencyTTL:         24 * time.Hour,
+	}
+	withCollector := base
+	withCollector.TraceExporter = "http://collector:4318"
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"minimal", base},
+		{"collector", withCollector},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := RenderDeploy(&DeploySpec{
+				Config:      &tt.config,
+				Image:       "registry.example.com/user-service:1.2.3",
+				Replicas:    1,
+				StorageSize: "5Gi",
+				Package:     "exercises/05-projects/04-microservice/student",
+				Context:     "../../../..",
+				Dockerfile:  "exercises/05-projects/04-microservice/student/deploy/Dockerfile",
+				Components:  stopDeadlines(&tt.config),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, got := range files {
+				if bytes.Contains(got, []byte(tt.config.JWTSecret)) {
+					t.Errorf("%s contains the JWT secret", name)
+				}
+
+				golden := filepath.Join("testdata", "deploy", tt.name, name+".golden")
+				if *update {
+					os.MkdirAll(filepath.Dir(golden), 0755)
+					if err := os.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s differs from %s:\n%s", name, golden, got)
+				}
+			}
+		})
+	}
+}
+
+// Pods do not share the SQLite database, so replicas behind one Service
+// would each see different users.
+func TestRenderDeployRefusesReplicas(t *testing.T) {
+	config := Config{ServiceName: "user-service"}
+	if _, err := RenderDeploy(&DeploySpec{Config: &config, Replicas: 2}); err == nil {
+		t.Error("expected 2 replicas to be refused")
+	}
+}
+
+// The rendered environment must be exactly what configFromEnv reads back.
+func TestConfigEnvRoundTrips(t *testing.T) {
+	want := Config{
+		ServiceName:            "svc",
+		Port:                   9090,
+		DatabaseURL:            "file:db.sqlite",
+		RedisURL:               "redis://cache",
+		LogLevel:               "debug",
+		LogFormat:              "text",
+		Environment:            "staging",
+		TraceExporter:          "file:traces.jsonl",
+		UpstreamURL:            "http://upstream",
+		DrainDelay:             7 * time.Second,
+		RequestTimeout:         3 * time.Second,
+		QueueURL:               "file:q.log",
+		QueueVisibilityTimeout: time.Minute,
+		QueueMaxDeliveries:     9,
+		IdempotencyStore:       "cache",
+		IdempotencyTTL:         time.Hour,
+	}
+	for _, v := range configEnv(&want) {
+		t.Setenv(v.Name, v.Value)
+	}
+
+	if got := configFromEnv(); !reflect.DeepEqual(*got, want) {
+		t.Errorf("expected %+v, got %+v", want, *got)
+	}
+}
+
+func TestProbePathsAreRoutes(t *testing.T) {
+	service := newTestService(t)
+	for _, path := range []string{livenessPath, readinessPath} {
+		found := false
+		for _, e := range service.endpoints {
+			found = found || strings.TrimPrefix(e.Pattern, "GET ") == path
+		}
+		if !found {
+			t.Errorf("probe path %s is not a registered GET route", path)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToAPIErrorMapsDomainErrors(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{fmt.Errorf("user 7: %w", ErrNotFound), http.StatusNotFound, CodeNotFound},
+		{fmt.Errorf("%w: email taken", ErrConflict), http.StatusConflict, CodeConflict},
+		{ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited},
+		{fmt.Errorf("fetching user: %w", ErrCircuitOpen), http.StatusServiceUnavailable, CodeUpstreamUnavailable},
+		{ErrQueueFull, http.StatusServiceUnavailable, CodeUnavailable},
+		{fmt.Errorf("querying users: %w", context.Canceled), statusClientClosedRequest, CodeClientClosedRequest},
+		{fmt.Errorf("wrapped: %w", newAPIError(http.StatusBadRequest, CodeInvalidRequest, "bad")), http.StatusBadRequest, CodeInvalidRequest},
+		{errors.New("disk on fire"), http.StatusInternalServerError, CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			problem := toAPIError(tt.err)
+			if problem.Status != tt.status || problem.Code != tt.code {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.code, problem.Status, problem.Code)
+			}
+			if problem.Type != "urn:problem:"+string(tt.code) || problem.Title != cmp.Or(http.StatusText(tt.status), "Client Closed Request") {
+				t.Errorf("unexpected type %q or title %q", problem.Type, problem.Title)
+			}
+		})
+	}
+
+	for _, err := range []error{
+		errors.New("password=hunter2"),
+		fmt.Errorf("%w: GET http://hunter2.internal:8080/users", ErrUpstream),
+	} {
+		if detail := toAPIError(err).Detail; detail == "" || strings.Contains(detail, "hunter2") {
+			t.Errorf("internal error text leaked into detail %q", detail)
+		}
+	}
+}
+
+func TestErrorResponsesAreProblemDetails(t *testing.T) {
+	service := newTestService(t)
+	token := testToken(t, &Claims{UserID: 1, Roles: []Role{RoleUser}})
+	create := `{"name":"Ann","email":"ann@example.com"}`
+
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, httptest.NewRequest("POST", "/api/users", strings.NewReader(create)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		status int
+		code   ErrorCode
+	}{
+		{"missing token", "GET", "/api/users/1", "", "", http.StatusUnauthorized, CodeUnauthorized},
+		{"not owner", "PUT", "/api/users/2", create, token, http.StatusForbidden, CodeForbidden},
+		{"unknown user", "GET", "/api/users/42", "", token, http.StatusNotFound, CodeNotFound},
+		{"bad ID", "GET", "/api/users/abc", "", token, http.StatusBadRequest, CodeInvalidRequest},
+		{"invalid body", "POST", "/api/users", `{"name":""}`, "", http.StatusBadRequest, CodeValidationFailed},
+		{"malformed body", "POST", "/api/users", `{`, "", http.StatusBadRequest, CodeInvalidRequest},
+		{"duplicate email", "POST", "/api/users", create, "", http.StatusConflict, CodeConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(requestIDHeader, "req-"+strings.ReplaceAll(tt.name, " ", "-"))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			service.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != problemContentType {
+				t.Errorf("expected content type %s, got %s", problemContentType, ct)
+			}
+
+			var problem APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if problem.Code != tt.code || problem.Status != tt.status {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.code, problem.Status, problem.Code)
+			}
+			if problem.Instance != tt.path {
+				t.Errorf("expected instance %s, got %s", tt.path, problem.Instance)
+			}
+			if problem.RequestID != req.Header.Get(requestIDHeader) {
+				t.Errorf("expected request ID %s, got %s", req.Header.Get(requestIDHeader), problem.RequestID)
+			}
+		})
+	}
+}
+
+func TestUpdateToTakenEmailConflicts(t *testing.T) {
+	service := newTestService(t)
+	for _, body := range []string{`{"name":"Ann","email":"ann@example.com"}`, `{"name":"Bo","email":"bo@example.com"}`} {
+		service.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/users", strings.NewReader(body)))
+	}
+
+	req := httptest.NewRequest("PUT", "/api/users/2", strings.NewReader(`{"name":"Bo","email":"ann@example.com"}`))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, &Claims{UserID: 2, Roles: []Role{RoleUser}}))
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body)
+	}
+}
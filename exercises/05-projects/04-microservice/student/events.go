@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const cloudEventsSpecVersion = "1.0"
+
+var (
+	ErrUnknownEventType   = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported event schema version")
+)
+
+// Upcaster migrates an event payload from one schema version to the next.
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+type eventSchema struct {
+	eventType string
+	goType    reflect.Type
+	version   int
+	// upcasters[v] turns version v into version v+1.
+	upcasters map[int]Upcaster
+}
+
+// EventRegistry maps event types to the Go type of their current schema
+// version, and holds the upcasters that bring older payloads up to date.
+type EventRegistry struct {
+	source   string
+	byType   map[string]*eventSchema
+	byGoType map[reflect.Type]*eventSchema
+	mu       sync.RWMutex
+}
+
+func NewEventRegistry(source string) *EventRegistry {
+	return &EventRegistry{
+		source:   source,
+		byType:   make(map[string]*eventSchema),
+		byGoType: make(map[reflect.Type]*eventSchema),
+	}
+}
+
+// Source returns the CloudEvents source of the events NewEvent creates.
+func (r *EventRegistry) Source() string {
+	return r.source
+}
+
+// RegisterEvent makes T the payload of eventType at the given schema
+// version. Registering a type twice is a programming error and panics.
+func RegisterEvent[T any](r *EventRegistry, eventType string, version int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	goType := reflect.TypeFor[T]()
+	if _, ok := r.byType[eventType]; ok {
+		panic(fmt.Sprintf("event type %s registered twice", eventType))
+	}
+	if _, ok := r.byGoType[goType]; ok {
+		panic(fmt.Sprintf("Go type %s registered twice", goType))
+	}
+	if version < 1 {
+		panic(fmt.Sprintf("event type %s: version must be at least 1", eventType))
+	}
+
+	schema := &eventSchema{eventType: eventType, goType: goType, version: version, upcasters: make(map[int]Upcaster)}
+	r.byType[eventType] = schema
+	r.byGoType[goType] = schema
+}
+
+// RegisterUpcaster adds the migration of eventType payloads from version
+// from to from+1.
+func (r *EventRegistry) RegisterUpcaster(eventType string, from int, up Upcaster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schema, ok := r.byType[eventType]
+	if !ok {
+		panic(fmt.Sprintf("upcaster for unregistered event type %s", eventType))
+	}
+	if from < 1 || from >= schema.version {
+		panic(fmt.Sprintf("event type %s: no upcaster possible from version %d to %d", eventType, from, schema.version))
+	}
+	schema.upcasters[from] = up
+}
+
+func (r *EventRegistry) schemaOf(goType reflect.Type) (*eventSchema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schema, ok := r.byGoType[goType]
+	return schema, ok
+}
+
+// upcast returns the payload of msg migrated to the current version of its
+// type. Messages without a version predate versioning and are version 1.
+func (r *EventRegistry) upcast(msg *Message) (*eventSchema, json.RawMessage, error) {
+	r.mu.RLock()
+	schema, ok := r.byType[msg.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownEventType, msg.Type)
+	}
+	if ct := msg.DataContentType; ct != "" && ct != "application/json" {
+		return nil, nil, fmt.Errorf("event %s: unsupported content type %s", msg.ID, ct)
+	}
+
+	version := max(msg.DataVersion, 1)
+	if version > schema.version {
+		return nil, nil, fmt.Errorf("%w: %s version %d is newer than %d", ErrUnsupportedVersion, msg.Type, version, schema.version)
+	}
+
+	data := msg.Data
+	for ; version < schema.version; version++ {
+		up, ok := schema.upcasters[version]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no upcaster for %s from version %d", ErrUnsupportedVersion, msg.Type, version)
+		}
+		var err error
+		if data, err = up(data); err != nil {
+			return nil, nil, fmt.Errorf("upcasting %s from version %d: %v", msg.Type, version, err)
+		}
+	}
+	return schema, data, nil
+}
+
+// NewEvent wraps data in an envelope carrying the registry's source and
+// the registered type and current schema version of T. ID and time are
+// filled in on publish.
+func NewEvent[T any](r *EventRegistry, data T) (*Message, error) {
+	schema, ok := r.schemaOf(reflect.TypeFor[T]())
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not registered", ErrUnknownEventType, reflect.TypeFor[T]())
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		SpecVersion:     cloudEventsSpecVersion,
+		Source:          r.Source(),
+		Type:            schema.eventType,
+		DataContentType: "application/json",
+		DataVersion:     schema.version,
+		Data:            payload,
+	}, nil
+}
+
+// DecodeEvent returns the payload of msg as T, upcasting older versions.
+func DecodeEvent[T any](r *EventRegistry, msg *Message) (T, error) {
+	var event T
+	schema, data, err := r.upcast(msg)
+	if err != nil {
+		return event, err
+	}
+	if schema.goType != reflect.TypeFor[T]() {
+		return event, fmt.Errorf("event %s has type %s, not %s", msg.ID, msg.Type, reflect.TypeFor[T]())
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, fmt.Errorf("decoding %s: %v", msg.Type, err)
+	}
+	return event, nil
+}
+
+// EventHandler is a typed handler bound to its event type; see On.
+type EventHandler struct {
+	eventType string
+	handle    func(context.Context, *Message) error
+}
+
+// On binds a handler to the event type registered for T in r. It panics
+// if T is not registered, so a missing registration fails at start-up.
+func On[T any](r *EventRegistry, handler func(context.Context, T) error) EventHandler {
+	schema, ok := r.schemaOf(reflect.TypeFor[T]())
+	if !ok {
+		panic(fmt.Sprintf("On: %s is not a registered event type", reflect.TypeFor[T]()))
+	}
+	return EventHandler{
+		eventType: schema.eventType,
+		handle: func(ctx context.Context, msg *Message) error {
+			event, err := DecodeEvent[T](r, msg)
+			if err != nil {
+				return err
+			}
+			return handler(ctx, event)
+		},
+	}
+}
+
+// Route returns a queue handler that dispatches each message to the
+// handler for its type. A message with no handler is an error, so it is
+// retried and eventually dead-lettered rather than silently dropped.
+func Route(handlers ...EventHandler) func(context.Context, *Message) error {
+	byType := make(map[string]func(context.Context, *Message) error, len(handlers))
+	for _, h := range handlers {
+		byType[h.eventType] = h.handle
+	}
+	return func(ctx context.Context, msg *Message) error {
+		handle, ok := byType[msg.Type]
+		if !ok {
+			return fmt.Errorf("%w: no handler for %s", ErrUnknownEventType, msg.Type)
+		}
+		return handle(ctx, msg)
+	}
+}
+
+// UserCreated is published when a user is created.
+type UserCreated struct {
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newUserEvents returns the registry of the events this service
+// publishes, with source as their CloudEvents source.
+func newUserEvents(source string) *EventRegistry {
+	r := NewEventRegistry(source)
+	RegisterEvent[UserCreated](r, "user.created", 1)
+	return r
+}
+
+// renameField returns an upcaster that moves a top-level field.
+func renameField(from, to string) Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		if value, ok := fields[from]; ok {
+			fields[to] = value
+			delete(fields, from)
+		}
+		return json.Marshal(fields)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserCreatedEventEnvelope(t *testing.T) {
+	service := newTestService(t)
+
+	service.relay.Start()
+	defer service.relay.Stop(context.Background())
+	received := make(chan UserCreated, 1)
+	var envelope map[string]any
+	service.queue.JoinGroup(userEventsTopic, "test", func(ctx context.Context, msg *Message) error {
+		raw, _ := json.Marshal(msg)
+		json.Unmarshal(raw, &envelope)
+		return Route(On(service.events, func(ctx context.Context, e UserCreated) error {
+			received <- e
+			return nil
+		}))(ctx, msg)
+	})
+
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"name":"Ann","email":"ann@example.com"}`))
+	service.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case e := <-received:
+		if e.UserID != 1 || e.Email != "ann@example.com" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	for attr, want := range map[string]any{
+		"specversion":     "1.0",
+		"type":            "user.created",
+		"source":          "/user-service",
+		"datacontenttype": "application/json",
+		"dataversion":     float64(1),
+	} {
+		if envelope[attr] != want {
+			t.Errorf("%s: expected %v, got %v", attr, want, envelope[attr])
+		}
+	}
+	if envelope["id"] == "" || envelope["time"] == "" {
+		t.Errorf("envelope missing id or time: %v", envelope)
+	}
+}
+
+func TestDecodeEventChecksVersion(t *testing.T) {
+	r := newUserEvents("/test")
+	// Messages without a version predate versioning and are version 1.
+	msg := &Message{Type: "user.created", Data: json.RawMessage(`{"user_id":7,"name":"Ann","email":"ann@example.com"}`)}
+
+	event, err := DecodeEvent[UserCreated](r, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.UserID != 7 || event.Name != "Ann" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	msg.DataVersion = 2
+	if _, err := DecodeEvent[UserCreated](r, msg); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion for a future version, got %v", err)
+	}
+}
+
+type orderPlaced struct {
+	OrderID string `json:"order_id"`
+	Total   int64  `json:"total_cents"`
+}
+
+func TestUpcastersChainInOrder(t *testing.T) {
+	r := NewEventRegistry("/test")
+	RegisterEvent[orderPlaced](r, "order.placed", 3)
+	r.RegisterUpcaster("order.placed", 1, renameField("id", "order_id"))
+
+	v1 := &Message{Type: "order.placed", DataVersion: 1, Data: json.RawMessage(`{"id":"o-1","total":1250}`)}
+	if _, err := DecodeEvent[orderPlaced](r, v1); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected missing upcaster from version 2 to fail, got %v", err)
+	}
+
+	r.RegisterUpcaster("order.placed", 2, renameField("total", "total_cents"))
+	event, err := DecodeEvent[orderPlaced](r, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.OrderID != "o-1" || event.Total != 1250 {
+		t.Errorf("unexpected event after two upcasts: %+v", event)
+	}
+}
+
+func TestRouteRejectsUnhandledTypes(t *testing.T) {
+	handler := Route(On(newUserEvents("/test"), func(ctx context.Context, e UserCreated) error { return nil }))
+
+	err := handler(context.Background(), &Message{Type: "user.deleted", Data: json.RawMessage(`{}`)})
+	if !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("expected ErrUnknownEventType, got %v", err)
+	}
+}
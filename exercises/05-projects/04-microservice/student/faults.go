@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInjected is a ready-made error for faults that should fail a call.
+	ErrInjected = errors.New("injected fault")
+	// ErrConnectionDropped is what a call sees when its connection is
+	// dropped by a fault.
+	ErrConnectionDropped = errors.New("connection dropped")
+)
+
+// Fault targets. A rule for a target applies to every operation on it; a
+// rule for "target.operation", such as "db.SELECT", "cache.get" or
+// "http.GET", applies to that operation only and takes precedence.
+const (
+	faultDB    = "db"
+	faultCache = "cache"
+	faultHTTP  = "http"
+)
+
+// Fault describes how calls to a dependency misbehave. Latency is added
+// before any other effect, and at most one of Hang, Drop, Status and Err
+// should be set.
+type Fault struct {
+	Latency time.Duration
+	// Hang blocks the call until its context is done.
+	Hang bool
+	// Drop fails the call with ErrConnectionDropped.
+	Drop bool
+	// Status answers outbound HTTP calls with this status code without
+	// reaching the server.
+	Status int
+	// Err fails the call with this error.
+	Err error
+
+	// Probability is the chance that the fault affects a call. Zero means
+	// every call.
+	Probability float64
+	// Times limits the fault to the next n affected calls, after which
+	// the rule is removed. Zero means no limit.
+	Times int
+}
+
+// FaultInjector makes the database, cache and outbound HTTP misbehave on
+// demand so that tests can check how the service copes. A nil injector
+// injects nothing.
+type FaultInjector struct {
+	mu    sync.Mutex
+	rules map[string]*Fault
+	calls map[string]int
+	rand  *rand.Rand
+}
+
+// NewFaultInjector returns an injector with no rules. The seed makes
+// probabilistic faults repeatable.
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{
+		rules: make(map[string]*Fault),
+		calls: make(map[string]int),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Set installs f for target, replacing any previous rule.
+func (fi *FaultInjector) Set(target string, f Fault) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.rules[target] = &f
+}
+
+// Clear removes the rule for target.
+func (fi *FaultInjector) Clear(target string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	delete(fi.rules, target)
+}
+
+// Reset removes every rule and forgets the call counts.
+func (fi *FaultInjector) Reset() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	clear(fi.rules)
+	clear(fi.calls)
+}
+
+// Calls returns how many calls reached target, or "target.operation",
+// whether or not a fault was injected.
+func (fi *FaultInjector) Calls(target string) int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.calls[target]
+}
+
+// pick counts the call and returns the fault that applies to it, if any.
+func (fi *FaultInjector) pick(target, operation string) (Fault, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	key := target + "." + operation
+	fi.calls[target]++
+	fi.calls[key]++
+
+	rule, name := fi.rules[key], key
+	if rule == nil {
+		rule, name = fi.rules[target], target
+	}
+	if rule == nil || (rule.Probability > 0 && fi.rand.Float64() >= rule.Probability) {
+		return Fault{}, false
+	}
+	if rule.Times > 0 {
+		if rule.Times--; rule.Times == 0 {
+			delete(fi.rules, name)
+		}
+	}
+	return *rule, true
+}
+
+// inject applies the fault for one call and returns the error the call
+// should fail with. Only outbound HTTP uses the returned fault's Status.
+func (fi *FaultInjector) inject(ctx context.Context, target, operation string) (Fault, error) {
+	if fi == nil {
+		return Fault{}, nil
+	}
+	f, ok := fi.pick(target, operation)
+	if !ok {
+		return Fault{}, nil
+	}
+
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-ctx.Done():
+			return f, ctx.Err()
+		}
+	}
+	switch {
+	case f.Hang:
+		<-ctx.Done()
+		return f, ctx.Err()
+	case f.Drop:
+		return f, ErrConnectionDropped
+	}
+	return f, f.Err
+}
+
+// Transport wraps base so that outbound requests pass through the
+// injector first. Operations are HTTP methods.
+func (fi *FaultInjector) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		f, err := fi.inject(req.Context(), faultHTTP, req.Method)
+		if err != nil {
+			return nil, err
+		}
+		if f.Status != 0 {
+			return &http.Response{
+				Status:     http.StatusText(f.Status),
+				StatusCode: f.Status,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}
+		return base.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// injectFaults installs fi in the service's database, cache and upstream
+// client. Only tests call it; the service otherwise runs without one.
+func (s *UserService) injectFaults(fi *FaultInjector) {
+	s.faults = fi
+	s.db.faults = fi
+	s.cache.faults = fi
+	if s.upstream != nil {
+		s.upstream.client.Transport = fi.Transport(nil)
+	}
+}
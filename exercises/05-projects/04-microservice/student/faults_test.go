@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorRules(t *testing.T) {
+	ctx := context.Background()
+
+	var none *FaultInjector
+	if _, err := none.inject(ctx, faultDB, "SELECT"); err != nil {
+		t.Errorf("nil injector returned %v", err)
+	}
+
+	fi := NewFaultInjector(1)
+	fi.Set(faultDB, Fault{Err: ErrInjected})
+	fi.Set("db.SELECT", Fault{Drop: true, Times: 2})
+	for i, want := range []error{ErrConnectionDropped, ErrConnectionDropped, ErrInjected} {
+		if _, err := fi.inject(ctx, faultDB, "SELECT"); !errors.Is(err, want) {
+			t.Errorf("call %d: expected %v, got %v", i, want, err)
+		}
+	}
+	if fi.Calls(faultDB) != 3 || fi.Calls("db.SELECT") != 3 {
+		t.Errorf("expected 3 calls, got %d and %d", fi.Calls(faultDB), fi.Calls("db.SELECT"))
+	}
+
+	fi.Reset()
+	fi.Set(faultCache, Fault{Err: ErrInjected, Probability: 0.25})
+	failed := 0
+	for range 1000 {
+		if _, err := fi.inject(ctx, faultCache, "get"); err != nil {
+			failed++
+		}
+	}
+	if failed < 200 || failed > 300 {
+		t.Errorf("expected about 250 of 1000 calls to fail, got %d", failed)
+	}
+
+	fi.Set(faultCache, Fault{Latency: time.Second})
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := fi.inject(short, faultCache, "get"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("latency should end with the context, got %v", err)
+	}
+}
+
+// newFrontService starts a back instance holding one user and returns a
+// front instance configured to ask it for users it does not have.
+func newFrontService(t *testing.T) *UserService {
+	t.Helper()
+	back := newTestService(t)
+	if _, err := back.db.CreateUser(context.Background(), &User{Name: "Remote", Email: "remote@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	backServer := httptest.NewServer(back)
+	t.Cleanup(backServer.Close)
+
+	front := newTestServiceWith(t, func(c *Config) { c.UpstreamURL = backServer.URL })
+	front.upstream.retryBackoff = time.Millisecond
+	front.injectFaults(NewFaultInjector(1))
+	return front
+}
+
+// getUser requests a user from service and decodes the problem, if any.
+func getUser(t *testing.T, service *UserService, path string) (int, ErrorCode) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, &Claims{UserID: 1, Roles: []Role{RoleUser}}))
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, req)
+
+	var problem APIError
+	if rec.Code >= 400 {
+		json.Unmarshal(rec.Body.Bytes(), &problem)
+	}
+	return rec.Code, problem.Code
+}
+
+func TestUpstreamRetriesDroppedConnections(t *testing.T) {
+	front := newFrontService(t)
+
+	front.faults.Set(faultHTTP, Fault{Drop: true, Times: 2})
+	if code, _ := getUser(t, front, "/api/users/1"); code != http.StatusOK {
+		t.Fatalf("expected the third attempt to succeed, got %d", code)
+	}
+	if calls := front.faults.Calls(faultHTTP); calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+	if state := front.upstream.breaker.State(); state != StateClosed {
+		t.Errorf("a call that succeeded on retry must not trip the breaker, got %s", state)
+	}
+}
+
+func TestCircuitBreakerOpensOnUpstreamFailures(t *testing.T) {
+	front := newFrontService(t)
+	front.upstream.breaker = NewCircuitBreaker(2, 100*time.Millisecond)
+
+	front.faults.Set(faultHTTP, Fault{Status: http.StatusServiceUnavailable})
+	for i := range 2 {
+		if code, errCode := getUser(t, front, "/api/users/1"); code != http.StatusBadGateway || errCode != CodeUpstreamUnavailable {
+			t.Fatalf("call %d: expected 502 %s, got %d %s", i, CodeUpstreamUnavailable, code, errCode)
+		}
+	}
+	attempts := front.faults.Calls(faultHTTP)
+	if attempts != 2*front.upstream.maxAttempts {
+		t.Errorf("expected every call to use all %d attempts, got %d in total", front.upstream.maxAttempts, attempts)
+	}
+
+	// Open: calls fail fast without touching the network.
+	if code, errCode := getUser(t, front, "/api/users/1"); code != http.StatusServiceUnavailable || errCode != CodeUpstreamUnavailable {
+		t.Fatalf("expected 503 while open, got %d %s", code, errCode)
+	}
+	if front.faults.Calls(faultHTTP) != attempts {
+		t.Error("an open breaker let a request through")
+	}
+	rec := httptest.NewRecorder()
+	front.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var report HealthReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if report.Checks["upstream"].Status != healthFail {
+		t.Errorf("expected the upstream check to fail, got %+v", report.Checks["upstream"])
+	}
+
+	// Once the upstream recovers, the half-open probe closes the breaker.
+	front.faults.Reset()
+	time.Sleep(150 * time.Millisecond)
+	if code, _ := getUser(t, front, "/api/users/1"); code != http.StatusOK {
+		t.Fatalf("expected the probe to succeed, got %d", code)
+	}
+	if state := front.upstream.breaker.State(); state != StateClosed {
+		t.Errorf("expected closed breaker, got %s", state)
+	}
+}
+
+func TestCacheFaultsFallBackToDatabase(t *testing.T) {
+	service := newTestService(t)
+	service.injectFaults(NewFaultInjector(1))
+	if _, err := service.db.CreateUser(context.Background(), &User{Name: "Ann", Email: "ann@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken cache costs a database query, not the request.
+	service.faults.Set(faultCache, Fault{Err: ErrInjected})
+	if code, _ := getUser(t, service, "/api/users/1"); code != http.StatusOK {
+		t.Fatalf("expected 200 with the cache down, got %d", code)
+	}
+	if calls := service.faults.Calls("db.SELECT"); calls != 1 {
+		t.Errorf("expected 1 database query, got %d", calls)
+	}
+
+	// With the cache back and warm, reads survive a dead database.
+	service.faults.Reset()
+	getUser(t, service, "/api/users/1")
+	service.faults.Set(faultDB, Fault{Drop: true})
+	if code, _ := getUser(t, service, "/api/users/1"); code != http.StatusOK {
+		t.Fatalf("expected a cache hit with the database down, got %d", code)
+	}
+	if code, errCode := getUser(t, service, "/api/users/2"); code != http.StatusInternalServerError || errCode != CodeInternal {
+		t.Errorf("expected 500 for an uncached user, got %d %s", code, errCode)
+	}
+}
+
+func TestHangingDependencyTimesOut(t *testing.T) {
+	service := newTestServiceWith(t, func(c *Config) { c.RequestTimeout = 100 * time.Millisecond })
+	service.injectFaults(NewFaultInjector(1))
+	service.faults.Set(faultDB, Fault{Hang: true})
+
+	start := time.Now()
+	code, errCode := getUser(t, service, "/api/users/1")
+	if code != http.StatusGatewayTimeout || errCode != CodeTimeout {
+		t.Errorf("expected 504 %s, got %d %s", CodeTimeout, code, errCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s despite a 100ms timeout", elapsed)
+	}
+}
+
+func TestDatabaseFaultFailsReadiness(t *testing.T) {
+	service := newTestService(t)
+	service.injectFaults(NewFaultInjector(1))
+	service.faults.Set("db.ping", Fault{Drop: true})
+
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+}
+
+func TestServiceRunsWithoutFaultInjector(t *testing.T) {
+	service := newTestServiceWith(t, func(c *Config) { c.UpstreamURL = "http://upstream.invalid" })
+	if service.faults != nil || service.db.faults != nil || service.cache.faults != nil {
+		t.Error("expected no fault injector outside tests")
+	}
+	if service.upstream.client.Transport != nil {
+		t.Error("expected the upstream client to use the default transport")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck reports whether one dependency is usable. It must return
+// promptly once ctx is done.
+type HealthCheck func(ctx context.Context) error
+
+// HealthChecker is a named check registered with a HealthRegistry.
+type HealthChecker struct {
+	Name  string
+	Check HealthCheck
+	// Timeout bounds a single run; zero uses the registry default.
+	Timeout time.Duration
+	// Critical checks make the service unready when they fail. A failing
+	// non-critical check only marks the report as degraded.
+	Critical bool
+}
+
+const (
+	healthPass     = "pass"
+	healthFail     = "fail"
+	healthDegraded = "degraded"
+	healthDraining = "draining"
+)
+
+type CheckResult struct {
+	Status   string  `json:"status"`
+	Critical bool    `json:"critical"`
+	Latency  float64 `json:"latency_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// HealthRegistry runs registered checks concurrently and caches the report
+// for a short time so that frequent probes do not hammer dependencies.
+type HealthRegistry struct {
+	checkers       []HealthChecker
+	defaultTimeout time.Duration
+	cacheTTL       time.Duration
+	draining       atomic.Bool
+
+	mu     sync.Mutex
+	cached *HealthReport
+}
+
+func NewHealthRegistry(defaultTimeout, cacheTTL time.Duration) *HealthRegistry {
+	return &HealthRegistry{defaultTimeout: defaultTimeout, cacheTTL: cacheTTL}
+}
+
+func (h *HealthRegistry) Register(checker HealthChecker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkers = append(h.checkers, checker)
+	h.cached = nil
+}
+
+// SetDraining makes readiness fail regardless of check results. It is set
+// at the start of shutdown so that load balancers stop sending traffic
+// before connections are closed.
+func (h *HealthRegistry) SetDraining(draining bool) {
+	h.draining.Store(draining)
+}
+
+func (h *HealthRegistry) Draining() bool {
+	return h.draining.Load()
+}
+
+// Check returns the cached report if it is fresh, and otherwise runs every
+// check concurrently. Concurrent callers wait for a single run. The run is
+// detached from the caller's cancellation because its result is shared.
+func (h *HealthRegistry) Check(ctx context.Context) HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cached != nil && time.Since(h.cached.CheckedAt) < h.cacheTTL {
+		return *h.cached
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	results := make([]CheckResult, len(h.checkers))
+	var wg sync.WaitGroup
+	for i, checker := range h.checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.run(ctx, checker)
+		}()
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: healthPass, Checks: make(map[string]CheckResult), CheckedAt: time.Now()}
+	for i, checker := range h.checkers {
+		report.Checks[checker.Name] = results[i]
+		if results[i].Status == healthPass {
+			continue
+		}
+		if checker.Critical {
+			report.Status = healthFail
+		} else if report.Status == healthPass {
+			report.Status = healthDegraded
+		}
+	}
+
+	h.cached = &report
+	return report
+}
+
+func (h *HealthRegistry) run(ctx context.Context, checker HealthChecker) CheckResult {
+	timeout := checker.Timeout
+	if timeout == 0 {
+		timeout = h.defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				errc <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		errc <- checker.Check(ctx)
+	}()
+
+	// A check that ignores its context must not hold up the report, so
+	// the timeout is enforced here as well.
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	result := CheckResult{
+		Status:   healthPass,
+		Critical: checker.Critical,
+		Latency:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = healthFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// handleLivez reports whether the process is able to serve HTTP at all.
+// It never touches dependencies, so a broken database does not get the
+// process restarted.
+func (h *HealthRegistry) handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": healthPass})
+}
+
+// handleReadyz reports whether the instance should receive traffic: it is
+// not draining and no critical check fails.
+func (h *HealthRegistry) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": healthDraining})
+		return
+	}
+
+	report := h.Check(r.Context())
+	status := http.StatusOK
+	if report.Status == healthFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"status": report.Status})
+}
+
+// handleHealthz returns the full report with per-component status and
+// latency.
+func (h *HealthRegistry) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := h.Check(r.Context())
+	if h.Draining() {
+		report.Status = healthDraining
+	}
+
+	status := http.StatusOK
+	if report.Status == healthFail || report.Status == healthDraining {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthRegistryRunsChecksConcurrentlyWithTimeouts(t *testing.T) {
+	h := NewHealthRegistry(50*time.Millisecond, time.Minute)
+	h.Register(HealthChecker{Name: "fast", Critical: true, Check: func(ctx context.Context) error { return nil }})
+	h.Register(HealthChecker{Name: "hangs", Check: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+	h.Register(HealthChecker{Name: "slow", Check: func(ctx context.Context) error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	}})
+
+	start := time.Now()
+	report := h.Check(context.Background())
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("checks took %s, expected them to run concurrently and time out", elapsed)
+	}
+
+	if report.Status != healthDegraded {
+		t.Errorf("expected degraded status, got %s", report.Status)
+	}
+	if report.Checks["hangs"].Status != healthFail || report.Checks["slow"].Status != healthPass {
+		t.Errorf("unexpected results: %+v", report.Checks)
+	}
+}
+
+func TestHealthRegistryCachesResults(t *testing.T) {
+	var calls atomic.Int32
+	h := NewHealthRegistry(time.Second, time.Minute)
+	h.Register(HealthChecker{Name: "db", Critical: true, Check: func(ctx context.Context) error {
+		calls.Add(1)
+		return errors.New("connection refused")
+	}})
+
+	for i := 0; i < 5; i++ {
+		if report := h.Check(context.Background()); report.Status != healthFail {
+			t.Fatalf("expected fail, got %s", report.Status)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 check run, got %d", calls.Load())
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	service := newTestService(t)
+
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d %v", code, body)
+	}
+	code, body := get("/healthz")
+	if code != http.StatusOK {
+		t.Fatalf("expected healthy, got %d %v", code, body)
+	}
+	checks := body["checks"].(map[string]interface{})
+	if _, ok := checks["database"]; !ok {
+		t.Errorf("expected database check in report: %v", body)
+	}
+
+	service.health.SetDraining(true)
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d", code)
+	}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("liveness must not depend on draining, got %d", code)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader marks a response that was stored by an earlier
+	// request with the same key.
+	replayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+	ErrRequestInProgress    = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotencyRecord is what is stored per key: the fingerprint of the
+// request that claimed it and, once that request finished, its response.
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	// Status is zero while the first request is still running.
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore holds idempotency records. Implementations must make
+// Reserve atomic: of several concurrent calls for one key, exactly one
+// succeeds.
+type IdempotencyStore interface {
+	// Reserve stores rec under key unless the key is present, and reports
+	// whether it did.
+	Reserve(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) (bool, error)
+	// Get returns the record stored under key, or ErrCacheMiss.
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error)
+	// Save replaces the record stored under key.
+	Save(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error
+	// Release removes key so that the request can be tried again.
+	Release(ctx context.Context, key string) error
+}
+
+// MemoryIdempotencyStore keeps records in process. Expired records are
+// dropped when they are next read and swept out periodically.
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	entries  map[string]memoryIdempotencyEntry
+	reserved int
+}
+
+type memoryIdempotencyEntry struct {
+	rec       IdempotencyRecord
+	expiresAt time.Time
+}
+
+// sweepEvery is how many reservations pass between sweeps.
+const sweepEvery = 256
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]memoryIdempotencyEntry)}
+}
+
+func (m *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.reserved++; m.reserved%sweepEvery == 0 {
+		for k, e := range m.entries {
+			if now.After(e.expiresAt) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	if e, ok := m.entries[key]; ok && !now.After(e.expiresAt) {
+		return false, nil
+	}
+	m.entries[key] = memoryIdempotencyEntry{rec: *rec, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		delete(m.entries, key)
+		return nil, ErrCacheMiss
+	}
+	rec := e.rec
+	return &rec, nil
+}
+
+func (m *MemoryIdempotencyStore) Save(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryIdempotencyEntry{rec: *rec, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// CacheIdempotencyStore keeps records in the service cache, so that they
+// are shared by every instance using the same cache.
+type CacheIdempotencyStore struct {
+	cache *Cache
+}
+
+func NewCacheIdempotencyStore(cache *Cache) *CacheIdempotencyStore {
+	return &CacheIdempotencyStore{cache: cache}
+}
+
+func idempotencyCacheKey(key string) string {
+	return "idempotency:" + key
+}
+
+func (c *CacheIdempotencyStore) Reserve(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) (bool, error) {
+	return c.cache.SetNX(ctx, idempotencyCacheKey(key), rec, ttl)
+}
+
+func (c *CacheIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	if err := c.cache.Get(ctx, idempotencyCacheKey(key), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (c *CacheIdempotencyStore) Save(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	return c.cache.Set(ctx, idempotencyCacheKey(key), rec, ttl)
+}
+
+func (c *CacheIdempotencyStore) Release(ctx context.Context, key string) error {
+	return c.cache.Delete(ctx, idempotencyCacheKey(key))
+}
+
+// Idempotency makes unsafe requests that carry an Idempotency-Key safe to
+// retry. The first request with a key runs and its response is stored;
+// retries with the same key and body get that response replayed, retries
+// with a different body are rejected with 422, and retries that arrive
+// while the first request is still running wait for it.
+//
+// Keys are scoped to the caller, so two clients cannot see each other's
+// responses by guessing keys. Responses with a 5xx status are not stored:
+// the failure may be transient, and a retry should run the request again.
+type Idempotency struct {
+	store IdempotencyStore
+	// ttl is how long a response is kept; lockTTL bounds how long a key
+	// stays claimed by a request that never finishes, e.g. because the
+	// process died.
+	ttl     time.Duration
+	lockTTL time.Duration
+	// poll is the interval at which waiting duplicates check the store.
+	poll time.Duration
+}
+
+func NewIdempotency(store IdempotencyStore, ttl time.Duration) *Idempotency {
+	return &Idempotency{store: store, ttl: ttl, lockTTL: time.Minute, poll: 20 * time.Millisecond}
+}
+
+// Wrap applies idempotency to next. Requests without the header pass
+// straight through.
+func (id *Idempotency) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, newAPIError(http.StatusBadRequest, CodeInvalidRequest,
+				fmt.Sprintf("%s must be at most %d characters", idempotencyHeader, maxIdempotencyKeyLength)))
+			return
+		}
+
+		body, err := readBody(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		storeKey := idempotencyScope(r) + " " + key
+		fingerprint := requestFingerprint(r, body)
+		for {
+			reserved, err := id.store.Reserve(ctx, storeKey, &IdempotencyRecord{Fingerprint: fingerprint}, id.lockTTL)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if reserved {
+				id.run(w, r, next, storeKey, fingerprint)
+				return
+			}
+
+			rec, err := id.store.Get(ctx, storeKey)
+			switch {
+			case errors.Is(err, ErrCacheMiss):
+				// Released or expired since Reserve; try to claim it.
+				continue
+			case err != nil:
+				writeError(w, r, err)
+				return
+			case rec.Fingerprint != fingerprint:
+				writeError(w, r, ErrIdempotencyKeyReused)
+				return
+			case rec.Status != 0:
+				replay(w, rec)
+				return
+			}
+
+			select {
+			case <-time.After(id.poll):
+			case <-ctx.Done():
+				writeError(w, r, ErrRequestInProgress)
+				return
+			}
+		}
+	})
+}
+
+// run serves the request that claimed the key and stores its response.
+// If the handler fails or panics the key is released instead.
+func (id *Idempotency) run(w http.ResponseWriter, r *http.Request, next http.Handler, key, fingerprint string) {
+	ctx := context.WithoutCancel(r.Context())
+	rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+	stored := false
+	defer func() {
+		if !stored {
+			if err := id.store.Release(ctx, key); err != nil {
+				logger.ErrorContext(ctx, "releasing idempotency key", "error", err)
+			}
+		}
+	}()
+
+	next.ServeHTTP(rec, r)
+	if rec.status >= http.StatusInternalServerError {
+		return
+	}
+
+	header := rec.Header().Clone()
+	header.Del(requestIDHeader)
+	err := id.store.Save(ctx, key, &IdempotencyRecord{
+		Fingerprint: fingerprint,
+		Status:      rec.status,
+		Header:      header,
+		Body:        rec.body.Bytes(),
+	}, id.ttl)
+	if err != nil {
+		logger.ErrorContext(ctx, "storing idempotent response", "error", err)
+		return
+	}
+	stored = true
+}
+
+// replay writes a stored response. The current request keeps its own
+// request ID.
+func replay(w http.ResponseWriter, rec *IdempotencyRecord) {
+	for name, values := range rec.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(replayedHeader, "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// idempotencyScope identifies the caller: the authenticated user or
+// client, or for anonymous requests the remote address.
+func idempotencyScope(r *http.Request) string {
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		if claims.UserID != 0 {
+			return "user:" + strconv.Itoa(claims.UserID)
+		}
+		return "client:" + claims.Username
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// requestFingerprint hashes what makes two requests the same: method,
+// path and body. JSON bodies are compared by value, so a retry that
+// serializes the same object with its keys in a different order matches.
+func requestFingerprint(r *http.Request, body []byte) string {
+	var value any
+	if json.Unmarshal(body, &value) == nil {
+		body, _ = json.Marshal(value)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder passes the response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotentCreateUser(t *testing.T) {
+	service := newTestService(t)
+
+	post := func(key, body, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/users", strings.NewReader(body))
+		req.Header.Set(idempotencyHeader, key)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := post("k1", `{"name":"Ann","email":"ann@example.com"}`, "192.0.2.1:1000")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body)
+	}
+
+	// Same caller, same body with its keys reordered: replayed.
+	retry := post("k1", `{"email":"ann@example.com","name":"Ann"}`, "192.0.2.1:2000")
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the first response replayed, got %d: %s", retry.Code, retry.Body)
+	}
+	if retry.Header().Get(replayedHeader) != "true" {
+		t.Error("replayed response is not marked")
+	}
+	if id := retry.Header().Get(requestIDHeader); id == "" || id == first.Header().Get(requestIDHeader) {
+		t.Errorf("replay should carry its own request ID, got %q", id)
+	}
+
+	// Same key, different body: rejected.
+	reused := post("k1", `{"name":"Bo","email":"bo@example.com"}`, "192.0.2.1:3000")
+	var problem APIError
+	json.Unmarshal(reused.Body.Bytes(), &problem)
+	if reused.Code != http.StatusUnprocessableEntity || problem.Code != CodeIdempotencyKeyReused {
+		t.Errorf("expected 422 %s, got %d %s", CodeIdempotencyKeyReused, reused.Code, problem.Code)
+	}
+
+	// Another caller's key lives in its own namespace.
+	other := post("k1", `{"name":"Bo","email":"bo@example.com"}`, "198.51.100.7:1000")
+	if other.Code != http.StatusCreated {
+		t.Errorf("expected another caller's request to run, got %d: %s", other.Code, other.Body)
+	}
+
+	if count := countRows(t, service.db, "SELECT COUNT(*) FROM users"); count != 2 {
+		t.Errorf("expected 2 users, got %d", count)
+	}
+}
+
+func countRows(t *testing.T, db *Database, query string) int {
+	t.Helper()
+	var n int
+	if err := db.db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIdempotencyStores(t *testing.T) {
+	cache, _ := NewCache("")
+	stores := map[string]func() IdempotencyStore{
+		"memory": func() IdempotencyStore { return NewMemoryIdempotencyStore() },
+		"cache":  func() IdempotencyStore { cache.Close(); return NewCacheIdempotencyStore(cache) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+"/concurrent duplicates wait", func(t *testing.T) {
+			var runs atomic.Int32
+			release := make(chan struct{})
+			handler := NewIdempotency(newStore(), time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := runs.Add(1)
+				<-release
+				writeJSON(w, http.StatusCreated, map[string]int32{"run": n})
+			}))
+
+			const clients = 8
+			bodies := make([]string, clients)
+			var wg sync.WaitGroup
+			for i := range clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					req := httptest.NewRequest("POST", "/things", strings.NewReader(`{"a":1}`))
+					req.Header.Set(idempotencyHeader, "same")
+					handler.ServeHTTP(rec, req)
+					bodies[i] = fmt.Sprint(rec.Code, " ", rec.Body)
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if runs.Load() != 1 {
+				t.Errorf("expected the handler to run once, ran %d times", runs.Load())
+			}
+			for _, body := range bodies {
+				if body != bodies[0] {
+					t.Errorf("responses differ: %q and %q", body, bodies[0])
+				}
+			}
+		})
+
+		t.Run(name+"/server errors are not stored", func(t *testing.T) {
+			var runs atomic.Int32
+			handler := NewIdempotency(newStore(), time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if runs.Add(1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+
+			for _, want := range []int{http.StatusServiceUnavailable, http.StatusCreated, http.StatusCreated} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("POST", "/things", nil)
+				req.Header.Set(idempotencyHeader, "retry-me")
+				handler.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("expected %d, got %d", want, rec.Code)
+				}
+			}
+			if runs.Load() != 2 {
+				t.Errorf("expected 2 runs, got %d", runs.Load())
+			}
+		})
+
+		t.Run(name+"/waiting gives up with the request", func(t *testing.T) {
+			release := make(chan struct{})
+			handler := NewIdempotency(newStore(), time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			}))
+
+			started, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(done)
+				req := httptest.NewRequest("POST", "/things", nil)
+				req.Header.Set(idempotencyHeader, "slow")
+				close(started)
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			defer func() {
+				close(release)
+				<-done
+			}()
+			<-started
+			time.Sleep(20 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req := httptest.NewRequest("POST", "/things", nil).WithContext(ctx)
+			req.Header.Set(idempotencyHeader, "slow")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("expected 409 while the first request runs, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	service := newTestService(t)
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"name":"Ann","email":"ann@example.com"}`))
+	req.Header.Set(idempotencyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
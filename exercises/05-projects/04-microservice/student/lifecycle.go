@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Component is a part of the service with an ordered start and stop.
+// Components start after everything they depend on and stop before it.
+type Component struct {
+	Name      string
+	DependsOn []string
+	// Start is optional. Components without one are considered running
+	// from the moment they are registered, which suits resources opened
+	// by a constructor.
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+	// StopTimeout is this component's own shutdown deadline. Zero means
+	// it is bounded only by the overall shutdown context.
+	StopTimeout time.Duration
+}
+
+// StopResult records how one component's shutdown went.
+type StopResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+	// Overran is set when Stop did not return within its deadline. The
+	// lifecycle moves on without waiting for it.
+	Overran bool
+}
+
+// Lifecycle starts and stops registered components in dependency order.
+type Lifecycle struct {
+	components []Component
+	running    map[string]bool
+	mu         sync.Mutex
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{running: make(map[string]bool)}
+}
+
+func (l *Lifecycle) Register(c Component) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, existing := range l.components {
+		if existing.Name == c.Name {
+			return fmt.Errorf("component %q registered twice", c.Name)
+		}
+	}
+	l.components = append(l.components, c)
+	if c.Start == nil {
+		l.running[c.Name] = true
+	}
+	return nil
+}
+
+// order sorts components so that each comes after its dependencies. Ties
+// keep registration order, which makes the sequence predictable.
+func (l *Lifecycle) order() ([]Component, error) {
+	byName := make(map[string]Component, len(l.components))
+	for _, c := range l.components {
+		byName[c.Name] = c
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var sorted []Component
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		c, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("component %q depends on unknown component %q", path[len(path)-1], name)
+		}
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		case done:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dep := range c.DependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		sorted = append(sorted, c)
+		return nil
+	}
+
+	for _, c := range l.components {
+		if err := visit(c.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// Start runs start hooks in dependency order. If one fails, the
+// components already started are stopped again in reverse order.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sorted, err := l.order()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range sorted {
+		if l.running[c.Name] || c.Start == nil {
+			continue
+		}
+		if err := c.Start(ctx); err != nil {
+			l.stopLocked(context.WithoutCancel(ctx), sorted)
+			return fmt.Errorf("starting %s: %w", c.Name, err)
+		}
+		l.running[c.Name] = true
+		logger.InfoContext(ctx, "component started", "component", c.Name)
+	}
+	return nil
+}
+
+// StopTimeout is how long Stop can take when every component uses its
+// whole deadline, since components stop one after another.
+func (l *Lifecycle) StopTimeout() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return stopTimeout(l.components)
+}
+
+func stopTimeout(components []Component) time.Duration {
+	var total time.Duration
+	for _, c := range components {
+		if c.Stop != nil {
+			total += c.StopTimeout
+		}
+	}
+	return total
+}
+
+// Stop runs stop hooks in reverse dependency order, each under its own
+// deadline. Every running component is given the chance to stop even if
+// an earlier one failed or overran. The returned error joins all failures.
+func (l *Lifecycle) Stop(ctx context.Context) ([]StopResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sorted, err := l.order()
+	if err != nil {
+		return nil, err
+	}
+	return l.stopLocked(ctx, sorted)
+}
+
+func (l *Lifecycle) stopLocked(ctx context.Context, sorted []Component) ([]StopResult, error) {
+	var results []StopResult
+	var errs []error
+
+	for i := len(sorted) - 1; i >= 0; i-- {
+		c := sorted[i]
+		if !l.running[c.Name] {
+			continue
+		}
+		delete(l.running, c.Name)
+		if c.Stop == nil {
+			continue
+		}
+
+		result := stopComponent(ctx, c)
+		results = append(results, result)
+
+		switch {
+		case result.Overran:
+			logger.WarnContext(ctx, "component overran its shutdown deadline",
+				"component", c.Name, "deadline", c.StopTimeout, "error", result.Err)
+			errs = append(errs, fmt.Errorf("stopping %s: %w", c.Name, result.Err))
+		case result.Err != nil:
+			logger.ErrorContext(ctx, "component failed to stop", "component", c.Name, "error", result.Err)
+			errs = append(errs, fmt.Errorf("stopping %s: %w", c.Name, result.Err))
+		default:
+			logger.InfoContext(ctx, "component stopped", "component", c.Name, "duration", result.Duration)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// stopComponent runs c.Stop in its own goroutine so that a hook which
+// ignores its context cannot hold up the rest of the shutdown.
+func stopComponent(ctx context.Context, c Component) StopResult {
+	if c.StopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.StopTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Stop(ctx) }()
+
+	result := StopResult{Name: c.Name}
+	select {
+	case err := <-errc:
+		result.Err = err
+		result.Overran = errors.Is(err, context.DeadlineExceeded)
+	case <-ctx.Done():
+		result.Err = ctx.Err()
+		result.Overran = true
+	}
+	result.Duration = time.Since(start)
+	return result
+}
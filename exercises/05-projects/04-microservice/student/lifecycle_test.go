@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventLog struct {
+	events []string
+	mu     sync.Mutex
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	l.events = append(l.events, event)
+	l.mu.Unlock()
+}
+
+func (l *eventLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.events, ",")
+}
+
+func recordingComponent(events *eventLog, name string, deps ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: deps,
+		Start:     func(ctx context.Context) error { events.add("start " + name); return nil },
+		Stop:      func(ctx context.Context) error { events.add("stop " + name); return nil },
+	}
+}
+
+func TestLifecycleOrdersByDependencies(t *testing.T) {
+	events := &eventLog{}
+	l := NewLifecycle()
+	// Registered out of order on purpose.
+	l.Register(recordingComponent(events, "http", "db", "cache"))
+	l.Register(recordingComponent(events, "cache", "db"))
+	l.Register(recordingComponent(events, "db"))
+
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "start db,start cache,start http,stop http,stop cache,stop db"
+	if got := events.String(); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestLifecycleReportsOverrunAndContinues(t *testing.T) {
+	events := &eventLog{}
+	l := NewLifecycle()
+	l.Register(recordingComponent(events, "db"))
+	l.Register(Component{
+		Name:        "stuck",
+		DependsOn:   []string{"db"},
+		Stop:        func(ctx context.Context) error { time.Sleep(time.Second); return nil },
+		StopTimeout: 20 * time.Millisecond,
+	})
+
+	l.Start(context.Background())
+	start := time.Now()
+	results, err := l.Stop(context.Background())
+
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("shutdown waited for the stuck component")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if len(results) != 2 || results[0].Name != "stuck" || !results[0].Overran {
+		t.Errorf("expected stuck to be reported as overrun: %+v", results)
+	}
+	if !strings.Contains(events.String(), "stop db") {
+		t.Error("db was not stopped after stuck overran")
+	}
+}
+
+func TestLifecycleRejectsCycles(t *testing.T) {
+	l := NewLifecycle()
+	l.Register(Component{Name: "a", DependsOn: []string{"b"}, Start: func(context.Context) error { return nil }})
+	l.Register(Component{Name: "b", DependsOn: []string{"a"}, Start: func(context.Context) error { return nil }})
+
+	if err := l.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+}
+
+// The shutdown deadline in main must leave every component its own
+// deadline, and the orchestrator's grace period must outlast it.
+func TestShutdownDeadlineCoversComponents(t *testing.T) {
+	service := newTestService(t)
+	var want time.Duration
+	for _, c := range service.lifecycle.components {
+		if c.Stop != nil && c.StopTimeout <= 0 {
+			t.Errorf("component %s has no stop deadline", c.Name)
+		}
+		want += c.StopTimeout
+	}
+	if got := service.lifecycle.StopTimeout(); got != want {
+		t.Errorf("expected a %s shutdown deadline, got %s", want, got)
+	}
+
+	// deploy gen takes the deadlines from the configuration alone.
+	var names []string
+	for _, c := range service.lifecycle.components {
+		names = append(names, c.Name)
+	}
+	spec := &DeploySpec{Components: stopDeadlines(service.config)}
+	if spec.ComponentNames() != strings.Join(names, ", ") {
+		t.Errorf("stopDeadlines lists %s, the service registers %s", spec.ComponentNames(), strings.Join(names, ", "))
+	}
+	if grace := spec.ShutdownGracePeriod(); grace <= want {
+		t.Errorf("grace period %s does not outlast the %s shutdown", grace, want)
+	}
+}
+
+func TestLifecycleStopsStartedComponentsWhenStartFails(t *testing.T) {
+	events := &eventLog{}
+	l := NewLifecycle()
+	l.Register(recordingComponent(events, "db"))
+	l.Register(Component{
+		Name:      "http",
+		DependsOn: []string{"db"},
+		Start:     func(ctx context.Context) error { return errors.New("address in use") },
+	})
+
+	if err := l.Start(context.Background()); err == nil {
+		t.Fatal("expected start error")
+	}
+	if got := events.String(); got != "start db,stop db" {
+		t.Errorf("got %s", got)
+	}
+}
+
+// TestShutdownDrainsInFlightRequests starts the real server, begins a slow
+// request and shuts down while it is running: readiness must fail while
+// draining, the slow request must still complete and the database must be
+// closed only afterwards.
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	service, err := NewUserService(&Config{
+		ServiceName: "user-service",
+		DatabaseURL: "file::memory:",
+		LogLevel:    "warn",
+		JWTSecret:   testSecret,
+		DrainDelay:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	service.mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(400 * time.Millisecond)
+		if err := service.db.Ping(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if err := service.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + service.listener.Addr().String()
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- service.Shutdown(context.Background()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(base + "/readyz")
+	if err != nil {
+		t.Fatalf("server stopped accepting before the drain delay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail while draining, got %d", resp.StatusCode)
+	}
+
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("in-flight request got %d, expected it to finish before the database closed", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+	if _, err := http.Get(base + "/livez"); err == nil {
+		t.Error("expected connections to be refused after shutdown")
+	}
+}
+
+func TestNewUserServiceClosesWhatItOpenedOnError(t *testing.T) {
+	openFiles := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("cannot count open files:", err)
+		}
+		return len(fds)
+	}
+
+	dir := t.TempDir()
+	before := openFiles()
+	_, err := NewUserService(&Config{
+		ServiceName:   "user-service",
+		DatabaseURL:   filepath.Join(dir, "users.db"),
+		QueueURL:      "file:" + filepath.Join(dir, "queue.log"),
+		TraceExporter: "ftp://collector",
+		LogLevel:      "warn",
+		JWTSecret:     testSecret,
+	})
+	if err == nil {
+		t.Fatal("expected an unsupported trace exporter to fail")
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("expected the database and queue files to be closed, %d files open before and %d after", before, after)
+	}
+}
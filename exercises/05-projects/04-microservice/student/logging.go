@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by every handler created by newLogger so that the
+// admin endpoint can change verbosity at run time.
+var logLevel = new(slog.LevelVar)
+
+// logger is used by the middleware, Database, Cache and MessageQueue. It
+// is replaced by NewUserService once the configuration is known.
+var logger = newLogger(os.Stderr, "text")
+
+// newLogger returns a logger writing JSON or text records to w. Every
+// record logged with a context is enriched with the request ID and the
+// current trace and span IDs.
+func newLogger(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// contextHandler adds request-scoped attributes from the context to each
+// record before passing it on.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts IDs generated by common proxies and load
+// balancers while refusing anything that could forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware reuses the caller's X-Request-ID when it is well
+// formed and generates one otherwise. The ID is stored in the context and
+// echoed in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// handleGetLogLevel and handleSetLogLevel back the admin endpoint for
+// reading and changing the log level without a restart.
+func handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, LogLevelBody{Level: logLevel.Level().String()})
+}
+
+// LogLevelBody is the request and response body of the log-level
+// endpoint.
+type LogLevelBody struct {
+	Level string `json:"level" validate:"required"`
+}
+
+func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body LogLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	level, err := parseLogLevel(body.Level)
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, CodeValidationFailed, err.Error()))
+		return
+	}
+
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	logger.InfoContext(r.Context(), "log level changed", "from", previous.String(), "to", level.String())
+	writeJSON(w, http.StatusOK, LogLevelBody{Level: level.String()})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer lets the test read log output written by other goroutines.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		out = append(out, record)
+	}
+	return out
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		reuse  bool
+	}{
+		{"generated when missing", "", false},
+		{"reused when valid", "req-123.abc", true},
+		{"replaced when invalid", "bad id\nwith newline", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set(requestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if seen == "" || rec.Header().Get(requestIDHeader) != seen {
+				t.Fatalf("context ID %q does not match response header %q", seen, rec.Header().Get(requestIDHeader))
+			}
+			if (seen == tt.header) != tt.reuse {
+				t.Errorf("header %q produced ID %q", tt.header, seen)
+			}
+		})
+	}
+}
+
+func TestLogsCarryRequestID(t *testing.T) {
+	service := newTestService(t)
+	service.relay.Start()
+	defer service.relay.Stop(context.Background())
+	handled := make(chan struct{})
+	// Joined before capturing logs: the rebalance is not part of a request.
+	service.queue.JoinGroup(userEventsTopic, "test", func(ctx context.Context, msg *Message) error {
+		logger.InfoContext(ctx, "consumer saw message")
+		close(handled)
+		return nil
+	})
+
+	out := &syncBuffer{}
+	defer func(previous *slog.Logger) { logger = previous }(logger)
+	logger = newLogger(out, "json")
+	logLevel.Set(slog.LevelDebug)
+	defer logLevel.Set(slog.LevelWarn)
+
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"name":"Ann","email":"ann@example.com"}`))
+	req.Header.Set(requestIDHeader, "trace-me-1")
+	service.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	service.queue.Close()
+
+	sources := map[string]bool{}
+	for _, record := range out.lines(t) {
+		if record["request_id"] != "trace-me-1" {
+			t.Errorf("log line without request ID: %v", record)
+		}
+		sources[record["msg"].(string)] = true
+	}
+	for _, msg := range []string{"database query", "message published", "consumer saw message", "request"} {
+		if !sources[msg] {
+			t.Errorf("expected a %q log line, got %v", msg, sources)
+		}
+	}
+}
+
+func TestAdminChangesLogLevel(t *testing.T) {
+	service := newTestService(t)
+	defer logLevel.Set(slog.LevelWarn)
+
+	user := testToken(t, &Claims{UserID: 1, Roles: []Role{RoleUser}})
+	admin := testToken(t, &Claims{UserID: 2, Roles: []Role{RoleAdmin}})
+
+	put := func(token, body string) int {
+		req := httptest.NewRequest("PUT", "/admin/log-level", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put(user, `{"level":"debug"}`); code != http.StatusForbidden {
+		t.Errorf("expected 403 for non-admin, got %d", code)
+	}
+	if code := put(admin, `{"level":"loud"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown level, got %d", code)
+	}
+	if code := put(admin, `{"level":"debug"}`); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("expected level debug, got %s", logLevel.Level())
+	}
+}
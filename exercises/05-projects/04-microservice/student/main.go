@@ -1,218 +1,1552 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"testing"
+	"net/mail"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 // Task 1: Define basic data structures
+// User's validate tags feed the OpenAPI schema, which request bodies are
+// checked against; see openapi.go.
 type User struct {
-	// TODO: Add fields: ID (int), Name (string), Email (string), CreatedAt (time.Time)
-	// Add JSON tags for proper serialization
+	ID        int       `json:"id" validate:"readonly"`
+	Name      string    `json:"name" validate:"required,max=100"`
+	Email     string    `json:"email" validate:"required,email"`
+	CreatedAt time.Time `json:"created_at" validate:"readonly"`
 }
 
 type Config struct {
-	// TODO: Add configuration fields
-	// Include service name, port, database URL, Redis URL, log level, etc.
+	ServiceName string `json:"service_name"`
+	Port        int    `json:"port"`
+	DatabaseURL string `json:"database_url"`
+	RedisURL    string `json:"redis_url"`
+	LogLevel    string `json:"log_level"`
+	LogFormat   string `json:"log_format"`
+	Environment string `json:"environment"`
+	JWTSecret   string `json:"-"`
+
+	// TraceExporter is "file:<path>", an OTLP/HTTP base URL, or empty.
+	TraceExporter string `json:"trace_exporter"`
+	// UpstreamURL points at another instance that is asked for users
+	// missing from the local database.
+	UpstreamURL string `json:"upstream_url"`
+	// DrainDelay is how long readiness reports failure before the server
+	// stops accepting connections, giving load balancers time to notice.
+	DrainDelay time.Duration `json:"drain_delay"`
+	// RequestTimeout bounds how long a handler may wait on dependencies.
+	// Zero means no limit.
+	RequestTimeout time.Duration `json:"request_timeout"`
+
+	// QueueURL is "file:<path>" for a durable queue, or empty for an
+	// in-memory one.
+	QueueURL               string        `json:"queue_url"`
+	QueueVisibilityTimeout time.Duration `json:"queue_visibility_timeout"`
+	QueueMaxDeliveries     int           `json:"queue_max_deliveries"`
+
+	// IdempotencyStore is "memory" or "cache"; IdempotencyTTL is how long
+	// responses are kept for replay.
+	IdempotencyStore string        `json:"idempotency_store"`
+	IdempotencyTTL   time.Duration `json:"idempotency_ttl"`
 }
 
 // Task 2: Create service structure
 type UserService struct {
-	// TODO: Add fields for service components
-	// Include logger, cache, database, HTTP client, etc.
+	config *Config
+	db     *Database
+	cache  *Cache
+	queue  *MessageQueue
+	relay  *OutboxRelay
+	// events registers the events the service publishes, with the
+	// service name as their source.
+	events   *EventRegistry
+	metrics  *Metrics
+	health   *HealthRegistry
+	tracer   *Tracer
+	upstream *ServiceClient
+	mux      *http.ServeMux
+	// tokenKey signs and verifies HS256 tokens.
+	tokenKey []byte
+	handler  http.Handler
+
+	// faults lets tests make the database, cache and upstream misbehave.
+	// It is nil, injecting nothing, unless a test calls injectFaults.
+	faults *FaultInjector
+
+	idempotency *Idempotency
+
+	endpoints []Endpoint
+	schemas   *schemaRegistry
+	openapi   []byte
+
+	server    *http.Server
+	listener  net.Listener
+	lifecycle *Lifecycle
 }
 
 // Task 3: Create NewUserService function
-func NewUserService(config *Config) (*UserService, error) {
-	// TODO: Initialize service components
-	// Set up logger, cache, database connections
-	// Return initialized service
-	return nil, nil
+func NewUserService(config *Config) (_ *UserService, err error) {
+	if config.LogLevel != "" {
+		level, err := parseLogLevel(config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		logLevel.Set(level)
+	}
+	logger = newLogger(os.Stderr, config.LogFormat).With("service", config.ServiceName)
+
+	// cleanup closes what has been opened so far, in reverse, if a later
+	// step fails.
+	var cleanup []func() error
+	defer func() {
+		if err != nil {
+			for _, undo := range slices.Backward(cleanup) {
+				undo()
+			}
+		}
+	}()
+
+	db, err := NewDatabase(config.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	cleanup = append(cleanup, db.Close)
+
+	cache, err := NewCache(config.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cache: %v", err)
+	}
+	cleanup = append(cleanup, cache.Close)
+
+	queue, err := NewMessageQueue(config.QueueURL, QueueOptions{
+		VisibilityTimeout: config.QueueVisibilityTimeout,
+		MaxDeliveries:     config.QueueMaxDeliveries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening message queue: %v", err)
+	}
+	cleanup = append(cleanup, queue.Close)
+
+	exporter, err := newExporter(config.ServiceName, config.TraceExporter)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+	serviceTracer := NewTracer(config.ServiceName, exporter)
+	cleanup = append(cleanup, func() error { return serviceTracer.Shutdown(context.Background()) })
+
+	relay, err := NewOutboxRelay(db, queue)
+	if err != nil {
+		return nil, fmt.Errorf("error creating outbox relay: %v", err)
+	}
+
+	s := &UserService{
+		config:  config,
+		db:      db,
+		cache:   cache,
+		queue:   queue,
+		relay:   relay,
+		events:  newUserEvents("/" + config.ServiceName),
+		metrics: NewMetrics(),
+		health:  NewHealthRegistry(2*time.Second, 2*time.Second),
+		tracer:  serviceTracer,
+		mux:     http.NewServeMux(),
+	}
+	s.tokenKey = newTokenKey(config.JWTSecret)
+	db.events = s.events
+	s.idempotency = NewIdempotency(newIdempotencyStore(config.IdempotencyStore, cache), cmp.Or(config.IdempotencyTTL, 24*time.Hour))
+	if config.UpstreamURL != "" {
+		s.upstream = NewServiceClient(config.UpstreamURL, config.ServiceName)
+		s.upstream.tokenKey = s.tokenKey
+	}
+	s.registerHealthChecks()
+	s.routes()
+	s.handler = requestIDMiddleware(loggingMiddleware(metricsMiddleware(s.metrics)(s.mux)))
+
+	s.server = &http.Server{
+		Addr:         fmt.Sprintf(":%d", config.Port),
+		Handler:      s,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+	if err := s.registerComponents(); err != nil {
+		return nil, err
+	}
+	tracer = s.tracer
+	return s, nil
+}
+
+// registerComponents describes how the service starts and stops. Shutdown
+// runs in reverse: readiness fails first, then the HTTP server stops
+// accepting connections and drains in-flight requests, then the outbox
+// relay publishes what those requests wrote and queue consumers finish,
+// and only then are the cache and database closed.
+func (s *UserService) registerComponents() error {
+	deadline := make(map[string]time.Duration)
+	for _, d := range stopDeadlines(s.config) {
+		deadline[d.Name] = d.Timeout
+	}
+
+	s.lifecycle = NewLifecycle()
+	return errors.Join(
+		s.lifecycle.Register(Component{
+			Name:        "tracer",
+			Stop:        s.tracer.Shutdown,
+			StopTimeout: deadline["tracer"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:        "database",
+			DependsOn:   []string{"tracer"},
+			Stop:        func(ctx context.Context) error { return s.db.Close() },
+			StopTimeout: deadline["database"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:        "cache",
+			DependsOn:   []string{"tracer"},
+			Stop:        func(ctx context.Context) error { return s.cache.Close() },
+			StopTimeout: deadline["cache"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:        "queue",
+			DependsOn:   []string{"database", "cache"},
+			Stop:        func(ctx context.Context) error { return s.queue.Close() },
+			StopTimeout: deadline["queue"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:      "outbox",
+			DependsOn: []string{"database", "queue"},
+			Start: func(ctx context.Context) error {
+				s.relay.Start()
+				return nil
+			},
+			Stop:        s.relay.Stop,
+			StopTimeout: deadline["outbox"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:        "http",
+			DependsOn:   []string{"database", "cache", "queue", "outbox"},
+			Start:       s.startHTTP,
+			Stop:        s.server.Shutdown,
+			StopTimeout: deadline["http"],
+		}),
+		s.lifecycle.Register(Component{
+			Name:      "readiness",
+			DependsOn: []string{"http"},
+			Start: func(ctx context.Context) error {
+				s.health.SetDraining(false)
+				return nil
+			},
+			Stop:        s.drain,
+			StopTimeout: deadline["readiness"],
+		}),
+	)
+}
+
+// stopDeadline is how long one lifecycle component may take to stop.
+type stopDeadline struct {
+	Name    string
+	Timeout time.Duration
+}
+
+// stopDeadlines lists the service's components in registration order with
+// their stop deadlines. deploy gen reads them to size the orchestrator's
+// grace period without building a service.
+func stopDeadlines(config *Config) []stopDeadline {
+	return []stopDeadline{
+		{"tracer", 5 * time.Second},
+		{"database", 5 * time.Second},
+		{"cache", 2 * time.Second},
+		{"queue", 10 * time.Second},
+		{"outbox", 5 * time.Second},
+		{"http", 15 * time.Second},
+		{"readiness", config.DrainDelay + time.Second},
+	}
+}
+
+// startHTTP binds the listener synchronously so that a busy port fails
+// Start, then serves in the background.
+func (s *UserService) startHTTP(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	go func() {
+		logger.Info("server listening", "addr", ln.Addr().String())
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("server error", "error", err)
+		}
+	}()
+	return nil
+}
+
+// drain fails readiness and waits for the configured delay while the
+// server keeps handling requests.
+func (s *UserService) drain(ctx context.Context) error {
+	s.health.SetDraining(true)
+	logger.InfoContext(ctx, "draining", "delay", s.config.DrainDelay)
+
+	select {
+	case <-time.After(s.config.DrainDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start starts every component in dependency order.
+func (s *UserService) Start(ctx context.Context) error {
+	return s.lifecycle.Start(ctx)
+}
+
+// routes registers every endpoint on the service mux and generates the
+// OpenAPI document from the same table. Each handler is wrapped in
+// authMiddleware and authorize so that the policy table in auth.go is
+// consulted using the matched route pattern.
+func (s *UserService) routes() {
+	s.schemas = newSchemaRegistry()
+	status := map[string]string{}
+	userID := map[string]any{"id": 0}
+
+	s.handle(Endpoint{Pattern: "GET /livez", Summary: "Liveness probe", Handler: s.health.handleLivez,
+		Responses: map[int]any{http.StatusOK: status}})
+	s.handle(Endpoint{Pattern: "GET /readyz", Summary: "Readiness probe", Handler: s.health.handleReadyz,
+		Responses: map[int]any{http.StatusOK: status, http.StatusServiceUnavailable: status}})
+	s.handle(Endpoint{Pattern: "GET /healthz", Summary: "Health report", Handler: s.healthCheck,
+		Responses: map[int]any{http.StatusOK: HealthReport{}, http.StatusServiceUnavailable: HealthReport{}}})
+	s.handle(Endpoint{Pattern: "GET /metrics", Summary: "Prometheus metrics", Handler: s.metrics.handleMetrics,
+		Responses: map[int]any{http.StatusOK: nil}})
+	s.handle(Endpoint{Pattern: "GET /openapi.json", Summary: "OpenAPI document", Handler: s.handleOpenAPI,
+		Responses: map[int]any{http.StatusOK: nil}})
+	s.handle(Endpoint{Pattern: "GET /admin/log-level", Summary: "Get the log level", Handler: handleGetLogLevel,
+		Responses: map[int]any{http.StatusOK: LogLevelBody{}}})
+	s.handle(Endpoint{Pattern: "PUT /admin/log-level", Summary: "Set the log level", Handler: handleSetLogLevel,
+		Request: LogLevelBody{}, Responses: map[int]any{http.StatusOK: LogLevelBody{}}})
+	s.handle(Endpoint{Pattern: "GET /api/users/{id}", Summary: "Get a user", Handler: s.handleGetUser,
+		PathParams: userID, Responses: map[int]any{http.StatusOK: User{}, http.StatusNotFound: APIError{}}})
+	s.handle(Endpoint{Pattern: "POST /api/users", Summary: "Create a user", Handler: s.handleCreateUser,
+		Request: User{}, Responses: map[int]any{http.StatusCreated: User{}, http.StatusConflict: APIError{}}})
+	s.handle(Endpoint{Pattern: "PUT /api/users/{id}", Summary: "Update a user", Handler: s.handleUpdateUser,
+		PathParams: userID, Request: User{}, Responses: map[int]any{http.StatusOK: User{}, http.StatusNotFound: APIError{}, http.StatusConflict: APIError{}}})
+	s.handle(Endpoint{Pattern: "DELETE /api/users/{id}", Summary: "Delete a user", Handler: s.handleDeleteUser,
+		PathParams: userID, Responses: map[int]any{http.StatusNoContent: nil, http.StatusNotFound: APIError{}}})
+
+	s.openapi, _ = json.MarshalIndent(buildOpenAPI(s.config.ServiceName, s.endpoints, s.schemas), "", "  ")
+}
+
+// handle registers route, validating request bodies against the schema of
+// route.Request before the handler runs. The request timeout is applied
+// here, after the ServeMux has matched, because the ServeMux records the
+// pattern only on the request it was given and the metrics and logging
+// middleware read it from theirs.
+func (s *UserService) handle(route Endpoint) {
+	var h http.Handler = route.Handler
+	if route.Request != nil {
+		h = s.schemas.validateBody(s.schemas.schemaOf(reflect.TypeOf(route.Request)), route.Handler)
+	}
+	if method, _, _ := strings.Cut(route.Pattern, " "); unsafeMethod(method) {
+		h = s.idempotency.Wrap(h)
+	}
+	s.endpoints = append(s.endpoints, route)
+	s.mux.Handle(route.Pattern, timeoutMiddleware(s.config.RequestTimeout)(authMiddleware(s.tokenKey)(authorize(h))))
+}
+
+// unsafeMethod reports whether requests with method change state, and so
+// accept an Idempotency-Key.
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// newIdempotencyStore returns the store named by IDEMPOTENCY_STORE. Any
+// name other than "cache" means in-memory.
+func newIdempotencyStore(name string, cache *Cache) IdempotencyStore {
+	if name == "cache" {
+		return NewCacheIdempotencyStore(cache)
+	}
+	return NewMemoryIdempotencyStore()
+}
+
+func (s *UserService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
 }
 
 // Task 4: Implement configuration loading
 func LoadConfig() (*Config, error) {
-	// TODO: Load configuration from environment variables
-	// Set default values for missing config
-	// Validate configuration parameters
-	return nil, nil
+	config := configFromEnv()
+
+	if config.Port <= 0 || config.Port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d", config.Port)
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return nil, err
+	}
+	if config.LogFormat != "json" && config.LogFormat != "text" {
+		return nil, fmt.Errorf("invalid log format %q", config.LogFormat)
+	}
+	if config.IdempotencyStore != "memory" && config.IdempotencyStore != "cache" {
+		return nil, fmt.Errorf("invalid idempotency store %q", config.IdempotencyStore)
+	}
+	if config.JWTSecret == "" && config.Environment == "production" {
+		return nil, errors.New("JWT_SECRET is required in production")
+	}
+	return config, nil
+}
+
+// configFromEnv reads every setting from the environment, falling back to
+// defaults, without validating the result. Each variable is named after
+// the upper-cased JSON name of its field.
+func configFromEnv() *Config {
+	return &Config{
+		ServiceName: getEnv("SERVICE_NAME", "user-service"),
+		Port:        getEnvAsInt("PORT", 8080),
+		DatabaseURL: getEnv("DATABASE_URL", "file:users.db?_foreign_keys=on"),
+		RedisURL:    getEnv("REDIS_URL", ""),
+		LogLevel:    getEnv("LOG_LEVEL", "info"),
+		LogFormat:   getEnv("LOG_FORMAT", "json"),
+		Environment: getEnv("ENVIRONMENT", "development"),
+		JWTSecret:   getEnv("JWT_SECRET", ""),
+
+		TraceExporter: getEnv("TRACE_EXPORTER", ""),
+		UpstreamURL:   getEnv("UPSTREAM_URL", ""),
+		DrainDelay:    getEnvAsDuration("DRAIN_DELAY", 5*time.Second),
+
+		RequestTimeout: getEnvAsDuration("REQUEST_TIMEOUT", 5*time.Second),
+
+		QueueURL:               getEnv("QUEUE_URL", "file:queue.log"),
+		QueueVisibilityTimeout: getEnvAsDuration("QUEUE_VISIBILITY_TIMEOUT", 30*time.Second),
+		QueueMaxDeliveries:     getEnvAsInt("QUEUE_MAX_DELIVERIES", 5),
+
+		IdempotencyStore: getEnv("IDEMPOTENCY_STORE", "memory"),
+		IdempotencyTTL:   getEnvAsDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
 }
 
 // Task 5: Implement health check
 func (s *UserService) healthCheck(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement health check endpoint
-	// Check database connectivity
-	// Check cache connectivity
-	// Return health status as JSON
+	s.health.handleHealthz(w, r)
+}
+
+// maxQueueDepth is the backlog at which the queue check starts failing.
+const maxQueueDepth = 800
+
+// registerHealthChecks wires each dependency into the health registry.
+// The database is critical; the others degrade the service without
+// taking it out of rotation.
+func (s *UserService) registerHealthChecks() {
+	s.health.Register(HealthChecker{Name: "database", Critical: true, Check: s.db.Ping})
+	s.health.Register(HealthChecker{Name: "cache", Check: func(ctx context.Context) error {
+		return s.cache.Ping(ctx)
+	}})
+	s.health.Register(HealthChecker{Name: "queue", Check: func(ctx context.Context) error {
+		if depth := s.queue.Depth(); depth > maxQueueDepth {
+			return fmt.Errorf("queue depth %d exceeds %d", depth, maxQueueDepth)
+		}
+		return nil
+	}})
+	if s.upstream != nil {
+		s.health.Register(HealthChecker{Name: "upstream", Check: func(ctx context.Context) error {
+			if state := s.upstream.breaker.State(); state == StateOpen {
+				return fmt.Errorf("circuit breaker is %s", state)
+			}
+			return nil
+		}})
+	}
 }
 
 // Task 6: Implement user handlers
 func (s *UserService) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Extract user ID from URL path
-	// Try to get user from cache first
-	// If not in cache, get from database
-	// Cache the result
-	// Return user as JSON
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var user User
+	if err := s.cache.Get(r.Context(), userCacheKey(id), &user); err == nil {
+		writeJSON(w, http.StatusOK, &user)
+		return
+	}
+
+	found, err := s.db.GetUser(r.Context(), id)
+	if errors.Is(err, ErrNotFound) && s.upstream != nil {
+		found, err = s.upstream.GetUser(r.Context(), id)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.cache.Set(r.Context(), userCacheKey(id), found, 5*time.Minute)
+	writeJSON(w, http.StatusOK, found)
 }
 
 func (s *UserService) handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Decode JSON request body
-	// Validate user data
-	// Create user in database
-	// Return created user with 201 status
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := validateUser(&user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := s.db.CreateUser(r.Context(), &user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
 }
 
 func (s *UserService) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Extract user ID from URL path
-	// Decode JSON request body
-	// Update user in database
-	// Invalidate cache
-	// Return updated user
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := validateUser(&user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	updated, err := s.db.UpdateUser(r.Context(), id, &user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.cache.Delete(r.Context(), userCacheKey(id))
+	writeJSON(w, http.StatusOK, updated)
 }
 
 func (s *UserService) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Extract user ID from URL path
-	// Delete user from database
-	// Invalidate cache
-	// Return 204 No Content status
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := s.db.DeleteUser(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.cache.Delete(r.Context(), userCacheKey(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, newAPIError(http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid user ID: %q", r.PathValue("id")))
+	}
+	return id, nil
+}
+
+func userCacheKey(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
 // Task 7: Implement circuit breaker
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// ErrUpstream wraps failures of calls to another service.
+	ErrUpstream = errors.New("upstream request failed")
+)
+
+type CircuitState int
+
+const (
+	StateClosed CircuitState = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
 type CircuitBreaker struct {
-	// TODO: Add circuit breaker fields
-	// Include failures count, last error time, state, threshold, timeout, mutex
+	failures  int
+	lastError time.Time
+	state     CircuitState
+	probing   bool
+	threshold int
+	timeout   time.Duration
+	mu        sync.Mutex
 }
 
 func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
-	// TODO: Initialize circuit breaker
-	return nil
+	return &CircuitBreaker{
+		threshold: threshold,
+		timeout:   timeout,
+		state:     StateClosed,
+	}
 }
 
+// Execute runs command unless the breaker is open. Once the timeout has
+// passed an open breaker lets a single probe through; its outcome decides
+// whether the breaker closes again or stays open.
 func (cb *CircuitBreaker) Execute(command func() error) error {
-	// TODO: Implement circuit breaker logic
-	// Check current state (closed, open, half-open)
-	// Execute command if allowed
-	// Update state based on result
+	cb.mu.Lock()
+	if cb.state == StateOpen && time.Since(cb.lastError) > cb.timeout {
+		cb.state = StateHalfOpen
+	}
+	if cb.state == StateOpen || (cb.state == StateHalfOpen && cb.probing) {
+		cb.mu.Unlock()
+		return ErrCircuitOpen
+	}
+	if cb.state == StateHalfOpen {
+		cb.probing = true
+	}
+	cb.mu.Unlock()
+
+	err := command()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if err != nil {
+		cb.failures++
+		cb.lastError = time.Now()
+		if cb.state == StateHalfOpen || cb.failures >= cb.threshold {
+			cb.state = StateOpen
+		}
+		return err
+	}
+
+	cb.failures = 0
+	cb.state = StateClosed
 	return nil
 }
 
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == StateOpen && time.Since(cb.lastError) > cb.timeout {
+		return StateHalfOpen
+	}
+	return cb.state
+}
+
 // Task 8: Implement HTTP client with circuit breaker
 type ServiceClient struct {
-	// TODO: Add HTTP client and circuit breaker
+	baseURL     string
+	serviceName string
+	client      *http.Client
+	breaker     *CircuitBreaker
+	// maxAttempts bounds how often one call is tried; retries wait
+	// retryBackoff, doubling each time.
+	maxAttempts  int
+	retryBackoff time.Duration
+	// tokenKey signs the service token sent with each call; the other
+	// instance must share it.
+	tokenKey []byte
 }
 
-func NewServiceClient() *ServiceClient {
-	// TODO: Initialize service client
-	return nil
+func NewServiceClient(baseURL, serviceName string) *ServiceClient {
+	return &ServiceClient{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		serviceName:  serviceName,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		breaker:      NewCircuitBreaker(5, 30*time.Second),
+		maxAttempts:  3,
+		retryBackoff: 50 * time.Millisecond,
+	}
+}
+
+// GetUser fetches a user from another instance of the service. The call is
+// traced as a client span whose context travels in the traceparent header,
+// so the remote server span joins the same trace. Transport errors and
+// 502, 503 and 504 responses are retried, since the request is idempotent.
+// Only a call that fails after its retries counts as a failure for the
+// circuit breaker, and only if it failed with a transport error or a 5xx.
+func (sc *ServiceClient) GetUser(ctx context.Context, id int) (*User, error) {
+	ctx, span := startSpan(ctx, "GET /api/users/{id}", SpanKindClient)
+	defer span.End()
+
+	url := fmt.Sprintf("%s/api/users/%d", sc.baseURL, id)
+	span.SetAttribute("http.request.method", http.MethodGet)
+	span.SetAttribute("url.full", url)
+
+	var user User
+	var status int
+	err := sc.breaker.Execute(func() error {
+		var err error
+		for attempt := 1; ; attempt++ {
+			status, err = sc.getUser(ctx, url, &user)
+			retry := (status == 0 && err != nil) || status == http.StatusBadGateway ||
+				status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+			if !retry || attempt >= sc.maxAttempts || ctx.Err() != nil {
+				span.SetAttribute("http.request.resend_count", attempt-1)
+				if status != 0 {
+					span.SetAttribute("http.response.status_code", status)
+				}
+				return err
+			}
+
+			delay := sc.retryBackoff << (attempt - 1)
+			logger.WarnContext(ctx, "retrying upstream call", "attempt", attempt, "delay", delay, "status", status, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	if err == nil && status == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("user service returned status %d", status)
+	}
+	if err != nil {
+		span.RecordError(err)
+		if !errors.Is(err, ErrCircuitOpen) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", ErrUpstream, err)
+		}
+		return nil, err
+	}
+	return &user, nil
 }
 
-func (sc *ServiceClient) GetUser(id int) (*User, error) {
-	// TODO: Implement HTTP client with circuit breaker
-	// Make HTTP request to user service
-	// Handle errors and timeouts
-	// Use circuit breaker for fault tolerance
-	return nil, nil
+// getUser makes one attempt. A zero status means the request never got a
+// response.
+func (sc *ServiceClient) getUser(ctx context.Context, url string, user *User) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	injectTraceContext(ctx, req.Header)
+
+	token, err := signClaims(sc.tokenKey, &Claims{Username: sc.serviceName, Scopes: []Permission{PermUsersRead}})
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, fmt.Errorf("user service returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(user)
 }
 
 // Task 9: Implement caching
+var ErrCacheMiss = errors.New("cache miss")
+
+type cacheEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// Cache is an in-process key/value store with per-key expiry. Values are
+// stored as JSON so that callers get copies, the same as with Redis.
 type Cache struct {
-	// TODO: Add cache fields
-	// Include Redis client or in-memory cache
+	entries map[string]cacheEntry
+	mu      sync.RWMutex
+	faults  *FaultInjector
 }
 
 func NewCache(redisURL string) (*Cache, error) {
-	// TODO: Initialize cache connection
-	return nil, nil
+	if redisURL != "" && redisURL != "memory://" {
+		return nil, fmt.Errorf("unsupported cache URL: %s", redisURL)
+	}
+	return &Cache{entries: make(map[string]cacheEntry)}, nil
+}
+
+func (c *Cache) Get(ctx context.Context, key string, dest interface{}) (err error) {
+	done := startCacheCall(ctx, "get", key)
+	defer func() { done(err) }()
+	if _, err := c.faults.inject(ctx, faultCache, "get"); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if !ok || (!entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt)) {
+		return ErrCacheMiss
+	}
+	return json.Unmarshal(entry.data, dest)
 }
 
-func (c *Cache) Get(key string, dest interface{}) error {
-	// TODO: Get value from cache
-	// Deserialize JSON data
-	// Return error if not found
+func (c *Cache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) (err error) {
+	done := startCacheCall(ctx, "set", key)
+	defer func() { done(err) }()
+	if _, err := c.faults.inject(ctx, faultCache, "set"); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error encoding cache value: %v", err)
+	}
+
+	entry := cacheEntry{data: data}
+	if expiration > 0 {
+		entry.expiresAt = time.Now().Add(expiration)
+	}
+
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *Cache) Set(key string, value interface{}, expiration time.Duration) error {
-	// TODO: Set value in cache
-	// Serialize data to JSON
-	// Set expiration time
+// SetNX stores value only if key is absent or expired, and reports
+// whether it did. It is atomic, like Redis SET NX.
+func (c *Cache) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (_ bool, err error) {
+	done := startCacheCall(ctx, "setnx", key)
+	defer func() { done(err) }()
+	if _, err := c.faults.inject(ctx, faultCache, "setnx"); err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("error encoding cache value: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && (entry.expiresAt.IsZero() || time.Now().Before(entry.expiresAt)) {
+		return false, nil
+	}
+	entry := cacheEntry{data: data}
+	if expiration > 0 {
+		entry.expiresAt = time.Now().Add(expiration)
+	}
+	c.entries[key] = entry
+	return true, nil
+}
+
+func (c *Cache) Delete(ctx context.Context, key string) (err error) {
+	done := startCacheCall(ctx, "delete", key)
+	defer func() { done(err) }()
+	if _, err := c.faults.inject(ctx, faultCache, "delete"); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *Cache) Delete(key string) error {
-	// TODO: Delete key from cache
+// startCacheCall opens a span for one cache operation. The returned
+// function ends the span and logs the outcome; a miss is not an error.
+func startCacheCall(ctx context.Context, operation, key string) func(error) {
+	ctx, span := startSpan(ctx, "cache "+operation, SpanKindInternal)
+	span.SetAttribute("cache.operation", operation)
+	span.SetAttribute("cache.key", key)
+	start := time.Now()
+
+	return func(err error) {
+		defer span.End()
+		if operation == "get" {
+			span.SetAttribute("cache.hit", err == nil)
+		}
+		if err != nil && !errors.Is(err, ErrCacheMiss) {
+			span.RecordError(err)
+			logger.ErrorContext(ctx, "cache operation failed", "operation", operation, "key", key, "error", err)
+			return
+		}
+		logger.DebugContext(ctx, "cache operation", "operation", operation, "key", key,
+			"hit", err == nil, "duration", time.Since(start))
+	}
+}
+
+func (c *Cache) Ping(ctx context.Context) error {
+	_, err := c.faults.inject(ctx, faultCache, "ping")
+	return err
+}
+
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
 	return nil
 }
 
 // Task 10: Implement database operations
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+)
+
 type Database struct {
-	// TODO: Add database connection
+	db *sql.DB
+	// outboxReady is signalled after a commit that wrote to the outbox.
+	outboxReady chan struct{}
+	faults      *FaultInjector
+	// events builds the outbox events. NewUserService replaces the default
+	// with the service's registry.
+	events *EventRegistry
 }
 
+const usersSchema = `
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    email TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);`
+
 func NewDatabase(databaseURL string) (*Database, error) {
-	// TODO: Initialize database connection
-	// Set up connection pool
-	// Test connection
-	return nil, nil
+	db, err := sql.Open("sqlite3", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// An in-memory SQLite database lives and dies with its connection, so
+	// the pool must never open a second one.
+	if strings.Contains(databaseURL, ":memory:") {
+		db.SetMaxOpenConns(1)
+	} else {
+		db.SetMaxOpenConns(25)
+		db.SetMaxIdleConns(5)
+		db.SetConnMaxLifetime(5 * time.Minute)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(usersSchema + outboxSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating schema: %v", err)
+	}
+
+	return &Database{db: db, outboxReady: make(chan struct{}, 1), events: newUserEvents("/user-service")}, nil
+}
+
+func (db *Database) Ping(ctx context.Context) error {
+	if _, err := db.faults.inject(ctx, faultDB, "ping"); err != nil {
+		return err
+	}
+	return db.db.PingContext(ctx)
 }
 
-func (db *Database) GetUser(id int) (*User, error) {
-	// TODO: Query user from database
-	// Use prepared statements
-	// Handle database errors
-	return nil, nil
+func (db *Database) Close() error {
+	return db.db.Close()
 }
 
-func (db *Database) CreateUser(user *User) (*User, error) {
-	// TODO: Insert user into database
-	// Generate ID and timestamps
-	// Return created user
-	return nil, nil
+// startDBCall opens a client span describing one SQL statement, using the
+// OpenTelemetry database semantic conventions. The returned function ends
+// the span and logs the statement; ErrNotFound and ErrConflict are not
+// treated as failures.
+func startDBCall(ctx context.Context, operation, query string) (context.Context, func(error)) {
+	ctx, span := startSpan(ctx, operation+" users", SpanKindClient)
+	span.SetAttribute("db.system", "sqlite")
+	span.SetAttribute("db.operation.name", operation)
+	span.SetAttribute("db.collection.name", "users")
+	span.SetAttribute("db.query.text", query)
+	start := time.Now()
+
+	return ctx, func(err error) {
+		defer span.End()
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrConflict) {
+			span.RecordError(err)
+			logger.ErrorContext(ctx, "database query failed", "operation", operation, "error", err)
+			return
+		}
+		logger.DebugContext(ctx, "database query", "operation", operation, "duration", time.Since(start))
+	}
 }
 
-func (db *Database) UpdateUser(id int, user *User) (*User, error) {
-	// TODO: Update user in database
-	// Handle not found errors
-	// Return updated user
-	return nil, nil
+func (db *Database) GetUser(ctx context.Context, id int) (_ *User, err error) {
+	const query = "SELECT id, name, email, created_at FROM users WHERE id = ?"
+	ctx, done := startDBCall(ctx, "SELECT", query)
+	defer func() { done(err) }()
+	if _, err := db.faults.inject(ctx, faultDB, "SELECT"); err != nil {
+		return nil, err
+	}
+
+	var user User
+	err = db.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying user: %v", err)
+	}
+	return &user, nil
 }
 
-func (db *Database) DeleteUser(id int) error {
-	// TODO: Delete user from database
-	// Handle not found errors
+func (db *Database) CreateUser(ctx context.Context, user *User) (_ *User, err error) {
+	const query = "INSERT INTO users (name, email, created_at) VALUES (?, ?, ?)"
+	ctx, done := startDBCall(ctx, "INSERT", query)
+	defer func() { done(err) }()
+	if _, err := db.faults.inject(ctx, faultDB, "INSERT"); err != nil {
+		return nil, err
+	}
+
+	created := *user
+	created.CreatedAt = time.Now().UTC()
+
+	// The user.created event is written in the same transaction, so it
+	// exists if and only if the user does. The outbox relay publishes it.
+	err = db.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, created.Name, created.Email, created.CreatedAt)
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%w: email %s is already registered", ErrConflict, created.Email)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting user: %v", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		created.ID = int(id)
+
+		event, err := NewEvent(db.events, UserCreated{
+			UserID:    created.ID,
+			Name:      created.Name,
+			Email:     created.Email,
+			CreatedAt: created.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		event.IdempotencyKey = fmt.Sprintf("user.created:%d", id)
+		return insertOutbox(ctx, tx, event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.notifyOutbox()
+	return &created, nil
+}
+
+func (db *Database) UpdateUser(ctx context.Context, id int, user *User) (*User, error) {
+	const query = "UPDATE users SET name = ?, email = ? WHERE id = ?"
+	spanCtx, done := startDBCall(ctx, "UPDATE", query)
+	if _, err := db.faults.inject(spanCtx, faultDB, "UPDATE"); err != nil {
+		done(err)
+		return nil, err
+	}
+
+	result, err := db.db.ExecContext(spanCtx, query, user.Name, user.Email, id)
+	if isUniqueViolation(err) {
+		err = fmt.Errorf("%w: email %s is already registered", ErrConflict, user.Email)
+		done(err)
+		return nil, err
+	}
+	if err != nil {
+		err = fmt.Errorf("error updating user: %v", err)
+		done(err)
+		return nil, err
+	}
+	n, _ := result.RowsAffected()
+	done(nil)
+
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	return db.GetUser(ctx, id)
+}
+
+func (db *Database) DeleteUser(ctx context.Context, id int) (err error) {
+	const query = "DELETE FROM users WHERE id = ?"
+	ctx, done := startDBCall(ctx, "DELETE", query)
+	defer func() { done(err) }()
+	if _, err := db.faults.inject(ctx, faultDB, "DELETE"); err != nil {
+		return err
+	}
+
+	result, err := db.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
 // Task 11: Implement message queue
+var (
+	ErrQueueFull   = errors.New("message queue is full")
+	ErrQueueClosed = errors.New("message queue is closed")
+	// ErrLeaseExpired is returned when a delivery is acked or nacked after
+	// its visibility timeout, by which time it may be with another consumer.
+	ErrLeaseExpired = errors.New("delivery lease expired")
+)
+
+// QueueOptions tune delivery. Zero values take the defaults noted below.
+type QueueOptions struct {
+	// Capacity bounds the number of live messages (default 1024).
+	Capacity int
+	// VisibilityTimeout is how long a received message stays hidden from
+	// other consumers before it is redelivered (default 30s).
+	VisibilityTimeout time.Duration
+	// MaxDeliveries is the number of failed deliveries after which a
+	// message is moved to the dead-letter queue (default 5).
+	MaxDeliveries int
+	// MinBackoff and MaxBackoff bound the redelivery delay, which doubles
+	// with every failure (defaults 100ms and 1m).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// TopicRetention and TopicMaxMessages bound each topic partition:
+	// older messages, and the oldest beyond the limit, are dropped whether
+	// or not every group has consumed them (defaults 7 days and 10000).
+	TopicRetention   time.Duration
+	TopicMaxMessages int
+	// DeadLetterRetention and MaxDeadLetters bound the dead-letter queue
+	// the same way: older dead letters, and the oldest beyond the limit,
+	// are dropped (defaults 7 days and 1000).
+	DeadLetterRetention time.Duration
+	MaxDeadLetters      int
+}
+
+func (o QueueOptions) withDefaults() QueueOptions {
+	if o.Capacity <= 0 {
+		o.Capacity = 1024
+	}
+	if o.VisibilityTimeout <= 0 {
+		o.VisibilityTimeout = 30 * time.Second
+	}
+	if o.MaxDeliveries <= 0 {
+		o.MaxDeliveries = 5
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Minute
+	}
+	if o.TopicRetention <= 0 {
+		o.TopicRetention = 7 * 24 * time.Hour
+	}
+	if o.TopicMaxMessages <= 0 {
+		o.TopicMaxMessages = 10000
+	}
+	if o.DeadLetterRetention <= 0 {
+		o.DeadLetterRetention = 7 * 24 * time.Hour
+	}
+	if o.MaxDeadLetters <= 0 {
+		o.MaxDeadLetters = 1000
+	}
+	return o
+}
+
+// MessageQueue delivers each message at least once. A received message is
+// leased to one consumer until it is acked, nacked or its visibility
+// timeout passes; failures are retried with exponential backoff and end up
+// in the dead-letter queue after MaxDeliveries attempts. With a file URL
+// every state change is appended to a log first, so nothing acknowledged
+// to a publisher is lost by a crash.
 type MessageQueue struct {
-	// TODO: Add message queue fields
-	// Include Redis client or other queue implementation
+	opts QueueOptions
+	log  *queueLog
+
+	mu      sync.Mutex
+	entries map[string]*queueEntry
+	order   []string
+	dead    []*Message
+	leases  uint64
+	changed chan struct{}
+
+	topics map[string]*topic
+	groups map[string]*consumerGroup
+
+	wg     sync.WaitGroup
+	closed chan struct{}
+	once   sync.Once
 }
 
+// Message metadata keys carrying request context from the publisher to
+// the consumer.
+const (
+	metaRequestID   = "request_id"
+	metaTraceparent = "traceparent"
+	// metaDeadLetterReason holds the last handler error of a dead letter.
+	metaDeadLetterReason = "dead_letter_reason"
+)
+
+// Message is a CloudEvents 1.0 envelope in its JSON format. DataVersion is
+// an extension attribute giving the schema version of Data; see
+// EventRegistry. The remaining fields are delivery state kept beside the
+// event.
 type Message struct {
-	// TODO: Add message fields
-	// Include ID, type, data, timestamp
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataVersion     int             `json:"dataversion,omitempty"`
+	Data            json.RawMessage `json:"data"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Redeliveries counts the failed deliveries before this one.
+	Redeliveries int `json:"redeliveries"`
+	// IdempotencyKey names the event rather than the delivery: a message
+	// published twice, for example by an outbox relay that crashed before
+	// recording the first send, carries the same key both times.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Key chooses the partition of a topic message; messages with the
+	// same key are delivered in order. Topic, Partition and Offset are
+	// set by PublishTopic.
+	Key       string `json:"key,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Partition int    `json:"partition,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+}
+
+// NewMessageQueue opens an in-memory queue for "" or "memory://" and a
+// durable one for "file:<path>", replaying the log found at path.
+func NewMessageQueue(url string, opts QueueOptions) (*MessageQueue, error) {
+	mq := &MessageQueue{
+		opts:    opts.withDefaults(),
+		entries: make(map[string]*queueEntry),
+		changed: make(chan struct{}),
+		topics:  make(map[string]*topic),
+		groups:  make(map[string]*consumerGroup),
+		closed:  make(chan struct{}),
+	}
+
+	switch {
+	case url == "" || url == "memory://":
+	case strings.HasPrefix(url, "file:"):
+		log, err := openQueueLog(strings.TrimPrefix(url, "file:"), mq.apply)
+		if err != nil {
+			return nil, err
+		}
+		mq.log = log
+		if err := mq.compactLocked(); err != nil {
+			log.Close()
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported queue URL: %s", url)
+	}
+	return mq, nil
 }
 
-func NewMessageQueue(redisURL string) (*MessageQueue, error) {
-	// TODO: Initialize message queue
-	return nil, nil
+// stampMessage fills in the ID, time and envelope defaults of msg and
+// records the request ID and trace context from ctx so that the consumer's
+// logs and spans can be tied back to the request that produced it.
+func stampMessage(ctx context.Context, msg *Message) {
+	if msg.ID == "" {
+		msg.ID = newRequestID()
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now().UTC()
+	}
+	if msg.SpecVersion == "" {
+		msg.SpecVersion = cloudEventsSpecVersion
+	}
+	if msg.DataContentType == "" {
+		msg.DataContentType = "application/json"
+	}
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]string)
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		msg.Metadata[metaRequestID] = id
+	}
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		msg.Metadata[metaTraceparent] = formatTraceparent(sc)
+	}
 }
 
-func (mq *MessageQueue) Publish(msg *Message) error {
-	// TODO: Publish message to queue
-	// Serialize message to JSON
-	// Add to queue with timestamp
+// Publish enqueues msg after stamping it. A message whose ID is already
+// queued is accepted without being queued twice. On a durable queue the
+// message is on disk when Publish returns.
+func (mq *MessageQueue) Publish(ctx context.Context, msg *Message) error {
+	stampMessage(ctx, msg)
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	select {
+	case <-mq.closed:
+		return ErrQueueClosed
+	default:
+	}
+	if _, ok := mq.entries[msg.ID]; ok {
+		return nil
+	}
+	if len(mq.entries) >= mq.opts.Capacity {
+		logger.WarnContext(ctx, "message dropped", "message_id", msg.ID, "type", msg.Type, "error", ErrQueueFull)
+		return ErrQueueFull
+	}
+
+	if err := mq.record(queueRecord{Op: opPublish, ID: msg.ID, Message: cloneMessage(msg)}); err != nil {
+		return err
+	}
+	logger.DebugContext(ctx, "message published", "message_id", msg.ID, "type", msg.Type)
 	return nil
 }
 
-func (mq *MessageQueue) Subscribe(handler func(*Message) error) {
-	// TODO: Subscribe to message queue
-	// Continuously poll for messages
-	// Deserialize messages
-	// Call handler function
+// Delivery is a message leased to one consumer. Exactly one of Ack or Nack
+// should be called; if neither is called before the visibility timeout the
+// message is redelivered as though it had been nacked.
+type Delivery struct {
+	*Message
+	// Deadline is when the lease runs out.
+	Deadline time.Time
+
+	mq    *MessageQueue
+	lease uint64
+}
+
+// Ack removes the message from the queue.
+func (d *Delivery) Ack() error {
+	return d.mq.settle(d, nil)
+}
+
+// Nack reports a failed delivery. The message is retried after a backoff,
+// or dead-lettered once it has failed MaxDeliveries times.
+func (d *Delivery) Nack(reason error) error {
+	if reason == nil {
+		reason = errors.New("nacked")
+	}
+	return d.mq.settle(d, reason)
+}
+
+// Receive blocks until a message is visible and leases it to the caller.
+func (mq *MessageQueue) Receive(ctx context.Context) (*Delivery, error) {
+	for {
+		mq.mu.Lock()
+		d, wake, err := mq.nextLocked(time.Now())
+		changed := mq.changed
+		mq.mu.Unlock()
+		if d != nil || err != nil {
+			return d, err
+		}
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			fire = timer.C
+		}
+		select {
+		case <-changed:
+		case <-fire:
+		case <-mq.closed:
+			err = ErrQueueClosed
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Subscribe starts a consumer goroutine that calls handler for every
+// message until the queue is closed. A nil return acks the message; an
+// error or a panic nacks it. The handler's context carries the publisher's
+// request ID and trace and expires with the lease.
+func (mq *MessageQueue) Subscribe(handler func(context.Context, *Message) error) {
+	mq.wg.Add(1)
+	go func() {
+		defer mq.wg.Done()
+		for {
+			d, err := mq.Receive(context.Background())
+			if err != nil {
+				return
+			}
+			mq.dispatch(d, handler)
+		}
+	}()
+}
+
+// messageContext restores the publisher's request ID and trace for a
+// consumer and starts the processing span.
+func messageContext(msg *Message) (context.Context, *Span) {
+	ctx := context.Background()
+	if id := msg.Metadata[metaRequestID]; id != "" {
+		ctx = withRequestID(ctx, id)
+	}
+	if sc, ok := parseTraceparent(msg.Metadata[metaTraceparent]); ok {
+		ctx = contextWithRemoteSpanContext(ctx, sc)
+	}
+
+	ctx, span := startSpan(ctx, "process "+msg.Type, SpanKindInternal)
+	span.SetAttribute("messaging.message.id", msg.ID)
+	span.SetAttribute("messaging.redeliveries", msg.Redeliveries)
+	return ctx, span
+}
+
+func (mq *MessageQueue) dispatch(d *Delivery, handler func(context.Context, *Message) error) {
+	msg := d.Message
+	ctx, span := messageContext(msg)
+	defer span.End()
+
+	ctx, cancel := context.WithDeadline(ctx, d.Deadline)
+	defer cancel()
+
+	if err := runHandler(ctx, handler, msg); err != nil {
+		span.RecordError(err)
+		logger.ErrorContext(ctx, "message handler failed",
+			"message_id", msg.ID, "type", msg.Type, "redeliveries", msg.Redeliveries, "error", err)
+		if err := d.Nack(err); err != nil {
+			logger.WarnContext(ctx, "message nack failed", "message_id", msg.ID, "error", err)
+		}
+		return
+	}
+	if err := d.Ack(); err != nil {
+		logger.WarnContext(ctx, "message ack failed", "message_id", msg.ID, "error", err)
+		return
+	}
+	logger.DebugContext(ctx, "message handled", "message_id", msg.ID, "type", msg.Type)
+}
+
+func runHandler(ctx context.Context, handler func(context.Context, *Message) error, msg *Message) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("handler panicked: %v", p)
+		}
+	}()
+	return handler(ctx, msg)
+}
+
+// Depth returns the number of live messages, including those in flight
+// and those waiting for a retry.
+func (mq *MessageQueue) Depth() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return len(mq.entries)
+}
+
+// DeadLetters returns the messages that exhausted their deliveries, oldest
+// first.
+func (mq *MessageQueue) DeadLetters() []*Message {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	out := make([]*Message, len(mq.dead))
+	for i, msg := range mq.dead {
+		out[i] = cloneMessage(msg)
+	}
+	return out
+}
+
+// Redrive moves a dead letter back onto the queue with a fresh delivery
+// count. Dead letters from topics are refused: the queue would deliver
+// them outside the consumer group that failed them.
+func (mq *MessageQueue) Redrive(id string) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	for _, msg := range mq.dead {
+		if msg.ID == id {
+			if msg.Topic != "" {
+				return fmt.Errorf("message %s came from topic %s and must be republished there", id, msg.Topic)
+			}
+			if len(mq.entries) >= mq.opts.Capacity {
+				return ErrQueueFull
+			}
+			return mq.record(queueRecord{Op: opRedrive, ID: id})
+		}
+	}
+	return ErrNotFound
+}
+
+// Close stops the consumers, waits for in-progress handlers to settle
+// their messages and closes the log.
+func (mq *MessageQueue) Close() error {
+	mq.once.Do(func() { close(mq.closed) })
+	mq.wg.Wait()
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if mq.log != nil {
+		return mq.log.Close()
+	}
+	return nil
 }
 
 // Task 12: Implement load balancer
@@ -234,6 +1568,8 @@ func (lb *LoadBalancer) GetNextServer() string {
 }
 
 // Task 13: Implement rate limiting
+var ErrRateLimited = errors.New("rate limit exceeded")
+
 type RateLimiter struct {
 	// TODO: Add rate limiter fields
 	// Include requests per second, last request time, mutex
@@ -252,34 +1588,102 @@ func (rl *RateLimiter) Allow() bool {
 }
 
 // Task 14: Implement middleware
+// loggingMiddleware opens the server span for every request, continuing
+// the trace from an inbound traceparent header, and writes one structured
+// access log line that carries the request and trace IDs.
 func loggingMiddleware(next http.Handler) http.Handler {
-	// TODO: Implement logging middleware
-	// Log request details (method, path, duration)
-	// Call next handler
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Implement logging logic
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		ctx := extractTraceContext(r.Context(), r.Header)
+		ctx, span := startSpan(ctx, r.Method, SpanKindServer)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("user_agent.original", r.UserAgent())
+
+		req := r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		route := routeOf(req)
+		if route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttribute("http.route", route)
+		}
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.RecordError(errors.New(http.StatusText(rec.status)))
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr)
 	})
 }
 
-func authMiddleware(next http.Handler) http.Handler {
-	// TODO: Implement authentication middleware
-	// Validate JWT token
-	// Extract user information
-	// Call next handler if authenticated
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Implement authentication logic
-		next.ServeHTTP(w, r)
-	})
+// authMiddleware authenticates the caller. A request without an
+// Authorization header passes through anonymously so that public routes
+// keep working; whether anonymous access is allowed is decided later by
+// authorize. A token that is present but malformed, forged or expired is
+// always rejected with 401.
+func authMiddleware(key []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				writeUnauthorized(w, r, "invalid_request", "authorization header must use the Bearer scheme")
+				return
+			}
+
+			claims, err := validateToken(key, token)
+			if err != nil {
+				writeUnauthorized(w, r, "invalid_token", err.Error())
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// timeoutMiddleware gives every request a deadline, so a handler stuck on
+// a dependency fails with 504 instead of holding the connection. A zero
+// timeout leaves requests unbounded.
+func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
 
 func rateLimitMiddleware(limiter *RateLimiter) func(http.Handler) http.Handler {
-	// TODO: Implement rate limiting middleware
-	// Check rate limit before processing request
-	// Return 429 Too Many Requests if limit exceeded
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// TODO: Implement rate limiting logic
+			if limiter != nil && !limiter.Allow() {
+				writeError(w, r, ErrRateLimited)
+				return
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -287,44 +1691,178 @@ func rateLimitMiddleware(limiter *RateLimiter) func(http.Handler) http.Handler {
 
 // Task 15: Implement metrics collection
 type Metrics struct {
-	// TODO: Add metrics fields
-	// Include request count, response time, error count
+	registry *Registry
+	requests *CounterVec
+	duration *HistogramVec
+	inFlight *GaugeVec
 }
 
 func NewMetrics() *Metrics {
-	// TODO: Initialize metrics
-	return nil
+	registry := NewRegistry()
+	start := time.Now()
+
+	m := &Metrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"Total number of HTTP requests handled.", "method", "route", "status"),
+		duration: registry.NewHistogramVec("http_request_duration_seconds",
+			"HTTP request latency in seconds.", defaultLatencyBuckets, "method", "route"),
+		inFlight: registry.NewGaugeVec("http_requests_in_flight",
+			"Number of HTTP requests currently being served."),
+	}
+	registry.NewGaugeFunc("process_start_time_seconds",
+		"Start time of the process since the Unix epoch in seconds.",
+		func() float64 { return float64(start.UnixNano()) / 1e9 })
+	registry.NewGaugeFunc("go_goroutines",
+		"Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	return m
 }
 
+// RecordRequest counts a finished request. path may be a route template
+// such as /api/users/{id} or a concrete path, which is normalized first.
 func (m *Metrics) RecordRequest(method, path string, duration time.Duration, status int) {
-	// TODO: Record request metrics
-	// Increment request count
-	// Record response time
-	// Record status code
+	route := normalizeRoute(path)
+	m.requests.Inc(method, route, strconv.Itoa(status))
+	m.duration.Observe(duration.Seconds(), method, route)
 }
 
+// handleMetrics serves the Prometheus text format by default and a JSON
+// view when asked for with ?format=json or Accept: application/json.
 func (m *Metrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	// TODO: Expose metrics endpoint
-	// Return metrics as JSON or Prometheus format
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, m.registry.Snapshot())
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	m.registry.WriteText(w)
+}
+
+// metricsMiddleware records every request under the route template the
+// ServeMux matched. Requests that matched no route share a single
+// "unmatched" series so that scanners cannot inflate label cardinality.
+func metricsMiddleware(m *Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			route := routeOf(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			m.RecordRequest(r.Method, route, time.Since(start), rec.status)
+		})
+	}
+}
+
+// routeOf returns the path template of the route the ServeMux matched for
+// r, or "" when no route matched. The ServeMux records the pattern on the
+// request it was given, so outer middleware can read it after the call.
+func routeOf(r *http.Request) string {
+	_, route, _ := strings.Cut(r.Pattern, " ")
+	return route
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
 
 // Task 16: Implement main function
 func main() {
-	// TODO: Load configuration
-	// Initialize service components
-	// Set up HTTP server with middleware
-	// Start server
-	// Handle graceful shutdown
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "collector":
+			runCollector()
+			return
+		case "deploy":
+			if err := runDeploy(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "probe":
+			if err := runProbe(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	service, err := NewUserService(config)
+	if err != nil {
+		log.Fatalf("Error creating service: %v", err)
+	}
+	if err := service.Start(context.Background()); err != nil {
+		logger.Error("error starting service", "error", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	logger.Info("shutting down", "signal", sig.String())
+
+	// The deadline leaves every component its own, and stays within the
+	// grace period "deploy gen" gives the orchestrator.
+	ctx, cancel := context.WithTimeout(context.Background(), service.lifecycle.StopTimeout())
+	defer cancel()
+
+	if err := service.Shutdown(ctx); err != nil {
+		logger.Error("shutdown incomplete", "error", err)
+		os.Exit(1)
+	}
+}
+
+// runCollector starts the trace collector stand-in on COLLECTOR_PORT
+// (default 4318) and appends everything it receives to COLLECTOR_FILE.
+func runCollector() {
+	path := getEnv("COLLECTOR_FILE", "traces.jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	addr := fmt.Sprintf(":%d", getEnvAsInt("COLLECTOR_PORT", 4318))
+	log.Printf("Trace collector listening on %s, writing to %s", addr, path)
+	log.Fatal(http.ListenAndServe(addr, collectorHandler(f)))
 }
 
 // Task 17: Implement graceful shutdown
+// Shutdown stops every component in reverse dependency order. Components
+// that overrun their own deadline are logged and included in the error.
 func (s *UserService) Shutdown(ctx context.Context) error {
-	// TODO: Implement graceful shutdown
-	// Close database connections
-	// Close cache connections
-	// Stop message queue consumers
-	// Wait for ongoing requests to complete
-	return nil
+	_, err := s.lifecycle.Stop(ctx)
+	return err
 }
 
 // Task 18: Implement service discovery
@@ -350,79 +1888,268 @@ func (sr *ServiceRegistry) GetService(serviceName string) (string, bool) {
 }
 
 // Task 19: Implement error handling
+
+// ErrorCode identifies a kind of error. Codes are part of the API: clients
+// branch on them, so they never change once published.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeValidationFailed     ErrorCode = "validation_failed"
+	CodePayloadTooLarge      ErrorCode = "payload_too_large"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeConflict             ErrorCode = "conflict"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeUpstreamUnavailable  ErrorCode = "upstream_unavailable"
+	CodeUnavailable          ErrorCode = "service_unavailable"
+	CodeTimeout              ErrorCode = "timeout"
+	CodeClientClosedRequest  ErrorCode = "client_closed_request"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeInternal             ErrorCode = "internal_error"
+)
+
+// problemContentType is the media type of RFC 7807 problem details.
+const problemContentType = "application/problem+json"
+
+// statusClientClosedRequest is the nginx convention for a request the
+// client gave up on before the response. The client never sees it; it
+// keeps disconnects out of the 5xx logs and metrics.
+const statusClientClosedRequest = 499
+
+// APIError is an RFC 7807 problem detail. Code, RequestID and Errors are
+// extension members: the stable error code, the ID that ties the response
+// to the server's logs, and a message per invalid field.
 type APIError struct {
-	// TODO: Add error fields
-	// Include code, message, details
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	Code      ErrorCode         `json:"code"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+func newAPIError(status int, code ErrorCode, detail string) *APIError {
+	return &APIError{
+		Type:   "urn:problem:" + string(code),
+		Title:  cmp.Or(http.StatusText(status), "Client Closed Request"),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
 }
 
 func (e *APIError) Error() string {
-	// TODO: Return error message
-	return ""
+	if e.Detail != "" {
+		return e.Detail
+	}
+	return e.Title
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
-	// TODO: Write error response
-	// Set Content-Type header
-	// Set HTTP status code
-	// Encode error as JSON
+var errInvalidJSON = newAPIError(http.StatusBadRequest, CodeInvalidRequest, "invalid JSON body")
+
+// errorStatuses maps domain errors, matched with errors.Is, to the status,
+// code and detail they are reported with. The detail is fixed because the
+// wrapped error text can name internal hosts and queries.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   ErrorCode
+	detail string
+}{
+	{ErrNotFound, http.StatusNotFound, CodeNotFound, "the resource does not exist"},
+	{ErrConflict, http.StatusConflict, CodeConflict, "the request conflicts with an existing resource"},
+	{ErrRequestInProgress, http.StatusConflict, CodeConflict, "a request with this idempotency key is in progress"},
+	{ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "the idempotency key was used for a different request"},
+	{ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited, "too many requests"},
+	{ErrCircuitOpen, http.StatusServiceUnavailable, CodeUpstreamUnavailable, "an upstream service is unavailable"},
+	{ErrUpstream, http.StatusBadGateway, CodeUpstreamUnavailable, "an upstream service failed"},
+	{ErrQueueFull, http.StatusServiceUnavailable, CodeUnavailable, "the service is overloaded"},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, CodeTimeout, "the request timed out"},
+	{context.Canceled, statusClientClosedRequest, CodeClientClosedRequest, "the client closed the request"},
+}
+
+// toAPIError turns any error into a problem. Errors that are neither an
+// *APIError nor a mapped domain error are internal. Only an *APIError's own
+// detail reaches the client; the text of other errors stays in the logs.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		problem := *apiErr
+		return &problem
+	}
+	for _, m := range errorStatuses {
+		if errors.Is(err, m.err) {
+			return newAPIError(m.status, m.code, m.detail)
+		}
+	}
+	return newAPIError(http.StatusInternalServerError, CodeInternal, "the server could not complete the request")
+}
+
+// writeError answers with the problem for err, stamped with the request
+// path and ID.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := toAPIError(err)
+	problem.Instance = r.URL.Path
+	problem.RequestID = requestIDFromContext(r.Context())
+	if problem.Status >= http.StatusInternalServerError {
+		logger.ErrorContext(r.Context(), "request failed", "code", problem.Code, "error", err)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// isUniqueViolation reports whether err is SQLite refusing a duplicate
+// value in a UNIQUE column.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
 }
 
 // Task 20: Implement validation
+
+// validateUser trims the user's fields and reports every invalid one as a
+// validation problem.
 func validateUser(user *User) error {
-	// TODO: Validate user data
-	// Check required fields
-	// Validate email format
-	// Validate name length
+	user.Name = strings.TrimSpace(user.Name)
+	user.Email = strings.TrimSpace(user.Email)
+
+	errs := make(map[string]string)
+	switch {
+	case user.Name == "":
+		errs["name"] = "must not be empty"
+	case len([]rune(user.Name)) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+	switch addr, err := mail.ParseAddress(user.Email); {
+	case user.Email == "":
+		errs["email"] = "must not be empty"
+	case err != nil || addr.Address != user.Email:
+		errs["email"] = "must be a valid email address"
+	}
+
+	if len(errs) > 0 {
+		problem := newAPIError(http.StatusBadRequest, CodeValidationFailed, "request body is invalid")
+		problem.Errors = errs
+		return problem
+	}
 	return nil
 }
 
 // Task 21: Implement JWT authentication
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+const tokenTTL = 24 * time.Hour
+
+// newTokenKey returns the key for secret. Without a secret it generates a
+// random key, which tokens from other instances and from before a restart
+// fail to verify against.
+func newTokenKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	logger.Warn("JWT_SECRET is not set; signing tokens with a random key")
+	return key
+}
+
 type Claims struct {
-	// TODO: Add JWT claims fields
-	// Include user ID, username, expiration
+	UserID    int          `json:"user_id"`
+	Username  string       `json:"username"`
+	Roles     []Role       `json:"roles,omitempty"`
+	Scopes    []Permission `json:"scopes,omitempty"`
+	IssuedAt  int64        `json:"iat"`
+	ExpiresAt int64        `json:"exp"`
 }
 
-func generateToken(userID int, username string) (string, error) {
-	// TODO: Generate JWT token
-	// Set claims and expiration
-	// Sign token with secret key
-	return "", nil
+func generateToken(key []byte, userID int, username string) (string, error) {
+	return signClaims(key, &Claims{
+		UserID:   userID,
+		Username: username,
+		Roles:    []Role{RoleUser},
+	})
 }
 
-func validateToken(tokenString string) (*Claims, error) {
-	// TODO: Validate JWT token
-	// Parse and verify token
-	// Extract claims
-	return nil, nil
+// signClaims fills in the timestamps when they are missing and encodes
+// the claims as a compact HS256 JWT.
+func signClaims(key []byte, claims *Claims) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("JWT secret is not configured")
+	}
+
+	now := time.Now()
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = now.Unix()
+	}
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = now.Add(tokenTTL).Unix()
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	return unsigned + "." + enc.EncodeToString(tokenSignature(key, unsigned)), nil
 }
 
-// Task 22: Implement Docker support
-func createDockerfile() {
-	// TODO: Create Dockerfile content
-	// Multi-stage build
-	// Copy application files
-	// Set working directory
-	// Expose port
-	// Set entry point
+func tokenSignature(key []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
 }
 
-// Task 23: Implement Docker Compose
-func createDockerCompose() {
-	// TODO: Create docker-compose.yml content
-	// Define services (app, database, cache)
-	// Set environment variables
-	// Configure networks
-	// Set up volumes
+func validateToken(key []byte, tokenString string) (*Claims, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 || len(key) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	enc := base64.RawURLEncoding
+	signature, err := enc.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, tokenSignature(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerJSON, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
 }
 
+// Task 22: Implement Docker support
+// Task 23: Implement Docker Compose
+// The Dockerfile, compose file and Kubernetes manifests are rendered by
+// "deploy gen"; see deploy.go.
+
 // Task 24: Implement testing
-func (s *UserService) TestGetUser(t *testing.T) {
-	// TODO: Test user retrieval
-	// Mock database and cache
-	// Test successful retrieval
-	// Test cache miss scenario
-	// Test error handling
-}
+// Dependencies are not mocked: the service's FaultInjector (faults.go)
+// makes the real database, cache and upstream client fail, and the
+// scenario tests in faults_test.go drive the service end to end.
 
 // Task 25: Implement monitoring
 func (s *UserService) setupMonitoring() {
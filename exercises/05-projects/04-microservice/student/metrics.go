@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This file holds a minimal metrics registry that renders the Prometheus
+// text exposition format (version 0.0.4) without pulling in the client
+// library. Only what the service needs is implemented: labeled counters,
+// labeled gauges, gauges computed on scrape and fixed-bucket histograms.
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// defaultLatencyBuckets are upper bounds in seconds, matching the
+// Prometheus client defaults.
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	writeText(w io.Writer)
+	snapshot() metricSnapshot
+}
+
+// metricSnapshot is the JSON view of one metric family.
+type metricSnapshot struct {
+	Name   string           `json:"name"`
+	Help   string           `json:"help"`
+	Type   string           `json:"type"`
+	Series []seriesSnapshot `json:"series"`
+}
+
+type seriesSnapshot struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   *float64          `json:"value,omitempty"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+}
+
+// Registry keeps metric families in registration order.
+type Registry struct {
+	collectors []collector
+	mu         sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+func (r *Registry) list() []collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]collector(nil), r.collectors...)
+}
+
+// WriteText renders every registered family in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) {
+	for _, c := range r.list() {
+		c.writeText(w)
+	}
+}
+
+// Snapshot returns every registered family for the JSON view.
+func (r *Registry) Snapshot() []metricSnapshot {
+	var out []metricSnapshot
+	for _, c := range r.list() {
+		out = append(out, c.snapshot())
+	}
+	return out
+}
+
+// vec stores one value per combination of label values. Keys join the
+// label values with a byte that cannot appear in valid UTF-8 text.
+type vec[V any] struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*V
+	values map[string][]string
+	mu     sync.Mutex
+	newV   func() *V
+}
+
+func newVec[V any](name, help string, labels []string, newV func() *V) *vec[V] {
+	return &vec[V]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*V),
+		values: make(map[string][]string),
+		newV:   newV,
+	}
+}
+
+// with returns the series for the label values, creating it on first use.
+// The caller must hold v.mu.
+func (v *vec[V]) with(labelValues []string) *V {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = v.newV()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+	return s
+}
+
+// sortedKeys returns series keys ordered by label values so that output is
+// stable between scrapes. The caller must hold v.mu.
+func (v *vec[V]) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec[V]) labelMap(key string) map[string]string {
+	if len(v.labels) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(v.labels))
+	for i, name := range v.labels {
+		m[name] = v.values[key][i]
+	}
+	return m
+}
+
+// CounterVec is a monotonically increasing value per label combination.
+type CounterVec struct {
+	*vec[float64]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels, func() *float64 { return new(float64) })}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(c.name + ": counters cannot decrease")
+	}
+	c.mu.Lock()
+	*c.with(labelValues) += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) writeText(w io.Writer) {
+	writeScalarText(w, c.vec, "counter")
+}
+
+func (c *CounterVec) snapshot() metricSnapshot {
+	return scalarSnapshot(c.vec, "counter")
+}
+
+// GaugeVec is a value per label combination that can go up and down.
+type GaugeVec struct {
+	*vec[float64]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, labels, func() *float64 { return new(float64) })}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	*g.with(labelValues) = value
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	*g.with(labelValues) += delta
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *GaugeVec) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *GaugeVec) writeText(w io.Writer) {
+	writeScalarText(w, g.vec, "gauge")
+}
+
+func (g *GaugeVec) snapshot() metricSnapshot {
+	return scalarSnapshot(g.vec, "gauge")
+}
+
+// GaugeFunc is an unlabeled gauge whose value is computed at scrape time.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) writeText(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func (g *GaugeFunc) snapshot() metricSnapshot {
+	v := g.fn()
+	return metricSnapshot{Name: g.name, Help: g.help, Type: "gauge", Series: []seriesSnapshot{{Value: &v}}}
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations into fixed buckets per label
+// combination.
+type HistogramVec struct {
+	*vec[histogramValue]
+	buckets []float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(name + ": buckets must be sorted")
+	}
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(name, help, labels, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(buckets))}
+	})
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.with(labelValues)
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) writeText(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range h.sortedKeys() {
+		s := h.series[key]
+		values := h.values[key]
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+func (h *HistogramVec) snapshot() metricSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := metricSnapshot{Name: h.name, Help: h.help, Type: "histogram", Series: []seriesSnapshot{}}
+	for _, key := range h.sortedKeys() {
+		s := h.series[key]
+		buckets := make(map[string]uint64, len(h.buckets)+1)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			buckets[formatFloat(upper)] = cumulative
+		}
+		buckets["+Inf"] = s.count
+
+		sum, count := s.sum, s.count
+		snap.Series = append(snap.Series, seriesSnapshot{
+			Labels:  h.labelMap(key),
+			Buckets: buckets,
+			Sum:     &sum,
+			Count:   &count,
+		})
+	}
+	return snap
+}
+
+func writeScalarText(w io.Writer, v *vec[float64], typ string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeHeader(w, v.name, v.help, typ)
+	for _, key := range v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.values[key]), formatFloat(*v.series[key]))
+	}
+}
+
+func scalarSnapshot(v *vec[float64], typ string) metricSnapshot {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	snap := metricSnapshot{Name: v.name, Help: v.help, Type: typ, Series: []seriesSnapshot{}}
+	for _, key := range v.sortedKeys() {
+		value := *v.series[key]
+		snap.Series = append(snap.Series, seriesSnapshot{Labels: v.labelMap(key), Value: &value})
+	}
+	return snap
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// formatLabels renders {name="value",...}. extra holds additional
+// name/value pairs appended after the regular labels, such as "le".
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	uuidSegment   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numberSegment = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// normalizeRoute turns a concrete path into a route template by replacing
+// segments that look like identifiers with {id}, so that /api/users/42 and
+// /api/users/43 share one time series. Paths that are already templates
+// are returned unchanged.
+func normalizeRoute(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if numberSegment.MatchString(seg) || uuidSegment.MatchString(seg) || hexSegment.MatchString(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
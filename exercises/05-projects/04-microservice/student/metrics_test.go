@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	tests := map[string]string{
+		"/api/users/42":   "/api/users/{id}",
+		"/api/users/{id}": "/api/users/{id}",
+		"/api/users/3fa85f64-5717-4562-b3fc-2c963f66afa6": "/api/users/{id}",
+		"/health": "/health",
+	}
+	for path, want := range tests {
+		if got := normalizeRoute(path); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestMetricsPrometheusText(t *testing.T) {
+	m := NewMetrics()
+	m.RecordRequest("GET", "/api/users/1", 3*time.Millisecond, 200)
+	m.RecordRequest("GET", "/api/users/2", 30*time.Millisecond, 200)
+	m.RecordRequest("GET", "/api/users/3", 2*time.Second, 404)
+
+	rec := httptest.NewRecorder()
+	m.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE http_requests_total counter\n",
+		`http_requests_total{method="GET",route="/api/users/{id}",status="200"} 2` + "\n",
+		`http_requests_total{method="GET",route="/api/users/{id}",status="404"} 1` + "\n",
+		"# TYPE http_request_duration_seconds histogram\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/api/users/{id}",le="0.005"} 1` + "\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/api/users/{id}",le="0.05"} 2` + "\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/api/users/{id}",le="+Inf"} 3` + "\n",
+		`http_request_duration_seconds_count{method="GET",route="/api/users/{id}"} 3` + "\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in output:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsJSONView(t *testing.T) {
+	m := NewMetrics()
+	m.RecordRequest("POST", "/api/users", time.Millisecond, 201)
+
+	rec := httptest.NewRecorder()
+	m.handleMetrics(rec, httptest.NewRequest("GET", "/metrics?format=json", nil))
+
+	var families []metricSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&families); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if families[0].Name != "http_requests_total" || *families[0].Series[0].Value != 1 {
+		t.Errorf("unexpected first family: %+v", families[0])
+	}
+}
+
+func TestMetricsMiddlewareUsesRouteTemplate(t *testing.T) {
+	// A request timeout replaces the request, which must not hide the
+	// matched pattern from the middleware outside it.
+	for _, timeout := range []time.Duration{0, 5 * time.Second} {
+		t.Run(fmt.Sprintf("timeout=%s", timeout), func(t *testing.T) {
+			service := newTestServiceWith(t, func(c *Config) { c.RequestTimeout = timeout })
+			for _, path := range []string{"/api/users/1", "/api/users/2", "/no/such/path"} {
+				service.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+
+			rec := httptest.NewRecorder()
+			service.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rec.Code)
+			}
+
+			body := rec.Body.String()
+			if !strings.Contains(body, `route="/api/users/{id}",status="401"} 2`) {
+				t.Errorf("expected user requests grouped by template:\n%s", body)
+			}
+			if !strings.Contains(body, `route="unmatched",status="404"} 1`) {
+				t.Errorf("expected unknown paths grouped as unmatched:\n%s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoint describes an endpoint for both the mux and the OpenAPI document.
+type Endpoint struct {
+	// Pattern is the ServeMux pattern, "METHOD /path/{param}".
+	Pattern string
+	Summary string
+	Handler http.HandlerFunc
+	// Request is a value of the JSON body type. When set, bodies are
+	// validated against its schema before Handler runs.
+	Request any
+	// Responses maps status codes to a value of the response body type,
+	// or to nil for a response without a JSON body.
+	Responses map[int]any
+	// PathParams gives a value of each path parameter's type; parameters
+	// not listed are strings.
+	PathParams map[string]any
+}
+
+// Schema is the subset of JSON Schema used by the generated document and
+// by request validation.
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Additional  *Schema            `json:"additionalProperties,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+	ReadOnly    bool               `json:"readOnly,omitempty"`
+	Description string             `json:"description,omitempty"`
+}
+
+// schemaRegistry builds schemas from Go types, collecting named structs as
+// reusable components.
+type schemaRegistry struct {
+	components map[string]*Schema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{components: make(map[string]*Schema)}
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// schemaOf returns the schema for t. Named structs become references to
+// components; their fields are described by their json and validate tags.
+func (sr *schemaRegistry) schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == reflect.TypeFor[json.RawMessage]():
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: sr.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", Additional: sr.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sr.structSchema(t)
+		}
+		if _, ok := sr.components[t.Name()]; !ok {
+			// Reserve the name first so that recursive types terminate.
+			sr.components[t.Name()] = &Schema{}
+			*sr.components[t.Name()] = *sr.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return &Schema{}
+}
+
+func (sr *schemaRegistry) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := sr.schemaOf(field.Type)
+		if applyValidateTag(prop, field.Tag.Get("validate")) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = prop
+	}
+	return s
+}
+
+// applyValidateTag adds the constraints of a validate tag such as
+// "required,max=100,email" to s and reports whether the field is required.
+// A required string must also be non-empty.
+func applyValidateTag(s *Schema, tag string) (required bool) {
+	for _, rule := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		n, _ := strconv.Atoi(value)
+		switch key {
+		case "required":
+			required = true
+			if s.Type == "string" && s.MinLength == nil {
+				s.MinLength = &[]int{1}[0]
+			}
+		case "min":
+			if s.Type == "string" {
+				s.MinLength = &n
+			} else {
+				f := float64(n)
+				s.Minimum = &f
+			}
+		case "max":
+			if s.Type == "string" {
+				s.MaxLength = &n
+			} else {
+				f := float64(n)
+				s.Maximum = &f
+			}
+		case "email":
+			s.Format = "email"
+		case "readonly":
+			s.ReadOnly = true
+		}
+	}
+	return required
+}
+
+// resolve follows a component reference.
+func (sr *schemaRegistry) resolve(s *Schema) *Schema {
+	if name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/"); ok {
+		return sr.components[name]
+	}
+	return s
+}
+
+// validate checks a decoded JSON value against s, recording one message
+// per failing field path in errs. Properties the schema does not describe
+// are allowed. Read-only properties are checked for type only; handlers
+// ignore their values.
+func (sr *schemaRegistry) validate(s *Schema, value any, path string, errs map[string]string) {
+	s = sr.resolve(s)
+	field := path
+	if field == "" {
+		field = "body"
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			errs[field] = "must be an object"
+			return
+		}
+		for _, name := range s.Required {
+			if v, ok := obj[name]; !ok || v == nil {
+				errs[joinPath(path, name)] = "is required"
+			}
+		}
+		for name, v := range obj {
+			if prop, ok := s.Properties[name]; ok && v != nil {
+				sr.validate(prop, v, joinPath(path, name), errs)
+			} else if !ok && s.Additional != nil {
+				sr.validate(s.Additional, v, joinPath(path, name), errs)
+			}
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			errs[field] = "must be an array"
+			return
+		}
+		for i, v := range items {
+			sr.validate(s.Items, v, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			errs[field] = "must be a string"
+			return
+		}
+		n := len([]rune(str))
+		switch {
+		case s.MinLength != nil && n < *s.MinLength:
+			if *s.MinLength == 1 {
+				errs[field] = "must not be empty"
+			} else {
+				errs[field] = fmt.Sprintf("must be at least %d characters", *s.MinLength)
+			}
+		case s.MaxLength != nil && n > *s.MaxLength:
+			errs[field] = fmt.Sprintf("must be at most %d characters", *s.MaxLength)
+		case s.Format == "email":
+			if addr, err := mail.ParseAddress(str); err != nil || addr.Address != str {
+				errs[field] = "must be a valid email address"
+			}
+		case s.Format == "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				errs[field] = "must be an RFC 3339 date-time"
+			}
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			errs[field] = map[string]string{"integer": "must be an integer", "number": "must be a number"}[s.Type]
+			return
+		}
+		f, err := num.Float64()
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				errs[field] = "must be an integer"
+				return
+			}
+		}
+		switch {
+		case err != nil:
+			errs[field] = "must be a number"
+		case s.Minimum != nil && f < *s.Minimum:
+			errs[field] = fmt.Sprintf("must be at least %s", formatFloat(*s.Minimum))
+		case s.Maximum != nil && f > *s.Maximum:
+			errs[field] = fmt.Sprintf("must be at most %s", formatFloat(*s.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs[field] = "must be a boolean"
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// maxBodyBytes bounds request bodies read for validation.
+const maxBodyBytes = 1 << 20
+
+// readBody reads the request body up to maxBodyBytes. It answers 413 for a
+// body over the limit and 400 if the body cannot be read otherwise, for
+// example because the client went away mid-upload.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, newAPIError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "request body too large")
+		}
+		return nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "could not read request body")
+	}
+	return body, nil
+}
+
+// validateBody checks the JSON body against schema and answers 400 with
+// one field error per invalid field. Strings are trimmed of surrounding
+// whitespace first, so a blank one fails a length check, and a valid body
+// is handed on with its strings trimmed.
+func (sr *schemaRegistry) validateBody(schema *Schema, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			writeError(w, r, errInvalidJSON)
+			return
+		}
+
+		value = trimStrings(value)
+		errs := make(map[string]string)
+		sr.validate(schema, value, "", errs)
+		if len(errs) > 0 {
+			problem := newAPIError(http.StatusBadRequest, CodeValidationFailed, "request body is invalid")
+			problem.Errors = errs
+			writeError(w, r, problem)
+			return
+		}
+
+		body, err = json.Marshal(value)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// trimStrings trims surrounding whitespace from every string in a decoded
+// JSON value, in place where it can.
+func trimStrings(value any) any {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]any:
+		for k, e := range v {
+			v[k] = trimStrings(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = trimStrings(e)
+		}
+	}
+	return value
+}
+
+// OpenAPI is the generated API description. Operations are kept as plain
+// maps because the document is only ever encoded.
+type OpenAPI struct {
+	OpenAPI    string                               `json:"openapi"`
+	Info       map[string]string                    `json:"info"`
+	Paths      map[string]map[string]map[string]any `json:"paths"`
+	Components map[string]any                       `json:"components"`
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// buildOpenAPI describes routes, marking those that need a token with the
+// bearer scheme and listing the permissions their policy requires.
+func buildOpenAPI(title string, routes []Endpoint, sr *schemaRegistry) *OpenAPI {
+	doc := &OpenAPI{
+		OpenAPI: "3.1.0",
+		Info:    map[string]string{"title": title, "version": "1.0.0"},
+		Paths:   make(map[string]map[string]map[string]any),
+	}
+	errorSchema := sr.schemaOf(reflect.TypeFor[APIError]())
+
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route.Pattern, " ")
+		op := map[string]any{"summary": route.Summary, "operationId": operationID(route.Pattern)}
+
+		var params []map[string]any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+			schema := &Schema{Type: "string"}
+			if v, ok := route.PathParams[m[1]]; ok {
+				schema = sr.schemaOf(reflect.TypeOf(v))
+			}
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": schema})
+		}
+		if unsafeMethod(method) {
+			maxLength := maxIdempotencyKeyLength
+			params = append(params, map[string]any{
+				"name": idempotencyHeader, "in": "header", "required": false,
+				"description": "Makes the request safe to retry: a repeat with the same key replays the first response.",
+				"schema":      &Schema{Type: "string", MaxLength: &maxLength},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		responses := make(map[string]any)
+		for status, body := range route.Responses {
+			resp := map[string]any{"description": http.StatusText(status)}
+			if _, ok := body.(APIError); ok {
+				resp["content"] = problemContent(errorSchema)
+			} else if body != nil {
+				resp["content"] = jsonContent(sr.schemaOf(reflect.TypeOf(body)))
+			}
+			responses[strconv.Itoa(status)] = resp
+		}
+		errorResponse := func(status int) {
+			if _, ok := responses[strconv.Itoa(status)]; !ok {
+				responses[strconv.Itoa(status)] = map[string]any{
+					"description": http.StatusText(status),
+					"content":     problemContent(errorSchema),
+				}
+			}
+		}
+
+		if unsafeMethod(method) {
+			errorResponse(http.StatusConflict)
+			errorResponse(http.StatusUnprocessableEntity)
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": jsonContent(sr.schemaOf(reflect.TypeOf(route.Request)))}
+			errorResponse(http.StatusBadRequest)
+		}
+		if policy := policies[route.Pattern]; !policy.Public {
+			op["security"] = []map[string][]string{{"bearerAuth": {}}}
+			if len(policy.Permissions) > 0 {
+				var perms []string
+				for _, p := range policy.Permissions {
+					perms = append(perms, string(p))
+				}
+				op["description"] = "Requires " + strings.Join(perms, ", ") + "."
+			}
+			errorResponse(http.StatusUnauthorized)
+			errorResponse(http.StatusForbidden)
+		}
+		op["responses"] = responses
+
+		// OpenAPI paths have no wildcard syntax, so "{path...}" is
+		// written as a plain parameter.
+		path = strings.ReplaceAll(path, "...}", "}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]map[string]any)
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+
+	doc.Components = map[string]any{
+		"schemas": sr.components,
+		"securitySchemes": map[string]any{
+			"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		},
+	}
+	return doc
+}
+
+func jsonContent(schema *Schema) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+func problemContent(schema *Schema) map[string]any {
+	return map[string]any{problemContentType: map[string]any{"schema": schema}}
+}
+
+// operationID turns "GET /api/users/{id}" into "getApiUsersId".
+func operationID(pattern string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range strings.ToLower(pattern) {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			if upper && c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			b.WriteRune(c)
+			upper = false
+		default:
+			upper = b.Len() > 0
+		}
+	}
+	return b.String()
+}
+
+func (s *UserService) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openapi)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	service := newTestService(t)
+	rec := httptest.NewRecorder()
+	service.ServeHTTP(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var doc struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]Schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("expected OpenAPI 3.1.0, got %q", doc.OpenAPI)
+	}
+
+	for pattern := range policies {
+		method, path, _ := strings.Cut(pattern, " ")
+		if doc.Paths[path][strings.ToLower(method)] == nil {
+			t.Errorf("%s is not documented", pattern)
+		}
+	}
+
+	getUser := doc.Paths["/api/users/{id}"]["get"]
+	if getUser["security"] == nil {
+		t.Error("protected route is missing its security requirement")
+	}
+	param := getUser["parameters"].([]any)[0].(map[string]any)
+	if param["name"] != "id" || param["schema"].(map[string]any)["type"] != "integer" {
+		t.Errorf("unexpected id parameter: %v", param)
+	}
+	if doc.Paths["/api/users"]["post"]["security"] != nil {
+		t.Error("public route should not require a token")
+	}
+
+	user := doc.Components.Schemas["User"]
+	if strings.Join(user.Required, ",") != "name,email" {
+		t.Errorf("expected name and email to be required, got %v", user.Required)
+	}
+	if max := user.Properties["name"].MaxLength; max == nil || *max != 100 {
+		t.Errorf("expected name maxLength 100, got %v", max)
+	}
+	if user.Properties["email"].Format != "email" {
+		t.Errorf("expected email format, got %q", user.Properties["email"].Format)
+	}
+	if !user.Properties["id"].ReadOnly || user.Properties["created_at"].Format != "date-time" {
+		t.Errorf("unexpected id or created_at schema: %+v %+v", user.Properties["id"], user.Properties["created_at"])
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	service := newTestService(t)
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		details map[string]string
+	}{
+		{"valid", `{"name":"Ann","email":"ann@example.com"}`, http.StatusCreated, nil},
+		{"missing fields", `{}`, http.StatusBadRequest, map[string]string{"name": "is required", "email": "is required"}},
+		{"wrong types", `{"name":5,"email":["x"]}`, http.StatusBadRequest, map[string]string{"name": "must be a string", "email": "must be a string"}},
+		{"constraints", `{"name":"","email":"not-an-email"}`, http.StatusBadRequest, map[string]string{"name": "must not be empty", "email": "must be a valid email address"}},
+		{"too long", `{"name":"` + strings.Repeat("x", 101) + `","email":"b@example.com"}`, http.StatusBadRequest, map[string]string{"name": "must be at most 100 characters"}},
+		{"read-only fields ignored", `{"id":99,"name":"Bo","email":"bo@example.com"}`, http.StatusCreated, nil},
+		{"read-only fields typed", `{"id":"abc","name":"Cy","email":"cy@example.com"}`, http.StatusBadRequest, map[string]string{"id": "must be an integer"}},
+		{"not an object", `[1]`, http.StatusBadRequest, map[string]string{"body": "must be an object"}},
+		{"blank once trimmed", `{"name":"   ","email":" d@example.com "}`, http.StatusBadRequest, map[string]string{"name": "must not be empty"}},
+		{"malformed", `{"name":`, http.StatusBadRequest, nil},
+		{"too large", `"` + strings.Repeat("x", maxBodyBytes) + `"`, http.StatusRequestEntityTooLarge, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			service.ServeHTTP(rec, httptest.NewRequest("POST", "/api/users", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.details == nil {
+				return
+			}
+
+			var apiErr APIError
+			json.Unmarshal(rec.Body.Bytes(), &apiErr)
+			if len(apiErr.Errors) != len(tt.details) {
+				t.Errorf("expected details %v, got %v", tt.details, apiErr.Errors)
+			}
+			for field, msg := range tt.details {
+				if apiErr.Errors[field] != msg {
+					t.Errorf("%s: expected %q, got %q", field, msg, apiErr.Errors[field])
+				}
+			}
+		})
+	}
+}
+
+func TestUnreadableBodyIsBadRequest(t *testing.T) {
+	service := newTestService(t)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/users", iotest.ErrReader(errors.New("connection reset")))
+	service.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOperationID(t *testing.T) {
+	tests := map[string]string{
+		"GET /api/users/{id}":   "getApiUsersId",
+		"POST /api/{id}/2fa":    "postApiId2fa",
+		"PUT /files/{path...}":  "putFilesPath",
+		"DELETE /v2/users/{id}": "deleteV2UsersId",
+	}
+	for pattern, want := range tests {
+		if got := operationID(pattern); got != want {
+			t.Errorf("operationID(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// outboxSchema holds events written in the same transaction as the change
+// they describe. The relay publishes pending rows and marks them sent.
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS outbox (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id TEXT NOT NULL UNIQUE,
+    idempotency_key TEXT NOT NULL,
+    source TEXT NOT NULL,
+    type TEXT NOT NULL,
+    data_content_type TEXT NOT NULL,
+    data_version INTEGER NOT NULL,
+    data TEXT NOT NULL,
+    metadata TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT
+);
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (seq) WHERE sent_at IS NULL;`
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (db *Database) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// insertOutbox stamps msg with the request context and adds it to the
+// outbox within tx.
+func insertOutbox(ctx context.Context, tx *sql.Tx, msg *Message) error {
+	stampMessage(ctx, msg)
+	if msg.IdempotencyKey == "" {
+		msg.IdempotencyKey = msg.ID
+	}
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	const query = `INSERT INTO outbox (message_id, idempotency_key, source, type, data_content_type,
+        data_version, data, metadata, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, query, msg.ID, msg.IdempotencyKey, msg.Source, msg.Type, msg.DataContentType,
+		msg.DataVersion, string(msg.Data), string(metadata), msg.Time); err != nil {
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+	return nil
+}
+
+// notifyOutbox wakes the relay after a transaction that wrote to the
+// outbox has committed.
+func (db *Database) notifyOutbox() {
+	select {
+	case db.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+type outboxRow struct {
+	seq int64
+	msg *Message
+}
+
+func (db *Database) pendingOutbox(ctx context.Context, limit int) ([]outboxRow, error) {
+	const query = `SELECT seq, message_id, idempotency_key, source, type, data_content_type, data_version,
+        data, metadata, created_at FROM outbox WHERE sent_at IS NULL ORDER BY seq LIMIT ?`
+	rows, err := db.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		var data, metadata string
+		msg := &Message{SpecVersion: cloudEventsSpecVersion}
+		if err := rows.Scan(&row.seq, &msg.ID, &msg.IdempotencyKey, &msg.Source, &msg.Type, &msg.DataContentType,
+			&msg.DataVersion, &data, &metadata, &msg.Time); err != nil {
+			return nil, fmt.Errorf("error reading outbox: %v", err)
+		}
+		msg.Data = json.RawMessage(data)
+		if err := json.Unmarshal([]byte(metadata), &msg.Metadata); err != nil {
+			return nil, fmt.Errorf("error reading outbox metadata: %v", err)
+		}
+		row.msg = msg
+		pending = append(pending, row)
+	}
+	return pending, rows.Err()
+}
+
+func (db *Database) markOutboxSent(ctx context.Context, seq int64) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE outbox SET sent_at = ?, attempts = attempts + 1 WHERE seq = ?", time.Now().UTC(), seq)
+	return err
+}
+
+func (db *Database) markOutboxFailed(ctx context.Context, seq int64, cause error) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE seq = ?", cause.Error(), seq)
+	return err
+}
+
+func (db *Database) purgeOutbox(ctx context.Context, sentBefore time.Time) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ?", sentBefore)
+	return err
+}
+
+// userEventsTopic is the topic the outbox relay publishes to. It has one
+// partition so that consumers see events in commit order, and topic
+// retention bounds it whether or not any group consumes it.
+const userEventsTopic = "user-events"
+
+// OutboxRelay publishes outbox rows to userEventsTopic in commit order. A
+// row is marked sent only after the publish succeeds, so a relay that dies between
+// the two publishes that row again when it restarts: delivery is at least
+// once, and consumers drop the repeat by its idempotency key.
+type OutboxRelay struct {
+	db      *Database
+	publish func(context.Context, *Message) error
+
+	interval  time.Duration
+	batchSize int
+	retention time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func NewOutboxRelay(db *Database, queue *MessageQueue) (*OutboxRelay, error) {
+	if err := queue.CreateTopic(userEventsTopic, 1); err != nil {
+		return nil, err
+	}
+	return &OutboxRelay{
+		db: db,
+		publish: func(ctx context.Context, msg *Message) error {
+			return queue.PublishTopic(ctx, userEventsTopic, msg)
+		},
+		interval:  time.Second,
+		batchSize: 100,
+		retention: 24 * time.Hour,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Start runs the relay until Stop. It polls every interval, to retry
+// failures and pick up rows written by other instances, and is woken
+// straight away by local commits.
+func (r *OutboxRelay) Start() {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			r.relayPending(context.Background())
+			select {
+			case <-r.db.outboxReady:
+			case <-ticker.C:
+				if err := r.db.purgeOutbox(context.Background(), time.Now().Add(-r.retention)); err != nil {
+					logger.Error("purging outbox failed", "error", err)
+				}
+			case <-r.stop:
+				// Relay whatever the last requests wrote before exiting.
+				r.relayPending(context.Background())
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the relay to publish the remaining rows and exit.
+func (r *OutboxRelay) Stop(ctx context.Context) error {
+	r.once.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// relayPending publishes pending rows until none are left or one fails.
+// Stopping at a failure keeps events in order.
+func (r *OutboxRelay) relayPending(ctx context.Context) {
+	for {
+		pending, err := r.db.pendingOutbox(ctx, r.batchSize)
+		if err != nil {
+			logger.ErrorContext(ctx, "reading outbox failed", "error", err)
+			return
+		}
+		for _, row := range pending {
+			if err := r.relay(ctx, row); err != nil {
+				return
+			}
+		}
+		if len(pending) < r.batchSize {
+			return
+		}
+	}
+}
+
+func (r *OutboxRelay) relay(ctx context.Context, row outboxRow) (err error) {
+	msg := row.msg
+	if id := msg.Metadata[metaRequestID]; id != "" {
+		ctx = withRequestID(ctx, id)
+	}
+	if sc, ok := parseTraceparent(msg.Metadata[metaTraceparent]); ok {
+		ctx = contextWithRemoteSpanContext(ctx, sc)
+	}
+	ctx, span := startSpan(ctx, "relay "+msg.Type, SpanKindInternal)
+	defer span.End()
+	span.SetAttribute("messaging.message.id", msg.ID)
+
+	if err := r.publish(ctx, msg); err != nil {
+		span.RecordError(err)
+		logger.WarnContext(ctx, "relaying outbox message failed", "message_id", msg.ID, "type", msg.Type, "error", err)
+		if markErr := r.db.markOutboxFailed(ctx, row.seq, err); markErr != nil {
+			logger.ErrorContext(ctx, "recording outbox failure failed", "message_id", msg.ID, "error", markErr)
+		}
+		return err
+	}
+	if err := r.db.markOutboxSent(ctx, row.seq); err != nil {
+		span.RecordError(err)
+		logger.ErrorContext(ctx, "marking outbox message sent failed", "message_id", msg.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// errDuplicateInProgress nacks a message whose idempotency key is being
+// handled by another delivery; the retry finds it done and skips it.
+var errDuplicateInProgress = errors.New("duplicate delivery in progress")
+
+// Deduplicator drops repeated deliveries of the same event. It remembers
+// the idempotency keys of the last capacity successfully handled messages.
+type Deduplicator struct {
+	capacity int
+	seen     map[string]bool
+	order    []string
+	running  map[string]bool
+	mu       sync.Mutex
+}
+
+func NewDeduplicator(capacity int) *Deduplicator {
+	return &Deduplicator{
+		capacity: capacity,
+		seen:     make(map[string]bool),
+		running:  make(map[string]bool),
+	}
+}
+
+// Wrap returns a handler that acks messages already handled without
+// calling handler again. Messages without an idempotency key are keyed by
+// ID.
+func (d *Deduplicator) Wrap(handler func(context.Context, *Message) error) func(context.Context, *Message) error {
+	return func(ctx context.Context, msg *Message) error {
+		key := msg.IdempotencyKey
+		if key == "" {
+			key = msg.ID
+		}
+
+		d.mu.Lock()
+		if d.seen[key] {
+			d.mu.Unlock()
+			logger.DebugContext(ctx, "duplicate message skipped", "message_id", msg.ID, "idempotency_key", key)
+			return nil
+		}
+		if d.running[key] {
+			d.mu.Unlock()
+			return errDuplicateInProgress
+		}
+		d.running[key] = true
+		d.mu.Unlock()
+
+		err := handler(ctx, msg)
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.running, key)
+		if err == nil {
+			d.remember(key)
+		}
+		return err
+	}
+}
+
+func (d *Deduplicator) remember(key string) {
+	d.seen[key] = true
+	d.order = append(d.order, key)
+	if len(d.order) > d.capacity {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+}
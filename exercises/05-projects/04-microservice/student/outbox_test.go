@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func pendingCount(t *testing.T, db *Database) int {
+	t.Helper()
+	pending, err := db.pendingOutbox(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pending)
+}
+
+func newTestRelay(t *testing.T, db *Database, queue *MessageQueue) *OutboxRelay {
+	t.Helper()
+	relay, err := NewOutboxRelay(db, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relay
+}
+
+func TestCreateUserWritesOutboxInSameTransaction(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := withRequestID(context.Background(), "req-1")
+
+	created, err := db.CreateUser(ctx, &User{Name: "Ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser(ctx, &User{Name: "Ann", Email: "ann@example.com"}); err == nil {
+		t.Fatal("expected duplicate email to fail")
+	}
+
+	pending, _ := db.pendingOutbox(context.Background(), 10)
+	if len(pending) != 1 {
+		t.Fatalf("expected one event for the one committed user, got %d", len(pending))
+	}
+	msg := pending[0].msg
+	if msg.Type != "user.created" || msg.IdempotencyKey != fmt.Sprintf("user.created:%d", created.ID) {
+		t.Errorf("unexpected event: %+v", msg)
+	}
+	if msg.Metadata[metaRequestID] != "req-1" {
+		t.Errorf("event lost the request ID: %v", msg.Metadata)
+	}
+}
+
+// TestOutboxRelayKilledMidFlight stops the relay goroutine dead after it
+// has published an event but before it records the send. A restarted
+// relay publishes that event again, so the topic delivers it twice; the
+// consumer must handle every event exactly once.
+func TestOutboxRelayKilledMidFlight(t *testing.T) {
+	db := newTestDatabase(t)
+	for i := 0; i < 5; i++ {
+		if _, err := db.CreateUser(context.Background(), &User{Name: "U", Email: fmt.Sprintf("u%d@example.com", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queue, _ := NewMessageQueue("", QueueOptions{})
+	defer queue.Close()
+	crashing := newTestRelay(t, db, queue)
+
+	var mu sync.Mutex
+	delivered := 0
+	handled := map[string]int{}
+	dedupe := NewDeduplicator(100).Wrap(func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		handled[msg.IdempotencyKey]++
+		mu.Unlock()
+		return nil
+	})
+	queue.JoinGroup(userEventsTopic, "test", func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		delivered++
+		mu.Unlock()
+		return dedupe(ctx, msg)
+	})
+
+	var published int
+	crashing.publish = func(ctx context.Context, msg *Message) error {
+		published++
+		if err := queue.PublishTopic(ctx, userEventsTopic, msg); err != nil {
+			return err
+		}
+		if published == 3 {
+			runtime.Goexit()
+		}
+		return nil
+	}
+	crashing.Start()
+	<-crashing.done
+
+	if n := pendingCount(t, db); n != 3 {
+		t.Fatalf("expected the in-flight event and the two after it pending, got %d", n)
+	}
+	restarted := newTestRelay(t, db, queue)
+	restarted.publish = func(ctx context.Context, msg *Message) error {
+		published++
+		return queue.PublishTopic(ctx, userEventsTopic, msg)
+	}
+	restarted.Start()
+	if err := restarted.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := pendingCount(t, db); n != 0 {
+		t.Errorf("expected the outbox to be drained, %d pending", n)
+	}
+	if published != 6 {
+		t.Errorf("expected one event to be published twice, got %d publishes", published)
+	}
+
+	waitFor(t, "all deliveries", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered == 6
+	})
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 5 || delivered != 6 {
+		t.Errorf("expected 6 deliveries of 5 events, got %d of %d", delivered, len(handled))
+	}
+	for key, n := range handled {
+		if n != 1 {
+			t.Errorf("event %s handled %d times", key, n)
+		}
+	}
+}
+
+// TestOutboxRelayOutrunsConsumers relays more events than the queue holds
+// with nobody consuming them. Topic retention drops the oldest, so the
+// relay never stalls on a full queue.
+func TestOutboxRelayOutrunsConsumers(t *testing.T) {
+	db := newTestDatabase(t)
+	const capacity = 10
+	queue, _ := NewMessageQueue("", QueueOptions{Capacity: capacity, TopicMaxMessages: capacity})
+	defer queue.Close()
+
+	relay := newTestRelay(t, db, queue)
+	relay.Start()
+	for i := 0; i < 3*capacity; i++ {
+		if _, err := db.CreateUser(context.Background(), &User{Name: "U", Email: fmt.Sprintf("u%d@example.com", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := relay.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := pendingCount(t, db); n != 0 {
+		t.Errorf("expected the outbox to be drained, %d pending", n)
+	}
+	if lag := queue.Lag(userEventsTopic, "consumer"); lag != capacity {
+		t.Errorf("expected the newest %d events to be kept, got %d", capacity, lag)
+	}
+}
+
+func TestDeduplicatorForgetsOldestKeys(t *testing.T) {
+	d := NewDeduplicator(2)
+	calls := 0
+	handler := d.Wrap(func(ctx context.Context, msg *Message) error {
+		calls++
+		return nil
+	})
+
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		handler(context.Background(), &Message{IdempotencyKey: key})
+	}
+	// "a" is skipped once, then evicted by "c" and handled again.
+	if calls != 4 {
+		t.Errorf("expected 4 calls, got %d", calls)
+	}
+}
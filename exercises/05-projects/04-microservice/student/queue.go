@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// queueEntry is a live message and its delivery state. Leases are kept in
+// memory only: after a restart every in-flight message is visible again,
+// which is what at-least-once delivery asks for.
+type queueEntry struct {
+	msg          *Message
+	visibleAt    time.Time
+	leased       bool
+	lease        uint64
+	leaseExpires time.Time
+}
+
+const (
+	opPublish = "publish"
+	opAck     = "ack"
+	opNack    = "nack"
+	opDead    = "dead"
+	opRedrive = "redrive"
+	opTopic   = "topic"
+	opAppend  = "append"
+	opCommit  = "commit"
+	opTrim    = "trim"
+)
+
+// queueRecord is one line of the append-only log. Replaying the records in
+// order rebuilds the queue.
+type queueRecord struct {
+	Op           string    `json:"op"`
+	ID           string    `json:"id"`
+	Message      *Message  `json:"message,omitempty"`
+	Redeliveries int       `json:"redeliveries,omitempty"`
+	VisibleAt    time.Time `json:"visible_at,omitzero"`
+	Error        string    `json:"error,omitempty"`
+
+	Topic      string `json:"topic,omitempty"`
+	Partitions int    `json:"partitions,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Partition  int    `json:"partition,omitempty"`
+	Offset     int64  `json:"offset,omitempty"`
+}
+
+// compactMinRecords is the log length below which the log is never
+// rewritten, however much of it is dead.
+const compactMinRecords = 1024
+
+// record makes a state change durable, then applies it. Nothing changes if
+// the log write fails.
+func (mq *MessageQueue) record(rec queueRecord) error {
+	if mq.log != nil {
+		if err := mq.log.append(rec); err != nil {
+			return fmt.Errorf("error writing queue log: %v", err)
+		}
+	}
+	mq.apply(rec)
+
+	if mq.log != nil && mq.log.records > compactMinRecords && mq.log.records > 2*mq.liveRecords() {
+		if err := mq.compactLocked(); err != nil {
+			logger.Error("queue log compaction failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// apply changes the in-memory state for rec and wakes waiting receivers.
+// Records for unknown IDs are ignored; they refer to messages that a
+// compaction has already dropped.
+func (mq *MessageQueue) apply(rec queueRecord) {
+	switch rec.Op {
+	case opPublish:
+		if _, ok := mq.entries[rec.ID]; ok || rec.Message == nil {
+			return
+		}
+		if rec.Message.Metadata == nil {
+			rec.Message.Metadata = make(map[string]string)
+		}
+		mq.entries[rec.ID] = &queueEntry{msg: rec.Message, visibleAt: rec.VisibleAt}
+		mq.order = append(mq.order, rec.ID)
+	case opAck:
+		mq.removeLocked(rec.ID)
+	case opNack:
+		if e, ok := mq.entries[rec.ID]; ok {
+			e.msg.Redeliveries = rec.Redeliveries
+			e.visibleAt = rec.VisibleAt
+			e.leased = false
+		}
+	case opDead:
+		// Records for topic messages, and compacted ones, carry the
+		// message itself; others refer to a live entry.
+		msg := rec.Message
+		if msg == nil {
+			if e := mq.removeLocked(rec.ID); e != nil {
+				msg = e.msg
+			}
+		}
+		if msg == nil {
+			return
+		}
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		msg.Redeliveries = rec.Redeliveries
+		msg.Metadata[metaDeadLetterReason] = rec.Error
+		mq.dead = append(mq.dead, msg)
+		mq.retainDeadLocked(time.Now())
+	case opRedrive:
+		i := slices.IndexFunc(mq.dead, func(m *Message) bool { return m.ID == rec.ID })
+		if i < 0 {
+			return
+		}
+		msg := mq.dead[i]
+		mq.dead = slices.Delete(mq.dead, i, i+1)
+		msg.Redeliveries = 0
+		delete(msg.Metadata, metaDeadLetterReason)
+		mq.entries[msg.ID] = &queueEntry{msg: msg}
+		mq.order = append(mq.order, msg.ID)
+	case opTopic, opAppend, opCommit, opTrim:
+		mq.applyTopic(rec)
+	}
+	mq.notifyLocked()
+}
+
+// retainDeadLocked drops the oldest dead letters beyond MaxDeadLetters and
+// those published more than DeadLetterRetention before now. It runs as a
+// dead letter is added, on replay too, so the log needs no record of it;
+// compaction leaves the dropped ones out.
+func (mq *MessageQueue) retainDeadLocked(now time.Time) {
+	drop := max(len(mq.dead)-mq.opts.MaxDeadLetters, 0)
+	cutoff := now.Add(-mq.opts.DeadLetterRetention)
+	for drop < len(mq.dead) && mq.dead[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	logger.Warn("dead letters dropped by retention", "dropped", drop)
+	clear(mq.dead[:drop])
+	mq.dead = mq.dead[drop:]
+}
+
+// notifyLocked wakes everything waiting for the queue state to change.
+func (mq *MessageQueue) notifyLocked() {
+	close(mq.changed)
+	mq.changed = make(chan struct{})
+}
+
+func (mq *MessageQueue) removeLocked(id string) *queueEntry {
+	e, ok := mq.entries[id]
+	if !ok {
+		return nil
+	}
+	delete(mq.entries, id)
+	mq.order = slices.DeleteFunc(mq.order, func(other string) bool { return other == id })
+	return e
+}
+
+// nextLocked leases the oldest visible message. Leases that ran out are
+// failed on the way. When nothing is visible it returns the time at which
+// something will be, or zero if the queue is empty.
+func (mq *MessageQueue) nextLocked(now time.Time) (*Delivery, time.Time, error) {
+	select {
+	case <-mq.closed:
+		return nil, time.Time{}, ErrQueueClosed
+	default:
+	}
+
+	var wake time.Time
+	for _, id := range slices.Clone(mq.order) {
+		e, ok := mq.entries[id]
+		if !ok {
+			continue
+		}
+		if e.leased && !now.Before(e.leaseExpires) {
+			logger.Warn("message visibility timeout expired", "message_id", id, "type", e.msg.Type)
+			if err := mq.failLocked(e, errors.New("visibility timeout expired"), now); err != nil {
+				return nil, time.Time{}, err
+			}
+			if _, ok := mq.entries[id]; !ok {
+				continue
+			}
+		}
+
+		if e.leased {
+			wake = earliest(wake, e.leaseExpires)
+			continue
+		}
+		if now.Before(e.visibleAt) {
+			wake = earliest(wake, e.visibleAt)
+			continue
+		}
+
+		mq.leases++
+		e.leased = true
+		e.lease = mq.leases
+		e.leaseExpires = now.Add(mq.opts.VisibilityTimeout)
+		return &Delivery{Message: cloneMessage(e.msg), Deadline: e.leaseExpires, mq: mq, lease: e.lease}, time.Time{}, nil
+	}
+	return nil, wake, nil
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// settle acks (reason == nil) or nacks the message held by d, provided d
+// still holds the lease.
+func (mq *MessageQueue) settle(d *Delivery, reason error) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	e, ok := mq.entries[d.ID]
+	if !ok || !e.leased || e.lease != d.lease {
+		return ErrLeaseExpired
+	}
+	if reason == nil {
+		return mq.record(queueRecord{Op: opAck, ID: d.ID})
+	}
+	return mq.failLocked(e, reason, time.Now())
+}
+
+// failLocked counts a failed delivery and either schedules a retry after
+// an exponential backoff or moves the message to the dead-letter queue.
+func (mq *MessageQueue) failLocked(e *queueEntry, reason error, now time.Time) error {
+	failures := e.msg.Redeliveries + 1
+	if failures >= mq.opts.MaxDeliveries {
+		logger.Warn("message dead-lettered", "message_id", e.msg.ID, "type", e.msg.Type,
+			"deliveries", failures, "error", reason)
+		return mq.record(queueRecord{Op: opDead, ID: e.msg.ID, Redeliveries: failures, Error: reason.Error()})
+	}
+	return mq.record(queueRecord{
+		Op:           opNack,
+		ID:           e.msg.ID,
+		Redeliveries: failures,
+		VisibleAt:    now.Add(mq.backoff(failures)),
+	})
+}
+
+// backoff returns the delay before the retry that follows the nth failure:
+// MinBackoff doubled n-1 times, capped at MaxBackoff.
+func (mq *MessageQueue) backoff(n int) time.Duration {
+	d := mq.opts.MinBackoff
+	for i := 1; i < n; i++ {
+		d *= 2
+		if d >= mq.opts.MaxBackoff {
+			return mq.opts.MaxBackoff
+		}
+	}
+	return min(d, mq.opts.MaxBackoff)
+}
+
+// compactLocked rewrites the log as the shortest sequence of records that
+// rebuilds the current state.
+func (mq *MessageQueue) compactLocked() error {
+	if mq.log == nil {
+		return nil
+	}
+
+	var records []queueRecord
+	for _, id := range mq.order {
+		e := mq.entries[id]
+		records = append(records, queueRecord{Op: opPublish, ID: id, Message: e.msg, VisibleAt: e.visibleAt})
+	}
+	for _, msg := range mq.dead {
+		records = append(records, queueRecord{
+			Op:           opDead,
+			ID:           msg.ID,
+			Message:      msg,
+			Redeliveries: msg.Redeliveries,
+			Error:        msg.Metadata[metaDeadLetterReason],
+		})
+	}
+	records = append(records, mq.topicRecords()...)
+	return mq.log.rewrite(records)
+}
+
+func cloneMessage(msg *Message) *Message {
+	clone := *msg
+	clone.Metadata = maps.Clone(msg.Metadata)
+	if clone.Metadata == nil {
+		clone.Metadata = make(map[string]string)
+	}
+	return &clone
+}
+
+// queueLog is the append-only file behind a durable MessageQueue. Each
+// record is a JSON line, synced before the change it describes is applied.
+type queueLog struct {
+	path    string
+	file    *os.File
+	records int
+}
+
+// openQueueLog replays the log at path through apply. A final line without
+// a newline is a write torn by a crash: it was never acknowledged, so it is
+// dropped. Any other unreadable line is corruption and fails the open.
+func openQueueLog(path string, apply func(queueRecord)) (*queueLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening queue log: %v", err)
+	}
+	l := &queueLog{path: path, file: file}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logger.Warn("dropping torn record at end of queue log", "path", path, "offset", offset)
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, fmt.Errorf("error truncating queue log: %v", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error reading queue log: %v", err)
+		}
+
+		var rec queueRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt queue log %s at offset %d: %v", path, offset, err)
+		}
+		apply(rec)
+		l.records++
+		offset += int64(len(line))
+	}
+	return l, nil
+}
+
+func (l *queueLog) append(rec queueRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.records++
+	return l.file.Sync()
+}
+
+// rewrite replaces the log with records. The new log is written and synced
+// beside the old one and renamed over it, so a crash leaves one or the
+// other intact.
+func (l *queueLog) rewrite(records []queueRecord) error {
+	tmp := l.path + ".compact"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.records = len(records)
+	return nil
+}
+
+func (l *queueLog) Close() error {
+	return l.file.Close()
+}
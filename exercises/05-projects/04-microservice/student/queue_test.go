@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, mq *MessageQueue) *Delivery {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d, err := mq.Receive(ctx)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	return d
+}
+
+func publish(t *testing.T, mq *MessageQueue, id string) {
+	t.Helper()
+	if err := mq.Publish(context.Background(), &Message{ID: id, Type: "test", Data: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueRetriesThenDeadLetters(t *testing.T) {
+	mq, err := NewMessageQueue("", QueueOptions{MaxDeliveries: 3, MinBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	publish(t, mq, "m1")
+
+	var previous time.Time
+	for attempt := 0; attempt < 3; attempt++ {
+		d := receive(t, mq)
+		if d.Redeliveries != attempt {
+			t.Errorf("attempt %d: expected %d redeliveries, got %d", attempt, attempt, d.Redeliveries)
+		}
+		// The second retry waits twice as long as the first.
+		if attempt == 2 && time.Since(previous) < 20*time.Millisecond {
+			t.Errorf("retry came after %s, expected backoff of 20ms", time.Since(previous))
+		}
+		previous = time.Now()
+		if err := d.Nack(errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if mq.Depth() != 0 {
+		t.Errorf("expected empty queue, got depth %d", mq.Depth())
+	}
+	dead := mq.DeadLetters()
+	if len(dead) != 1 || dead[0].Redeliveries != 3 || dead[0].Metadata[metaDeadLetterReason] != "boom" {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+
+	if err := mq.Redrive("m1"); err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, mq)
+	if d.Redeliveries != 0 {
+		t.Errorf("redriven message kept %d redeliveries", d.Redeliveries)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if mq.Depth() != 0 || len(mq.DeadLetters()) != 0 {
+		t.Error("acked message is still queued")
+	}
+}
+
+func TestQueueRedeliversAfterVisibilityTimeout(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{VisibilityTimeout: 30 * time.Millisecond, MinBackoff: time.Millisecond})
+	defer mq.Close()
+	publish(t, mq, "m1")
+
+	first := receive(t, mq)
+	second := receive(t, mq)
+	if second.ID != "m1" || second.Redeliveries != 1 {
+		t.Errorf("expected redelivery of m1, got %s with %d redeliveries", second.ID, second.Redeliveries)
+	}
+	if err := first.Ack(); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("expected stale ack to fail with ErrLeaseExpired, got %v", err)
+	}
+	if err := second.Ack(); err != nil {
+		t.Errorf("current lease holder could not ack: %v", err)
+	}
+}
+
+func TestSubscribeNacksPanickingHandler(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{MinBackoff: time.Millisecond})
+	publish(t, mq, "m1")
+
+	done := make(chan int, 1)
+	mq.Subscribe(func(ctx context.Context, msg *Message) error {
+		if msg.Redeliveries == 0 {
+			panic("first attempt")
+		}
+		done <- msg.Redeliveries
+		return nil
+	})
+
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("expected one redelivery, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not redelivered after the panic")
+	}
+	mq.Close()
+	if mq.Depth() != 0 {
+		t.Errorf("expected message to be acked, depth %d", mq.Depth())
+	}
+}
+
+// TestFileQueueSurvivesRestart closes a durable queue with one message
+// acked, one in flight and one dead, then reopens it from the log.
+func TestFileQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	opts := QueueOptions{MaxDeliveries: 1}
+
+	mq, err := NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, mq, "acked")
+	publish(t, mq, "in-flight")
+	publish(t, mq, "dead")
+
+	receive(t, mq).Ack()
+	receive(t, mq) // never settled, as though the process crashed
+	receive(t, mq).Nack(errors.New("poison"))
+	mq.Close()
+
+	// Simulate a crash in the middle of the next append.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"op":"publish","id":"torn"`)
+	f.Close()
+
+	mq, err = NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+
+	if mq.Depth() != 1 {
+		t.Fatalf("expected only the in-flight message to survive, depth %d", mq.Depth())
+	}
+	if d := receive(t, mq); d.ID != "in-flight" {
+		t.Errorf("expected in-flight to be redelivered, got %s", d.ID)
+	}
+	if dead := mq.DeadLetters(); len(dead) != 1 || dead[0].ID != "dead" {
+		t.Errorf("dead letters were not restored: %+v", dead)
+	}
+
+	// The torn record is gone and the next append starts on a clean line.
+	publish(t, mq, "after")
+	mq.Close()
+	if _, err := NewMessageQueue("file:"+path, opts); err != nil {
+		t.Errorf("log unreadable after recovery: %v", err)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	defer mq.Close()
+
+	for n, want := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		60: time.Second,
+	} {
+		if got := mq.backoff(n); got != want {
+			t.Errorf("backoff(%d): expected %s, got %s", n, want, got)
+		}
+	}
+}
+
+func TestFileQueueCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	mq, err := NewMessageQueue("file:"+path, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+
+	publish(t, mq, "kept")
+	receive(t, mq) // held in flight throughout
+	for i := 0; i < compactMinRecords; i++ {
+		publish(t, mq, fmt.Sprintf("m%d", i))
+		receive(t, mq).Ack()
+	}
+
+	if mq.log.records > compactMinRecords {
+		t.Errorf("log was not compacted: %d records", mq.log.records)
+	}
+	mq.Close()
+	mq, err = NewMessageQueue("file:"+path, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mq.Depth() != 1 {
+		t.Errorf("expected only kept to survive compaction, depth %d", mq.Depth())
+	}
+}
+
+func TestPublishIsIdempotentWhenFull(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{Capacity: 2})
+	defer mq.Close()
+
+	publish(t, mq, "m1")
+	publish(t, mq, "m2")
+	publish(t, mq, "m1") // already queued, so not refused for capacity
+	if err := mq.Publish(context.Background(), &Message{ID: "m3", Type: "test"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull for a new message, got %v", err)
+	}
+	if mq.Depth() != 2 {
+		t.Errorf("expected depth 2, got %d", mq.Depth())
+	}
+}
+
+func TestDeadLetterRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	opts := QueueOptions{MaxDeliveries: 1, MaxDeadLetters: 2, DeadLetterRetention: time.Hour}
+	mq, err := NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := &Message{ID: "old", Type: "test", Time: time.Now().Add(-2 * time.Hour)}
+	if err := mq.Publish(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, mq).Nack(errors.New("boom"))
+	if dead := mq.DeadLetters(); len(dead) != 0 {
+		t.Errorf("expected the expired dead letter to be dropped, got %d", len(dead))
+	}
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		publish(t, mq, id)
+		receive(t, mq).Nack(errors.New("boom"))
+	}
+	mq.Close()
+
+	mq, err = NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	dead := mq.DeadLetters()
+	if len(dead) != 2 || dead[0].ID != "m2" || dead[1].ID != "m3" {
+		t.Errorf("expected the newest two dead letters to survive a restart, got %+v", dead)
+	}
+}
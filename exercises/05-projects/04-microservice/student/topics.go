@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Message metadata keys set on dead letters that came from a topic.
+const metaGroup = "group"
+
+// topic is a named log split into partitions. Messages are kept after they
+// are consumed, until retention drops them; each consumer group tracks its
+// own position.
+type topic struct {
+	name       string
+	partitions [][]*Message
+	// base holds, per partition, the offset of the first message kept.
+	base []int64
+	// next spreads messages without a key across partitions.
+	next int
+}
+
+// consumerGroup shares a topic's partitions between its members. Each
+// partition has one owner at a time and is consumed in offset order.
+type consumerGroup struct {
+	topic string
+	name  string
+
+	members    []*GroupMember
+	generation int
+	nextMember int
+
+	// committed holds, per partition, the offset of the next message the
+	// group will consume. It survives restarts on a durable queue.
+	committed []int64
+	// busy marks partitions with a message in a handler. The owner may
+	// change in a rebalance meanwhile; the new owner waits for it.
+	busy     []bool
+	failures []int
+	retryAt  []time.Time
+}
+
+// GroupMember is one consumer in a group, running handler for messages of
+// the partitions assigned to it.
+type GroupMember struct {
+	ID string
+
+	mq         *MessageQueue
+	group      *consumerGroup
+	handler    func(context.Context, *Message) error
+	partitions []int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func groupKey(topicName, group string) string {
+	return topicName + "/" + group
+}
+
+// CreateTopic creates a topic with the given number of partitions. It is a
+// no-op if the topic already exists with that many.
+func (mq *MessageQueue) CreateTopic(name string, partitions int) error {
+	if name == "" || partitions <= 0 {
+		return fmt.Errorf("invalid topic %q with %d partitions", name, partitions)
+	}
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if t, ok := mq.topics[name]; ok {
+		if len(t.partitions) != partitions {
+			return fmt.Errorf("topic %s already exists with %d partitions", name, len(t.partitions))
+		}
+		return nil
+	}
+	return mq.record(queueRecord{Op: opTopic, Topic: name, Partitions: partitions})
+}
+
+// PublishTopic appends msg to a partition of the topic chosen by hashing
+// msg.Key, so that messages with the same key keep their order. Messages
+// without a key are spread round-robin.
+func (mq *MessageQueue) PublishTopic(ctx context.Context, topicName string, msg *Message) error {
+	stampMessage(ctx, msg)
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	select {
+	case <-mq.closed:
+		return ErrQueueClosed
+	default:
+	}
+	t, ok := mq.topics[topicName]
+	if !ok {
+		return fmt.Errorf("unknown topic %s", topicName)
+	}
+
+	if msg.Key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(msg.Key))
+		msg.Partition = int(h.Sum32() % uint32(len(t.partitions)))
+	} else {
+		msg.Partition = t.next % len(t.partitions)
+		t.next++
+	}
+	msg.Topic = topicName
+	msg.Offset = t.base[msg.Partition] + int64(len(t.partitions[msg.Partition]))
+
+	if err := mq.record(queueRecord{Op: opAppend, ID: msg.ID, Message: cloneMessage(msg)}); err != nil {
+		return err
+	}
+	mq.retainLocked(t, msg.Partition, time.Now())
+	logger.DebugContext(ctx, "message published", "message_id", msg.ID, "type", msg.Type,
+		"topic", topicName, "partition", msg.Partition, "offset", msg.Offset)
+	return nil
+}
+
+// retainLocked drops the oldest messages of partition p beyond
+// TopicMaxMessages and those published more than TopicRetention before now.
+func (mq *MessageQueue) retainLocked(t *topic, p int, now time.Time) {
+	messages := t.partitions[p]
+	drop := max(len(messages)-mq.opts.TopicMaxMessages, 0)
+	cutoff := now.Add(-mq.opts.TopicRetention)
+	for drop < len(messages) && messages[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	offset := t.base[p] + int64(drop)
+	if err := mq.record(queueRecord{Op: opTrim, Topic: t.name, Partition: p, Offset: offset}); err != nil {
+		logger.Error("topic retention failed", "topic", t.name, "partition", p, "error", err)
+	}
+}
+
+// JoinGroup adds a consumer to group on the topic and rebalances the
+// partitions between its members. The member resumes each partition from
+// the group's committed offset, or from the oldest message kept if
+// retention has dropped the messages there. A handler error is retried with backoff;
+// after MaxDeliveries failures the message is dead-lettered and skipped so
+// that the partition does not stall.
+func (mq *MessageQueue) JoinGroup(topicName, group string, handler func(context.Context, *Message) error) (*GroupMember, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	select {
+	case <-mq.closed:
+		return nil, ErrQueueClosed
+	default:
+	}
+	t, ok := mq.topics[topicName]
+	if !ok {
+		return nil, fmt.Errorf("unknown topic %s", topicName)
+	}
+
+	g := mq.groupLocked(t, group)
+	g.nextMember++
+	m := &GroupMember{
+		ID:      group + "-" + strconv.Itoa(g.nextMember),
+		mq:      mq,
+		group:   g,
+		handler: handler,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	g.members = append(g.members, m)
+	mq.rebalanceLocked(g)
+
+	mq.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+// Leave stops the member after its in-flight message is settled and hands
+// its partitions to the rest of the group.
+func (m *GroupMember) Leave() {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.done
+
+	m.mq.mu.Lock()
+	defer m.mq.mu.Unlock()
+	g := m.group
+	if i := slices.Index(g.members, m); i >= 0 {
+		g.members = slices.Delete(g.members, i, i+1)
+		m.mq.rebalanceLocked(g)
+	}
+}
+
+// Partitions returns the partitions currently assigned to the member.
+func (m *GroupMember) Partitions() []int {
+	m.mq.mu.Lock()
+	defer m.mq.mu.Unlock()
+	return slices.Clone(m.partitions)
+}
+
+// Lag returns how many messages of the topic the group has yet to
+// consume.
+func (mq *MessageQueue) Lag(topicName, group string) int64 {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	t, ok := mq.topics[topicName]
+	if !ok {
+		return 0
+	}
+	// A group that has never committed would start from the oldest
+	// message kept. Looking it up rather than creating it keeps a read
+	// from adding a group that is then persisted.
+	g, joined := mq.groups[groupKey(topicName, group)]
+	var lag int64
+	for p, messages := range t.partitions {
+		committed := t.base[p]
+		if joined {
+			committed = max(g.committed[p], committed)
+		}
+		lag += t.base[p] + int64(len(messages)) - committed
+	}
+	return lag
+}
+
+func (mq *MessageQueue) groupLocked(t *topic, name string) *consumerGroup {
+	key := groupKey(t.name, name)
+	g, ok := mq.groups[key]
+	if !ok {
+		n := len(t.partitions)
+		g = &consumerGroup{
+			topic:     t.name,
+			name:      name,
+			committed: make([]int64, n),
+			busy:      make([]bool, n),
+			failures:  make([]int, n),
+			retryAt:   make([]time.Time, n),
+		}
+		mq.groups[key] = g
+	}
+	return g
+}
+
+// rebalanceLocked deals the partitions out to the members in join order,
+// partition p going to member p mod n.
+func (mq *MessageQueue) rebalanceLocked(g *consumerGroup) {
+	g.generation++
+	for _, m := range g.members {
+		m.partitions = nil
+	}
+	if len(g.members) > 0 {
+		for p := range g.committed {
+			m := g.members[p%len(g.members)]
+			m.partitions = append(m.partitions, p)
+		}
+	}
+
+	assignment := make(map[string][]int, len(g.members))
+	for _, m := range g.members {
+		assignment[m.ID] = m.partitions
+	}
+	logger.Info("consumer group rebalanced", "topic", g.topic, "group", g.name,
+		"generation", g.generation, "assignment", assignment)
+	mq.notifyLocked()
+}
+
+func (m *GroupMember) run() {
+	defer m.mq.wg.Done()
+	defer close(m.done)
+
+	mq := m.mq
+	for {
+		mq.mu.Lock()
+		msg, wake := m.nextLocked(time.Now())
+		changed := mq.changed
+		mq.mu.Unlock()
+
+		if msg != nil {
+			m.process(msg)
+			continue
+		}
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			fire = timer.C
+		}
+		stopped := false
+		select {
+		case <-changed:
+		case <-fire:
+		case <-m.stop:
+			stopped = true
+		case <-mq.closed:
+			stopped = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// nextLocked claims the next message from one of the member's partitions,
+// or returns when a partition waiting out a backoff becomes ready.
+func (m *GroupMember) nextLocked(now time.Time) (*Message, time.Time) {
+	select {
+	case <-m.stop:
+		return nil, time.Time{}
+	case <-m.mq.closed:
+		return nil, time.Time{}
+	default:
+	}
+
+	g := m.group
+	t := m.mq.topics[g.topic]
+	var wake time.Time
+	for _, p := range m.partitions {
+		if g.busy[p] {
+			continue
+		}
+		if g.committed[p] < t.base[p] {
+			logger.Warn("consumer group skipped messages dropped by retention", "topic", g.topic, "group", g.name,
+				"partition", p, "skipped", t.base[p]-g.committed[p])
+			g.committed[p] = t.base[p]
+			g.failures[p] = 0
+			g.retryAt[p] = time.Time{}
+		}
+		if g.committed[p] >= t.base[p]+int64(len(t.partitions[p])) {
+			continue
+		}
+		if now.Before(g.retryAt[p]) {
+			wake = earliest(wake, g.retryAt[p])
+			continue
+		}
+		g.busy[p] = true
+		msg := cloneMessage(t.partitions[p][g.committed[p]-t.base[p]])
+		msg.Redeliveries = g.failures[p]
+		return msg, time.Time{}
+	}
+	return nil, wake
+}
+
+// process runs the handler and then commits the offset, schedules a retry
+// or dead-letters the message. The commit is made even if the partition
+// moved to another member meanwhile: that member could not have started on
+// it while it was busy here.
+func (m *GroupMember) process(msg *Message) {
+	ctx, span := messageContext(msg)
+	defer span.End()
+	span.SetAttribute("messaging.destination.name", msg.Topic)
+	span.SetAttribute("messaging.consumer.group.name", m.group.name)
+
+	err := runHandler(ctx, m.handler, msg)
+
+	mq := m.mq
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	g, p := m.group, msg.Partition
+	g.busy[p] = false
+	defer mq.notifyLocked()
+
+	if err != nil {
+		span.RecordError(err)
+		g.failures[p]++
+		logger.ErrorContext(ctx, "message handler failed", "message_id", msg.ID, "type", msg.Type,
+			"topic", msg.Topic, "partition", p, "offset", msg.Offset, "group", g.name, "error", err)
+
+		if g.failures[p] < mq.opts.MaxDeliveries {
+			g.retryAt[p] = time.Now().Add(mq.backoff(g.failures[p]))
+			return
+		}
+		dead := cloneMessage(msg)
+		dead.Metadata[metaGroup] = g.name
+		logger.WarnContext(ctx, "message dead-lettered", "message_id", msg.ID, "type", msg.Type,
+			"topic", msg.Topic, "group", g.name, "deliveries", g.failures[p], "error", err)
+		if err := mq.record(queueRecord{Op: opDead, ID: msg.ID, Message: dead, Redeliveries: g.failures[p], Error: err.Error()}); err != nil {
+			logger.ErrorContext(ctx, "dead-lettering failed", "message_id", msg.ID, "error", err)
+			return
+		}
+	}
+
+	g.failures[p] = 0
+	g.retryAt[p] = time.Time{}
+	if err := mq.record(queueRecord{Op: opCommit, Topic: g.topic, Group: g.name, Partition: p, Offset: msg.Offset + 1}); err != nil {
+		logger.ErrorContext(ctx, "offset commit failed", "topic", g.topic, "group", g.name, "partition", p, "error", err)
+	}
+}
+
+// applyTopic applies topic, append, commit and trim records.
+func (mq *MessageQueue) applyTopic(rec queueRecord) {
+	switch rec.Op {
+	case opTopic:
+		if _, ok := mq.topics[rec.Topic]; !ok {
+			mq.topics[rec.Topic] = &topic{
+				name:       rec.Topic,
+				partitions: make([][]*Message, rec.Partitions),
+				base:       make([]int64, rec.Partitions),
+			}
+		}
+	case opAppend:
+		msg := rec.Message
+		t, ok := mq.topics[msg.Topic]
+		if !ok || msg.Partition >= len(t.partitions) || msg.Offset != t.base[msg.Partition]+int64(len(t.partitions[msg.Partition])) {
+			return
+		}
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		t.partitions[msg.Partition] = append(t.partitions[msg.Partition], msg)
+	case opCommit:
+		t, ok := mq.topics[rec.Topic]
+		if !ok || rec.Partition >= len(t.partitions) {
+			return
+		}
+		g := mq.groupLocked(t, rec.Group)
+		g.committed[rec.Partition] = max(g.committed[rec.Partition], rec.Offset)
+	case opTrim:
+		t, ok := mq.topics[rec.Topic]
+		if !ok || rec.Partition >= len(t.partitions) {
+			return
+		}
+		// A compacted log trims a partition before appending the messages
+		// kept, so the base may move past the messages held.
+		p := rec.Partition
+		drop := min(max(rec.Offset-t.base[p], 0), int64(len(t.partitions[p])))
+		clear(t.partitions[p][:drop])
+		t.partitions[p] = t.partitions[p][drop:]
+		t.base[p] = max(t.base[p], rec.Offset)
+	}
+}
+
+// topicRecords returns the records that rebuild the topics and committed
+// offsets, for compaction.
+func (mq *MessageQueue) topicRecords() []queueRecord {
+	var records []queueRecord
+	for _, name := range slices.Sorted(maps.Keys(mq.topics)) {
+		t := mq.topics[name]
+		records = append(records, queueRecord{Op: opTopic, Topic: name, Partitions: len(t.partitions)})
+		for p, messages := range t.partitions {
+			if t.base[p] > 0 {
+				records = append(records, queueRecord{Op: opTrim, Topic: name, Partition: p, Offset: t.base[p]})
+			}
+			for _, msg := range messages {
+				records = append(records, queueRecord{Op: opAppend, ID: msg.ID, Message: msg})
+			}
+		}
+	}
+	for _, g := range mq.groups {
+		for p, offset := range g.committed {
+			if offset > 0 {
+				records = append(records, queueRecord{Op: opCommit, Topic: g.topic, Group: g.name, Partition: p, Offset: offset})
+			}
+		}
+	}
+	return records
+}
+
+// liveRecords is the number of records compaction would write.
+func (mq *MessageQueue) liveRecords() int {
+	n := len(mq.entries) + len(mq.dead)
+	for _, t := range mq.topics {
+		n++
+		for p, messages := range t.partitions {
+			n += len(messages)
+			if t.base[p] > 0 {
+				n++
+			}
+		}
+	}
+	for _, g := range mq.groups {
+		n += len(g.committed)
+	}
+	return n
+}
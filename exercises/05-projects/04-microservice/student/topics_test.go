@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func publishKeyed(t *testing.T, mq *MessageQueue, topicName, key string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg := &Message{ID: fmt.Sprintf("%s-%d", key, i), Type: "test", Key: key}
+		if err := mq.PublishTopic(context.Background(), topicName, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type seenMessages struct {
+	ids map[string]int
+	// order records the IDs per key in delivery order.
+	order map[string][]string
+	mu    sync.Mutex
+}
+
+func newSeenMessages() *seenMessages {
+	return &seenMessages{ids: make(map[string]int), order: make(map[string][]string)}
+}
+
+func (s *seenMessages) handler(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[msg.ID]++
+	s.order[msg.Key] = append(s.order[msg.Key], msg.ID)
+	return nil
+}
+
+func (s *seenMessages) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
+func TestPublishTopicPartitionsByKey(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{})
+	defer mq.Close()
+	mq.CreateTopic("users", 4)
+
+	var partitions []int
+	for i := 0; i < 3; i++ {
+		msg := &Message{Type: "test", Key: "user-42"}
+		mq.PublishTopic(context.Background(), "users", msg)
+		partitions = append(partitions, msg.Partition)
+		if msg.Offset != int64(i) {
+			t.Errorf("expected offset %d, got %d", i, msg.Offset)
+		}
+	}
+	if partitions[0] != partitions[1] || partitions[1] != partitions[2] {
+		t.Errorf("messages with one key spread over partitions %v", partitions)
+	}
+
+	if err := mq.CreateTopic("users", 8); err == nil {
+		t.Error("expected error recreating topic with a different partition count")
+	}
+}
+
+func TestConsumerGroupRebalances(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{})
+	defer mq.Close()
+	mq.CreateTopic("users", 4)
+
+	seen := newSeenMessages()
+	a, _ := mq.JoinGroup("users", "mailer", seen.handler)
+	if got := a.Partitions(); !slices.Equal(got, []int{0, 1, 2, 3}) {
+		t.Errorf("sole member should own every partition, got %v", got)
+	}
+
+	b, _ := mq.JoinGroup("users", "mailer", seen.handler)
+	if pa, pb := a.Partitions(), b.Partitions(); len(pa) != 2 || len(pb) != 2 {
+		t.Errorf("expected partitions split 2/2, got %v and %v", pa, pb)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		publishKeyed(t, mq, "users", key, 10)
+	}
+	a.Leave()
+	if got := b.Partitions(); len(got) != 4 {
+		t.Errorf("remaining member should take over every partition, got %v", got)
+	}
+	waitFor(t, "all messages", func() bool { return mq.Lag("users", "mailer") == 0 })
+
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	if len(seen.ids) != 50 {
+		t.Errorf("expected 50 distinct messages, got %d", len(seen.ids))
+	}
+	for id, n := range seen.ids {
+		if n != 1 {
+			t.Errorf("message %s delivered %d times", id, n)
+		}
+	}
+	for key, ids := range seen.order {
+		for i, id := range ids {
+			if id != fmt.Sprintf("%s-%d", key, i) {
+				t.Errorf("key %s delivered out of order: %v", key, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestConsumerGroupsAreIndependent(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{})
+	defer mq.Close()
+	mq.CreateTopic("users", 2)
+	publishKeyed(t, mq, "users", "k", 5)
+
+	mailer, audit := newSeenMessages(), newSeenMessages()
+	mq.JoinGroup("users", "mailer", mailer.handler)
+	mq.JoinGroup("users", "audit", audit.handler)
+
+	waitFor(t, "both groups", func() bool { return mailer.count() == 5 && audit.count() == 5 })
+}
+
+func TestConsumerGroupDeadLettersPoisonMessage(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{MaxDeliveries: 2, MinBackoff: time.Millisecond})
+	defer mq.Close()
+	mq.CreateTopic("users", 1)
+	publishKeyed(t, mq, "users", "k", 3)
+
+	seen := newSeenMessages()
+	mq.JoinGroup("users", "mailer", func(ctx context.Context, msg *Message) error {
+		if msg.ID == "k-1" {
+			return errors.New("poison")
+		}
+		return seen.handler(ctx, msg)
+	})
+
+	waitFor(t, "partition to move past the poison message", func() bool { return mq.Lag("users", "mailer") == 0 })
+	if seen.count() != 2 {
+		t.Errorf("expected the other two messages to be handled, got %d", seen.count())
+	}
+	dead := mq.DeadLetters()
+	if len(dead) != 1 || dead[0].ID != "k-1" || dead[0].Metadata[metaGroup] != "mailer" {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+	if err := mq.Redrive("k-1"); err == nil {
+		t.Error("expected topic dead letters to be refused by Redrive")
+	}
+}
+
+func TestConsumerGroupResumesFromCommittedOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	mq, err := NewMessageQueue("file:"+path, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.CreateTopic("users", 2)
+	publishKeyed(t, mq, "users", "k", 3)
+
+	first := newSeenMessages()
+	member, _ := mq.JoinGroup("users", "mailer", first.handler)
+	waitFor(t, "first batch", func() bool { return first.count() == 3 })
+	member.Leave()
+	mq.Close()
+
+	mq, err = NewMessageQueue("file:"+path, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	if err := mq.CreateTopic("users", 2); err != nil {
+		t.Fatal(err)
+	}
+	publishKeyed(t, mq, "users", "later", 2)
+
+	second := newSeenMessages()
+	mq.JoinGroup("users", "mailer", second.handler)
+	waitFor(t, "second batch", func() bool { return mq.Lag("users", "mailer") == 0 })
+
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	if len(second.ids) != 2 || second.ids["later-0"] != 1 || second.ids["later-1"] != 1 {
+		t.Errorf("expected only the new messages after restart, got %v", second.ids)
+	}
+}
+
+func TestTopicRetentionDropsOldestMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	opts := QueueOptions{TopicMaxMessages: 3, TopicRetention: time.Hour}
+	mq, err := NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.CreateTopic("users", 1)
+
+	old := &Message{ID: "old", Type: "test", Time: time.Now().Add(-2 * time.Hour)}
+	if err := mq.PublishTopic(context.Background(), "users", old); err != nil {
+		t.Fatal(err)
+	}
+	if lag := mq.Lag("users", "mailer"); lag != 0 {
+		t.Errorf("expected the expired message to be dropped, lag %d", lag)
+	}
+	publishKeyed(t, mq, "users", "k", compactMinRecords)
+
+	if n := len(mq.topics["users"].partitions[0]); n != 3 {
+		t.Errorf("expected 3 messages kept, got %d", n)
+	}
+	if mq.log.records > compactMinRecords {
+		t.Errorf("log was not compacted: %d records", mq.log.records)
+	}
+	mq.Close()
+
+	mq, err = NewMessageQueue("file:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	if lag := mq.Lag("users", "mailer"); lag != 3 {
+		t.Errorf("expected a lag of 3 after reopening, got %d", lag)
+	}
+	msg := &Message{ID: "next", Type: "test", Key: "k"}
+	if err := mq.PublishTopic(context.Background(), "users", msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(compactMinRecords + 1); msg.Offset != want {
+		t.Errorf("expected offset %d, got %d", want, msg.Offset)
+	}
+
+	seen := newSeenMessages()
+	mq.JoinGroup("users", "mailer", seen.handler)
+	waitFor(t, "kept messages", func() bool { return mq.Lag("users", "mailer") == 0 })
+
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	want := []string{fmt.Sprintf("k-%d", compactMinRecords-2), fmt.Sprintf("k-%d", compactMinRecords-1), "next"}
+	if !slices.Equal(seen.order["k"], want) {
+		t.Errorf("expected the group to skip to %v, got %v", want, seen.order["k"])
+	}
+}
+
+func TestLagDoesNotCreateGroup(t *testing.T) {
+	mq, _ := NewMessageQueue("", QueueOptions{})
+	defer mq.Close()
+	mq.CreateTopic("users", 2)
+	publishKeyed(t, mq, "users", "k", 3)
+
+	if lag := mq.Lag("users", "auditor"); lag != 3 {
+		t.Errorf("expected a lag of 3 for a group that never joined, got %d", lag)
+	}
+	if len(mq.groups) != 0 {
+		t.Errorf("expected Lag to leave the groups alone, got %v", slices.Collect(maps.Keys(mq.groups)))
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of distributed tracing to follow a
+// request across service instances: spans with W3C Trace Context
+// propagation (https://www.w3.org/TR/trace-context/) and exporters that
+// write the OTLP JSON encoding, either to a file or to an OTLP/HTTP
+// endpoint such as the stand-in started with "go run . collector".
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+	Remote     bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind values follow the OTLP enumeration.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span records one timed operation. Methods are safe to call on a nil
+// span so that code paths without a tracer need no checks.
+type Span struct {
+	tracer     *Tracer
+	name       string
+	kind       SpanKind
+	sc         SpanContext
+	parent     SpanID
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	statusCode int
+	statusMsg  string
+	ended      bool
+	mu         sync.Mutex
+}
+
+// Span status codes from OTLP.
+const (
+	spanStatusUnset = 0
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed. A nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = spanStatusError
+	s.statusMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End stamps the end time and hands the span to the exporter. Calling End
+// more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+func contextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanExporter receives finished spans in batches.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and exports finished ones from a background
+// goroutine so that request handling never waits on the exporter.
+type Tracer struct {
+	serviceName string
+	exporter    SpanExporter
+	queue       chan *Span
+	done        chan struct{}
+	flush       chan chan struct{}
+	closeOnce   sync.Once
+}
+
+const (
+	traceQueueSize     = 2048
+	traceBatchSize     = 256
+	traceFlushInterval = 2 * time.Second
+)
+
+// NewTracer returns a tracer that sends spans to exporter. With a nil
+// exporter spans are still created and propagated but never exported.
+func NewTracer(serviceName string, exporter SpanExporter) *Tracer {
+	t := &Tracer{serviceName: serviceName, exporter: exporter}
+	if exporter != nil {
+		t.queue = make(chan *Span, traceQueueSize)
+		t.done = make(chan struct{})
+		t.flush = make(chan chan struct{})
+		go t.run()
+	}
+	return t
+}
+
+// tracer is used by the middleware, Database, Cache and ServiceClient. It
+// is replaced by NewUserService once the exporter is configured.
+var tracer = NewTracer("user-service", nil)
+
+// Start begins a span as a child of the span in ctx, or of a remote parent
+// extracted from an inbound request, or as a new trace root.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.sc = parent.sc
+		span.sc.Remote = false
+		span.parent = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.IsValid() {
+		span.sc = remote
+		span.sc.Remote = false
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = true
+	}
+	rand.Read(span.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startSpan starts a span on the service-wide tracer.
+func startSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return tracer.Start(ctx, name, kind)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	if t.queue == nil {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		// The exporter cannot keep up; dropping is better than blocking
+		// requests.
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.ExportSpans(ctx, batch); err != nil {
+			logger.Error("trace export failed", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ack := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(ack)
+		case <-t.done:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			return
+		}
+	}
+}
+
+// ForceFlush exports every span that has ended so far.
+func (t *Tracer) ForceFlush(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown flushes pending spans and closes the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	err := t.ForceFlush(ctx)
+	t.closeOnce.Do(func() { close(t.done) })
+	return errors.Join(err, t.exporter.Shutdown(ctx))
+}
+
+// W3C Trace Context
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// parseTraceparent decodes a version 00 traceparent header. Unknown future
+// versions are accepted as long as the first four fields parse, as the
+// specification requires.
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags&0x01 == 1
+	sc.Remote = true
+	return sc, true
+}
+
+func formatTraceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// extractTraceContext returns ctx carrying the remote parent found in the
+// request headers, if any.
+func extractTraceContext(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = header.Get(tracestateHeader)
+	return contextWithRemoteSpanContext(ctx, sc)
+}
+
+// injectTraceContext writes the span in ctx to outbound request headers.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	sc := SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(traceparentHeader, formatTraceparent(sc))
+	if sc.TraceState != "" {
+		header.Set(tracestateHeader, sc.TraceState)
+	}
+}
+
+// OTLP JSON encoding
+// (https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding).
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue. 64-bit integers are encoded as strings, as
+// the protobuf JSON mapping requires.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func toOTLPValue(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func toOTLPAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		out = append(out, otlpKeyValue{Key: k, Value: toOTLPValue(v)})
+	}
+	return out
+}
+
+func encodeOTLP(serviceName string, spans []*Span) otlpTraces {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			TraceState:        s.sc.TraceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        toOTLPAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMsg},
+		}
+		s.mu.Unlock()
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.String()
+		}
+		encoded = append(encoded, span)
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: toOTLPAttributes(map[string]interface{}{
+			"service.name": serviceName,
+		})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "go-playground/microservice"}, Spans: encoded}},
+	}}}
+}
+
+// FileExporter appends each batch to a file as one line of OTLP JSON, the
+// layout used by the OpenTelemetry Collector file exporter.
+type FileExporter struct {
+	serviceName string
+	file        *os.File
+	mu          sync.Mutex
+}
+
+func NewFileExporter(serviceName, path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{serviceName: serviceName, file: f}, nil
+}
+
+func (e *FileExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	line, err := json.Marshal(encodeOTLP(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
+
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// HTTPExporter posts batches to an OTLP/HTTP endpoint using the JSON
+// encoding.
+type HTTPExporter struct {
+	serviceName string
+	endpoint    string
+	client      *http.Client
+}
+
+func NewHTTPExporter(serviceName, baseURL string) *HTTPExporter {
+	return &HTTPExporter{
+		serviceName: serviceName,
+		endpoint:    strings.TrimSuffix(baseURL, "/") + "/v1/traces",
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (e *HTTPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(encodeOTLP(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *HTTPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// newExporter builds an exporter from the TRACE_EXPORTER setting:
+// "file:<path>" writes to a file, an http(s) URL posts to an OTLP/HTTP
+// collector, and an empty value disables export.
+func newExporter(serviceName, target string) (SpanExporter, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case strings.HasPrefix(target, "file:"):
+		return NewFileExporter(serviceName, strings.TrimPrefix(target, "file:"))
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return NewHTTPExporter(serviceName, target), nil
+	}
+	return nil, fmt.Errorf("unsupported trace exporter: %s", target)
+}
+
+// collectorHandler is a stand-in for an OpenTelemetry Collector. It
+// accepts OTLP/HTTP JSON on /v1/traces and appends every payload as one
+// line to out, so spans from several services end up in one file.
+func collectorHandler(out io.Writer) http.Handler {
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		var payload otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid OTLP JSON", http.StatusBadRequest)
+			return
+		}
+		line, _ := json.Marshal(payload)
+
+		mu.Lock()
+		out.Write(append(line, '\n'))
+		mu.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+	})
+	return mux
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingExporter struct {
+	spans []*Span
+	mu    sync.Mutex
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error { return nil }
+
+func (e *recordingExporter) find(name string, kind SpanKind) *Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.spans {
+		if s.name == name && s.kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("expected valid traceparent")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("unexpected span context: %+v", sc)
+	}
+	if got := formatTraceparent(sc); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("round trip produced %q", got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(invalid); ok {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// useTracer makes tr the service-wide tracer until the test ends, then
+// shuts it down and puts the previous one back.
+func useTracer(t *testing.T, tr *Tracer) {
+	previous := tracer
+	tracer = tr
+	t.Cleanup(func() {
+		tr.Shutdown(context.Background())
+		tracer = previous
+	})
+}
+
+// TestTracePropagatesAcrossServices runs two instances in-process: the
+// front instance does not have the user and asks the back instance, which
+// must join the same trace as a child of the outbound client span.
+func TestTracePropagatesAcrossServices(t *testing.T) {
+	back := newTestService(t)
+	backServer := httptest.NewServer(back)
+	defer backServer.Close()
+
+	if _, err := back.db.CreateUser(context.Background(), &User{Name: "Remote", Email: "remote@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	front := newTestService(t)
+	front.upstream = NewServiceClient(backServer.URL, "front")
+	front.upstream.tokenKey = front.tokenKey
+
+	exporter := &recordingExporter{}
+	useTracer(t, NewTracer("test", exporter))
+
+	token := testToken(t, &Claims{UserID: 1, Roles: []Role{RoleUser}})
+	req := httptest.NewRequest("GET", "/api/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	front.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if err := tracer.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []*Span
+	exporter.mu.Lock()
+	for _, s := range exporter.spans {
+		if s.kind == SpanKindServer {
+			servers = append(servers, s)
+		}
+	}
+	exporter.mu.Unlock()
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 server spans, got %d", len(servers))
+	}
+
+	client := exporter.find("GET /api/users/{id}", SpanKindClient)
+	if client == nil {
+		t.Fatal("missing client span for the upstream call")
+	}
+	for _, s := range servers {
+		if s.sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("server span %q is not part of the inbound trace", s.name)
+		}
+	}
+
+	var backSpan *Span
+	for _, s := range servers {
+		if s.parent == client.sc.SpanID {
+			backSpan = s
+		}
+	}
+	if backSpan == nil {
+		t.Error("back instance server span is not a child of the client span")
+	}
+
+	if db := exporter.find("SELECT users", SpanKindClient); db == nil || db.attributes["db.system"] != "sqlite" {
+		t.Error("expected a database span with db.system=sqlite")
+	}
+}
+
+type failingExporter struct{}
+
+func (failingExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	return errors.New("collector unreachable")
+}
+
+func (failingExporter) Shutdown(ctx context.Context) error { return nil }
+
+func TestExportFailuresAreLogged(t *testing.T) {
+	out := &syncBuffer{}
+	defer func(previous *slog.Logger) { logger = previous }(logger)
+	logger = newLogger(out, "json")
+
+	tr := NewTracer("test", failingExporter{})
+	_, span := tr.Start(context.Background(), "work", SpanKindInternal)
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := out.lines(t)
+	if len(lines) != 1 || lines[0]["msg"] != "trace export failed" || lines[0]["error"] != "collector unreachable" {
+		t.Errorf("expected the export failure to be logged, got %v", lines)
+	}
+}
+
+func TestFileExporterWritesOTLPJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exporter, err := NewFileExporter("user-service", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTracer("user-service", exporter)
+	_, span := tr.Start(context.Background(), "work", SpanKindInternal)
+	span.SetAttribute("attempt", 3)
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("expected one line of output")
+	}
+	var payload otlpTraces
+	if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	got := payload.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.Name != "work" || len(got.TraceID) != 32 || len(got.SpanID) != 16 {
+		t.Errorf("unexpected span: %+v", got)
+	}
+	if !strings.Contains(scanner.Text(), `"intValue":"3"`) {
+		t.Errorf("expected integer attribute encoded as string: %s", scanner.Text())
+	}
+}
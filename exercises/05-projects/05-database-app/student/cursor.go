@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidCursor is returned for a cursor that was tampered with, was
+// signed with another key, or belongs to a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor marks a position in a sorted list: the sort key of the row next
+// to it. Backward cursors page towards the start of the list.
+type cursor struct {
+	Sort     string            `json:"s"`
+	Values   []json.RawMessage `json:"v"`
+	Backward bool              `json:"b,omitempty"`
+}
+
+// CursorCodec turns cursors into opaque tokens signed with HMAC-SHA256,
+// so that clients cannot forge positions or smuggle values into queries.
+type CursorCodec struct {
+	key []byte
+	// random is set for a key of this process only, whose cursors no
+	// other instance, and no later run, accepts.
+	random bool
+	warn   sync.Once
+}
+
+// minCursorKeySize is the shortest key accepted, the size of the MAC.
+const minCursorKeySize = sha256.Size
+
+// NewCursorCodec returns a codec signing with key. Instances serving the
+// same clients must share the key; a nil key picks a random one, and a
+// warning is logged when it signs its first cursor.
+func NewCursorCodec(key []byte) *CursorCodec {
+	if key == nil {
+		key = make([]byte, minCursorKeySize)
+		rand.Read(key)
+		return &CursorCodec{key: key, random: true}
+	}
+	return &CursorCodec{key: key}
+}
+
+func (c *CursorCodec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (c *CursorCodec) encode(cur *cursor) (string, error) {
+	if c.random {
+		c.warn.Do(func() {
+			log.Print("CURSOR_KEY is not set: page links are signed with a random key and break on restart or on another instance")
+		})
+	}
+	payload, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(c.sign(payload)), nil
+}
+
+func (c *CursorCodec) decode(token string) (*cursor, error) {
+	enc := base64.RawURLEncoding
+	data, sig, ok := strings.Cut(token, ".")
+	payload, err1 := enc.DecodeString(data)
+	mac, err2 := enc.DecodeString(sig)
+	if !ok || err1 != nil || err2 != nil || !hmac.Equal(mac, c.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+	var cur cursor
+	if err := json.Unmarshal(payload, &cur); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cur, nil
+}
+
+// CursorOptions selects a page by position instead of by offset.
+type CursorOptions struct {
+	Filters []Filter
+	// Sort is a sort list as in ListOptions. Unless it has one, the ID is
+	// added as the last column, so that rows with equal sort keys keep a
+	// stable order and none is skipped or repeated at a page boundary.
+	Sort  string
+	Limit int
+	// Cursor is a Next or Prev token of an earlier page with the same
+	// Sort; empty means the first page.
+	Cursor string
+}
+
+// CursorPage is one page of a keyset-paginated list. Next and Prev are
+// empty at the ends of the list.
+type CursorPage[T any] struct {
+	Items []*T   `json:"items"`
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+}
+
+// Paginate returns the page after (or, for a Prev token, before) the
+// cursor. Unlike List it reads only the rows it returns, however deep the
+// page, as long as an index covers the sort columns. Sort columns must
+// not be nullable.
+func (r *Repository[T]) Paginate(ctx context.Context, opts CursorOptions) (*CursorPage[T], error) {
+	if opts.Limit <= 0 || opts.Limit > r.config.MaxLimit {
+		opts.Limit = r.config.MaxLimit
+	}
+	terms, err := parseSort(opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(terms, func(t sortTerm) bool { return t.column == "id" }) {
+		// Breaking ties in the direction of the last column lets one index
+		// on (column, id), read forwards or backwards, serve the order.
+		desc := len(terms) > 0 && terms[len(terms)-1].desc
+		terms = append(terms, sortTerm{column: "id", desc: desc})
+	}
+	sort := joinSort(terms)
+
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]mappedField, len(terms))
+	for i, t := range terms {
+		f, ok := plan.byColumn[t.column]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnsortableColumn, t.column)
+		}
+		fields[i] = plan.fields[f]
+	}
+
+	var after *cursor
+	if opts.Cursor != "" {
+		if after, err = r.config.Cursors.decode(opts.Cursor); err != nil {
+			return nil, err
+		}
+		if after.Sort != sort || len(after.Values) != len(terms) {
+			return nil, fmt.Errorf("%w: it belongs to another sort order", ErrInvalidCursor)
+		}
+	}
+	backward := after != nil && after.Backward
+
+	// Going backward, read in reverse order and flip the page afterwards.
+	order := terms
+	if backward {
+		order = make([]sortTerm, len(terms))
+		for i, t := range terms {
+			order[i] = sortTerm{column: t.column, desc: !t.desc}
+		}
+	}
+	qb := r.selectQuery().Sortable(r.config.Sortable...).Sortable("id").
+		OrderBy(joinSort(order)).Limit(opts.Limit + 1)
+	applyFilters(qb, opts.Filters)
+	if after != nil {
+		values, err := decodeCursorValues(plan, fields, after.Values)
+		if err != nil {
+			return nil, err
+		}
+		condition, args := keysetCondition(order, values)
+		qb.Where(condition, args...)
+	}
+
+	rows, err := r.query(ctx, qb)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ScanAll[T](rows)
+	if err != nil {
+		return nil, handleDatabaseError(err)
+	}
+	more := len(items) > opts.Limit
+	if more {
+		items = items[:opts.Limit]
+	}
+	if backward {
+		slices.Reverse(items)
+	}
+
+	page := &CursorPage[T]{Items: items}
+	if len(items) == 0 {
+		return page, nil
+	}
+	if more || backward {
+		if page.Next, err = r.cursorAt(items[len(items)-1], sort, fields, false); err != nil {
+			return nil, err
+		}
+	}
+	if (backward && more) || (!backward && after != nil) {
+		if page.Prev, err = r.cursorAt(items[0], sort, fields, true); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func joinSort(terms []sortTerm) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = t.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// cursorAt returns the token for the position of item.
+func (r *Repository[T]) cursorAt(item *T, sort string, fields []mappedField, backward bool) (string, error) {
+	v := reflect.ValueOf(item).Elem()
+	cur := &cursor{Sort: sort, Backward: backward}
+	for _, f := range fields {
+		raw, err := json.Marshal(v.FieldByIndex(f.index).Interface())
+		if err != nil {
+			return "", err
+		}
+		cur.Values = append(cur.Values, raw)
+	}
+	return r.config.Cursors.encode(cur)
+}
+
+// decodeCursorValues decodes each value into its field's type, so that it
+// is bound with the same representation as the column, e.g. a time.Time
+// rather than its JSON string.
+func decodeCursorValues(plan *typePlan, fields []mappedField, raw []json.RawMessage) ([]any, error) {
+	values := make([]any, len(fields))
+	for i, f := range fields {
+		v := reflect.New(plan.typ.FieldByIndex(f.index).Type)
+		if err := json.Unmarshal(raw[i], v.Interface()); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		values[i] = v.Elem().Interface()
+	}
+	return values, nil
+}
+
+// keysetCondition matches the rows after values in the given order:
+//
+//	a >= ? AND ((a > ?) OR (a = ? AND b < ?) OR (a = ? AND b = ? AND id > ?))
+//
+// for "a ASC, b DESC, id ASC". Spelling it out rather than comparing row
+// values lets each column have its own direction; the redundant bound on
+// the first column lets the database seek in an index on it instead of
+// testing the disjunction on every row.
+func keysetCondition(order []sortTerm, values []any) (string, []any) {
+	var ors []string
+	var args []any
+	var bound string
+	if len(order) > 1 {
+		op := ">="
+		if order[0].desc {
+			op = "<="
+		}
+		bound = mustQuoteIdent(order[0].column) + " " + op + " ? AND "
+		args = append(args, values[0])
+	}
+	for i, t := range order {
+		var ands []string
+		for j := range i {
+			ands = append(ands, mustQuoteIdent(order[j].column)+" = ?")
+			args = append(args, values[j])
+		}
+		op := ">"
+		if t.desc {
+			op = "<"
+		}
+		ands = append(ands, mustQuoteIdent(t.column)+" "+op+" ?")
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	if bound == "" {
+		return strings.Join(ors, " OR "), args
+	}
+	return bound + "(" + strings.Join(ors, " OR ") + ")", args
+}
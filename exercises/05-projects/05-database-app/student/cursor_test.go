@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var seedEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// seedUsers inserts n users directly, bypassing the hooks. Every group of
+// tie users shares a created_at, so sorting by it alone is ambiguous.
+func seedUsers(tb testing.TB, db *Database, n, tie int) {
+	tb.Helper()
+	tx, err := db.db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO users (username, email, password_hash, created_at, updated_at) VALUES (?, ?, 'x', ?, ?)`)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := range n {
+		at := seedEpoch.Add(time.Duration(i/tie) * time.Second)
+		if _, err := stmt.Exec(fmt.Sprintf("user%07d", i), fmt.Sprintf("user%07d@example.com", i), at, at); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func ids(users []*User) []int {
+	var out []int
+	for _, u := range users {
+		out = append(out, u.ID)
+	}
+	return out
+}
+
+func TestPaginateWalksBothWays(t *testing.T) {
+	db := newMigratedDB(t)
+	seedUsers(t, db, 20, 4)
+	ctx := context.Background()
+
+	// The full order: newest first, ties broken by descending ID.
+	var want []int
+	for id := 20; id > 0; id-- {
+		want = append(want, id)
+	}
+
+	var pages [][]int
+	opts := CursorOptions{Sort: "-created_at", Limit: 3}
+	for {
+		page, err := db.GetUsersPage(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, ids(page.Items))
+		if len(pages) == 1 && page.Prev != "" {
+			t.Error("the first page has a prev cursor")
+		}
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = page.Next
+
+		// A user added mid-walk sorts before the cursor and must not
+		// shift the remaining pages.
+		if len(pages) == 2 {
+			db.CreateUser(&User{Username: "latecomer", Email: "late@example.com", PasswordHash: "x"})
+		}
+	}
+	if got := slices.Concat(pages...); !slices.Equal(got, want) {
+		t.Fatalf("forward walk:\n got  %v\n want %v", got, want)
+	}
+
+	// Walk back from the last page with the prev cursors.
+	last, _ := db.GetUsersPage(ctx, opts)
+	opts.Cursor = last.Prev
+	for i := len(pages) - 2; i >= 0; i-- {
+		page, err := db.GetUsersPage(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(page.Items); !slices.Equal(got, pages[i]) {
+			t.Errorf("backward page %d: got %v, want %v", i, got, pages[i])
+		}
+		if page.Next == "" {
+			t.Errorf("backward page %d has no next cursor", i)
+		}
+		opts.Cursor = page.Prev
+	}
+	if opts.Cursor == "" {
+		t.Fatal("expected the page before the first to exist: the latecomer")
+	}
+	page, _ := db.GetUsersPage(ctx, opts)
+	if len(page.Items) != 1 || page.Items[0].Username != "latecomer" || page.Prev != "" {
+		t.Errorf("expected only the latecomer before the first page, got %v", ids(page.Items))
+	}
+}
+
+func TestPaginateRejectsBadCursors(t *testing.T) {
+	db := newMigratedDB(t)
+	seedUsers(t, db, 5, 1)
+	ctx := context.Background()
+
+	page, err := db.GetUsersPage(ctx, CursorOptions{Sort: "username", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving the position while keeping the signature.
+	_, sig, _ := strings.Cut(page.Next, ".")
+	payload, _ := json.Marshal(cursor{Sort: "username ASC, id ASC", Values: []json.RawMessage{[]byte(`"a"`), []byte(`0`)}})
+	forged := base64.RawURLEncoding.EncodeToString(payload) + "." + sig
+	for name, opts := range map[string]CursorOptions{
+		"tampered":   {Sort: "username", Cursor: forged},
+		"garbage":    {Sort: "username", Cursor: "not-a-cursor"},
+		"other sort": {Sort: "-username", Cursor: page.Next},
+		"other key":  {Sort: "username", Cursor: mustEncode(t, NewCursorCodec([]byte("other")), page.Next, db)},
+	} {
+		if _, err := db.GetUsersPage(ctx, opts); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: expected %v, got %v", name, ErrInvalidCursor, err)
+		}
+	}
+
+	if _, err := db.GetUsersPage(ctx, CursorOptions{Sort: "password_hash"}); !errors.Is(err, ErrUnsortableColumn) {
+		t.Errorf("expected %v, got %v", ErrUnsortableColumn, err)
+	}
+}
+
+func TestCursorsSurviveAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	url := "file:" + t.TempDir() + "/shared.db?_foreign_keys=on&_busy_timeout=5000"
+	key := []byte(strings.Repeat("k", minCursorKeySize))
+	open := func(opts ...DatabaseOption) *Database {
+		t.Helper()
+		db, err := NewDatabase(url, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	first := open(WithCursorKey(key))
+	if err := first.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	seedUsers(t, first, 5, 1)
+	page, err := first.GetUsersPage(ctx, CursorOptions{Sort: "username", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance, or the same one restarted, with the same key.
+	second := open(WithCursorKey(key))
+	next, err := second.GetUsersPage(ctx, CursorOptions{Sort: "username", Limit: 2, Cursor: page.Next})
+	if err != nil || !slices.Equal(ids(next.Items), []int{3, 4}) {
+		t.Errorf("expected users 3 and 4 from the shared key, got %v (%v)", ids(next.Items), err)
+	}
+
+	t.Setenv("CURSOR_KEY", string(key))
+	if _, err := open().GetUsersPage(ctx, CursorOptions{Sort: "username", Limit: 2, Cursor: page.Next}); err != nil {
+		t.Errorf("expected CURSOR_KEY to configure the key, got %v", err)
+	}
+	t.Setenv("CURSOR_KEY", "")
+	if _, err := open().GetUsersPage(ctx, CursorOptions{Sort: "username", Limit: 2, Cursor: page.Next}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected a random key to reject the cursor, got %v", err)
+	}
+	if _, err := NewDatabase(url, WithCursorKey([]byte("short"))); err == nil {
+		t.Error("expected a short key to be refused")
+	}
+}
+
+// mustEncode re-signs the payload of token with codec.
+func mustEncode(t *testing.T, codec *CursorCodec, token string, db *Database) string {
+	t.Helper()
+	cur, err := db.cursors.decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := codec.encode(cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestListEndpointLinks(t *testing.T) {
+	db := newMigratedDB(t)
+	seedUsers(t, db, 5, 2)
+	app := NewApp(db)
+
+	get := func(url string) (*httptest.ResponseRecorder, listResponse[User]) {
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		var body listResponse[User]
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec, body
+	}
+
+	rec, first := get("/users?limit=2&sort=-created_at")
+	if rec.Code != http.StatusOK || len(first.Items) != 2 || first.Links.Prev != "" {
+		t.Fatalf("unexpected first page %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(first.Links.Next, "sort=-created_at") || !strings.Contains(first.Links.Next, "limit=2") {
+		t.Errorf("next link should keep the query, got %q", first.Links.Next)
+	}
+	if link := rec.Header().Get("Link"); !strings.Contains(link, `rel="next"`) {
+		t.Errorf("expected a Link header, got %q", link)
+	}
+
+	_, second := get(first.Links.Next)
+	if len(second.Items) != 2 || second.Links.Prev == "" || second.Links.Next == "" {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+	_, back := get(second.Links.Prev)
+	if !slices.Equal(ids(back.Items), ids(first.Items)) {
+		t.Errorf("prev link should lead back to the first page, got %v", ids(back.Items))
+	}
+
+	for _, url := range []string{"/users?cursor=bogus", "/users?sort=password_hash", "/users?sort=id+sideways", "/users?limit=-1"} {
+		if rec, _ := get(url); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", url, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, httptest.NewRequest("GET", "/products", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"items":[]`) {
+		t.Errorf("expected an empty product list, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// BenchmarkUserPaging compares reading a page deep into a million users
+// by OFFSET and by cursor. OFFSET reads and discards every earlier row,
+// so its cost grows with depth; the cursor seeks through the index.
+//
+//	go test -run '^$' -bench UserPaging
+func BenchmarkUserPaging(b *testing.B) {
+	const rows, pageSize = 1_000_000, 50
+
+	db, err := NewDatabase("file:" + b.TempDir() + "/bench.db?_foreign_keys=on&_journal_mode=WAL")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.RunMigrations(); err != nil {
+		b.Fatal(err)
+	}
+	seedUsers(b, db, rows, 10)
+	ctx := context.Background()
+	users := db.Users()
+
+	for _, depth := range []int{1_000, 100_000, 990_000} {
+		offsetPage := func(limit, offset int) []*User {
+			rows, err := users.query(ctx, users.selectQuery().Sortable("created_at", "id").
+				OrderBy("-created_at, -id").Limit(limit).Offset(offset))
+			if err != nil {
+				b.Fatal(err)
+			}
+			items, err := ScanAll[User](rows)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return items
+		}
+
+		// The cursor for the row just before the page, as a client
+		// following next links would hold it.
+		plan, _ := planFor(reflect.TypeFor[User]())
+		fields := []mappedField{plan.fields[plan.byColumn["created_at"]], plan.fields[plan.byColumn["id"]]}
+		cursor, err := users.cursorAt(offsetPage(1, depth-1)[0], "created_at DESC, id DESC", fields, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("offset/depth=%d", depth), func(b *testing.B) {
+			for b.Loop() {
+				offsetPage(pageSize, depth)
+			}
+		})
+		b.Run(fmt.Sprintf("keyset/depth=%d", depth), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := users.Paginate(ctx, CursorOptions{Sort: "-created_at", Limit: pageSize, Cursor: cursor}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
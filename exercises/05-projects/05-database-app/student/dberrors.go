@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrNotFound is returned when the row an operation needs does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ConstraintKind is the kind of integrity constraint a write violated.
+type ConstraintKind string
+
+const (
+	UniqueViolation     ConstraintKind = "unique"
+	ForeignKeyViolation ConstraintKind = "foreign key"
+	NotNullViolation    ConstraintKind = "not null"
+	CheckViolation      ConstraintKind = "check"
+)
+
+// ConstraintError is a write rejected by an integrity constraint. The
+// drivers do not always say which: SQLite names the columns but not the
+// constraint, Postgres the reverse for most kinds.
+type ConstraintError struct {
+	Kind ConstraintKind
+	// Constraint is the constraint's name or, for a SQLite CHECK, its
+	// expression.
+	Constraint string
+	// Column lists the columns involved, comma-separated.
+	Column string
+}
+
+func (e *ConstraintError) Error() string {
+	msg := string(e.Kind) + " constraint violated"
+	if e.Constraint != "" {
+		msg += fmt.Sprintf(" by %q", e.Constraint)
+	}
+	if e.Column != "" {
+		msg += " on " + e.Column
+	}
+	return msg
+}
+
+// Is matches a target ConstraintError of the same kind whose non-empty
+// fields agree, so that errors.Is(err, &ConstraintError{Kind:
+// UniqueViolation, Column: "email"}) asks whether an email was taken.
+func (e *ConstraintError) Is(target error) bool {
+	t, ok := target.(*ConstraintError)
+	return ok && t.Kind == e.Kind &&
+		(t.Constraint == "" || t.Constraint == e.Constraint) &&
+		(t.Column == "" || t.Column == e.Column)
+}
+
+// DatabaseError is an error from the database driver, or sql.ErrNoRows,
+// with what it means to the application. It unwraps to both, so that
+// errors.Is and errors.As find either.
+type DatabaseError struct {
+	// Code is the driver's error code: the SQLSTATE for Postgres, the
+	// extended result code for SQLite. Empty for sql.ErrNoRows.
+	Code string
+	// Reason is ErrNotFound, a *ConstraintError, or nil when the error has
+	// no meaning beyond the driver's.
+	Reason error
+	Err    error
+}
+
+func (e *DatabaseError) Error() string {
+	if e.Reason == nil {
+		return e.Err.Error()
+	}
+	return e.Reason.Error() + ": " + e.Err.Error()
+}
+
+func (e *DatabaseError) Unwrap() []error {
+	if e.Reason == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Reason, e.Err}
+}
+
+// handleDatabaseError classifies err if it came from the database, and
+// returns any other error, such as a hook's, unchanged.
+func handleDatabaseError(err error) error {
+	var dbErr *DatabaseError
+	if err == nil || errors.As(err, &dbErr) {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &DatabaseError{Reason: ErrNotFound, Err: err}
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		dbErr = &DatabaseError{Code: strconv.Itoa(int(sqliteErr.ExtendedCode)), Err: err}
+		if ce := sqliteConstraint(sqliteErr); ce != nil {
+			dbErr.Reason = ce
+		}
+		return dbErr
+	}
+
+	// Both Postgres drivers, lib/pq and pgx, give their errors a SQLState
+	// method; matching it keeps either out of the build.
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		dbErr = &DatabaseError{Code: pgErr.SQLState(), Err: err}
+		if ce := postgresConstraint(pgErr.SQLState(), err.Error()); ce != nil {
+			dbErr.Reason = ce
+		}
+		return dbErr
+	}
+	return err
+}
+
+// sqliteConstraint reads a constraint error from messages such as
+// "UNIQUE constraint failed: users.email".
+func sqliteConstraint(err sqlite3.Error) *ConstraintError {
+	if err.Code != sqlite3.ErrConstraint {
+		return nil
+	}
+	var kind ConstraintKind
+	switch err.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		kind = UniqueViolation
+	case sqlite3.ErrConstraintForeignKey:
+		kind = ForeignKeyViolation
+	case sqlite3.ErrConstraintNotNull:
+		kind = NotNullViolation
+	case sqlite3.ErrConstraintCheck:
+		kind = CheckViolation
+	default:
+		return nil
+	}
+
+	ce := &ConstraintError{Kind: kind}
+	_, detail, _ := strings.Cut(err.Error(), "constraint failed: ")
+	if kind == CheckViolation {
+		ce.Constraint = detail
+		return ce
+	}
+	var columns []string
+	for col := range strings.SplitSeq(detail, ", ") {
+		if _, name, ok := strings.Cut(col, "."); ok {
+			columns = append(columns, name)
+		}
+	}
+	ce.Column = strings.Join(columns, ",")
+	return ce
+}
+
+var (
+	pgConstraintName = regexp.MustCompile(`constraint "([^"]+)"`)
+	pgColumnName     = regexp.MustCompile(`column "([^"]+)"`)
+)
+
+// postgresConstraint reads a constraint error from a SQLSTATE of class 23
+// and the message, which names the constraint or, for NOT NULL, the
+// column.
+func postgresConstraint(state, message string) *ConstraintError {
+	var kind ConstraintKind
+	switch state {
+	case "23505":
+		kind = UniqueViolation
+	case "23503":
+		kind = ForeignKeyViolation
+	case "23502":
+		kind = NotNullViolation
+	case "23514":
+		kind = CheckViolation
+	default:
+		return nil
+	}
+	ce := &ConstraintError{Kind: kind}
+	if m := pgConstraintName.FindStringSubmatch(message); m != nil {
+		ce.Constraint = m[1]
+	}
+	if m := pgColumnName.FindStringSubmatch(message); m != nil {
+		ce.Column = m[1]
+	}
+	return ce
+}
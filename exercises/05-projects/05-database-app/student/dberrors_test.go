@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestHandleDatabaseErrorSQLite(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+	user := newCustomer(t, db)
+
+	err := db.CreateUser(&User{Username: "buyer", Email: "other@example.com", PasswordHash: "h"})
+	var ce *ConstraintError
+	if !errors.As(err, &ce) || ce.Kind != UniqueViolation || ce.Column != "username" {
+		t.Fatalf("expected a unique violation on username, got %v", err)
+	}
+	if !errors.Is(err, &ConstraintError{Kind: UniqueViolation, Column: "username"}) || errors.Is(err, &ConstraintError{Kind: UniqueViolation, Column: "email"}) {
+		t.Error("errors.Is should match on kind and column")
+	}
+	var dbErr *DatabaseError
+	var driverErr sqlite3.Error
+	if !errors.As(err, &dbErr) || dbErr.Code != "2067" || !errors.As(err, &driverErr) {
+		t.Errorf("expected the driver's error wrapped with its code, got %#v", err)
+	}
+
+	tests := map[string]struct {
+		err  error
+		want *ConstraintError
+	}{
+		"foreign key": {
+			db.Orders().Create(ctx, &Order{UserID: 999}),
+			&ConstraintError{Kind: ForeignKeyViolation},
+		},
+		"not null": {
+			handleDatabaseError(exec(db, `INSERT INTO users (username, password_hash) VALUES ('nomail', 'h')`)),
+			&ConstraintError{Kind: NotNullViolation, Column: "email"},
+		},
+		"check": {
+			handleDatabaseError(exec(db, `INSERT INTO products (name, price, stock) VALUES ('Void', 1, -1)`)),
+			&ConstraintError{Kind: CheckViolation, Constraint: "stock >= 0"},
+		},
+		"composite unique": {
+			handleDatabaseError(exec(db, `INSERT INTO users (id, username, email, password_hash) VALUES (?, 'dup', 'dup@example.com', 'h')`, user.ID)),
+			&ConstraintError{Kind: UniqueViolation, Column: "id"},
+		},
+	}
+	for name, tt := range tests {
+		if !errors.As(tt.err, &ce) || *ce != *tt.want {
+			t.Errorf("%s: expected %+v, got %v", name, tt.want, tt.err)
+		}
+	}
+
+	if _, err := db.GetUser(999); !errors.Is(err, ErrNotFound) || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected %v wrapping %v, got %v", ErrNotFound, sql.ErrNoRows, err)
+	}
+	if err := db.DeleteUser(999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	// Errors that did not come from the database pass through untouched.
+	validation := &ValidationError{Field: "name", Reason: "is required"}
+	if got := handleDatabaseError(validation); got != validation {
+		t.Errorf("expected the validation error unchanged, got %v", got)
+	}
+}
+
+func exec(db *Database, query string, args ...any) error {
+	_, err := db.db.Exec(query, args...)
+	return err
+}
+
+// pgError mimics the errors of lib/pq and pgx, which carry a SQLSTATE.
+type pgError struct{ state, message string }
+
+func (e *pgError) Error() string    { return "ERROR: " + e.message + " (SQLSTATE " + e.state + ")" }
+func (e *pgError) SQLState() string { return e.state }
+
+func TestHandleDatabaseErrorPostgres(t *testing.T) {
+	tests := []struct {
+		err  *pgError
+		want ConstraintError
+	}{
+		{
+			&pgError{"23505", `duplicate key value violates unique constraint "users_email_key"`},
+			ConstraintError{Kind: UniqueViolation, Constraint: "users_email_key"},
+		},
+		{
+			&pgError{"23503", `insert or update on table "orders" violates foreign key constraint "orders_user_id_fkey"`},
+			ConstraintError{Kind: ForeignKeyViolation, Constraint: "orders_user_id_fkey"},
+		},
+		{
+			&pgError{"23502", `null value in column "email" of relation "users" violates not-null constraint`},
+			ConstraintError{Kind: NotNullViolation, Column: "email"},
+		},
+		{
+			&pgError{"23514", `new row for relation "products" violates check constraint "products_stock_check"`},
+			ConstraintError{Kind: CheckViolation, Constraint: "products_stock_check"},
+		},
+	}
+	for _, tt := range tests {
+		err := handleDatabaseError(tt.err)
+		var ce *ConstraintError
+		if !errors.As(err, &ce) || *ce != tt.want {
+			t.Errorf("%s: expected %+v, got %v", tt.err.state, tt.want, err)
+		}
+		var dbErr *DatabaseError
+		if !errors.As(err, &dbErr) || dbErr.Code != tt.err.state || !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected the original error wrapped with its code, got %#v", tt.err.state, err)
+		}
+	}
+
+	err := handleDatabaseError(&pgError{"40001", "could not serialize access"})
+	var ce *ConstraintError
+	var dbErr *DatabaseError
+	if errors.As(err, &ce) || !errors.As(err, &dbErr) || dbErr.Reason != nil {
+		t.Errorf("expected an unclassified database error, got %#v", err)
+	}
+
+	// The registered driver's own error type is classified the same way.
+	err = handleDatabaseError(&pq.Error{Code: "23505", Message: `duplicate key value violates unique constraint "users_email_key"`})
+	if !errors.As(err, &ce) || ce.Kind != UniqueViolation || ce.Constraint != "users_email_key" {
+		t.Errorf("expected a unique violation from a lib/pq error, got %v", err)
+	}
+}
+
+func TestUserHandlersMapErrors(t *testing.T) {
+	iterations := passwordIterations
+	passwordIterations = 1000
+	t.Cleanup(func() { passwordIterations = iterations })
+
+	db := newMigratedDB(t)
+	app := NewApp(db)
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do("POST", "/users", `{"username":"ann","email":"ann@example.com","password":"correct horse"}`)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/users/1" {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	ann, _ := db.GetUser(1)
+	if !strings.HasPrefix(ann.PasswordHash, "pbkdf2-sha256$1000$") || strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("expected the password stored hashed and never echoed, got %q and %s", ann.PasswordHash, rec.Body)
+	}
+	// A rename without a password keeps the old one.
+	if rec := do("PUT", "/users/1", `{"username":"annie","email":"ann@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+	if annie, _ := db.GetUser(1); annie.Username != "annie" || annie.PasswordHash != ann.PasswordHash {
+		t.Errorf("unexpected user after the rename: %+v", annie)
+	}
+	do("POST", "/users", `{"username":"bob","email":"bob@example.com","password":"correct horse"}`)
+	if err := db.Orders().Create(context.Background(), &Order{UserID: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, url, body string
+		want              int
+	}{
+		{"POST", "/users", `{"username":"annie","email":"ann2@example.com","password":"correct horse"}`, http.StatusConflict},
+		{"POST", "/users", `{"username":"cat","email":"not an email","password":"correct horse"}`, http.StatusUnprocessableEntity},
+		{"POST", "/users", `{"username":"cat","email":"cat@example.com","password":"short"}`, http.StatusUnprocessableEntity},
+		{"POST", "/users", `{"username":"cat","admin":true}`, http.StatusBadRequest},
+		{"GET", "/users/1", "", http.StatusOK},
+		{"GET", "/users/999", "", http.StatusNotFound},
+		{"GET", "/users/abc", "", http.StatusBadRequest},
+		{"PUT", "/users/1", `{"username":"bob","email":"ann@example.com"}`, http.StatusConflict},
+		{"PUT", "/users/999", `{"username":"nobody","email":"no@example.com"}`, http.StatusNotFound},
+		{"DELETE", "/users/2", "", http.StatusConflict}, // bob has an order
+		{"DELETE", "/users/1", "", http.StatusNoContent},
+		{"DELETE", "/users/1", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.url, tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s %s: expected %d, got %d %s", tt.method, tt.url, tt.body, tt.want, rec.Code, rec.Body)
+		}
+	}
+
+	// Failures of no known class do not leak details.
+	db.Close()
+	rec = do("GET", "/users/2", "")
+	if rec.Code != http.StatusInternalServerError || bytes.Contains(rec.Body.Bytes(), []byte("sql")) {
+		t.Errorf("expected an opaque 500, got %d %s", rec.Code, rec.Body)
+	}
+}
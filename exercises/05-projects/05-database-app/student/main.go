@@ -1,194 +1,363 @@
 package main
 
 import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // Task 1: Define data models
 type User struct {
-	// TODO: Add fields: ID (int), Username (string), Email (string), PasswordHash (string)
-	// Add CreatedAt (time.Time), UpdatedAt (time.Time)
-	// Add JSON and database tags for proper serialization
+	ID           int       `json:"id" db:"id"`
+	Username     string    `json:"username" db:"username"`
+	Email        string    `json:"email" db:"email"`
+	PasswordHash string    `json:"-" db:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type Product struct {
-	// TODO: Add fields: ID (int), Name (string), Description (string), Price (float64)
-	// Add Stock (int), Active (bool), CreatedAt (time.Time), UpdatedAt (time.Time)
-	// Add JSON and database tags
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	Price       Money     `json:"price" db:"price"`
+	Stock       int       `json:"stock" db:"stock"`
+	Active      bool      `json:"active" db:"active"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type Order struct {
-	// TODO: Add fields: ID (int), UserID (int), TotalAmount (float64), Status (string)
-	// Add CreatedAt (time.Time), UpdatedAt (time.Time)
-	// Add JSON and database tags
+	ID          int         `json:"id" db:"id"`
+	UserID      int         `json:"user_id" db:"user_id"`
+	TotalAmount Money       `json:"total_amount" db:"total_amount"`
+	Status      OrderStatus `json:"status" db:"status"`
+	CreatedAt   time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at" db:"updated_at"`
 }
 
 type OrderItem struct {
-	// TODO: Add fields: ID (int), OrderID (int), ProductID (int), Quantity (int)
-	// Add Price (float64), JSON and database tags
+	ID        int   `json:"id" db:"id"`
+	OrderID   int   `json:"order_id" db:"order_id"`
+	ProductID int   `json:"product_id" db:"product_id"`
+	Quantity  int   `json:"quantity" db:"quantity"`
+	Price     Money `json:"price" db:"price"`
 }
 
 // Task 2: Create database connection structure
 type Database struct {
-	// TODO: Add database connection field
-	// Include *sql.DB for database connection
+	db      *sql.DB
+	dialect Dialect
+	cursors *CursorCodec
+}
+
+// defaultDatabaseURL is used when DATABASE_URL is not set. Transactions
+// take SQLite's write lock as they begin, so one that reads before writing
+// waits for other writers rather than failing with "database is locked".
+const defaultDatabaseURL = "file:app.db?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate"
+
+// DatabaseOption configures NewDatabase.
+type DatabaseOption func(*Database) error
+
+// WithCursorKey sets the key that signs pagination cursors, which every
+// instance serving the same clients must share. Without it the key comes
+// from CURSOR_KEY, and without that it is random.
+func WithCursorKey(key []byte) DatabaseOption {
+	return func(db *Database) error {
+		if len(key) < minCursorKeySize {
+			return fmt.Errorf("the cursor key must be at least %d bytes", minCursorKeySize)
+		}
+		db.cursors = NewCursorCodec(key)
+		return nil
+	}
 }
 
 // Task 3: Create NewDatabase function
-func NewDatabase(databaseURL string) (*Database, error) {
-	// TODO: Initialize database connection
-	// Set up connection pooling parameters
-	// Test the connection
-	// Return database instance
-	return nil, nil
+func NewDatabase(databaseURL string, opts ...DatabaseOption) (*Database, error) {
+	if key := os.Getenv("CURSOR_KEY"); key != "" {
+		opts = append([]DatabaseOption{WithCursorKey([]byte(key))}, opts...)
+	}
+	d := &Database{cursors: NewCursorCodec(nil)}
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			return nil, err
+		}
+	}
+
+	driver, dialect := dialectFor(databaseURL)
+	db, err := sql.Open(driver, databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// An in-memory SQLite database lives and dies with its connection, so
+	// the pool must never open a second one.
+	if strings.Contains(databaseURL, ":memory:") {
+		db.SetMaxOpenConns(1)
+	} else {
+		db.SetMaxOpenConns(25)
+		db.SetMaxIdleConns(5)
+		db.SetConnMaxLifetime(5 * time.Minute)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	d.db, d.dialect = db, dialect
+	return d, nil
 }
 
-// Task 4: Implement database migrations
-type Migration struct {
-	// TODO: Add migration fields
-	// Include ID (int), Name (string), AppliedAt (time.Time)
+func (db *Database) Close() error {
+	return db.db.Close()
 }
 
-func (db *Database) RunMigrations() error {
-	// TODO: Create migrations table if it doesn't exist
-	// Define and run initial migrations
-	// Track applied migrations
-	return nil
+func (db *Database) Dialect() Dialect {
+	return db.dialect
 }
 
-func (db *Database) createMigrationsTable() error {
-	// TODO: Create migrations table
-	// SQL: CREATE TABLE IF NOT EXISTS migrations (id SERIAL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)
-	return nil
+func (db *Database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.db.ExecContext(ctx, query, args...)
 }
 
-func (db *Database) isMigrationApplied(name string) bool {
-	// TODO: Check if migration is already applied
-	// Query migrations table for the given name
-	return false
+func (db *Database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.db.QueryContext(ctx, query, args...)
 }
 
-func (db *Database) applyMigration(name, sql string) error {
-	// TODO: Apply migration in a transaction
-	// Execute migration SQL
-	// Record migration in migrations table
-	return nil
+func (db *Database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.db.QueryRowContext(ctx, query, args...)
 }
 
-// Task 5: Implement CRUD operations for User
-func (db *Database) CreateUser(user *User) error {
-	// TODO: Insert user into database
-	// Use prepared statement for security
-	// Set timestamps
-	// Return generated ID
-	return nil
+// Tx is a transaction that remembers its database's dialect, so that it
+// can be passed wherever a Querier is expected.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
 }
 
-func (db *Database) GetUser(id int) (*User, error) {
-	// TODO: Query user by ID
-	// Use prepared statement
-	// Handle sql.ErrNoRows
-	// Return user struct
-	return nil, nil
+func (db *Database) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.dialect}, nil
 }
 
-func (db *Database) GetUsers(limit, offset int) ([]*User, error) {
-	// TODO: Query multiple users with pagination
-	// Use LIMIT and OFFSET
-	// Return slice of users
-	return nil, nil
+func (tx *Tx) Dialect() Dialect {
+	return tx.dialect
 }
 
-func (db *Database) UpdateUser(user *User) error {
-	// TODO: Update user in database
-	// Use prepared statement
-	// Update timestamp
-	// Handle not found errors
+// Task 4: Implement database migrations
+//
+// Migrations live in migrations.go; RunMigrations applies every pending one.
+func (db *Database) RunMigrations() error {
+	m, err := NewMigrator(db, embeddedMigrations())
+	if err != nil {
+		return err
+	}
+	return m.Up(context.Background())
+}
+
+// Model configuration: each model's repository, filterable columns and
+// hooks. The repositories do the rest.
+func (db *Database) Users() *Repository[User] {
+	return NewRepository[User](db, RepositoryConfig{
+		Table:    "users",
+		Sortable: []string{"username", "email", "created_at"},
+		Cursors:  db.cursors,
+	})
+}
+
+func (db *Database) Products() *Repository[Product] {
+	return NewRepository[Product](db, RepositoryConfig{
+		Table:    "products",
+		Sortable: []string{"name", "price", "stock", "created_at"},
+		Cursors:  db.cursors,
+	})
+}
+
+func (db *Database) Orders() *Repository[Order] {
+	return NewRepository[Order](db, RepositoryConfig{
+		Table:    "orders",
+		Sortable: []string{"user_id", "total_amount", "status", "created_at"},
+		Cursors:  db.cursors,
+	})
+}
+
+func (db *Database) OrderItems() *Repository[OrderItem] {
+	return NewRepository[OrderItem](db, RepositoryConfig{
+		Table:    "order_items",
+		Sortable: []string{"order_id", "product_id"},
+		Cursors:  db.cursors,
+	})
+}
+
+var UserFields = struct {
+	ID        Column[int]
+	Username  Column[string]
+	Email     Column[string]
+	CreatedAt Column[time.Time]
+}{Col[int]("id"), Col[string]("username"), Col[string]("email"), Col[time.Time]("created_at")}
+
+var ProductFields = struct {
+	ID     Column[int]
+	Name   Column[string]
+	Price  Column[Money]
+	Stock  Column[int]
+	Active Column[bool]
+}{Col[int]("id"), Col[string]("name"), Col[Money]("price"), Col[int]("stock"), Col[bool]("active")}
+
+var OrderFields = struct {
+	ID     Column[int]
+	UserID Column[int]
+	Status Column[OrderStatus]
+}{Col[int]("id"), Col[int]("user_id"), Col[OrderStatus]("status")}
+
+var OrderItemFields = struct {
+	OrderID   Column[int]
+	ProductID Column[int]
+}{Col[int]("order_id"), Col[int]("product_id")}
+
+func (u *User) BeforeCreate(ctx context.Context) error {
+	u.CreatedAt = time.Now().UTC()
+	u.UpdatedAt = u.CreatedAt
+	return validateUser(u)
+}
+
+func (u *User) BeforeUpdate(ctx context.Context) error {
+	u.UpdatedAt = time.Now().UTC()
+	return validateUser(u)
+}
+
+func (p *Product) BeforeCreate(ctx context.Context) error {
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	return validateProduct(p)
+}
+
+func (p *Product) BeforeUpdate(ctx context.Context) error {
+	p.UpdatedAt = time.Now().UTC()
+	return validateProduct(p)
+}
+
+func (o *Order) BeforeCreate(ctx context.Context) error {
+	o.CreatedAt = time.Now().UTC()
+	o.UpdatedAt = o.CreatedAt
+	if o.Status == "" {
+		o.Status = OrderPending
+	}
+	if o.Status != OrderPending {
+		return &ValidationError{Field: "status", Reason: "must be pending for a new order"}
+	}
 	return nil
 }
 
-func (db *Database) DeleteUser(id int) error {
-	// TODO: Delete user from database
-	// Use prepared statement
-	// Handle not found errors
+// BeforeUpdate only checks that the status exists; moving an order along
+// the workflow is TransitionOrder's job.
+func (o *Order) BeforeUpdate(ctx context.Context) error {
+	o.UpdatedAt = time.Now().UTC()
+	if !o.Status.Valid() {
+		return &ValidationError{Field: "status", Reason: "is not an order status"}
+	}
 	return nil
 }
 
-// Task 6: Implement CRUD operations for Product
-func (db *Database) CreateProduct(product *Product) error {
-	// TODO: Insert product into database
-	// Set timestamps
-	// Return generated ID
+func (i *OrderItem) BeforeCreate(ctx context.Context) error {
+	if i.Quantity <= 0 {
+		return &ValidationError{Field: "quantity", Reason: "must be positive"}
+	}
 	return nil
 }
 
-func (db *Database) GetProduct(id int) (*Product, error) {
-	// TODO: Query product by ID
-	// Handle not found errors
-	return nil, nil
+// Task 5: Implement CRUD operations for User
+func (db *Database) CreateUser(user *User) error {
+	return db.Users().Create(context.Background(), user)
 }
 
-func (db *Database) GetProducts(limit, offset int) ([]*Product, error) {
-	// TODO: Query multiple products with pagination
-	// Add filtering by active status
-	return nil, nil
+func (db *Database) GetUser(id int) (*User, error) {
+	return db.Users().Get(context.Background(), id)
 }
 
-func (db *Database) UpdateProduct(product *Product) error {
-	// TODO: Update product in database
-	// Update timestamp
-	return nil
+// GetUsers pages through users by offset. Deep pages get slower, and rows
+// shift between pages when users are added; GetUsersPage avoids both.
+func (db *Database) GetUsers(limit, offset int) ([]*User, error) {
+	page, err := db.Users().List(context.Background(), ListOptions{Limit: limit, Offset: offset})
+	if err != nil {
+		return nil, err
+	}
+	return page.Items, nil
 }
 
-func (db *Database) DeleteProduct(id int) error {
-	// TODO: Delete product from database
-	return nil
+// GetUsersPage pages through users by cursor; see Repository.Paginate.
+func (db *Database) GetUsersPage(ctx context.Context, opts CursorOptions) (*CursorPage[User], error) {
+	return db.Users().Paginate(ctx, opts)
 }
 
-// Task 7: Implement query builder
-type QueryBuilder struct {
-	// TODO: Add query builder fields
-	// Include table name, select columns, where conditions, args, order by, limit, offset
+func (db *Database) UpdateUser(user *User) error {
+	return db.Users().Update(context.Background(), user)
 }
 
-func NewQueryBuilder(table string) *QueryBuilder {
-	// TODO: Initialize query builder
-	return nil
+func (db *Database) DeleteUser(id int) error {
+	return db.Users().Delete(context.Background(), id)
 }
 
-func (qb *QueryBuilder) Select(cols ...string) *QueryBuilder {
-	// TODO: Set select columns
-	return qb
+// Task 6: Implement CRUD operations for Product
+func (db *Database) CreateProduct(product *Product) error {
+	return db.Products().Create(context.Background(), product)
 }
 
-func (qb *QueryBuilder) Where(condition string, args ...interface{}) *QueryBuilder {
-	// TODO: Add where condition
-	return qb
+func (db *Database) GetProduct(id int) (*Product, error) {
+	return db.Products().Get(context.Background(), id)
 }
 
-func (qb *QueryBuilder) OrderBy(orderBy string) *QueryBuilder {
-	// TODO: Set order by clause
-	return qb
+// GetProducts pages through the active products.
+func (db *Database) GetProducts(limit, offset int) ([]*Product, error) {
+	page, err := db.Products().List(context.Background(), ListOptions{
+		Filters: []Filter{ProductFields.Active.Eq(true)},
+		Limit:   limit,
+		Offset:  offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Items, nil
 }
 
-func (qb *QueryBuilder) Limit(limit int) *QueryBuilder {
-	// TODO: Set limit
-	return qb
+// GetProductsPage pages through the active products by cursor.
+func (db *Database) GetProductsPage(ctx context.Context, opts CursorOptions) (*CursorPage[Product], error) {
+	opts.Filters = append(opts.Filters, ProductFields.Active.Eq(true))
+	return db.Products().Paginate(ctx, opts)
 }
 
-func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
-	// TODO: Set offset
-	return qb
+func (db *Database) UpdateProduct(product *Product) error {
+	return db.Products().Update(context.Background(), product)
 }
 
-func (qb *QueryBuilder) Build() (string, []interface{}) {
-	// TODO: Build final SQL query
-	// Combine all parts (SELECT, FROM, WHERE, ORDER BY, LIMIT, OFFSET)
-	return "", nil
+func (db *Database) DeleteProduct(id int) error {
+	return db.Products().Delete(context.Background(), id)
 }
 
+// Task 7: Implement query builder
+//
+// QueryBuilder and the INSERT, UPDATE and DELETE builders live in
+// querybuilder.go.
+
 // Task 8: Implement prepared statements
 type PreparedStatements struct {
 	// TODO: Add prepared statements map
@@ -208,24 +377,8 @@ func (db *Database) getPreparedStatement(name string) *sql.Stmt {
 }
 
 // Task 9: Implement transactions
-func (db *Database) CreateOrderWithItems(order *Order, items []OrderItem) error {
-	// TODO: Implement transaction for creating order with items
-	// Begin transaction
-	// Insert order
-	// Insert order items
-	// Commit transaction
-	// Handle rollback on error
-	return nil
-}
-
-func (db *Database) UpdateProductStock(productID, quantity int) error {
-	// TODO: Update product stock in transaction
-	// Begin transaction
-	// Check current stock
-	// Update stock
-	// Commit transaction
-	return nil
-}
+//
+// The order workflow and stock reservation live in orders.go.
 
 // Task 10: Implement connection pooling monitoring
 type ConnectionPool struct {
@@ -250,88 +403,318 @@ func (cp *ConnectionPool) MonitorPool() {
 }
 
 // Task 11: Implement error handling
-type DatabaseError struct {
-	// TODO: Add error fields
-	// Include error code, message, original error
-}
+//
+// DatabaseError and handleDatabaseError live in dberrors.go. Repositories
+// classify every error they return; handlers map the classes to statuses
+// in writeErr.
 
-func (e *DatabaseError) Error() string {
-	// TODO: Return formatted error message
-	return ""
+// Task 12: Implement data validation
+type ValidationError struct {
+	Field  string
+	Reason string
 }
 
-func handleDatabaseError(err error) error {
-	// TODO: Handle specific database errors
-	// Check for unique constraint violations
-	// Check for foreign key violations
-	// Check for not null violations
-	// Return appropriate error types
-	return err
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Reason
 }
 
-// Task 12: Implement data validation
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
 func validateUser(user *User) error {
-	// TODO: Validate user data
-	// Check required fields
-	// Validate email format
-	// Validate username length
+	switch {
+	case len(user.Username) < 3 || len(user.Username) > 50:
+		return &ValidationError{Field: "username", Reason: "must be 3 to 50 characters"}
+	case !emailPattern.MatchString(user.Email):
+		return &ValidationError{Field: "email", Reason: "must be a valid email address"}
+	case user.PasswordHash == "":
+		return &ValidationError{Field: "password_hash", Reason: "is required"}
+	}
 	return nil
 }
 
 func validateProduct(product *Product) error {
-	// TODO: Validate product data
-	// Check required fields
-	// Validate price range
-	// Validate stock quantity
+	switch {
+	case strings.TrimSpace(product.Name) == "":
+		return &ValidationError{Field: "name", Reason: "is required"}
+	case product.Price.IsNegative():
+		return &ValidationError{Field: "price", Reason: "must not be negative"}
+	case product.Stock < 0:
+		return &ValidationError{Field: "stock", Reason: "must not be negative"}
+	}
 	return nil
 }
 
+// passwordIterations is the PBKDF2 work factor, as recommended by OWASP
+// for HMAC-SHA256.
+var passwordIterations = 600_000
+
+// hashPassword derives a salted PBKDF2-SHA256 hash of password, encoded as
+// "pbkdf2-sha256$iterations$salt$key".
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", &ValidationError{Field: "password", Reason: "must be at least 8 characters"}
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
 // Task 13: Implement HTTP handlers
 type App struct {
-	// TODO: Add app fields
-	// Include database connection
+	db  *Database
+	mux *http.ServeMux
 }
 
+// defaultPageSize is the page size of list endpoints without a limit.
+const defaultPageSize = 20
+
 func NewApp(db *Database) *App {
-	// TODO: Initialize app with database
+	app := &App{db: db, mux: http.NewServeMux()}
+	app.mux.HandleFunc("GET /users", app.handleGetUsers)
+	app.mux.HandleFunc("POST /users", app.handleCreateUser)
+	app.mux.HandleFunc("GET /users/{id}", app.handleGetUser)
+	app.mux.HandleFunc("PUT /users/{id}", app.handleUpdateUser)
+	app.mux.HandleFunc("DELETE /users/{id}", app.handleDeleteUser)
+	app.mux.HandleFunc("GET /products", app.handleGetProducts)
+	return app
+}
+
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeErr answers with the status the class of err calls for. Errors of
+// no known class are logged and hidden behind a 500.
+func writeErr(w http.ResponseWriter, err error) {
+	var validation *ValidationError
+	var constraint *ConstraintError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.As(err, &validation), errors.Is(err, ErrEmptyOrder):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.As(err, &constraint):
+		status := http.StatusConflict
+		if constraint.Kind == NotNullViolation || constraint.Kind == CheckViolation {
+			status = http.StatusUnprocessableEntity
+		}
+		writeError(w, status, constraint.Error())
+	case errors.Is(err, ErrInsufficientStock), errors.Is(err, ErrProductUnavailable), errors.Is(err, ErrInvalidTransition):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidSort), errors.Is(err, ErrUnsortableColumn):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("internal error: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// maxBodySize caps request bodies.
+const maxBodySize = 1 << 20
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
 	return nil
 }
 
-func (app *App) handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle user creation
-	// Decode JSON request
-	// Validate user data
-	// Create user in database
-	// Return created user
+// pathID reads the {id} path parameter.
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid id %q", r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// listResponse is a page of a list endpoint. The links repeat the request
+// with the page's cursors, so clients never build cursors themselves.
+type listResponse[T any] struct {
+	Items []*T      `json:"items"`
+	Links pageLinks `json:"links"`
+}
+
+type pageLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// parsePageRequest reads the limit, sort and cursor query parameters.
+func parsePageRequest(r *http.Request) (CursorOptions, error) {
+	q := r.URL.Query()
+	opts := CursorOptions{Sort: q.Get("sort"), Cursor: q.Get("cursor"), Limit: defaultPageSize}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return opts, fmt.Errorf("limit must be a positive integer")
+		}
+		opts.Limit = limit
+	}
+	return opts, nil
+}
+
+// writePage writes a page with next and prev links, which are also sent
+// in a Link header.
+func writePage[T any](w http.ResponseWriter, r *http.Request, page *CursorPage[T], err error) {
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	resp := listResponse[T]{Items: page.Items}
+	if resp.Items == nil {
+		resp.Items = []*T{}
+	}
+	var links []string
+	if page.Next != "" {
+		resp.Links.Next = pageURL(r, page.Next)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, resp.Links.Next))
+	}
+	if page.Prev != "" {
+		resp.Links.Prev = pageURL(r, page.Prev)
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, resp.Links.Prev))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pageURL is the request's URL with its cursor replaced.
+func pageURL(r *http.Request, cursor string) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// userRequest is the body of POST and PUT /users. The password is only
+// ever stored hashed.
+type userRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
 }
 
-func (app *App) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle user retrieval
-	// Extract user ID from URL
-	// Get user from database
-	// Return user as JSON
+func (app *App) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	user := &User{Username: req.Username, Email: req.Email, PasswordHash: hash}
+	if err := app.db.Users().Create(r.Context(), user); err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/users/%d", user.ID))
+	writeJSON(w, http.StatusCreated, user)
 }
 
+func (app *App) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, err := app.db.Users().Get(r.Context(), id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// handleGetUsers lists users a page at a time, e.g.
+// GET /users?sort=-created_at&limit=50, following links.next for more.
 func (app *App) handleGetUsers(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle users list
-	// Parse query parameters (limit, offset)
-	// Get users from database
-	// Return users as JSON
-}
-
+	opts, err := parsePageRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := app.db.GetUsersPage(r.Context(), opts)
+	writePage(w, r, page, err)
+}
+
+func (app *App) handleGetProducts(w http.ResponseWriter, r *http.Request) {
+	opts, err := parsePageRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := app.db.GetProductsPage(r.Context(), opts)
+	writePage(w, r, page, err)
+}
+
+// handleUpdateUser replaces a user's username and email, and changes the
+// password if the body has one.
 func (app *App) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle user update
-	// Extract user ID from URL
-	// Decode JSON request
-	// Update user in database
-	// Return updated user
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req userRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	users := app.db.Users()
+	user, err := users.Get(r.Context(), id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	user.Username, user.Email = req.Username, req.Email
+	if req.Password != "" {
+		if user.PasswordHash, err = hashPassword(req.Password); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+	if err := users.Update(r.Context(), user); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
 }
 
 func (app *App) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle user deletion
-	// Extract user ID from URL
-	// Delete user from database
-	// Return appropriate status
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := app.db.Users().Delete(r.Context(), id); err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Task 14: Implement health check
@@ -343,6 +726,18 @@ func (app *App) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 
 // Task 15: Implement main function
 func main() {
+	subcommands := map[string]func([]string) error{
+		"migrate": runMigrate,
+		"export":  runExport,
+		"import":  runImport,
+	}
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		if err := subcommands[os.Args[1]](os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// TODO: Load configuration
 	// Initialize database connection
 	// Run migrations
@@ -359,20 +754,8 @@ func (app *App) Shutdown() error {
 }
 
 // Task 17: Implement search functionality
-func (db *Database) SearchUsers(query string, limit, offset int) ([]*User, error) {
-	// TODO: Implement user search
-	// Use LIKE operator for partial matches
-	// Search in username and email
-	// Return matching users
-	return nil, nil
-}
-
-func (db *Database) SearchProducts(query string, limit, offset int) ([]*Product, error) {
-	// TODO: Implement product search
-	// Search in name and description
-	// Filter by active status
-	return nil, nil
-}
+//
+// SearchUsers and SearchProducts live in search.go.
 
 // Task 18: Implement bulk operations
 func (db *Database) BulkCreateUsers(users []*User) error {
@@ -389,28 +772,14 @@ func (db *Database) BulkUpdateProducts(products []*Product) error {
 }
 
 // Task 19: Implement data export
-func (db *Database) ExportUsersToJSON() ([]byte, error) {
-	// TODO: Export all users to JSON
-	// Query all users
-	// Marshal to JSON
-	return nil, nil
-}
-
-func (db *Database) ExportProductsToCSV() ([]byte, error) {
-	// TODO: Export products to CSV
-	// Query all products
-	// Format as CSV
-	return nil, nil
-}
+//
+// ExportUsers and ExportProducts in transfer.go stream CSV, JSON Lines or
+// JSON as rows are read.
 
 // Task 20: Implement data import
-func (db *Database) ImportUsersFromJSON(data []byte) error {
-	// TODO: Import users from JSON
-	// Unmarshal JSON data
-	// Validate each user
-	// Insert users in transaction
-	return nil
-}
+//
+// ImportUsers and ImportProducts in transfer.go read rows as they go and
+// write them in batched transactions; see ImportOptions.
 
 // Task 21: Implement soft delete
 func (db *Database) SoftDeleteUser(id int) error {
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ErrUnmappedColumn is returned when a query returns a column that no
+// field of the destination type is tagged with.
+var ErrUnmappedColumn = errors.New("column has no matching field")
+
+// Querier runs statements: a *Database, or a *Tx begun on one. The
+// mapping helpers take one so that they work inside transactions.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	Dialect() Dialect
+}
+
+// mappedField is a struct field tagged db:"column". Fields of embedded
+// structs are reached through their index path.
+type mappedField struct {
+	column string
+	index  []int
+	// part is the column's position among those of a multiColumn field,
+	// or -1 for a field stored in one column.
+	part int
+}
+
+// multiColumn is implemented by pointers to values stored in more than
+// one column, such as Money's amount and currency. The field's tag names
+// the first column, and the others are named by adding a suffix to it.
+type multiColumn interface {
+	// columns returns the suffix of each column, the first empty, and
+	// what binds and scans each one.
+	columns() (suffixes []string, parts []any)
+}
+
+// dest returns where the field's column is scanned into in v.
+func (f mappedField) dest(v reflect.Value) any {
+	ptr := v.FieldByIndex(f.index).Addr().Interface()
+	if f.part < 0 {
+		return ptr
+	}
+	_, parts := ptr.(multiColumn).columns()
+	return parts[f.part]
+}
+
+// value returns what the field's column is bound to in v.
+func (f mappedField) value(v reflect.Value) any {
+	if f.part < 0 {
+		return v.FieldByIndex(f.index).Interface()
+	}
+	return f.dest(v)
+}
+
+// typePlan is how a struct type maps to columns, worked out once per type.
+type typePlan struct {
+	typ      reflect.Type
+	fields   []mappedField
+	byColumn map[string]int
+	// pk is the index in fields of the primary key: the field tagged
+	// db:"...,pk", or else the one tagged db:"id". -1 if there is none.
+	pk int
+}
+
+var typePlans sync.Map // reflect.Type -> *typePlan
+
+func planFor(t reflect.Type) (*typePlan, error) {
+	if plan, ok := typePlans.Load(t); ok {
+		return plan.(*typePlan), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot map rows to %s: not a struct", t)
+	}
+
+	plan := &typePlan{typ: t, byColumn: make(map[string]int), pk: -1}
+	explicitPK := false
+	var walk func(t reflect.Type, index []int) error
+	walk = func(t reflect.Type, index []int) error {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			path := append(append([]int(nil), index...), i)
+			tag, tagged := f.Tag.Lookup("db")
+			if !tagged && f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if err := walk(f.Type, path); err != nil {
+					return err
+				}
+				continue
+			}
+			if !tagged || tag == "-" || !f.IsExported() {
+				continue
+			}
+
+			column, options, _ := strings.Cut(tag, ",")
+			if mc, ok := reflect.New(f.Type).Interface().(multiColumn); ok {
+				suffixes, _ := mc.columns()
+				for part, suffix := range suffixes {
+					if err := plan.add(mappedField{column: column + suffix, index: path, part: part}); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			switch {
+			case options == "pk":
+				plan.pk, explicitPK = len(plan.fields), true
+			case column == "id" && !explicitPK:
+				plan.pk = len(plan.fields)
+			}
+			if err := plan.add(mappedField{column: column, index: path, part: -1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(t, nil); err != nil {
+		return nil, err
+	}
+
+	actual, _ := typePlans.LoadOrStore(t, plan)
+	return actual.(*typePlan), nil
+}
+
+func (p *typePlan) add(f mappedField) error {
+	if _, dup := p.byColumn[f.column]; dup {
+		return fmt.Errorf("%s: column %q is mapped twice", p.typ, f.column)
+	}
+	p.byColumn[f.column] = len(p.fields)
+	p.fields = append(p.fields, f)
+	return nil
+}
+
+// destinations returns, for each result column, the index of the field
+// it is scanned into.
+func (p *typePlan) destinations(columns []string) ([]int, error) {
+	fields := make([]int, len(columns))
+	for i, col := range columns {
+		f, ok := p.byColumn[col]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q in %s", ErrUnmappedColumn, col, p.typ)
+		}
+		fields[i] = f
+	}
+	return fields, nil
+}
+
+func (p *typePlan) scan(rows *sql.Rows, fields []int, v reflect.Value) error {
+	dest := make([]any, len(fields))
+	for i, f := range fields {
+		dest[i] = p.fields[f].dest(v)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return fmt.Errorf("scanning %s: %w", p.typ, err)
+	}
+	return nil
+}
+
+// ScanAll reads every row into a new T, matching columns to the fields'
+// db tags, and closes rows. Nullable columns need a pointer or sql.Null*
+// field; scanning NULL into anything else fails.
+func ScanAll[T any](rows *sql.Rows) ([]*T, error) {
+	defer rows.Close()
+	plan, fields, err := prepareScan[T](rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*T
+	for rows.Next() {
+		v := new(T)
+		if err := plan.scan(rows, fields, reflect.ValueOf(v).Elem()); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// ScanEach reads the rows like ScanAll, but one at a time, passing each to
+// fn as it is read; it stops at fn's first error. It closes rows.
+func ScanEach[T any](rows *sql.Rows, fn func(*T) error) error {
+	defer rows.Close()
+	plan, fields, err := prepareScan[T](rows)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		v := new(T)
+		if err := plan.scan(rows, fields, reflect.ValueOf(v).Elem()); err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ScanOne reads the first row like ScanAll, returning sql.ErrNoRows when
+// there is none, and closes rows.
+func ScanOne[T any](rows *sql.Rows) (*T, error) {
+	defer rows.Close()
+	plan, fields, err := prepareScan[T](rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	v := new(T)
+	if err := plan.scan(rows, fields, reflect.ValueOf(v).Elem()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func prepareScan[T any](rows *sql.Rows) (*typePlan, []int, error) {
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := plan.destinations(columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, fields, nil
+}
+
+// Columns returns the column names T maps, in field order, for use in
+// Select.
+func Columns[T any]() []string {
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		panic(err)
+	}
+	cols := make([]string, len(plan.fields))
+	for i, f := range plan.fields {
+		cols[i] = f.column
+	}
+	return cols
+}
+
+// Insert writes v as a new row of table. A zero primary key is left for
+// the database to generate and read back into v.
+func Insert[T any](ctx context.Context, q Querier, table string, v *T) error {
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return err
+	}
+	value := reflect.ValueOf(v).Elem()
+
+	var cols []string
+	var vals []any
+	var generated reflect.Value
+	for i, f := range plan.fields {
+		field := value.FieldByIndex(f.index)
+		if i == plan.pk && field.IsZero() {
+			generated = field
+			continue
+		}
+		cols = append(cols, f.column)
+		vals = append(vals, f.value(value))
+	}
+
+	ib := NewInsert(table).Dialect(q.Dialect()).Columns(cols...).Values(vals...)
+	if generated.IsValid() {
+		ib.Returning(plan.fields[plan.pk].column)
+	}
+	query, args, err := ib.Build()
+	if err != nil {
+		return err
+	}
+	if generated.IsValid() {
+		return q.QueryRowContext(ctx, query, args...).Scan(generated.Addr().Interface())
+	}
+	_, err = q.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Update writes every mapped field of v to the row of table with v's
+// primary key, returning sql.ErrNoRows if there is no such row.
+func Update[T any](ctx context.Context, q Querier, table string, v *T) error {
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return err
+	}
+	if plan.pk < 0 {
+		return fmt.Errorf("cannot update %s: it has no primary key field", plan.typ)
+	}
+	value := reflect.ValueOf(v).Elem()
+
+	ub := NewUpdate(table).Dialect(q.Dialect())
+	for i, f := range plan.fields {
+		if i != plan.pk {
+			ub.Set(f.column, f.value(value))
+		}
+	}
+	pk := plan.fields[plan.pk]
+	quoted, err := quoteIdent(pk.column)
+	if err != nil {
+		return err
+	}
+	query, args, err := ub.Where(quoted+" = ?", value.FieldByIndex(pk.index).Interface()).Build()
+	if err != nil {
+		return err
+	}
+
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// newMigratedDB opens an empty database with every migration applied.
+func newMigratedDB(t *testing.T) *Database {
+	t.Helper()
+	db := newTestDB(t)
+	if err := db.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUserCRUDThroughMapper(t *testing.T) {
+	db := newMigratedDB(t)
+
+	user := &User{Username: "ann", Email: "ann@example.com", PasswordHash: "hash"}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 {
+		t.Fatal("the generated ID was not read back")
+	}
+
+	got, err := db.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "ann" || got.PasswordHash != "hash" || !got.CreatedAt.Equal(user.CreatedAt) {
+		t.Errorf("unexpected user %+v", got)
+	}
+
+	got.Email = "ann@example.org"
+	if err := db.UpdateUser(got); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := db.GetUser(user.ID); again.Email != "ann@example.org" {
+		t.Errorf("update not stored, got %+v", again)
+	}
+	if err := db.UpdateUser(&User{ID: 99, Username: "xavier", Email: "x@example.com", PasswordHash: "x"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows updating a missing user, got %v", err)
+	}
+
+	db.CreateUser(&User{Username: "bob", Email: "bob@example.com", PasswordHash: "hash"})
+	users, err := db.GetUsers(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "bob" {
+		t.Errorf("expected [bob], got %v", users)
+	}
+
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUser(user.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestGetProductsSkipsInactive(t *testing.T) {
+	db := newMigratedDB(t)
+	for _, p := range []*Product{
+		{Name: "Widget", Price: usd("2.50"), Stock: 3, Active: true},
+		{Name: "Retired", Price: usd("1"), Active: false},
+	} {
+		if err := db.CreateProduct(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	products, err := db.GetProducts(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].Name != "Widget" || !products[0].Active || products[0].Price != usd("2.50") {
+		t.Errorf("unexpected products %+v", products)
+	}
+}
+
+type audit struct {
+	CreatedBy string `db:"created_by"`
+}
+
+type note struct {
+	Key      string         `db:"key,pk"`
+	Body     *string        `db:"body"`
+	Author   sql.NullString `db:"author"`
+	Internal string         `db:"-"`
+	audit
+}
+
+func TestScanNullsAndEmbeddedFields(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if _, err := db.db.Exec(`CREATE TABLE notes (key TEXT PRIMARY KEY, body TEXT, author TEXT, created_by TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "hello"
+	if err := Insert(ctx, db, "notes", &note{Key: "a", Body: &body, audit: audit{"ann"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Insert(ctx, db, "notes", &note{Key: "b", Author: sql.NullString{String: "bo", Valid: true}, audit: audit{"bo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT key, body, author, created_by FROM notes ORDER BY key`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, err := ScanAll[note](rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("expected 2 notes, got %d", len(notes))
+	}
+	if notes[0].Body == nil || *notes[0].Body != "hello" || notes[0].Author.Valid || notes[0].CreatedBy != "ann" {
+		t.Errorf("unexpected first note %+v", notes[0])
+	}
+	if notes[1].Body != nil || notes[1].Author.String != "bo" {
+		t.Errorf("unexpected second note %+v", notes[1])
+	}
+
+	// An explicit pk tag is used by Update.
+	notes[1].Body = &body
+	if err := Update(ctx, db, "notes", notes[1]); err != nil {
+		t.Fatal(err)
+	}
+	rows, _ = db.QueryContext(ctx, `SELECT key, body FROM notes WHERE key = 'b'`)
+	if n, err := ScanOne[note](rows); err != nil || n.Body == nil {
+		t.Errorf("update not stored: %+v, %v", n, err)
+	}
+
+	// A NULL in a plain field is reported instead of silently zeroed.
+	type strict struct {
+		Body string `db:"body"`
+	}
+	rows, _ = db.QueryContext(ctx, `SELECT NULL AS body`)
+	if _, err := ScanOne[strict](rows); err == nil {
+		t.Error("expected an error scanning NULL into a string field")
+	}
+}
+
+func TestScanRejectsUnmappedColumns(t *testing.T) {
+	db := newMigratedDB(t)
+	db.CreateUser(&User{Username: "ann", Email: "ann@example.com", PasswordHash: "x"})
+
+	rows, err := db.QueryContext(context.Background(), `SELECT id, username, 1 AS extra FROM users`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScanAll[User](rows); !errors.Is(err, ErrUnmappedColumn) {
+		t.Errorf("expected %v, got %v", ErrUnmappedColumn, err)
+	}
+
+	rows, _ = db.QueryContext(context.Background(), `SELECT id FROM users WHERE id = 42`)
+	if _, err := ScanOne[User](rows); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestTypePlansAreCached(t *testing.T) {
+	first, err := planFor(reflect.TypeFor[User]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := planFor(reflect.TypeFor[User]())
+	if first != second {
+		t.Error("expected the plan to be built once")
+	}
+	if got := Columns[User](); !reflect.DeepEqual(got, []string{"id", "username", "email", "password_hash", "created_at", "updated_at"}) {
+		t.Errorf("unexpected columns %v", got)
+	}
+	// Money is stored as an amount and a currency.
+	if got := Columns[OrderItem](); !reflect.DeepEqual(got, []string{"id", "order_id", "product_id", "quantity", "price", "price_currency"}) {
+		t.Errorf("unexpected columns %v", got)
+	}
+
+	type twice struct {
+		A int `db:"a"`
+		B int `db:"a"`
+	}
+	if _, err := planFor(reflect.TypeFor[twice]()); err == nil {
+		t.Error("expected an error for a column mapped twice")
+	}
+}
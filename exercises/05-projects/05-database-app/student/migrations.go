@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// embeddedMigrations returns the migrations compiled into the binary.
+func embeddedMigrations() fs.FS {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+var (
+	ErrMigrationLocked = errors.New("migrations are locked by another process")
+	// ErrChecksumMismatch means a migration file changed after it was
+	// applied. Edit the schema with a new migration instead.
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+	// ErrUnknownMigration means the database has a migration applied that
+	// this build does not know about, usually because it is older than
+	// the build that migrated the database.
+	ErrUnknownMigration = errors.New("applied migration is not known to this build")
+	ErrIrreversible     = errors.New("migration has no down section")
+)
+
+// Section markers in a migration file. Everything after the up marker
+// until the down marker runs on the way up; the rest runs on the way down.
+// A requires line before the up marker names a database feature the
+// migration needs.
+const (
+	upMarker       = "-- +migrate Up"
+	downMarker     = "-- +migrate Down"
+	requiresMarker = "-- +migrate Requires "
+)
+
+// featureProbes test for the features a migration may require. A probe
+// runs in a transaction that is rolled back, and the feature is there if
+// it succeeds.
+var featureProbes = map[string]string{
+	"fts5": `CREATE VIRTUAL TABLE temp.migrate_probe USING fts5(x)`,
+}
+
+// Migration is one numbered schema change, loaded from a file named like
+// 0001_create_users.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Requires lists the features the migration needs. Without them it
+	// is skipped, and stays pending until a database has them.
+	Requires []string
+	// Checksum is the SHA-256 of the whole file, recorded when the
+	// migration is applied so that later edits can be detected.
+	Checksum string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// loadMigrations reads every .sql file at the root of fsys, ordered by
+// version.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, name := range names {
+		number, label, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 || label == "" {
+			return nil, fmt.Errorf("migration %s: file name must look like 0001_description.sql", name)
+		}
+		if other, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		seen[version] = name
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		mig, err := parseMigration(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", name, err)
+		}
+		sum := sha256.Sum256(data)
+		mig.Version, mig.Name, mig.Checksum = version, label, hex.EncodeToString(sum[:])
+		migrations = append(migrations, mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// parseMigration splits a migration file into its up and down sections
+// and reads its requirements. Only comments and blank lines may come
+// before the up marker.
+func parseMigration(text string) (Migration, error) {
+	var mig Migration
+	var sections [2]strings.Builder
+	current := -1
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		trimmed := strings.TrimSpace(scanner.Text())
+		switch {
+		case trimmed == upMarker:
+			if current != -1 {
+				return mig, fmt.Errorf("line %d: unexpected %q", line, upMarker)
+			}
+			current = 0
+		case trimmed == downMarker:
+			if current != 0 {
+				return mig, fmt.Errorf("line %d: %q must follow %q", line, downMarker, upMarker)
+			}
+			current = 1
+		case current == -1 && strings.HasPrefix(trimmed, requiresMarker):
+			for _, feature := range strings.Fields(strings.TrimPrefix(trimmed, requiresMarker)) {
+				if _, ok := featureProbes[feature]; !ok {
+					return mig, fmt.Errorf("line %d: unknown feature %q", line, feature)
+				}
+				mig.Requires = append(mig.Requires, feature)
+			}
+		case current == -1:
+			if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				return mig, fmt.Errorf("line %d: SQL before %q", line, upMarker)
+			}
+		default:
+			sections[current].WriteString(scanner.Text())
+			sections[current].WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return mig, err
+	}
+
+	mig.Up, mig.Down = strings.TrimSpace(sections[0].String()), strings.TrimSpace(sections[1].String())
+	if mig.Up == "" {
+		return mig, fmt.Errorf("no %q section", upMarker)
+	}
+	return mig, nil
+}
+
+// MigrationStatus reports where one migration stands in the database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Missing lists the required features the database lacks, for a
+	// pending migration that would be skipped.
+	Missing []string
+	// Modified is set when the file changed after it was applied.
+	Modified bool
+	// Unknown is set for a migration recorded in the database that is
+	// not part of this build; only Version and Name are filled in.
+	Unknown bool
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// migrationStep is one migration run in one direction.
+type migrationStep struct {
+	migration Migration
+	up        bool
+}
+
+// Migrator applies and rolls back migrations. Applied versions and their
+// checksums are recorded in schema_migrations, and every change happens
+// while holding the single row of schema_migrations_lock, so two
+// processes migrating the same database at once cannot interleave.
+type Migrator struct {
+	db         *Database
+	migrations []Migration
+	owner      string
+
+	// DryRun writes the SQL that would run to Out instead of running it.
+	DryRun bool
+	// Out receives progress messages and, in a dry run, the SQL.
+	Out io.Writer
+	// LockTimeout is how long to wait for another process to finish.
+	LockTimeout time.Duration
+	// StaleLock is the age past which a lock is assumed to belong to a
+	// process that died without releasing it.
+	StaleLock time.Duration
+}
+
+func NewMigrator(db *Database, fsys fs.FS) (*Migrator, error) {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:          db,
+		migrations:  migrations,
+		owner:       lockOwner(),
+		Out:         io.Discard,
+		LockTimeout: 30 * time.Second,
+		StaleLock:   15 * time.Minute,
+	}, nil
+}
+
+// lockOwner identifies this process in the lock table.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Up applies every pending migration in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.run(ctx, func(applied map[int]appliedMigration) ([]migrationStep, error) {
+		var steps []migrationStep
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok {
+				steps = append(steps, migrationStep{mig, true})
+			}
+		}
+		return steps, nil
+	})
+}
+
+// Down rolls back the n most recently applied migrations.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.run(ctx, func(applied map[int]appliedMigration) ([]migrationStep, error) {
+		var steps []migrationStep
+		for i := len(m.migrations) - 1; i >= 0 && len(steps) < n; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				steps = append(steps, migrationStep{m.migrations[i], false})
+			}
+		}
+		return steps, nil
+	})
+}
+
+// To migrates up or down until exactly the migrations up to version are
+// applied. Version 0 rolls everything back.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("no migration with version %d", version)
+	}
+	return m.run(ctx, func(applied map[int]appliedMigration) ([]migrationStep, error) {
+		var down, up []migrationStep
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				down = append(down, migrationStep{mig, false})
+			}
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				up = append(up, migrationStep{mig, true})
+			}
+		}
+		return append(down, up...), nil
+	})
+}
+
+// Redo rolls back the most recently applied migration and applies it
+// again, which is handy while writing it.
+func (m *Migrator) Redo(ctx context.Context) error {
+	return m.run(ctx, func(applied map[int]appliedMigration) ([]migrationStep, error) {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				return []migrationStep{{m.migrations[i], false}, {m.migrations[i], true}}, nil
+			}
+		}
+		return nil, errors.New("no migration has been applied")
+	})
+}
+
+// Status lists every migration, plus any applied migration this build
+// does not know, in version order. Unlike the other operations it does
+// not fail on modified or unknown migrations; it reports them.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTables(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, mig := range m.migrations {
+		s := MigrationStatus{Migration: mig}
+		if a, ok := applied[mig.Version]; ok {
+			s.Applied, s.AppliedAt = true, a.appliedAt
+			s.Modified = a.checksum != mig.Checksum
+			delete(applied, mig.Version)
+		} else if s.Missing, err = m.missing(ctx, mig); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	for _, a := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Migration: Migration{Version: a.version, Name: a.name},
+			Applied:   true,
+			AppliedAt: a.appliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// run takes the lock, checks the applied migrations against the files and
+// runs the steps plan returns. A dry run takes no lock and changes
+// nothing but the bookkeeping tables' existence.
+func (m *Migrator) run(ctx context.Context, plan func(map[int]appliedMigration) ([]migrationStep, error)) error {
+	if err := m.ensureTables(ctx); err != nil {
+		return err
+	}
+	if !m.DryRun {
+		if err := m.lock(ctx); err != nil {
+			return err
+		}
+		defer m.unlock(context.WithoutCancel(ctx))
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.verify(applied); err != nil {
+		return err
+	}
+	steps, err := plan(applied)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if !step.up && step.migration.Down == "" {
+			return fmt.Errorf("%w: %s", ErrIrreversible, step.migration)
+		}
+	}
+
+	for _, step := range steps {
+		if step.up {
+			missing, err := m.missing(ctx, step.migration)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				fmt.Fprintf(m.Out, "skipping %s: the database lacks %s\n", step.migration, strings.Join(missing, ", "))
+				continue
+			}
+		}
+		if err := m.execute(ctx, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missing returns the features mig requires that the database lacks.
+func (m *Migrator) missing(ctx context.Context, mig Migration) ([]string, error) {
+	var missing []string
+	for _, feature := range mig.Requires {
+		ok, err := m.probe(ctx, feature)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, feature)
+		}
+	}
+	return missing, nil
+}
+
+func (m *Migrator) probe(ctx context.Context, feature string) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, featureProbes[feature])
+	return err == nil, nil
+}
+
+// verify refuses to go on if an applied migration was edited or is
+// missing from this build.
+func (m *Migrator) verify(applied map[int]appliedMigration) error {
+	files := make(map[int]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		files[mig.Version] = mig
+	}
+
+	var errs []error
+	for _, a := range applied {
+		mig, ok := files[a.version]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%w: %04d_%s", ErrUnknownMigration, a.version, a.name))
+		case mig.Checksum != a.checksum:
+			errs = append(errs, fmt.Errorf("%w: %s", ErrChecksumMismatch, mig))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// execute runs one step and records it in the same transaction, so a
+// failed migration leaves neither schema changes nor a record behind.
+func (m *Migrator) execute(ctx context.Context, step migrationStep) error {
+	mig, query, direction := step.migration, step.migration.Up, "up"
+	if !step.up {
+		query, direction = mig.Down, "down"
+	}
+	if m.DryRun {
+		fmt.Fprintf(m.Out, "-- %s (%s)\n%s\n\n", mig, direction, query)
+		return nil
+	}
+	fmt.Fprintf(m.Out, "migrating %s %s\n", direction, mig)
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("migration %s (%s): %w", mig, direction, err)
+	}
+	if step.up {
+		_, err = tx.ExecContext(ctx,
+			m.db.dialect.Rebind(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`),
+			mig.Version, mig.Name, mig.Checksum, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, m.db.dialect.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("recording migration %s: %w", mig, err)
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) ensureTables(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			owner TEXT NOT NULL,
+			acquired_at TIMESTAMP NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("error creating migration tables: %v", err)
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.version] = a
+	}
+	return applied, rows.Err()
+}
+
+// lock claims the lock row, waiting up to LockTimeout for another holder
+// to release it. The primary key makes the insert succeed for exactly one
+// process.
+func (m *Migrator) lock(ctx context.Context) error {
+	deadline := time.Now().Add(m.LockTimeout)
+	for {
+		_, insertErr := m.db.ExecContext(ctx,
+			m.db.dialect.Rebind(`INSERT INTO schema_migrations_lock (id, owner, acquired_at) VALUES (1, ?, ?)`),
+			m.owner, time.Now().UTC())
+		if insertErr == nil {
+			return nil
+		}
+
+		var holder string
+		var acquiredAt time.Time
+		err := m.db.QueryRowContext(ctx,
+			`SELECT owner, acquired_at FROM schema_migrations_lock WHERE id = 1`).Scan(&holder, &acquiredAt)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Released since the insert, or the insert failed for another
+			// reason; the deadline below stops the latter looping forever.
+		case err != nil:
+			return err
+		case time.Since(acquiredAt) > m.StaleLock:
+			fmt.Fprintf(m.Out, "breaking stale migration lock held by %s since %s\n", holder, acquiredAt.Format(time.RFC3339))
+			if _, err := m.db.ExecContext(ctx,
+				m.db.dialect.Rebind(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`), holder); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			if holder == "" {
+				return fmt.Errorf("error taking migration lock: %v", insertErr)
+			}
+			return fmt.Errorf("%w: held by %s since %s", ErrMigrationLocked, holder, acquiredAt.Format(time.RFC3339))
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *Migrator) unlock(ctx context.Context) {
+	if _, err := m.db.ExecContext(ctx, m.db.dialect.Rebind(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`), m.owner); err != nil {
+		fmt.Fprintf(m.Out, "error releasing migration lock: %v\n", err)
+	}
+}
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate [-db URL] [-dry-run] up | down [N] | to N | status | redo
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	databaseURL := databaseFlag(flags)
+	dryRun := flags.Bool("dry-run", false, "print the SQL that would run without running it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: migrate [flags] up | down [N] | to N | status | redo")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing migrate command")
+	}
+
+	db, err := NewDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, embeddedMigrations())
+	if err != nil {
+		return err
+	}
+	m.DryRun, m.Out = *dryRun, os.Stdout
+
+	ctx := context.Background()
+	command, rest := flags.Arg(0), flags.Args()[1:]
+	number := func(def int) (int, error) {
+		if len(rest) == 0 && def >= 0 {
+			return def, nil
+		}
+		if len(rest) != 1 {
+			return 0, fmt.Errorf("migrate %s takes one number", command)
+		}
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("migrate %s: invalid number %q", command, rest[0])
+		}
+		return n, nil
+	}
+
+	switch command {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		n, err := number(1)
+		if err != nil {
+			return err
+		}
+		return m.Down(ctx, n)
+	case "to":
+		version, err := number(-1)
+		if err != nil {
+			return err
+		}
+		return m.To(ctx, version)
+	case "redo":
+		return m.Redo(ctx)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printMigrationStatus(os.Stdout, statuses)
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown migrate command %q", command)
+}
+
+// databaseFlag adds the -db flag of the subcommands, which defaults to
+// DATABASE_URL when that is set.
+func databaseFlag(flags *flag.FlagSet) *string {
+	databaseURL := flags.String("db", defaultDatabaseURL, "database URL (default from DATABASE_URL)")
+	if url := os.Getenv("DATABASE_URL"); url != "" {
+		flags.Set("db", url)
+	}
+	return databaseURL
+}
+
+func printMigrationStatus(w io.Writer, statuses []MigrationStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+	for _, s := range statuses {
+		state, appliedAt := "pending", ""
+		switch {
+		case s.Unknown:
+			state = "unknown"
+		case s.Modified:
+			state = "modified"
+		case s.Applied:
+			state = "applied"
+		case len(s.Missing) > 0:
+			state = "pending (needs " + strings.Join(s.Missing, ", ") + ")"
+		}
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+	}
+	return tw.Flush()
+}
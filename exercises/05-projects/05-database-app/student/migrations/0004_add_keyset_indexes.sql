@@ -0,0 +1,12 @@
+-- Keyset pagination reads pages in (sort column, id) order; these indexes
+-- let it seek straight to a cursor instead of scanning.
+
+-- +migrate Up
+CREATE INDEX idx_users_created_at_id ON users (created_at, id);
+CREATE INDEX idx_products_created_at_id ON products (created_at, id);
+CREATE INDEX idx_products_price_id ON products (price, id);
+
+-- +migrate Down
+DROP INDEX idx_products_price_id;
+DROP INDEX idx_products_created_at_id;
+DROP INDEX idx_users_created_at_id;
@@ -0,0 +1,39 @@
+-- Amounts become integer minor units of the store currency, so that sums
+-- are exact. SQLite cannot change a column's type, so each column is
+-- replaced by a converted copy.
+
+-- +migrate Up
+DROP INDEX idx_products_price_id;
+ALTER TABLE products ADD COLUMN price_minor INTEGER NOT NULL DEFAULT 0 CHECK (price_minor >= 0);
+UPDATE products SET price_minor = CAST(ROUND(price * 100) AS INTEGER);
+ALTER TABLE products DROP COLUMN price;
+ALTER TABLE products RENAME COLUMN price_minor TO price;
+CREATE INDEX idx_products_price_id ON products (price, id);
+
+ALTER TABLE orders ADD COLUMN total_minor INTEGER NOT NULL DEFAULT 0;
+UPDATE orders SET total_minor = CAST(ROUND(total_amount * 100) AS INTEGER);
+ALTER TABLE orders DROP COLUMN total_amount;
+ALTER TABLE orders RENAME COLUMN total_minor TO total_amount;
+
+ALTER TABLE order_items ADD COLUMN price_minor INTEGER NOT NULL DEFAULT 0 CHECK (price_minor >= 0);
+UPDATE order_items SET price_minor = CAST(ROUND(price * 100) AS INTEGER);
+ALTER TABLE order_items DROP COLUMN price;
+ALTER TABLE order_items RENAME COLUMN price_minor TO price;
+
+-- +migrate Down
+ALTER TABLE order_items ADD COLUMN price_major REAL NOT NULL DEFAULT 0 CHECK (price_major >= 0);
+UPDATE order_items SET price_major = price / 100.0;
+ALTER TABLE order_items DROP COLUMN price;
+ALTER TABLE order_items RENAME COLUMN price_major TO price;
+
+ALTER TABLE orders ADD COLUMN total_major REAL NOT NULL DEFAULT 0;
+UPDATE orders SET total_major = total_amount / 100.0;
+ALTER TABLE orders DROP COLUMN total_amount;
+ALTER TABLE orders RENAME COLUMN total_major TO total_amount;
+
+DROP INDEX idx_products_price_id;
+ALTER TABLE products ADD COLUMN price_major REAL NOT NULL DEFAULT 0 CHECK (price_major >= 0);
+UPDATE products SET price_major = price / 100.0;
+ALTER TABLE products DROP COLUMN price;
+ALTER TABLE products RENAME COLUMN price_major TO price;
+CREATE INDEX idx_products_price_id ON products (price, id);
@@ -0,0 +1,56 @@
+-- Full-text indexes for search: external-content FTS5 tables that store
+-- only the index and read the text from their source tables, kept in step
+-- by triggers. Without FTS5 this migration stays pending and search falls
+-- back to LIKE.
+-- +migrate Requires fts5
+
+-- +migrate Up
+CREATE VIRTUAL TABLE products_fts USING fts5(
+    name, description,
+    content = 'products', content_rowid = 'id',
+    tokenize = 'porter unicode61 remove_diacritics 2'
+);
+INSERT INTO products_fts (products_fts) VALUES ('rebuild');
+-- A name match counts ten times a description match.
+INSERT INTO products_fts (products_fts, rank) VALUES ('rank', 'bm25(10.0, 1.0)');
+
+CREATE TRIGGER products_fts_insert AFTER INSERT ON products BEGIN
+    INSERT INTO products_fts (rowid, name, description) VALUES (new.id, new.name, new.description);
+END;
+CREATE TRIGGER products_fts_delete AFTER DELETE ON products BEGIN
+    INSERT INTO products_fts (products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+END;
+CREATE TRIGGER products_fts_update AFTER UPDATE OF name, description ON products BEGIN
+    INSERT INTO products_fts (products_fts, rowid, name, description) VALUES ('delete', old.id, old.name, old.description);
+    INSERT INTO products_fts (rowid, name, description) VALUES (new.id, new.name, new.description);
+END;
+
+CREATE VIRTUAL TABLE users_fts USING fts5(
+    username, email,
+    content = 'users', content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+INSERT INTO users_fts (users_fts) VALUES ('rebuild');
+INSERT INTO users_fts (users_fts, rank) VALUES ('rank', 'bm25(2.0, 1.0)');
+
+CREATE TRIGGER users_fts_insert AFTER INSERT ON users BEGIN
+    INSERT INTO users_fts (rowid, username, email) VALUES (new.id, new.username, new.email);
+END;
+CREATE TRIGGER users_fts_delete AFTER DELETE ON users BEGIN
+    INSERT INTO users_fts (users_fts, rowid, username, email) VALUES ('delete', old.id, old.username, old.email);
+END;
+CREATE TRIGGER users_fts_update AFTER UPDATE OF username, email ON users BEGIN
+    INSERT INTO users_fts (users_fts, rowid, username, email) VALUES ('delete', old.id, old.username, old.email);
+    INSERT INTO users_fts (rowid, username, email) VALUES (new.id, new.username, new.email);
+END;
+
+-- +migrate Down
+DROP TRIGGER users_fts_update;
+DROP TRIGGER users_fts_delete;
+DROP TRIGGER users_fts_insert;
+DROP TABLE users_fts;
+
+DROP TRIGGER products_fts_update;
+DROP TRIGGER products_fts_delete;
+DROP TRIGGER products_fts_insert;
+DROP TABLE products_fts;
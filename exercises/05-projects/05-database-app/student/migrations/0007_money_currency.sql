@@ -0,0 +1,18 @@
+-- Amounts get a currency column beside them, named after the amount with
+-- a _currency suffix. Every amount so far was in dollars. An empty
+-- currency is only valid for a zero amount.
+
+-- +migrate Up
+ALTER TABLE products ADD COLUMN price_currency TEXT NOT NULL DEFAULT '';
+UPDATE products SET price_currency = 'USD' WHERE price <> 0;
+
+ALTER TABLE orders ADD COLUMN total_amount_currency TEXT NOT NULL DEFAULT '';
+UPDATE orders SET total_amount_currency = 'USD' WHERE total_amount <> 0;
+
+ALTER TABLE order_items ADD COLUMN price_currency TEXT NOT NULL DEFAULT '';
+UPDATE order_items SET price_currency = 'USD' WHERE price <> 0;
+
+-- +migrate Down
+ALTER TABLE order_items DROP COLUMN price_currency;
+ALTER TABLE orders DROP COLUMN total_amount_currency;
+ALTER TABLE products DROP COLUMN price_currency;
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestDB opens an empty database in a temporary file.
+func newTestDB(t *testing.T) *Database {
+	t.Helper()
+	db, err := NewDatabase("file:" + filepath.Join(t.TempDir(), "test.db") + "?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *Database, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n == 1
+}
+
+func appliedVersions(t *testing.T, m *Migrator) []int {
+	t.Helper()
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int
+	for _, s := range statuses {
+		if s.Applied {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigrateUpDownToRedo(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	m, err := NewMigrator(db, embeddedMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"users", "products", "orders", "order_items"} {
+		if !tableExists(t, db, table) {
+			t.Errorf("table %s missing after up", table)
+		}
+	}
+	// Everything is applied but what needs a feature this build lacks.
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.Applied && len(s.Missing) == 0 {
+			t.Errorf("%s is pending after up", s.Migration)
+		}
+	}
+	all := len(appliedVersions(t, m))
+
+	if err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, m); len(got) != all-1 {
+		t.Errorf("down should roll back only the last migration, got %v", got)
+	}
+
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "orders") || !tableExists(t, db, "products") {
+		t.Error("migrating to 2 should leave products but not orders")
+	}
+	if err := m.To(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, m); len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected only version 1 applied, got %v", got)
+	}
+	if err := m.To(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.To(ctx, 999); err == nil {
+		t.Error("expected an error migrating to an unknown version")
+	}
+
+	if err := m.Redo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, m); len(got) != 3 || !tableExists(t, db, "order_items") {
+		t.Errorf("redo should leave versions 1 to 3 applied, got %v", got)
+	}
+
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "users") {
+		t.Error("migrating to 0 should roll everything back")
+	}
+}
+
+func TestMigrateDetectsEditedMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	files := fstest.MapFS{
+		"0001_things.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE things (id INTEGER);\n-- +migrate Down\nDROP TABLE things;\n")},
+	}
+	m, err := NewMigrator(db, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	files["0001_things.sql"].Data = []byte("-- +migrate Up\nCREATE TABLE things (id INTEGER, name TEXT);\n-- +migrate Down\nDROP TABLE things;\n")
+	files["0002_more.sql"] = &fstest.MapFile{Data: []byte("-- +migrate Up\nCREATE TABLE more (id INTEGER);\n")}
+	edited, err := NewMigrator(db, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := edited.Up(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected %v, got %v", ErrChecksumMismatch, err)
+	}
+	if tableExists(t, db, "more") {
+		t.Error("no migration should run once an edit is detected")
+	}
+
+	statuses, err := edited.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Modified || statuses[1].Applied {
+		t.Errorf("unexpected status %+v", statuses)
+	}
+
+	// A build that lacks an applied migration must not touch the schema.
+	older, err := NewMigrator(db, fstest.MapFS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := older.Down(ctx, 1); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("expected %v, got %v", ErrUnknownMigration, err)
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	first, _ := NewMigrator(db, embeddedMigrations())
+	second, _ := NewMigrator(db, embeddedMigrations())
+	second.LockTimeout = 200 * time.Millisecond
+
+	if err := first.ensureTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Up(ctx); !errors.Is(err, ErrMigrationLocked) {
+		t.Fatalf("expected %v, got %v", ErrMigrationLocked, err)
+	}
+	if tableExists(t, db, "users") {
+		t.Error("migrations ran without the lock")
+	}
+
+	// The lock is released as soon as its holder finishes.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.unlock(ctx)
+	}()
+	second.LockTimeout = 5 * time.Second
+	if err := second.Up(ctx); err != nil {
+		t.Fatalf("expected to get the lock once released, got %v", err)
+	}
+
+	// A lock left behind by a dead process is eventually broken.
+	if err := first.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	second.StaleLock = 0
+	if err := second.Down(ctx, 1); err != nil {
+		t.Fatalf("expected the stale lock to be broken, got %v", err)
+	}
+}
+
+// TestMigrateBindsForDialect runs the migrator's own statements with
+// Postgres placeholders, which SQLite also understands.
+func TestMigrateBindsForDialect(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	db.dialect = Postgres
+	m, _ := NewMigrator(db, embeddedMigrations())
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	applied := appliedVersions(t, m)
+	if err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := appliedVersions(t, m), applied[:len(applied)-1]; !slices.Equal(got, want) {
+		t.Errorf("expected %v applied after rolling one back, got %v", want, got)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	m, _ := NewMigrator(db, embeddedMigrations())
+	var out bytes.Buffer
+	m.DryRun, m.Out = true, &out
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "users") {
+		t.Error("dry run changed the schema")
+	}
+	for _, want := range []string{"-- 0001_create_users (up)", "CREATE TABLE users", "-- 0003_create_orders (up)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dry run output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	m.DryRun = false
+	m.Up(ctx)
+	out.Reset()
+	m.DryRun = true
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "DROP TABLE order_items;") || !tableExists(t, db, "order_items") {
+		t.Errorf("unexpected dry run of down:\n%s", out.String())
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"bad name":       {"create_users.sql": {Data: []byte("-- +migrate Up\nSELECT 1;")}},
+		"duplicate":      {"1_a.sql": {Data: []byte("-- +migrate Up\nSELECT 1;")}, "0001_b.sql": {Data: []byte("-- +migrate Up\nSELECT 1;")}},
+		"no up section":  {"0001_a.sql": {Data: []byte("SELECT 1;")}},
+		"empty up":       {"0001_a.sql": {Data: []byte("-- +migrate Up\n-- +migrate Down\nSELECT 1;")}},
+		"down before up": {"0001_a.sql": {Data: []byte("-- +migrate Down\nSELECT 1;\n-- +migrate Up\nSELECT 1;")}},
+	}
+	for name, files := range tests {
+		if _, err := loadMigrations(files); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDownRefusesIrreversibleMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	m, _ := NewMigrator(db, fstest.MapFS{
+		"0001_things.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE things (id INTEGER);\n")},
+	})
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(ctx, 1); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("expected %v, got %v", ErrIrreversible, err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrMoneyOverflow    = errors.New("amount out of range")
+)
+
+// currencyDigits is the number of minor unit digits of each supported ISO
+// 4217 currency.
+var currencyDigits = map[string]int{
+	"AUD": 2, "CAD": 2, "CHF": 2, "EUR": 2, "GBP": 2, "USD": 2,
+	"JPY": 0, "KRW": 0,
+	"BHD": 3, "KWD": 3,
+}
+
+// Money is an exact amount: a whole number of a currency's minor units,
+// such as cents. The zero Money is zero in no currency yet and takes the
+// currency of whatever it is combined with, so that it can start a sum.
+type Money struct {
+	amount   int64
+	currency string
+}
+
+// NewMoney returns amount minor units of currency. It panics on an unknown
+// currency, since currencies are chosen by the program; use ParseMoney for
+// input.
+func NewMoney(amount int64, currency string) Money {
+	if _, ok := currencyDigits[currency]; !ok {
+		panic(fmt.Sprintf("%v: %q", ErrUnknownCurrency, currency))
+	}
+	return Money{amount: amount, currency: currency}
+}
+
+// ParseMoney parses a decimal amount such as "-12.345" in currency.
+// Digits beyond the currency's minor unit are rounded half to even.
+func ParseMoney(amount, currency string) (Money, error) {
+	digits, ok := currencyDigits[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	s, neg := strings.CutPrefix(amount, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || !allDigits(whole) || !allDigits(frac) {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+
+	n, _ := new(big.Int).SetString(whole+frac, 10)
+	if neg {
+		n.Neg(n)
+	}
+	if len(frac) <= digits {
+		return fromBig(n.Mul(n, pow10(digits-len(frac))), currency)
+	}
+	return fromBig(roundHalfEven(n, pow10(len(frac)-digits)), currency)
+}
+
+func allDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Money) Amount() int64    { return m.amount }
+func (m Money) Currency() string { return m.currency }
+func (m Money) IsZero() bool     { return m.amount == 0 }
+func (m Money) IsNegative() bool { return m.amount < 0 }
+
+// Decimal returns the amount in major units, e.g. "12.30".
+func (m Money) Decimal() string {
+	digits := currencyDigits[m.currency]
+	s := strconv.FormatInt(m.amount, 10)
+	s, neg := strings.CutPrefix(s, "-")
+	if digits > 0 {
+		s = strings.Repeat("0", max(0, digits+1-len(s))) + s
+		s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	}
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+func (m Money) String() string {
+	if m.currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.currency
+}
+
+// common returns the currency of an operation on m and o.
+func (m Money) common(o Money) (string, error) {
+	switch {
+	case m.currency == o.currency || o.currency == "":
+		return m.currency, nil
+	case m.currency == "":
+		return o.currency, nil
+	}
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.currency, o.currency)
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	currency, err := m.common(o)
+	if err != nil {
+		return Money{}, err
+	}
+	return fromBig(new(big.Int).Add(big.NewInt(m.amount), big.NewInt(o.amount)), currency)
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	currency, err := m.common(o)
+	if err != nil {
+		return Money{}, err
+	}
+	return fromBig(new(big.Int).Sub(big.NewInt(m.amount), big.NewInt(o.amount)), currency)
+}
+
+// Cmp returns -1, 0 or +1 as m is less than, equal to or greater than o.
+func (m Money) Cmp(o Money) (int, error) {
+	if _, err := m.common(o); err != nil {
+		return 0, err
+	}
+	return big.NewInt(m.amount).Cmp(big.NewInt(o.amount)), nil
+}
+
+// Mul returns m times n, e.g. a line total from a unit price.
+func (m Money) Mul(n int64) (Money, error) {
+	return fromBig(new(big.Int).Mul(big.NewInt(m.amount), big.NewInt(n)), m.currency)
+}
+
+// Scale returns m times num/den rounded half to even, e.g. Scale(825,
+// 10000) for 8.25% tax. Rounding half to even rather than up keeps the
+// errors of many roundings from adding up in one direction.
+func (m Money) Scale(num, den int64) (Money, error) {
+	if den == 0 {
+		return Money{}, errors.New("money scaled by a zero denominator")
+	}
+	n := new(big.Int).Mul(big.NewInt(m.amount), big.NewInt(num))
+	return fromBig(roundHalfEven(n, big.NewInt(den)), m.currency)
+}
+
+// Allocate splits m into parts proportional to weights without losing a
+// minor unit: the parts always add up to m. Units left over by rounding
+// down go one each to the parts that lost the most, earlier parts first
+// among equals.
+func (m Money) Allocate(weights ...int64) ([]Money, error) {
+	total := new(big.Int)
+	for _, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("negative allocation weight %d", w)
+		}
+		total.Add(total, big.NewInt(w))
+	}
+	if total.Sign() == 0 {
+		return nil, errors.New("allocation weights add up to zero")
+	}
+
+	// Allocate the magnitude, so that rounding down and handing out the
+	// leftovers work the same way for negative amounts.
+	amount := big.NewInt(m.amount)
+	neg := amount.Sign() < 0
+	amount.Abs(amount)
+
+	shares := make([]*big.Int, len(weights))
+	remainders := make([]*big.Int, len(weights))
+	left := new(big.Int).Set(amount)
+	for i, w := range weights {
+		shares[i], remainders[i] = new(big.Int).QuoRem(new(big.Int).Mul(amount, big.NewInt(w)), total, new(big.Int))
+		left.Sub(left, shares[i])
+	}
+	// Fewer units are left than there are parts, each with a remainder.
+	for ; left.Sign() > 0; left.Sub(left, big.NewInt(1)) {
+		best := -1
+		for i, r := range remainders {
+			if r.Sign() > 0 && (best < 0 || r.Cmp(remainders[best]) > 0) {
+				best = i
+			}
+		}
+		shares[best].Add(shares[best], big.NewInt(1))
+		remainders[best].SetInt64(0)
+	}
+
+	parts := make([]Money, len(weights))
+	for i, share := range shares {
+		if neg {
+			share.Neg(share)
+		}
+		// Every share is at most m, so it fits.
+		parts[i] = Money{amount: share.Int64(), currency: m.currency}
+	}
+	return parts, nil
+}
+
+// Split divides m into n parts as equal as possible.
+func (m Money) Split(n int) ([]Money, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("cannot split into %d parts", n)
+	}
+	weights := make([]int64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return m.Allocate(weights...)
+}
+
+func fromBig(n *big.Int, currency string) (Money, error) {
+	if !n.IsInt64() {
+		return Money{}, fmt.Errorf("%w: %s %s", ErrMoneyOverflow, n, currency)
+	}
+	return Money{amount: n.Int64(), currency: currency}, nil
+}
+
+// roundHalfEven returns n/d rounded to the nearest integer, ties to even.
+func roundHalfEven(n, d *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	// QuoRem truncates; step away from zero when the rest is more than
+	// half, or exactly half and q is odd.
+	away := int64(n.Sign() * d.Sign())
+	switch new(big.Int).Abs(new(big.Int).Lsh(r, 1)).Cmp(new(big.Int).Abs(d)) {
+	case 1:
+		q.Add(q, big.NewInt(away))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(away))
+		}
+	}
+	return q
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// moneyJSON is the wire form of Money. The amount is a decimal string, so
+// that clients parsing JSON numbers as floats do not round it.
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.currency})
+}
+
+// UnmarshalJSON accepts the amount as a string or a number, and parses
+// either exactly. A zero amount without a currency is the zero Money, as
+// MarshalJSON writes it.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var v moneyJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	amount := string(v.Amount)
+	if strings.HasPrefix(amount, `"`) {
+		if err := json.Unmarshal(v.Amount, &amount); err != nil {
+			return err
+		}
+	}
+	if v.Currency == "" {
+		// Any currency will do to check that the amount is zero.
+		if zero, err := ParseMoney(amount, "USD"); err != nil || !zero.IsZero() {
+			return fmt.Errorf("%w: amount %s has no currency", ErrUnknownCurrency, amount)
+		}
+		*m = Money{}
+		return nil
+	}
+	parsed, err := ParseMoney(amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Money is stored in two columns: the amount in minor units in the tagged
+// one, and the currency in one named with a _currency suffix, such as
+// price and price_currency. The zero Money has an empty currency.
+func (m *Money) columns() ([]string, []any) {
+	return []string{"", "_currency"}, []any{m, (*moneyCurrency)(m)}
+}
+
+// Value binds the amount in minor units. Filters compare the currency
+// separately, as Column does.
+func (m Money) Value() (driver.Value, error) {
+	return m.amount, nil
+}
+
+// Scan reads the amount in minor units, keeping the currency, which is
+// scanned from its own column.
+func (m *Money) Scan(src any) error {
+	amount, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	m.amount = amount
+	return nil
+}
+
+// moneyCurrency binds and scans the currency column of a Money.
+type moneyCurrency Money
+
+func (c *moneyCurrency) Value() (driver.Value, error) {
+	return c.currency, nil
+}
+
+func (c *moneyCurrency) Scan(src any) error {
+	var currency string
+	switch src := src.(type) {
+	case string:
+		currency = src
+	case []byte:
+		currency = string(src)
+	default:
+		return fmt.Errorf("cannot scan %T into a currency", src)
+	}
+	if _, ok := currencyDigits[currency]; !ok && currency != "" {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	c.currency = currency
+	return nil
+}
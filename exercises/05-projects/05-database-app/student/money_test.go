@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func usd(amount string) Money {
+	m, err := ParseMoney(amount, "USD")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             int64
+	}{
+		{"12.34", "USD", 1234},
+		{"1", "USD", 100},
+		{".5", "USD", 50},
+		{"-0.05", "USD", -5},
+		// Half to even: ties go to the even neighbour, in both directions.
+		{"12.345", "USD", 1234},
+		{"12.355", "USD", 1236},
+		{"12.3451", "USD", 1235},
+		{"-0.125", "USD", -12},
+		{"-0.135", "USD", -14},
+		{"1234.5", "JPY", 1234},
+		{"1235.5", "JPY", 1236},
+		{"1.2345", "KWD", 1234},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.amount, tt.currency)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if m.Amount() != tt.want || m.Currency() != tt.currency {
+			t.Errorf("%s %s: expected %d, got %d %s", tt.amount, tt.currency, tt.want, m.Amount(), m.Currency())
+		}
+	}
+
+	for _, bad := range []string{"", "-", "+1", "1e3", "1.2.3", "12,50", " 1", "99999999999999999999"} {
+		if _, err := ParseMoney(bad, "USD"); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	if _, err := ParseMoney("1", "XXX"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("expected %v, got %v", ErrUnknownCurrency, err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	for m, want := range map[Money]string{
+		NewMoney(-5, "USD"):     "-0.05 USD",
+		NewMoney(123456, "EUR"): "1234.56 EUR",
+		NewMoney(100, "JPY"):    "100 JPY",
+		NewMoney(1, "KWD"):      "0.001 KWD",
+		{}:                      "0",
+	} {
+		if got := m.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	// Ten dimes are a dollar, which float64 cannot manage.
+	var total Money
+	for range 10 {
+		var err error
+		if total, err = total.Add(usd("0.10")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != usd("1") {
+		t.Errorf("expected 1.00 USD, got %s", total)
+	}
+
+	if _, err := usd("1").Add(NewMoney(1, "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("add: expected %v, got %v", ErrCurrencyMismatch, err)
+	}
+	if _, err := usd("1").Cmp(NewMoney(1, "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("cmp: expected %v, got %v", ErrCurrencyMismatch, err)
+	}
+	if diff, _ := usd("1").Sub(usd("1.01")); diff != usd("-0.01") {
+		t.Errorf("expected -0.01 USD, got %s", diff)
+	}
+	if c, _ := usd("2").Cmp(usd("10")); c != -1 {
+		t.Errorf("expected 2 < 10, got %d", c)
+	}
+	if _, err := NewMoney(1<<62, "USD").Mul(4); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("mul: expected %v, got %v", ErrMoneyOverflow, err)
+	}
+	if _, err := NewMoney(1<<62, "USD").Add(NewMoney(1<<62, "USD")); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("add: expected %v, got %v", ErrMoneyOverflow, err)
+	}
+
+	for _, tt := range []struct {
+		m        Money
+		num, den int64
+		want     Money
+	}{
+		{usd("10"), 825, 10000, usd("0.82")},    // 0.825
+		{usd("10.10"), 825, 10000, usd("0.83")}, // 0.83325
+		{usd("0.25"), 1, 2, usd("0.12")},        // 0.125
+		{usd("0.35"), 1, 2, usd("0.18")},        // 0.175
+		{usd("-0.25"), 1, 2, usd("-0.12")},
+		{usd("1"), 1, 3, usd("0.33")},
+	} {
+		if got, err := tt.m.Scale(tt.num, tt.den); err != nil || got != tt.want {
+			t.Errorf("%s × %d/%d: expected %s, got %s (%v)", tt.m, tt.num, tt.den, tt.want, got, err)
+		}
+	}
+}
+
+func TestMoneyAllocate(t *testing.T) {
+	tests := []struct {
+		m       Money
+		weights []int64
+		want    []string
+	}{
+		{usd("1"), []int64{1, 1, 1}, []string{"0.34", "0.33", "0.33"}},
+		{usd("-1"), []int64{1, 1, 1}, []string{"-0.34", "-0.33", "-0.33"}},
+		{usd("0.05"), []int64{3, 7}, []string{"0.02", "0.03"}},
+		// The leftover cent goes to the part that lost the most.
+		{usd("0.10"), []int64{1, 2, 3}, []string{"0.02", "0.03", "0.05"}},
+		{usd("10"), []int64{0, 1}, []string{"0.00", "10.00"}},
+	}
+	for _, tt := range tests {
+		parts, err := tt.m.Allocate(tt.weights...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range parts {
+			got = append(got, p.Decimal())
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s by %v: got %v", tt.m, tt.weights, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s by %v: expected %v, got %v", tt.m, tt.weights, tt.want, got)
+				break
+			}
+		}
+	}
+
+	// Whatever the split, no cent is lost or made up.
+	for amount := int64(-50); amount <= 50; amount += 7 {
+		for n := 1; n <= 7; n++ {
+			parts, err := NewMoney(amount, "USD").Split(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum Money
+			for _, p := range parts {
+				sum, _ = sum.Add(p)
+			}
+			if sum.Amount() != amount {
+				t.Errorf("split %d into %d: parts add up to %d", amount, n, sum.Amount())
+			}
+		}
+	}
+
+	if _, err := usd("1").Allocate(0, 0); err == nil {
+		t.Error("expected an error for zero weights")
+	}
+	if _, err := usd("1").Allocate(1, -1); err == nil {
+		t.Error("expected an error for a negative weight")
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(Product{Name: "Anvil", Price: usd("120")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	if got := string(fields["price"]); got != `{"amount":"120.00","currency":"USD"}` {
+		t.Errorf("unexpected price JSON %s", got)
+	}
+
+	for in, want := range map[string]Money{
+		`{"amount":"0.10","currency":"USD"}`: usd("0.10"),
+		`{"amount":0.1,"currency":"USD"}`:    usd("0.10"),
+		`{"amount":"500","currency":"JPY"}`:  NewMoney(500, "JPY"),
+		`{"amount":"0","currency":""}`:       {},
+		`{"amount":0}`:                       {},
+	} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err != nil || m != want {
+			t.Errorf("%s: expected %s, got %s (%v)", in, want, m, err)
+		}
+	}
+	// The zero Money, such as an unset total, round-trips.
+	var order Order
+	data, _ = json.Marshal(order)
+	if err := json.Unmarshal(data, &order); err != nil || order.TotalAmount != (Money{}) {
+		t.Errorf("expected the zero total back from %s, got %s (%v)", data, order.TotalAmount, err)
+	}
+
+	for _, in := range []string{`{"amount":"1"}`, `{"amount":"x","currency":""}`, `{"amount":1e2,"currency":"USD"}`, `{"amount":true,"currency":"USD"}`, `"1.00"`} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestMoneyStorage(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+
+	anvil := &Product{Name: "Anvil", Price: usd("19.99"), Stock: 5, Active: true}
+	euroAnvil := &Product{Name: "Euro anvil", Price: NewMoney(1999, "EUR"), Stock: 5, Active: true}
+	free := &Product{Name: "Sticker", Stock: 5, Active: true}
+	for _, p := range []*Product{anvil, euroAnvil, free} {
+		if err := db.CreateProduct(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stored int64
+	var currency string
+	db.db.QueryRow(`SELECT price, price_currency FROM products WHERE id = ?`, euroAnvil.ID).Scan(&stored, &currency)
+	if stored != 1999 || currency != "EUR" {
+		t.Errorf("expected 1999 EUR cents stored, got %d %q", stored, currency)
+	}
+	for _, want := range []*Product{anvil, euroAnvil, free} {
+		got, err := db.GetProduct(want.ID)
+		if err != nil || got.Price != want.Price {
+			t.Errorf("expected %s back, got %s (%v)", want.Price, got.Price, err)
+		}
+	}
+
+	// Filters match amounts in the same currency only.
+	for _, tt := range []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"gt", ProductFields.Price.Gt(NewMoney(1, "EUR")), 1},
+		{"eq", ProductFields.Price.Eq(usd("19.99")), 1},
+		{"ne", ProductFields.Price.Ne(usd("19.99")), 2},
+		{"in", ProductFields.Price.In(NewMoney(1999, "EUR"), NewMoney(1999, "JPY")), 1},
+	} {
+		if n, err := db.Products().Count(ctx, tt.filter); err != nil || n != tt.want {
+			t.Errorf("%s: expected %d matches, got %d (%v)", tt.name, tt.want, n, err)
+		}
+	}
+
+	user := newCustomer(t, db)
+	items := []OrderItem{{ProductID: anvil.ID, Quantity: 1}, {ProductID: euroAnvil.ID, Quantity: 1}}
+	if err := db.CreateOrderWithItems(&Order{UserID: user.ID}, items); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("expected %v for an order in two currencies, got %v", ErrCurrencyMismatch, err)
+	}
+	order := &Order{UserID: user.ID}
+	if err := db.CreateOrderWithItems(order, []OrderItem{{ProductID: euroAnvil.ID, Quantity: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Orders().Get(ctx, order.ID); err != nil || got.TotalAmount != NewMoney(3998, "EUR") {
+		t.Errorf("expected a total of 39.98 EUR, got %+v (%v)", got, err)
+	}
+}
+
+func TestMoneyMigrationConvertsAmounts(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	m, err := NewMigrator(db, embeddedMigrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.To(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`INSERT INTO products (name, price) VALUES ('Legacy', 19.99)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.db.Exec(`INSERT INTO products (name, price) VALUES ('Free', 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.To(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int]Money{1: usd("19.99"), 2: {}} {
+		p, err := db.GetProduct(id)
+		if err != nil || p.Price != want {
+			t.Fatalf("expected %s after the migrations, got %s (%v)", want, p.Price, err)
+		}
+	}
+
+	if err := m.To(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	var price float64
+	db.db.QueryRow(`SELECT price FROM products WHERE id = 1`).Scan(&price)
+	if price != 19.99 {
+		t.Errorf("expected 19.99 after rolling back, got %v", price)
+	}
+}
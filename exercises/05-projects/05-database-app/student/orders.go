@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrInvalidTransition is returned for a status change the order
+	// workflow does not allow, including one that lost a race with another.
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	// ErrInsufficientStock is returned when a product has fewer units left
+	// than asked for.
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrProductUnavailable is returned when ordering an inactive product.
+	ErrProductUnavailable = errors.New("product unavailable")
+	ErrEmptyOrder         = errors.New("order has no items")
+)
+
+// OrderStatus is a stage of the order workflow:
+//
+//	pending ──> paid ──> shipped ──> delivered
+//	   │          │                      │
+//	   v          v                      │
+//	cancelled  refunded <────────────────┘
+//
+// Orders are created pending and only move along the arrows.
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "pending"
+	OrderPaid      OrderStatus = "paid"
+	OrderShipped   OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRefunded  OrderStatus = "refunded"
+)
+
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderShipped, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+}
+
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderPending, OrderPaid, OrderShipped, OrderDelivered, OrderCancelled, OrderRefunded:
+		return true
+	}
+	return false
+}
+
+func (s OrderStatus) CanTransitionTo(to OrderStatus) bool {
+	return slices.Contains(orderTransitions[s], to)
+}
+
+// releasesStock reports whether moving from s to to gives the reserved
+// units back: the goods never left the warehouse.
+func (s OrderStatus) releasesStock(to OrderStatus) bool {
+	return (to == OrderCancelled || to == OrderRefunded) && (s == OrderPending || s == OrderPaid)
+}
+
+// CreateOrderWithItems stores order and its items in one transaction. It
+// reserves the stock of every item, prices the items at their products'
+// current prices, whatever the caller set, and totals the order from them.
+// If any product lacks the stock, nothing is stored or reserved.
+func (db *Database) CreateOrderWithItems(order *Order, items []OrderItem) error {
+	return db.createOrder(context.Background(), order, items)
+}
+
+func (db *Database) createOrder(ctx context.Context, order *Order, items []OrderItem) error {
+	if len(items) == 0 {
+		return ErrEmptyOrder
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Reserving in product order makes concurrent checkouts lock rows in
+	// the same order, so that they cannot deadlock on each other.
+	byProduct := make([]int, len(items))
+	for i := range items {
+		byProduct[i] = i
+	}
+	slices.SortStableFunc(byProduct, func(a, b int) int { return items[a].ProductID - items[b].ProductID })
+
+	products := db.Products().WithTx(tx)
+	var total Money
+	for _, i := range byProduct {
+		item := &items[i]
+		if item.Quantity <= 0 {
+			return &ValidationError{Field: "quantity", Reason: "must be positive"}
+		}
+		if err := adjustStock(ctx, tx, item.ProductID, -item.Quantity); err != nil {
+			return err
+		}
+		product, err := products.Get(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		if !product.Active {
+			return fmt.Errorf("product %d: %w", product.ID, ErrProductUnavailable)
+		}
+		item.Price = product.Price
+		line, err := item.Price.Mul(int64(item.Quantity))
+		if err != nil {
+			return err
+		}
+		if total, err = total.Add(line); err != nil {
+			return err
+		}
+	}
+
+	order.Status = OrderPending
+	order.TotalAmount = total
+	if err := db.Orders().WithTx(tx).Create(ctx, order); err != nil {
+		return err
+	}
+	orderItems := db.OrderItems().WithTx(tx)
+	for i := range items {
+		items[i].OrderID = order.ID
+		if err := orderItems.Create(ctx, &items[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateProductStock adds quantity units to a product's stock, or removes
+// them if it is negative. The check and the change are one conditional
+// statement, so concurrent updates can never take the stock below zero.
+func (db *Database) UpdateProductStock(productID, quantity int) error {
+	return adjustStock(context.Background(), db, productID, quantity)
+}
+
+// adjustStock changes a product's stock by delta, or returns
+// ErrInsufficientStock if that would make it negative.
+func adjustStock(ctx context.Context, q Querier, productID, delta int) error {
+	query, args, err := NewUpdate("products").Dialect(q.Dialect()).
+		Set("stock", Raw(`"stock" + ?`, delta)).
+		Set("updated_at", time.Now().UTC()).
+		Where(`"id" = ?`, productID).
+		Where(`"stock" + ? >= 0`, delta).
+		Build()
+	if err != nil {
+		return err
+	}
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return handleDatabaseError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// Nothing changed: either the product is missing or short of stock.
+	var stock int
+	query, args, err = NewQueryBuilder("products").Dialect(q.Dialect()).
+		Select("stock").Where(`"id" = ?`, productID).Build()
+	if err != nil {
+		return err
+	}
+	if err := q.QueryRowContext(ctx, query, args...).Scan(&stock); err != nil {
+		return fmt.Errorf("product %d: %w", productID, handleDatabaseError(err))
+	}
+	return fmt.Errorf("product %d: %w: %d left, %d wanted", productID, ErrInsufficientStock, stock, -delta)
+}
+
+// TransitionOrder moves an order to status to, returning the stock it
+// reserved when the goods are no longer going out. The change is made only
+// if the order still has the status it was read with, so of two concurrent
+// transitions one fails with ErrInvalidTransition.
+func (db *Database) TransitionOrder(ctx context.Context, id int, to OrderStatus) (*Order, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := db.Orders().WithTx(tx).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	from := order.Status
+	if !from.CanTransitionTo(to) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	order.Status = to
+	order.UpdatedAt = time.Now().UTC()
+	query, args, err := NewUpdate("orders").Dialect(tx.Dialect()).
+		Set("status", order.Status).
+		Set("updated_at", order.UpdatedAt).
+		Where(`"id" = ?`, id).
+		Where(`"status" = ?`, from).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, handleDatabaseError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, fmt.Errorf("%w: order %d is no longer %s", ErrInvalidTransition, id, from)
+	}
+
+	if from.releasesStock(to) {
+		items := db.OrderItems().WithTx(tx)
+		rows, err := items.query(ctx, items.selectQuery().Where(`"order_id" = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		reserved, err := ScanAll[OrderItem](rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range reserved {
+			if err := adjustStock(ctx, tx, item.ProductID, item.Quantity); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (db *Database) PayOrder(ctx context.Context, id int) (*Order, error) {
+	return db.TransitionOrder(ctx, id, OrderPaid)
+}
+
+func (db *Database) ShipOrder(ctx context.Context, id int) (*Order, error) {
+	return db.TransitionOrder(ctx, id, OrderShipped)
+}
+
+func (db *Database) DeliverOrder(ctx context.Context, id int) (*Order, error) {
+	return db.TransitionOrder(ctx, id, OrderDelivered)
+}
+
+// CancelOrder cancels an unpaid order and releases its stock.
+func (db *Database) CancelOrder(ctx context.Context, id int) (*Order, error) {
+	return db.TransitionOrder(ctx, id, OrderCancelled)
+}
+
+// RefundOrder refunds a paid or delivered order. A paid order's stock is
+// released; delivered goods are not counted back in.
+func (db *Database) RefundOrder(ctx context.Context, id int) (*Order, error) {
+	return db.TransitionOrder(ctx, id, OrderRefunded)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func newCustomer(t *testing.T, db *Database) *User {
+	t.Helper()
+	user := &User{Username: "buyer", Email: "buyer@example.com", PasswordHash: "h"}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func stockOf(t *testing.T, db *Database, id int) int {
+	t.Helper()
+	p, err := db.GetProduct(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Stock
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+	allowed := map[[2]OrderStatus]bool{
+		{OrderPending, OrderPaid}:       true,
+		{OrderPending, OrderCancelled}:  true,
+		{OrderPaid, OrderShipped}:       true,
+		{OrderPaid, OrderRefunded}:      true,
+		{OrderShipped, OrderDelivered}:  true,
+		{OrderDelivered, OrderRefunded}: true,
+	}
+	all := []OrderStatus{OrderPending, OrderPaid, OrderShipped, OrderDelivered, OrderCancelled, OrderRefunded}
+	for _, from := range all {
+		for _, to := range all {
+			if got := from.CanTransitionTo(to); got != allowed[[2]OrderStatus{from, to}] {
+				t.Errorf("%s to %s: expected %v", from, to, !got)
+			}
+		}
+	}
+	if OrderStatus("lost").Valid() {
+		t.Error("an unknown status is valid")
+	}
+}
+
+func TestCreateOrderWithItems(t *testing.T) {
+	db := newMigratedDB(t)
+	seedProducts(t, db) // 1 Anvil 120 ×2, 2 Bolt 0.25 ×1000, 3 Crate ×0, 4 Drill inactive, 5 Epoxy 15 ×40
+	user := newCustomer(t, db)
+
+	order := &Order{UserID: user.ID, Status: OrderDelivered, TotalAmount: usd("1")}
+	items := []OrderItem{
+		{ProductID: 5, Quantity: 3, Price: usd("0.01")},
+		{ProductID: 2, Quantity: 10},
+		{ProductID: 1, Quantity: 1},
+	}
+	if err := db.CreateOrderWithItems(order, items); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != OrderPending || order.TotalAmount != usd("167.50") {
+		t.Errorf("expected a pending order of 167.5, got %s %v", order.Status, order.TotalAmount)
+	}
+	if items[0].Price != usd("15") || items[0].OrderID != order.ID || items[0].ID == 0 {
+		t.Errorf("item not priced and stored: %+v", items[0])
+	}
+	for id, want := range map[int]int{1: 1, 2: 990, 5: 37} {
+		if got := stockOf(t, db, id); got != want {
+			t.Errorf("product %d: expected stock %d, got %d", id, want, got)
+		}
+	}
+
+	failures := map[string]struct {
+		items []OrderItem
+		want  error
+	}{
+		"short":    {[]OrderItem{{ProductID: 5, Quantity: 1}, {ProductID: 1, Quantity: 2}}, ErrInsufficientStock},
+		"inactive": {[]OrderItem{{ProductID: 5, Quantity: 1}, {ProductID: 4, Quantity: 1}}, ErrProductUnavailable},
+		"missing":  {[]OrderItem{{ProductID: 5, Quantity: 1}, {ProductID: 99, Quantity: 1}}, ErrNotFound},
+		"empty":    {nil, ErrEmptyOrder},
+	}
+	for name, tt := range failures {
+		if err := db.CreateOrderWithItems(&Order{UserID: user.ID}, tt.items); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", name, tt.want, err)
+		}
+	}
+	if got := stockOf(t, db, 5); got != 37 {
+		t.Errorf("failed orders should reserve nothing, got stock %d", got)
+	}
+	if n, _ := db.Orders().Count(context.Background()); n != 1 {
+		t.Errorf("failed orders should store nothing, got %d orders", n)
+	}
+}
+
+func TestOrderWorkflowReleasesStock(t *testing.T) {
+	db := newMigratedDB(t)
+	seedProducts(t, db)
+	user := newCustomer(t, db)
+	ctx := context.Background()
+
+	checkout := func() int {
+		t.Helper()
+		order := &Order{UserID: user.ID}
+		if err := db.CreateOrderWithItems(order, []OrderItem{{ProductID: 5, Quantity: 4}}); err != nil {
+			t.Fatal(err)
+		}
+		return order.ID
+	}
+	step := func(id int, to OrderStatus) {
+		t.Helper()
+		order, err := db.TransitionOrder(ctx, id, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := db.Orders().Get(ctx, id); order.Status != to || stored.Status != to {
+			t.Fatalf("expected order %d to be %s", id, to)
+		}
+	}
+
+	cancelled := checkout()
+	if _, err := db.ShipOrder(ctx, cancelled); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("shipping an unpaid order: expected %v, got %v", ErrInvalidTransition, err)
+	}
+	step(cancelled, OrderCancelled)
+	if got := stockOf(t, db, 5); got != 40 {
+		t.Errorf("cancelling should release the stock, got %d", got)
+	}
+	if _, err := db.CancelOrder(ctx, cancelled); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("cancelling twice: expected %v, got %v", ErrInvalidTransition, err)
+	}
+
+	refunded := checkout()
+	step(refunded, OrderPaid)
+	step(refunded, OrderRefunded)
+	if got := stockOf(t, db, 5); got != 40 {
+		t.Errorf("refunding before shipping should release the stock, got %d", got)
+	}
+
+	returned := checkout()
+	for _, to := range []OrderStatus{OrderPaid, OrderShipped, OrderDelivered, OrderRefunded} {
+		step(returned, to)
+	}
+	if got := stockOf(t, db, 5); got != 36 {
+		t.Errorf("refunding delivered goods should not restock, got %d", got)
+	}
+
+	if _, err := db.CancelOrder(ctx, 99); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	order, _ := db.Orders().Get(ctx, returned)
+	order.Status = "lost"
+	if err := db.Orders().Update(ctx, order); err == nil {
+		t.Error("expected an unknown status to be rejected")
+	}
+}
+
+func TestConcurrentCheckoutNeverOversells(t *testing.T) {
+	db := newMigratedDB(t)
+	seedProducts(t, db)
+	user := newCustomer(t, db)
+	const stock, buyers = 40, 30 // Epoxy; the buyers want 60 in total
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sold := 0
+	for i := range buyers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quantity := 1 + i%3
+			// Every order also takes a Bolt, so the two products are
+			// reserved together and in varying item order.
+			items := []OrderItem{{ProductID: 5, Quantity: quantity}, {ProductID: 2, Quantity: 1}}
+			if i%2 == 0 {
+				items[0], items[1] = items[1], items[0]
+			}
+			err := db.CreateOrderWithItems(&Order{UserID: user.ID}, items)
+			switch {
+			case err == nil:
+				mu.Lock()
+				sold += quantity
+				mu.Unlock()
+			case !errors.Is(err, ErrInsufficientStock):
+				t.Errorf("buyer %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	left := stockOf(t, db, 5)
+	if left < 0 || left != stock-sold {
+		t.Fatalf("sold %d of %d but %d are left", sold, stock, left)
+	}
+	if left > 2 {
+		t.Errorf("buyers were turned away with %d left", left)
+	}
+
+	var reserved int
+	db.db.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE product_id = 5`).Scan(&reserved)
+	if reserved != sold {
+		t.Errorf("orders hold %d units but %d were sold", reserved, sold)
+	}
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the flavour of SQL a query is rendered for. Builders write
+// every placeholder as ? and the dialect renumbers them at the end.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+func (d Dialect) String() string {
+	if d == Postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// Placeholder returns the marker for the n-th argument, counting from 1.
+func (d Dialect) Placeholder(n int) string {
+	if d == Postgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// dialectFor picks the driver and dialect for a database URL.
+func dialectFor(databaseURL string) (driver string, dialect Dialect) {
+	if strings.HasPrefix(databaseURL, "postgres://") || strings.HasPrefix(databaseURL, "postgresql://") {
+		return "postgres", Postgres
+	}
+	return "sqlite3", SQLite
+}
+
+var (
+	ErrInvalidIdentifier = errors.New("invalid SQL identifier")
+	ErrInvalidSort       = errors.New("invalid sort term")
+	// ErrUnsortableColumn is returned for a sort column that is not in
+	// the builder's allowlist; the column usually comes from the client.
+	ErrUnsortableColumn = errors.New("column cannot be sorted on")
+	// ErrUnfilteredWrite stops an UPDATE or DELETE without a WHERE clause
+	// unless All was called.
+	ErrUnfilteredWrite = errors.New("update or delete without a WHERE clause")
+	// ErrEmptyList is returned for an empty slice argument. "id IN ()" is
+	// not valid SQL, and no one placeholder value gives both IN and NOT IN
+	// their meaning, so the caller must handle the empty case itself.
+	ErrEmptyList = errors.New("empty list argument")
+)
+
+var identPart = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// quoteIdent quotes a possibly qualified identifier such as users.id. A
+// trailing * is left bare so that users.* works.
+func quoteIdent(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if part == "*" && i == len(parts)-1 {
+			continue
+		}
+		if !identPart.MatchString(part) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, name)
+		}
+		parts[i] = `"` + part + `"`
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// mustQuoteIdent quotes a name the program itself supplies, such as a
+// struct tag, where an invalid name is a bug.
+func mustQuoteIdent(name string) string {
+	quoted, err := quoteIdent(name)
+	if err != nil {
+		panic(err)
+	}
+	return quoted
+}
+
+// quoteAliased quotes "name", "name alias" or "name AS alias".
+func quoteAliased(ref string) (string, error) {
+	fields := strings.Fields(ref)
+	if len(fields) == 3 && strings.EqualFold(fields[1], "AS") {
+		fields = []string{fields[0], fields[2]}
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, ref)
+	}
+	name, err := quoteIdent(fields[0])
+	if err != nil || len(fields) == 1 {
+		return name, err
+	}
+	if !identPart.MatchString(fields[1]) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, ref)
+	}
+	return name + ` AS "` + fields[1] + `"`, nil
+}
+
+// Expr is a fragment of raw SQL with its arguments. It can be passed as
+// an argument to Where, Having, Set and the other clauses to splice SQL
+// in place of a placeholder, e.g. Set("stock", Raw("stock - ?", n)).
+type Expr struct {
+	SQL  string
+	Args []any
+}
+
+func Raw(sql string, args ...any) Expr {
+	return Expr{SQL: sql, Args: args}
+}
+
+// sqlWriter accumulates SQL with ? placeholders and its arguments. The
+// first error sticks and is reported by the builder's Build.
+type sqlWriter struct {
+	strings.Builder
+	args []any
+	err  error
+}
+
+func (w *sqlWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *sqlWriter) ident(name string) {
+	quoted, err := quoteIdent(name)
+	if err != nil {
+		w.fail(err)
+	}
+	w.WriteString(quoted)
+}
+
+func (w *sqlWriter) idents(names []string) {
+	for i, name := range names {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.ident(name)
+	}
+}
+
+// clause writes sql, binding args to its placeholders in order:
+//   - an Expr is spliced in with its own arguments;
+//   - a *QueryBuilder becomes a parenthesized subquery;
+//   - a slice expands to a comma-separated list, so "id IN (?)" works
+//     with []int; an empty slice is an ErrEmptyList error;
+//   - anything else stays a placeholder.
+func (w *sqlWriter) clause(sql string, args []any) {
+	next := 0
+	scanPlaceholders(sql, func(text string, placeholder bool) {
+		if !placeholder {
+			w.WriteString(text)
+			return
+		}
+		if next >= len(args) {
+			w.fail(fmt.Errorf("not enough arguments for %q", sql))
+			return
+		}
+		w.arg(args[next])
+		next++
+	})
+	if next < len(args) {
+		w.fail(fmt.Errorf("too many arguments for %q", sql))
+	}
+}
+
+func (w *sqlWriter) arg(arg any) {
+	switch a := arg.(type) {
+	case Expr:
+		w.clause(a.SQL, a.Args)
+		return
+	case *QueryBuilder:
+		w.WriteByte('(')
+		a.write(w)
+		w.WriteByte(')')
+		return
+	case []byte:
+		w.WriteByte('?')
+		w.args = append(w.args, a)
+		return
+	}
+
+	v := reflect.ValueOf(arg)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		w.WriteByte('?')
+		w.args = append(w.args, arg)
+		return
+	}
+	if v.Len() == 0 {
+		w.fail(ErrEmptyList)
+		return
+	}
+	for i := range v.Len() {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.WriteByte('?')
+		w.args = append(w.args, v.Index(i).Interface())
+	}
+}
+
+// scanPlaceholders splits sql into text and ? placeholders, ignoring
+// question marks inside string literals and quoted identifiers.
+func scanPlaceholders(sql string, emit func(text string, placeholder bool)) {
+	start := 0
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			emit(sql[start:i], false)
+			emit("?", true)
+			start = i + 1
+		}
+	}
+	emit(sql[start:], false)
+}
+
+// render replaces the placeholders of a finished statement with the
+// dialect's own.
+func render(d Dialect, w *sqlWriter) (string, []any, error) {
+	if w.err != nil {
+		return "", nil, w.err
+	}
+	return d.Rebind(w.String()), w.args, nil
+}
+
+// Rebind replaces the ? placeholders of hand-written SQL with the
+// dialect's own.
+func (d Dialect) Rebind(sql string) string {
+	if d == SQLite {
+		return sql
+	}
+	var out strings.Builder
+	n := 0
+	scanPlaceholders(sql, func(text string, placeholder bool) {
+		if placeholder {
+			n++
+			text = d.Placeholder(n)
+		}
+		out.WriteString(text)
+	})
+	return out.String()
+}
+
+// condition is a WHERE or HAVING term, ANDed with the others.
+type condition struct {
+	sql  string
+	args []any
+}
+
+func writeConditions(w *sqlWriter, keyword string, conds []condition) {
+	for i, c := range conds {
+		if i == 0 {
+			w.WriteString(" " + keyword + " ")
+		} else {
+			w.WriteString(" AND ")
+		}
+		w.WriteByte('(')
+		w.clause(c.sql, c.args)
+		w.WriteByte(')')
+	}
+}
+
+type join struct {
+	kind  string
+	table string
+	on    condition
+}
+
+// QueryBuilder builds SELECT statements. Identifiers are validated and
+// quoted; values only ever travel as arguments.
+type QueryBuilder struct {
+	dialect  Dialect
+	table    string
+	columns  []string
+	exprs    []condition
+	joins    []join
+	where    []condition
+	groupBy  []string
+	having   []condition
+	orderBy  []string
+	sortable map[string]bool
+	limit    int
+	offset   int
+	err      error
+}
+
+// NewQueryBuilder starts a SELECT from table, rendered for SQLite unless
+// Dialect says otherwise.
+func NewQueryBuilder(table string) *QueryBuilder {
+	return &QueryBuilder{table: table}
+}
+
+func (qb *QueryBuilder) Dialect(d Dialect) *QueryBuilder {
+	qb.dialect = d
+	return qb
+}
+
+// Select sets the columns to return. Each is an identifier, optionally
+// qualified and aliased: "id", "u.name", "users.email AS contact".
+func (qb *QueryBuilder) Select(cols ...string) *QueryBuilder {
+	qb.columns = append(qb.columns, cols...)
+	return qb
+}
+
+// SelectExpr adds a computed column, such as "COUNT(*) AS total".
+func (qb *QueryBuilder) SelectExpr(sql string, args ...any) *QueryBuilder {
+	qb.exprs = append(qb.exprs, condition{sql, args})
+	return qb
+}
+
+// Join adds an INNER JOIN. table may carry an alias, as in "orders o".
+func (qb *QueryBuilder) Join(table, on string, args ...any) *QueryBuilder {
+	qb.joins = append(qb.joins, join{"JOIN", table, condition{on, args}})
+	return qb
+}
+
+func (qb *QueryBuilder) LeftJoin(table, on string, args ...any) *QueryBuilder {
+	qb.joins = append(qb.joins, join{"LEFT JOIN", table, condition{on, args}})
+	return qb
+}
+
+// Where adds a condition; several are ANDed. Arguments bind to ?
+// placeholders; see sqlWriter.clause for slices and subqueries.
+func (qb *QueryBuilder) Where(condition string, args ...interface{}) *QueryBuilder {
+	qb.where = append(qb.where, newCondition(condition, args))
+	return qb
+}
+
+func newCondition(sql string, args []any) condition {
+	return condition{sql: sql, args: args}
+}
+
+func (qb *QueryBuilder) GroupBy(cols ...string) *QueryBuilder {
+	qb.groupBy = append(qb.groupBy, cols...)
+	return qb
+}
+
+func (qb *QueryBuilder) Having(condition string, args ...any) *QueryBuilder {
+	qb.having = append(qb.having, newCondition(condition, args))
+	return qb
+}
+
+// Sortable sets the columns OrderBy accepts.
+func (qb *QueryBuilder) Sortable(cols ...string) *QueryBuilder {
+	if qb.sortable == nil {
+		qb.sortable = make(map[string]bool)
+	}
+	for _, c := range cols {
+		qb.sortable[c] = true
+	}
+	return qb
+}
+
+// sortTerm is one column of a sort order.
+type sortTerm struct {
+	column string
+	desc   bool
+}
+
+func (t sortTerm) String() string {
+	if t.desc {
+		return t.column + " DESC"
+	}
+	return t.column + " ASC"
+}
+
+// parseSort parses a comma-separated sort list such as
+// "name, created_at DESC" or "-created_at".
+func parseSort(list string) ([]sortTerm, error) {
+	var terms []sortTerm
+	for _, term := range strings.Split(list, ",") {
+		fields := strings.Fields(term)
+		if len(fields) == 0 {
+			continue
+		}
+		t := sortTerm{column: fields[0]}
+		if strings.HasPrefix(t.column, "-") {
+			t.column, t.desc = t.column[1:], true
+		}
+		valid := len(fields) == 1
+		if len(fields) == 2 {
+			dir := strings.ToUpper(fields[1])
+			valid = dir == "ASC" || dir == "DESC"
+			t.desc = dir == "DESC"
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w %q", ErrInvalidSort, strings.TrimSpace(term))
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+// OrderBy adds sort terms from a sort list as parsed by parseSort. Every
+// column must have been allowed with Sortable, so the list can come
+// straight from a request.
+func (qb *QueryBuilder) OrderBy(orderBy string) *QueryBuilder {
+	terms, err := parseSort(orderBy)
+	if err != nil {
+		qb.fail(err)
+	}
+	for _, t := range terms {
+		if !qb.sortable[t.column] {
+			qb.fail(fmt.Errorf("%w: %q", ErrUnsortableColumn, t.column))
+			continue
+		}
+		quoted, err := quoteIdent(t.column)
+		if err != nil {
+			qb.fail(err)
+			continue
+		}
+		qb.orderBy = append(qb.orderBy, quoted+strings.TrimPrefix(t.String(), t.column))
+	}
+	return qb
+}
+
+func (qb *QueryBuilder) fail(err error) {
+	if qb.err == nil {
+		qb.err = err
+	}
+}
+
+func (qb *QueryBuilder) Limit(limit int) *QueryBuilder {
+	qb.limit = limit
+	return qb
+}
+
+func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
+	qb.offset = offset
+	return qb
+}
+
+// Build returns the SELECT statement and its arguments, or the first
+// error any clause ran into.
+func (qb *QueryBuilder) Build() (string, []interface{}, error) {
+	w := &sqlWriter{}
+	qb.write(w)
+	return render(qb.dialect, w)
+}
+
+// write renders the statement with ? placeholders, so that it can also be
+// embedded in another statement as a subquery.
+func (qb *QueryBuilder) write(w *sqlWriter) {
+	if qb.err != nil {
+		w.fail(qb.err)
+	}
+
+	w.WriteString("SELECT ")
+	if len(qb.columns) == 0 && len(qb.exprs) == 0 {
+		w.WriteString("*")
+	}
+	for i, col := range qb.columns {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		quoted, err := quoteAliased(col)
+		if err != nil {
+			w.fail(err)
+		}
+		w.WriteString(quoted)
+	}
+	for i, e := range qb.exprs {
+		if i > 0 || len(qb.columns) > 0 {
+			w.WriteString(", ")
+		}
+		w.clause(e.sql, e.args)
+	}
+
+	w.WriteString(" FROM ")
+	table, err := quoteAliased(qb.table)
+	if err != nil {
+		w.fail(err)
+	}
+	w.WriteString(table)
+
+	for _, j := range qb.joins {
+		table, err := quoteAliased(j.table)
+		if err != nil {
+			w.fail(err)
+		}
+		w.WriteString(" " + j.kind + " " + table + " ON ")
+		w.clause(j.on.sql, j.on.args)
+	}
+	writeConditions(w, "WHERE", qb.where)
+	if len(qb.groupBy) > 0 {
+		w.WriteString(" GROUP BY ")
+		w.idents(qb.groupBy)
+	}
+	writeConditions(w, "HAVING", qb.having)
+	if len(qb.orderBy) > 0 {
+		w.WriteString(" ORDER BY " + strings.Join(qb.orderBy, ", "))
+	}
+
+	switch {
+	case qb.limit > 0:
+		fmt.Fprintf(w, " LIMIT %d", qb.limit)
+	case qb.offset > 0 && qb.dialect == SQLite:
+		// SQLite only accepts OFFSET after a LIMIT; -1 means no limit.
+		w.WriteString(" LIMIT -1")
+	}
+	if qb.offset > 0 {
+		fmt.Fprintf(w, " OFFSET %d", qb.offset)
+	}
+}
+
+// InsertBuilder builds INSERT statements of one or more rows.
+type InsertBuilder struct {
+	dialect   Dialect
+	table     string
+	columns   []string
+	rows      [][]any
+	conflict  *onConflict
+	returning []string
+}
+
+// onConflict is an upsert clause. Without target columns it skips rows
+// that violate any unique constraint.
+type onConflict struct {
+	target []string
+	update []string
+}
+
+func NewInsert(table string) *InsertBuilder {
+	return &InsertBuilder{table: table}
+}
+
+func (ib *InsertBuilder) Dialect(d Dialect) *InsertBuilder {
+	ib.dialect = d
+	return ib
+}
+
+func (ib *InsertBuilder) Columns(cols ...string) *InsertBuilder {
+	ib.columns = cols
+	return ib
+}
+
+// Values adds a row; it must have one value per column. An Expr value is
+// spliced in as SQL.
+func (ib *InsertBuilder) Values(values ...any) *InsertBuilder {
+	ib.rows = append(ib.rows, values)
+	return ib
+}
+
+// OnConflictDoNothing skips rows that would violate a unique constraint.
+func (ib *InsertBuilder) OnConflictDoNothing() *InsertBuilder {
+	ib.conflict = &onConflict{}
+	return ib
+}
+
+// OnConflictUpdate turns a row whose target columns match an existing
+// row into an update of that row's update columns with the new values.
+// The target columns need a unique index; SQLite supports it from 3.24.
+func (ib *InsertBuilder) OnConflictUpdate(target []string, update ...string) *InsertBuilder {
+	ib.conflict = &onConflict{target: target, update: update}
+	return ib
+}
+
+// Returning asks for columns of the inserted rows back, such as the
+// generated ID. SQLite supports it from 3.35.
+func (ib *InsertBuilder) Returning(cols ...string) *InsertBuilder {
+	ib.returning = cols
+	return ib
+}
+
+func (ib *InsertBuilder) Build() (string, []any, error) {
+	w := &sqlWriter{}
+	if len(ib.columns) == 0 || len(ib.rows) == 0 {
+		w.fail(errors.New("insert needs columns and at least one row"))
+	}
+
+	w.WriteString("INSERT INTO ")
+	w.ident(ib.table)
+	w.WriteString(" (")
+	w.idents(ib.columns)
+	w.WriteString(") VALUES ")
+	for i, row := range ib.rows {
+		if len(row) != len(ib.columns) {
+			w.fail(fmt.Errorf("insert row %d has %d values for %d columns", i+1, len(row), len(ib.columns)))
+		}
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.WriteByte('(')
+		for j, v := range row {
+			if j > 0 {
+				w.WriteString(", ")
+			}
+			writeValue(w, v)
+		}
+		w.WriteByte(')')
+	}
+	if c := ib.conflict; c != nil {
+		writeOnConflict(w, c)
+	}
+	writeReturning(w, ib.returning)
+	return render(ib.dialect, w)
+}
+
+// writeValue binds a single column value. Unlike clause arguments,
+// slices are not expanded: a []byte or other slice is stored as is.
+func writeValue(w *sqlWriter, v any) {
+	if e, ok := v.(Expr); ok {
+		w.clause(e.SQL, e.Args)
+		return
+	}
+	w.WriteByte('?')
+	w.args = append(w.args, v)
+}
+
+func writeOnConflict(w *sqlWriter, c *onConflict) {
+	w.WriteString(" ON CONFLICT")
+	if len(c.target) > 0 {
+		w.WriteString(" (")
+		w.idents(c.target)
+		w.WriteByte(')')
+	}
+	if len(c.update) == 0 {
+		w.WriteString(" DO NOTHING")
+		return
+	}
+	if len(c.target) == 0 {
+		w.fail(errors.New("an upsert needs the columns of a unique index"))
+	}
+	w.WriteString(" DO UPDATE SET ")
+	for i, col := range c.update {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.ident(col)
+		w.WriteString(" = excluded.")
+		w.ident(col)
+	}
+}
+
+func writeReturning(w *sqlWriter, cols []string) {
+	if len(cols) > 0 {
+		w.WriteString(" RETURNING ")
+		w.idents(cols)
+	}
+}
+
+// UpdateBuilder builds UPDATE statements. It refuses to build without a
+// WHERE clause unless All is called.
+type UpdateBuilder struct {
+	dialect   Dialect
+	table     string
+	sets      []string
+	values    []any
+	where     []condition
+	all       bool
+	returning []string
+}
+
+func NewUpdate(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+func (ub *UpdateBuilder) Dialect(d Dialect) *UpdateBuilder {
+	ub.dialect = d
+	return ub
+}
+
+// Set assigns a column; an Expr value is spliced in as SQL.
+func (ub *UpdateBuilder) Set(col string, value any) *UpdateBuilder {
+	ub.sets = append(ub.sets, col)
+	ub.values = append(ub.values, value)
+	return ub
+}
+
+func (ub *UpdateBuilder) Where(condition string, args ...any) *UpdateBuilder {
+	ub.where = append(ub.where, newCondition(condition, args))
+	return ub
+}
+
+// All allows the update to touch every row.
+func (ub *UpdateBuilder) All() *UpdateBuilder {
+	ub.all = true
+	return ub
+}
+
+func (ub *UpdateBuilder) Returning(cols ...string) *UpdateBuilder {
+	ub.returning = cols
+	return ub
+}
+
+func (ub *UpdateBuilder) Build() (string, []any, error) {
+	w := &sqlWriter{}
+	if len(ub.sets) == 0 {
+		w.fail(errors.New("update sets no columns"))
+	}
+	if len(ub.where) == 0 && !ub.all {
+		w.fail(ErrUnfilteredWrite)
+	}
+
+	w.WriteString("UPDATE ")
+	w.ident(ub.table)
+	w.WriteString(" SET ")
+	for i, col := range ub.sets {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.ident(col)
+		w.WriteString(" = ")
+		writeValue(w, ub.values[i])
+	}
+	writeConditions(w, "WHERE", ub.where)
+	writeReturning(w, ub.returning)
+	return render(ub.dialect, w)
+}
+
+// DeleteBuilder builds DELETE statements. Like UpdateBuilder it needs a
+// WHERE clause or an explicit All.
+type DeleteBuilder struct {
+	dialect Dialect
+	table   string
+	where   []condition
+	all     bool
+}
+
+func NewDelete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+func (del *DeleteBuilder) Dialect(d Dialect) *DeleteBuilder {
+	del.dialect = d
+	return del
+}
+
+func (del *DeleteBuilder) Where(condition string, args ...any) *DeleteBuilder {
+	del.where = append(del.where, newCondition(condition, args))
+	return del
+}
+
+func (del *DeleteBuilder) All() *DeleteBuilder {
+	del.all = true
+	return del
+}
+
+func (del *DeleteBuilder) Build() (string, []any, error) {
+	w := &sqlWriter{}
+	if len(del.where) == 0 && !del.all {
+		w.fail(ErrUnfilteredWrite)
+	}
+	w.WriteString("DELETE FROM ")
+	w.ident(del.table)
+	writeConditions(w, "WHERE", del.where)
+	return render(del.dialect, w)
+}
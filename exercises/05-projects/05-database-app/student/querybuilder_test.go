@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type builder interface {
+	Build() (string, []any, error)
+}
+
+func TestBuilders(t *testing.T) {
+	activeIDs := NewQueryBuilder("products").Select("id").Where("active = ?", true)
+
+	tests := []struct {
+		name     string
+		builder  builder
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:    "select everything",
+			builder: NewQueryBuilder("users"),
+			wantSQL: `SELECT * FROM "users"`,
+		},
+		{
+			name: "where, order and page",
+			builder: NewQueryBuilder("users").Select("id", "username").
+				Where("email = ?", "ann@example.com").Where("id > ?", 10).
+				Sortable("username", "created_at").OrderBy("-created_at, username").
+				Limit(20).Offset(40),
+			wantSQL:  `SELECT "id", "username" FROM "users" WHERE (email = ?) AND (id > ?) ORDER BY "created_at" DESC, "username" ASC LIMIT 20 OFFSET 40`,
+			wantArgs: []any{"ann@example.com", 10},
+		},
+		{
+			name:    "offset without limit",
+			builder: NewQueryBuilder("users").Offset(5),
+			wantSQL: `SELECT * FROM "users" LIMIT -1 OFFSET 5`,
+		},
+		{
+			name: "join and group",
+			builder: NewQueryBuilder("users u").Select("u.id", "u.username AS name").
+				SelectExpr("COUNT(o.id) AS orders").
+				LeftJoin("orders AS o", "o.user_id = u.id AND o.status <> ?", "cancelled").
+				GroupBy("u.id", "u.username").
+				Having("COUNT(o.id) >= ?", 2),
+			wantSQL:  `SELECT "u"."id", "u"."username" AS "name", COUNT(o.id) AS orders FROM "users" AS "u" LEFT JOIN "orders" AS "o" ON o.user_id = u.id AND o.status <> ? GROUP BY "u"."id", "u"."username" HAVING (COUNT(o.id) >= ?)`,
+			wantArgs: []any{"cancelled", 2},
+		},
+		{
+			name:     "in list and subquery",
+			builder:  NewQueryBuilder("order_items").Where("order_id IN (?)", []int{1, 2, 3}).Where("product_id IN ?", activeIDs),
+			wantSQL:  `SELECT * FROM "order_items" WHERE (order_id IN (?, ?, ?)) AND (product_id IN (SELECT "id" FROM "products" WHERE (active = ?)))`,
+			wantArgs: []any{1, 2, 3, true},
+		},
+		{
+			name:     "question marks in literals are not placeholders",
+			builder:  NewQueryBuilder("users").Where("username <> '?' AND id = ?", 1),
+			wantSQL:  `SELECT * FROM "users" WHERE (username <> '?' AND id = ?)`,
+			wantArgs: []any{1},
+		},
+		{
+			name:     "postgres placeholders",
+			builder:  NewQueryBuilder("order_items").Dialect(Postgres).Where("order_id IN (?)", []int{7, 8}).Where("product_id IN ?", activeIDs),
+			wantSQL:  `SELECT * FROM "order_items" WHERE (order_id IN ($1, $2)) AND (product_id IN (SELECT "id" FROM "products" WHERE (active = $3)))`,
+			wantArgs: []any{7, 8, true},
+		},
+		{
+			name:     "insert",
+			builder:  NewInsert("users").Columns("username", "email").Values("ann", "a@x").Values("bo", "b@x").Returning("id"),
+			wantSQL:  `INSERT INTO "users" ("username", "email") VALUES (?, ?), (?, ?) RETURNING "id"`,
+			wantArgs: []any{"ann", "a@x", "bo", "b@x"},
+		},
+		{
+			name:     "insert keeps byte slices whole",
+			builder:  NewInsert("files").Dialect(Postgres).Columns("data").Values([]byte("abc")),
+			wantSQL:  `INSERT INTO "files" ("data") VALUES ($1)`,
+			wantArgs: []any{[]byte("abc")},
+		},
+		{
+			name:     "upsert",
+			builder:  NewInsert("users").Dialect(Postgres).Columns("username", "email").Values("ann", "a@x").OnConflictUpdate([]string{"email"}, "username"),
+			wantSQL:  `INSERT INTO "users" ("username", "email") VALUES ($1, $2) ON CONFLICT ("email") DO UPDATE SET "username" = excluded."username"`,
+			wantArgs: []any{"ann", "a@x"},
+		},
+		{
+			name:     "insert or skip",
+			builder:  NewInsert("users").Columns("username").Values("ann").OnConflictDoNothing(),
+			wantSQL:  `INSERT INTO "users" ("username") VALUES (?) ON CONFLICT DO NOTHING`,
+			wantArgs: []any{"ann"},
+		},
+		{
+			name:     "update with expression",
+			builder:  NewUpdate("products").Dialect(Postgres).Set("stock", Raw("stock - ?", 2)).Set("name", "Widget").Where("id = ?", 5).Where("stock >= ?", 2),
+			wantSQL:  `UPDATE "products" SET "stock" = stock - $1, "name" = $2 WHERE (id = $3) AND (stock >= $4)`,
+			wantArgs: []any{2, "Widget", 5, 2},
+		},
+		{
+			name:     "delete",
+			builder:  NewDelete("users").Where("id IN (?)", []int{4, 5}),
+			wantSQL:  `DELETE FROM "users" WHERE (id IN (?, ?))`,
+			wantArgs: []any{4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := tt.builder.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.wantSQL {
+				t.Errorf("SQL:\n got  %s\n want %s", sql, tt.wantSQL)
+			}
+			if len(args) != 0 || len(tt.wantArgs) != 0 {
+				if !reflect.DeepEqual(args, tt.wantArgs) {
+					t.Errorf("args: got %v, want %v", args, tt.wantArgs)
+				}
+			}
+		})
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder builder
+		want    error
+	}{
+		{"sort column not allowed", NewQueryBuilder("users").Sortable("username").OrderBy("password_hash"), ErrUnsortableColumn},
+		{"sort injection", NewQueryBuilder("users").Sortable("username").OrderBy("username; DROP TABLE users"), nil},
+		{"bad direction", NewQueryBuilder("users").Sortable("username").OrderBy("username sideways"), nil},
+		{"bad table", NewQueryBuilder("users; DROP TABLE users"), ErrInvalidIdentifier},
+		{"bad column", NewQueryBuilder("users").Select(`id"`), ErrInvalidIdentifier},
+		{"bad subquery", NewQueryBuilder("users").Where("id IN ?", NewQueryBuilder("x y z")), ErrInvalidIdentifier},
+		{"missing argument", NewQueryBuilder("users").Where("id = ? OR id = ?", 1), nil},
+		{"extra argument", NewQueryBuilder("users").Where("id = ?", 1, 2), nil},
+		{"insert row width", NewInsert("users").Columns("a", "b").Values(1), nil},
+		{"update everything", NewUpdate("users").Set("email", ""), ErrUnfilteredWrite},
+		{"delete everything", NewDelete("users"), ErrUnfilteredWrite},
+		{"empty in list", NewQueryBuilder("users").Where("id IN (?)", []int{}), ErrEmptyList},
+		{"empty not in list", NewQueryBuilder("users").Where("id NOT IN (?)", []int{}), ErrEmptyList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, _, err := tt.builder.Build()
+			if err == nil {
+				t.Fatalf("expected an error, got %s", sql)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, _, err := NewDelete("users").All().Build(); err != nil {
+		t.Errorf("All should allow an unfiltered delete, got %v", err)
+	}
+}
+
+func TestBuiltQueriesRun(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	insert := NewInsert("users").Columns("username", "email", "password_hash")
+	for _, name := range []string{"ann", "bo", "cy"} {
+		insert.Values(name, name+"@example.com", "x")
+	}
+	sql, args, err := insert.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(sql, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	sql, args, err = NewQueryBuilder("users").Select("username").
+		Where("id IN (?)", []int{1, 3}).
+		Sortable("username").OrderBy("-username").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.db.Query(sql, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	if !reflect.DeepEqual(names, []string{"cy", "ann"}) {
+		t.Errorf("expected [cy ann], got %v", names)
+	}
+}
+
+func TestDialectDriversAreRegistered(t *testing.T) {
+	for url, want := range map[string]Dialect{
+		"shop.db":                          SQLite,
+		"postgres://shop@localhost/shop":   Postgres,
+		"postgresql://shop@localhost/shop": Postgres,
+	} {
+		driver, dialect := dialectFor(url)
+		if dialect != want {
+			t.Errorf("%s: expected %s, got %s", url, want, dialect)
+		}
+		if !slices.Contains(sql.Drivers(), driver) {
+			t.Errorf("%s: driver %q is not registered", url, driver)
+		}
+	}
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := `DELETE FROM notes WHERE owner = ? AND body <> '?' AND id > ?`
+	if got := SQLite.Rebind(query); got != query {
+		t.Errorf("sqlite: expected the query unchanged, got %s", got)
+	}
+	want := `DELETE FROM notes WHERE owner = $1 AND body <> '?' AND id > $2`
+	if got := Postgres.Rebind(query); got != want {
+		t.Errorf("postgres: got %s\nwant %s", got, want)
+	}
+}
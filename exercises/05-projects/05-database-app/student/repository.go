@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Model hooks. A model implements the ones it needs on its pointer type;
+// an error from a Before hook stops the write, and one from an After hook
+// is returned after the write happened, so it should be wrapped in a
+// transaction if it must undo it.
+type (
+	BeforeCreateHook interface {
+		BeforeCreate(ctx context.Context) error
+	}
+	AfterCreateHook interface {
+		AfterCreate(ctx context.Context) error
+	}
+	BeforeUpdateHook interface {
+		BeforeUpdate(ctx context.Context) error
+	}
+	AfterUpdateHook interface {
+		AfterUpdate(ctx context.Context) error
+	}
+)
+
+// Filter is a condition on a model's columns, built from a Column so that
+// its values have the column's type.
+type Filter struct {
+	expr Expr
+}
+
+// Column is a filterable column whose values have type V.
+type Column[V any] struct {
+	name   string
+	quoted string
+}
+
+// Col declares a column. It panics on an invalid name, since columns are
+// declared once by the program, not taken from input.
+func Col[V any](name string) Column[V] {
+	return Column[V]{name: name, quoted: mustQuoteIdent(name)}
+}
+
+// compare compares a value stored in several columns, such as Money, on
+// its first column, and matches only rows equal to it in the others, such
+// as the currency.
+func (c Column[V]) compare(op string, v V) Filter {
+	mc, ok := any(&v).(multiColumn)
+	if !ok {
+		return Filter{Raw(c.quoted+" "+op+" ?", v)}
+	}
+	if op == "<>" {
+		return Not(c.compare("=", v))
+	}
+	suffixes, parts := mc.columns()
+	conds := []string{c.quoted + " " + op + " ?"}
+	for _, suffix := range suffixes[1:] {
+		conds = append(conds, mustQuoteIdent(c.name+suffix)+" = ?")
+	}
+	return Filter{Raw(strings.Join(conds, " AND "), parts...)}
+}
+
+func (c Column[V]) Eq(v V) Filter  { return c.compare("=", v) }
+func (c Column[V]) Ne(v V) Filter  { return c.compare("<>", v) }
+func (c Column[V]) Lt(v V) Filter  { return c.compare("<", v) }
+func (c Column[V]) Lte(v V) Filter { return c.compare("<=", v) }
+func (c Column[V]) Gt(v V) Filter  { return c.compare(">", v) }
+func (c Column[V]) Gte(v V) Filter { return c.compare(">=", v) }
+
+// In matches any of values; with none it matches nothing, and its Not
+// matches everything.
+func (c Column[V]) In(values ...V) Filter {
+	if len(values) == 0 {
+		// The builder refuses an empty list; 1 = 0 also gives Not its
+		// meaning.
+		return Filter{Raw("1 = 0")}
+	}
+	if _, ok := any(&values[0]).(multiColumn); ok {
+		filters := make([]Filter, len(values))
+		for i, v := range values {
+			filters[i] = c.Eq(v)
+		}
+		return Or(filters...)
+	}
+	return Filter{Raw(c.quoted+" IN (?)", values)}
+}
+
+// Like matches a LIKE pattern, where % and _ are wildcards.
+func (c Column[V]) Like(pattern string) Filter {
+	return Filter{Raw(c.quoted+" LIKE ?", pattern)}
+}
+
+func (c Column[V]) IsNull() Filter  { return Filter{Raw(c.quoted + " IS NULL")} }
+func (c Column[V]) NotNull() Filter { return Filter{Raw(c.quoted + " IS NOT NULL")} }
+
+// And matches when all filters do; Or when any does.
+func And(filters ...Filter) Filter { return combine(" AND ", filters) }
+func Or(filters ...Filter) Filter  { return combine(" OR ", filters) }
+
+func Not(f Filter) Filter {
+	return Filter{Raw("NOT (?)", f.expr)}
+}
+
+func combine(op string, filters []Filter) Filter {
+	if len(filters) == 0 {
+		return Filter{Raw("1 = 1")}
+	}
+	parts := make([]string, len(filters))
+	args := make([]any, len(filters))
+	for i, f := range filters {
+		parts[i], args[i] = "(?)", f.expr
+	}
+	return Filter{Raw(strings.Join(parts, op), args...)}
+}
+
+// ListOptions selects a page of models.
+type ListOptions struct {
+	Filters []Filter
+	// Sort is a sort list as accepted by QueryBuilder.OrderBy, checked
+	// against the repository's sortable columns. Empty means by ID.
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// Page is one page of a list, with the number of matches on all pages.
+type Page[T any] struct {
+	Items  []*T `json:"items"`
+	Total  int  `json:"total"`
+	Limit  int  `json:"limit"`
+	Offset int  `json:"offset"`
+}
+
+// RepositoryConfig is everything a model has to say about its storage.
+type RepositoryConfig struct {
+	Table string
+	// Sortable lists the columns clients may sort by.
+	Sortable []string
+	// MaxLimit caps the page size; zero means 100.
+	MaxLimit int
+	// Cursors signs the cursors of Paginate.
+	Cursors *CursorCodec
+}
+
+// Repository stores models of type T in one table, mapping columns by the
+// db tags of T and running its hooks around writes.
+type Repository[T any] struct {
+	q      Querier
+	config RepositoryConfig
+}
+
+func NewRepository[T any](q Querier, config RepositoryConfig) *Repository[T] {
+	if config.MaxLimit == 0 {
+		config.MaxLimit = 100
+	}
+	return &Repository[T]{q: q, config: config}
+}
+
+// WithTx returns the repository working inside tx.
+func (r *Repository[T]) WithTx(tx *Tx) *Repository[T] {
+	return &Repository[T]{q: tx, config: r.config}
+}
+
+func (r *Repository[T]) Create(ctx context.Context, v *T) error {
+	if h, ok := any(v).(BeforeCreateHook); ok {
+		if err := h.BeforeCreate(ctx); err != nil {
+			return err
+		}
+	}
+	if err := Insert(ctx, r.q, r.config.Table, v); err != nil {
+		return handleDatabaseError(err)
+	}
+	if h, ok := any(v).(AfterCreateHook); ok {
+		return h.AfterCreate(ctx)
+	}
+	return nil
+}
+
+// Get returns the model with the given ID, or ErrNotFound.
+func (r *Repository[T]) Get(ctx context.Context, id int) (*T, error) {
+	rows, err := r.query(ctx, r.selectQuery().Where(`"id" = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	v, err := ScanOne[T](rows)
+	return v, handleDatabaseError(err)
+}
+
+// List returns the page opts asks for and the total number of matches.
+func (r *Repository[T]) List(ctx context.Context, opts ListOptions) (*Page[T], error) {
+	if opts.Limit <= 0 || opts.Limit > r.config.MaxLimit {
+		opts.Limit = r.config.MaxLimit
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	if opts.Sort == "" {
+		opts.Sort = "id"
+	}
+
+	qb := r.selectQuery().Sortable(r.config.Sortable...).Sortable("id").
+		OrderBy(opts.Sort).Limit(opts.Limit).Offset(opts.Offset)
+	applyFilters(qb, opts.Filters)
+	rows, err := r.query(ctx, qb)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ScanAll[T](rows)
+	if err != nil {
+		return nil, handleDatabaseError(err)
+	}
+
+	total, err := r.Count(ctx, opts.Filters...)
+	if err != nil {
+		return nil, err
+	}
+	return &Page[T]{Items: items, Total: total, Limit: opts.Limit, Offset: opts.Offset}, nil
+}
+
+// Count returns the number of models matching all filters.
+func (r *Repository[T]) Count(ctx context.Context, filters ...Filter) (int, error) {
+	qb := NewQueryBuilder(r.config.Table).SelectExpr("COUNT(*)")
+	applyFilters(qb, filters)
+	query, args, err := qb.Dialect(r.q.Dialect()).Build()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = r.q.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, handleDatabaseError(err)
+}
+
+func (r *Repository[T]) Update(ctx context.Context, v *T) error {
+	if h, ok := any(v).(BeforeUpdateHook); ok {
+		if err := h.BeforeUpdate(ctx); err != nil {
+			return err
+		}
+	}
+	if err := Update(ctx, r.q, r.config.Table, v); err != nil {
+		return handleDatabaseError(err)
+	}
+	if h, ok := any(v).(AfterUpdateHook); ok {
+		return h.AfterUpdate(ctx)
+	}
+	return nil
+}
+
+// Delete removes the model with the given ID, or returns ErrNotFound.
+func (r *Repository[T]) Delete(ctx context.Context, id int) error {
+	query, args, err := NewDelete(r.config.Table).Dialect(r.q.Dialect()).Where(`"id" = ?`, id).Build()
+	if err != nil {
+		return err
+	}
+	res, err := r.q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return handleDatabaseError(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return handleDatabaseError(sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (r *Repository[T]) selectQuery() *QueryBuilder {
+	return NewQueryBuilder(r.config.Table).Select(Columns[T]()...)
+}
+
+func (r *Repository[T]) query(ctx context.Context, qb *QueryBuilder) (*sql.Rows, error) {
+	query, args, err := qb.Dialect(r.q.Dialect()).Build()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	return rows, handleDatabaseError(err)
+}
+
+func applyFilters(qb *QueryBuilder, filters []Filter) {
+	for _, f := range filters {
+		qb.Where(f.expr.SQL, f.expr.Args...)
+	}
+}
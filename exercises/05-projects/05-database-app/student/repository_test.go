@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func seedProducts(t *testing.T, db *Database) {
+	t.Helper()
+	for _, p := range []*Product{
+		{Name: "Anvil", Price: usd("120"), Stock: 2, Active: true},
+		{Name: "Bolt", Price: usd("0.25"), Stock: 1000, Active: true},
+		{Name: "Crate", Price: usd("15"), Stock: 0, Active: true},
+		{Name: "Drill", Price: usd("80"), Stock: 5, Active: false},
+		{Name: "Epoxy", Price: usd("15"), Stock: 40, Active: true},
+	} {
+		if err := db.CreateProduct(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func names(products []*Product) []string {
+	var out []string
+	for _, p := range products {
+		out = append(out, p.Name)
+	}
+	return out
+}
+
+func TestRepositoryListFiltersSortsAndCounts(t *testing.T) {
+	db := newMigratedDB(t)
+	seedProducts(t, db)
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		opts  ListOptions
+		want  []string
+		total int
+	}{
+		{"default order", ListOptions{}, []string{"Anvil", "Bolt", "Crate", "Drill", "Epoxy"}, 5},
+		{
+			"filtered and paged",
+			ListOptions{Filters: []Filter{ProductFields.Active.Eq(true)}, Sort: "-price, name", Limit: 2, Offset: 1},
+			[]string{"Crate", "Epoxy"}, 4,
+		},
+		{
+			"or, in and not",
+			ListOptions{Filters: []Filter{
+				Or(ProductFields.Stock.Eq(0), ProductFields.Price.Gte(usd("100"))),
+				Not(ProductFields.Name.In("Anvil", "Bolt")),
+			}},
+			[]string{"Crate"}, 1,
+		},
+		{"like", ListOptions{Filters: []Filter{ProductFields.Name.Like("%r%")}, Sort: "-name"}, []string{"Drill", "Crate"}, 2},
+		{"empty in", ListOptions{Filters: []Filter{ProductFields.ID.In()}}, nil, 0},
+		{"not empty in", ListOptions{Filters: []Filter{Not(ProductFields.ID.In())}}, []string{"Anvil", "Bolt", "Crate", "Drill", "Epoxy"}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := db.Products().List(ctx, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page.Items); !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+			if page.Total != tt.total {
+				t.Errorf("expected total %d, got %d", tt.total, page.Total)
+			}
+		})
+	}
+
+	if _, err := db.Products().List(ctx, ListOptions{Sort: "description"}); !errors.Is(err, ErrUnsortableColumn) {
+		t.Errorf("expected %v, got %v", ErrUnsortableColumn, err)
+	}
+	page, _ := db.Products().List(ctx, ListOptions{Limit: 1000})
+	if page.Limit != 100 {
+		t.Errorf("expected the limit capped at 100, got %d", page.Limit)
+	}
+}
+
+func TestRepositoryHooks(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+
+	if err := db.Users().Create(ctx, &User{Username: "x", Email: "nope", PasswordHash: "h"}); err == nil {
+		t.Fatal("expected BeforeCreate to reject an invalid user")
+	}
+	if n, _ := db.Users().Count(ctx); n != 0 {
+		t.Errorf("a rejected user was stored")
+	}
+
+	user := &User{Username: "ann", Email: "ann@example.com", PasswordHash: "h"}
+	if err := db.Users().Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.CreatedAt.IsZero() || !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Errorf("timestamps not set: %+v", user)
+	}
+
+	created := user.CreatedAt
+	time.Sleep(time.Millisecond)
+	if err := db.Users().Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if !user.CreatedAt.Equal(created) || !user.UpdatedAt.After(created) {
+		t.Errorf("update should only move updated_at: %+v", user)
+	}
+
+	order := &Order{UserID: user.ID}
+	if err := db.Orders().Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != "pending" {
+		t.Errorf("expected a new order to be pending, got %q", order.Status)
+	}
+	var validation *ValidationError
+	if err := db.OrderItems().Create(ctx, &OrderItem{OrderID: order.ID, ProductID: 1}); !errors.As(err, &validation) || validation.Field != "quantity" {
+		t.Errorf("expected a quantity validation error, got %v", err)
+	}
+}
+
+func TestRepositoryWithTx(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Products().WithTx(tx).Create(ctx, &Product{Name: "Temp", Price: usd("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.Products().WithTx(tx).Count(ctx); n != 1 {
+		t.Errorf("expected the product inside the transaction, got %d", n)
+	}
+	tx.Rollback()
+	if n, _ := db.Products().Count(ctx); n != 0 {
+		t.Errorf("expected the rollback to discard the product, got %d", n)
+	}
+}
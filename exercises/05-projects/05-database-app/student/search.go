@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSearch is returned for a query scoped to a field that cannot
+// be searched.
+var ErrInvalidSearch = errors.New("invalid search query")
+
+// SearchHit is one search result.
+type SearchHit[T any] struct {
+	Item *T `json:"item"`
+	// Snippet is an HTML excerpt of the best matching field, with the
+	// matches in <mark> elements and everything else escaped.
+	Snippet string `json:"snippet"`
+	// Score is the BM25 relevance, higher for better matches. It is zero
+	// for all hits of the LIKE fallback.
+	Score float64 `json:"score"`
+}
+
+// searchTerm is one term of a search query. All terms must match.
+type searchTerm struct {
+	// field is the column to search, or empty for all of them.
+	field  string
+	text   string
+	phrase bool
+	prefix bool
+}
+
+// parseSearch parses a query such as
+//
+//	lap* "gaming mouse" name:logitech description:"usb c"
+//
+// into terms: words, quoted phrases, a trailing * for a prefix, and a
+// field: prefix to search one of fields only.
+func parseSearch(query string, fields []string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		var t searchTerm
+		if i := strings.IndexAny(rest, `: "`); i > 0 && rest[i] == ':' {
+			t.field, rest = rest[:i], rest[i+1:]
+			if !slices.Contains(fields, t.field) {
+				return nil, fmt.Errorf("%w: cannot search by %q; try %s", ErrInvalidSearch, t.field, strings.Join(fields, ", "))
+			}
+		}
+
+		if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+			// An unterminated phrase runs to the end of the query.
+			t.text, rest, _ = strings.Cut(quoted, `"`)
+			t.phrase = true
+			rest, t.prefix = strings.CutPrefix(rest, "*")
+		} else {
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			t.text, rest = rest[:end], rest[end:]
+			t.prefix = strings.HasSuffix(t.text, "*")
+			t.text = strings.TrimRight(t.text, "*")
+		}
+		if t.text = strings.TrimSpace(t.text); t.text != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms, nil
+}
+
+// ftsMatch renders terms as an FTS5 MATCH expression. Every term becomes
+// a quoted string, so no input is read as FTS5 syntax.
+func ftsMatch(terms []searchTerm) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		s := `"` + strings.ReplaceAll(t.text, `"`, `""`) + `"`
+		if t.prefix {
+			s += "*"
+		}
+		if t.field != "" {
+			s = t.field + " : " + s
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// likeFilters matches terms with LIKE, for databases without FTS5. It
+// finds substrings rather than words, and cannot use an index.
+func likeFilters(terms []searchTerm, fields []string) []Filter {
+	var filters []Filter
+	for _, t := range terms {
+		pattern := "%" + likeEscaper.Replace(t.text) + "%"
+		scope := fields
+		if t.field != "" {
+			scope = []string{t.field}
+		}
+		var matches []Filter
+		for _, f := range scope {
+			matches = append(matches, Filter{Raw(mustQuoteIdent(f)+` LIKE ? ESCAPE '\'`, pattern)})
+		}
+		filters = append(filters, Or(matches...))
+	}
+	return filters
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Snippet markers: control characters that never occur in stored text,
+// replaced with <mark> tags once the snippet has been escaped.
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+	// snippetWidth is the length of the LIKE fallback's snippets, in
+	// bytes; FTS5 snippets are snippetTokens tokens long.
+	snippetWidth  = 80
+	snippetTokens = 16
+)
+
+var markReplacer = strings.NewReplacer(markOpen, "<mark>", markClose, "</mark>")
+
+// searchConfig describes a repository's full-text index.
+type searchConfig struct {
+	// fts is the FTS5 table indexing fields of the repository's table, by
+	// its IDs. Its rank option sets the BM25 weights.
+	fts    string
+	fields []string
+	// fallbackSort orders the hits of the LIKE fallback.
+	fallbackSort string
+}
+
+// search returns the models matching query, best first. It uses the FTS5
+// index if the database has one, and LIKE otherwise.
+func search[T any](ctx context.Context, db *Database, r *Repository[T], config searchConfig, query string, limit, offset int, filters ...Filter) ([]SearchHit[T], error) {
+	terms, err := parseSearch(query, config.fields)
+	if err != nil || len(terms) == 0 {
+		return nil, err
+	}
+	if limit <= 0 || limit > r.config.MaxLimit {
+		limit = r.config.MaxLimit
+	}
+	offset = max(offset, 0)
+
+	fts, err := db.hasTable(ctx, config.fts)
+	if err != nil {
+		return nil, err
+	}
+	if fts {
+		return searchFTS(ctx, r, config, terms, limit, offset, filters)
+	}
+	return searchLike(ctx, r, config, terms, limit, offset, filters)
+}
+
+// hasTable reports whether a SQLite database has the table; it is always
+// false for other databases.
+func (db *Database) hasTable(ctx context.Context, name string) (bool, error) {
+	if db.dialect != SQLite {
+		return false, nil
+	}
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	return n > 0, err
+}
+
+// searchFTS ranks the matching IDs in the index, then loads their models.
+func searchFTS[T any](ctx context.Context, r *Repository[T], config searchConfig, terms []searchTerm, limit, offset int, filters []Filter) ([]SearchHit[T], error) {
+	table := r.config.Table
+	qb := NewQueryBuilder(config.fts).
+		Select(config.fts+".rowid").
+		SelectExpr(fmt.Sprintf("snippet(%s, -1, ?, ?, ?, %d)", mustQuoteIdent(config.fts), snippetTokens), markOpen, markClose, "…").
+		SelectExpr(`-"rank"`).
+		Join(table, mustQuoteIdent(table+".id")+" = "+mustQuoteIdent(config.fts+".rowid")).
+		Where(mustQuoteIdent(config.fts)+" MATCH ?", ftsMatch(terms)).
+		Sortable("rank").OrderBy("rank").Limit(limit).Offset(offset)
+	applyFilters(qb, filters)
+	rows, err := r.query(ctx, qb)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []SearchHit[T]
+	var ids []int
+	for rows.Next() {
+		var id int
+		var hit SearchHit[T]
+		if err := rows.Scan(&id, &hit.Snippet, &hit.Score); err != nil {
+			return nil, err
+		}
+		hit.Snippet = markReplacer.Replace(html.EscapeString(hit.Snippet))
+		hits = append(hits, hit)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, handleDatabaseError(err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	items, err := r.query(ctx, r.selectQuery().Where(`"id" IN (?)`, ids))
+	if err != nil {
+		return nil, err
+	}
+	models, err := ScanAll[T](items)
+	if err != nil {
+		return nil, handleDatabaseError(err)
+	}
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*T, len(models))
+	for _, m := range models {
+		byID[int(reflect.ValueOf(m).Elem().FieldByIndex(plan.fields[plan.pk].index).Int())] = m
+	}
+
+	// A model deleted between the two queries is left out.
+	found := hits[:0]
+	for i, hit := range hits {
+		if hit.Item = byID[ids[i]]; hit.Item != nil {
+			found = append(found, hit)
+		}
+	}
+	return found, nil
+}
+
+func searchLike[T any](ctx context.Context, r *Repository[T], config searchConfig, terms []searchTerm, limit, offset int, filters []Filter) ([]SearchHit[T], error) {
+	qb := r.selectQuery().Sortable(config.fallbackSort, "id").
+		OrderBy(config.fallbackSort + ", id").Limit(limit).Offset(offset)
+	applyFilters(qb, append(filters, likeFilters(terms, config.fields)...))
+	rows, err := r.query(ctx, qb)
+	if err != nil {
+		return nil, err
+	}
+	models, err := ScanAll[T](rows)
+	if err != nil {
+		return nil, handleDatabaseError(err)
+	}
+
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]SearchHit[T], len(models))
+	for i, m := range models {
+		v := reflect.ValueOf(m).Elem()
+		var texts []string
+		for _, f := range config.fields {
+			texts = append(texts, v.FieldByIndex(plan.fields[plan.byColumn[f]].index).String())
+		}
+		hits[i] = SearchHit[T]{Item: m, Snippet: likeSnippet(texts, terms)}
+	}
+	return hits, nil
+}
+
+// likeSnippet excerpts the first of texts that matches a term, around the
+// first match, and marks every match in the excerpt.
+func likeSnippet(texts []string, terms []searchTerm) string {
+	alternatives := make([]string, len(terms))
+	for i, t := range terms {
+		alternatives[i] = regexp.QuoteMeta(t.text)
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(alternatives, "|"))
+
+	for _, text := range texts {
+		loc := re.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+		start, end := 0, len(text)
+		if len(text) > snippetWidth {
+			start = max(0, loc[0]-snippetWidth/4)
+			end = min(len(text), start+snippetWidth)
+			for start > 0 && !utf8.RuneStart(text[start]) {
+				start--
+			}
+			for end < len(text) && !utf8.RuneStart(text[end]) {
+				end++
+			}
+		}
+
+		var b strings.Builder
+		if start > 0 {
+			b.WriteString("…")
+		}
+		excerpt, last := text[start:end], 0
+		for _, m := range re.FindAllStringIndex(excerpt, -1) {
+			b.WriteString(html.EscapeString(excerpt[last:m[0]]))
+			b.WriteString("<mark>" + html.EscapeString(excerpt[m[0]:m[1]]) + "</mark>")
+			last = m[1]
+		}
+		b.WriteString(html.EscapeString(excerpt[last:]))
+		if end < len(text) {
+			b.WriteString("…")
+		}
+		return b.String()
+	}
+	return ""
+}
+
+var (
+	userSearch    = searchConfig{fts: "users_fts", fields: []string{"username", "email"}, fallbackSort: "username"}
+	productSearch = searchConfig{fts: "products_fts", fields: []string{"name", "description"}, fallbackSort: "name"}
+)
+
+// SearchUsers finds users by username and email.
+func (db *Database) SearchUsers(query string, limit, offset int) ([]SearchHit[User], error) {
+	return search(context.Background(), db, db.Users(), userSearch, query, limit, offset)
+}
+
+// SearchProducts finds active products by name and description.
+func (db *Database) SearchProducts(query string, limit, offset int) ([]SearchHit[Product], error) {
+	return search(context.Background(), db, db.Products(), productSearch, query, limit, offset, ProductFields.Active.Eq(true))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseSearch(t *testing.T) {
+	fields := []string{"name", "description"}
+	tests := []struct {
+		query string
+		want  []searchTerm
+		match string
+	}{
+		{"", nil, ""},
+		{"  lap*  ", []searchTerm{{text: "lap", prefix: true}}, `"lap"*`},
+		{
+			`"gaming mouse" name:logi* description:"usb c"`,
+			[]searchTerm{
+				{text: "gaming mouse", phrase: true},
+				{field: "name", text: "logi", prefix: true},
+				{field: "description", text: "usb c", phrase: true},
+			},
+			`"gaming mouse" AND name : "logi"* AND description : "usb c"`,
+		},
+		// FTS5 syntax in the input is matched as text.
+		{`NEAR(a b) OR "x`, []searchTerm{{text: "NEAR(a"}, {text: "b)"}, {text: "OR"}, {text: "x", phrase: true}}, `"NEAR(a" AND "b)" AND "OR" AND "x"`},
+		{`say "" 12":00`, []searchTerm{{text: "say"}, {text: `12":00`}}, `"say" AND "12"":00"`},
+	}
+	for _, tt := range tests {
+		got, err := parseSearch(tt.query, fields)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %+v, got %+v", tt.query, tt.want, got)
+		}
+		if match := ftsMatch(got); match != tt.match {
+			t.Errorf("%q: expected MATCH %s, got %s", tt.query, tt.match, match)
+		}
+	}
+
+	if _, err := parseSearch("price:10", fields); !errors.Is(err, ErrInvalidSearch) {
+		t.Errorf("expected %v, got %v", ErrInvalidSearch, err)
+	}
+}
+
+func seedCatalog(t *testing.T, db *Database) {
+	t.Helper()
+	for _, p := range []*Product{
+		{Name: "Claw hammer", Description: "Forged steel head with a rubber grip.", Price: usd("25"), Active: true},
+		{Name: "Steel rule", Description: "A 30 cm rule for <measuring> & marking.", Price: usd("8"), Active: true},
+		{Name: "Mallet", Description: "Rubber head; no steel to mar the work.", Price: usd("12"), Active: true},
+		{Name: "Steel wool", Description: "Retired.", Price: usd("3"), Active: false},
+	} {
+		if err := db.CreateProduct(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func productNames(hits []SearchHit[Product]) []string {
+	var out []string
+	for _, h := range hits {
+		out = append(out, h.Item.Name)
+	}
+	return out
+}
+
+func TestSearchProductsFTS(t *testing.T) {
+	db := newMigratedDB(t)
+	if ok, err := db.hasTable(context.Background(), "products_fts"); err != nil || !ok {
+		t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+	}
+	seedCatalog(t, db)
+
+	// A name match outranks a description match, and inactive products
+	// are left out.
+	hits, err := db.SearchProducts("steel", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := productNames(hits); !reflect.DeepEqual(got, []string{"Steel rule", "Claw hammer", "Mallet"}) {
+		t.Fatalf("unexpected ranking %v", got)
+	}
+	if hits[0].Score <= hits[1].Score {
+		t.Errorf("expected descending scores, got %v and %v", hits[0].Score, hits[1].Score)
+	}
+	if !strings.Contains(hits[1].Snippet, "<mark>steel</mark>") {
+		t.Errorf("expected the match marked, got %q", hits[1].Snippet)
+	}
+
+	for query, want := range map[string][]string{
+		"hamm*":                      {"Claw hammer"},
+		"measure":                    {"Steel rule"}, // stemmed
+		`"rubber grip"`:              {"Claw hammer"},
+		`name:steel description:cm`:  {"Steel rule"},
+		"description:mallet":         nil,
+		`rubber "steel" head`:        {"Claw hammer", "Mallet"},
+		`"steel rule" OR NEAR(claw)`: nil,
+	} {
+		hits, err := db.SearchProducts(query, 10, 0)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if got := productNames(hits); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", query, want, got)
+		}
+	}
+
+	// Text around the match is escaped.
+	hits, _ = db.SearchProducts("measuring", 10, 0)
+	if len(hits) != 1 || !strings.Contains(hits[0].Snippet, "&lt;<mark>measuring</mark>&gt; &amp;") {
+		t.Errorf("expected an escaped snippet, got %+v", hits)
+	}
+
+	// The triggers keep the index in step with the table.
+	mallet, _ := db.GetProduct(3)
+	mallet.Name = "Rubber mallet"
+	mallet.Description = "Soft head."
+	if err := db.UpdateProduct(mallet); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteProduct(1); err != nil {
+		t.Fatal(err)
+	}
+	hits, _ = db.SearchProducts("rubber", 10, 0)
+	if got := productNames(hits); !reflect.DeepEqual(got, []string{"Rubber mallet"}) {
+		t.Errorf("expected the index updated, got %v", got)
+	}
+
+	hits, _ = db.SearchProducts("steel", 1, 0)
+	if got := productNames(hits); !reflect.DeepEqual(got, []string{"Steel rule"}) {
+		t.Errorf("expected one hit per page, got %v", got)
+	}
+}
+
+func TestSearchUsersFTS(t *testing.T) {
+	db := newMigratedDB(t)
+	if ok, err := db.hasTable(context.Background(), "users_fts"); err != nil || !ok {
+		t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+	}
+	seedUsers(t, db, 3, 1)
+
+	hits, err := db.SearchUsers("user0000001", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Item.ID != 2 {
+		t.Errorf("expected user 2, got %+v", hits)
+	}
+	if hits, _ := db.SearchUsers("email:example", 10, 0); len(hits) != 3 {
+		t.Errorf("expected every user by email, got %d", len(hits))
+	}
+}
+
+func TestSearchFallsBackToLike(t *testing.T) {
+	// Leaving out the FTS5 migration leaves the database without search
+	// indexes, as if SQLite lacked FTS5.
+	files := fstest.MapFS{}
+	names, _ := fs.Glob(embeddedMigrations(), "*.sql")
+	for _, name := range names {
+		if !strings.HasPrefix(name, "0006_") {
+			data, _ := fs.ReadFile(embeddedMigrations(), name)
+			files[name] = &fstest.MapFile{Data: data}
+		}
+	}
+	db := newTestDB(t)
+	m, err := NewMigrator(db, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	seedCatalog(t, db)
+
+	for query, want := range map[string][]string{
+		"steel":                     {"Claw hammer", "Mallet", "Steel rule"},
+		"STEEL name:rule":           {"Steel rule"},
+		`"rubber grip"`:             {"Claw hammer"},
+		"50%":                       nil,
+		`description:"no steel"`:    {"Mallet"},
+		`name:steel description:cm`: {"Steel rule"},
+	} {
+		hits, err := db.SearchProducts(query, 10, 0)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if got := productNames(hits); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", query, want, got)
+		}
+	}
+
+	hits, _ := db.SearchProducts("measuring", 10, 0)
+	if len(hits) != 1 || hits[0].Snippet != "A 30 cm rule for &lt;<mark>measuring</mark>&gt; &amp; marking." {
+		t.Errorf("expected an escaped snippet, got %+v", hits)
+	}
+	if hits, _ := db.SearchProducts("steel", 2, 1); !reflect.DeepEqual(productNames(hits), []string{"Mallet", "Steel rule"}) {
+		t.Errorf("expected the second page, got %v", productNames(hits))
+	}
+}
+
+func TestLikeSnippetWindow(t *testing.T) {
+	text := strings.Repeat("é", 60) + " needle " + strings.Repeat("x", 100)
+	got := likeSnippet([]string{"no match", text}, []searchTerm{{text: "NEEDLE"}})
+	if !strings.HasPrefix(got, "…é") || !strings.HasSuffix(got, "x…") || !strings.Contains(got, " <mark>needle</mark> ") {
+		t.Errorf("unexpected snippet %q", got)
+	}
+}
@@ -0,0 +1,1011 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a file format for imports and exports.
+type Format string
+
+const (
+	CSV Format = "csv"
+	// JSONLines is one JSON object per line.
+	JSONLines Format = "jsonl"
+	// JSON is an array of objects.
+	JSON Format = "json"
+)
+
+// ParseFormat parses a format name, or a file name by its extension.
+func ParseFormat(name string) (Format, error) {
+	if ext := filepath.Ext(name); ext != "" {
+		name = ext[1:]
+	}
+	switch f := Format(strings.ToLower(name)); f {
+	case CSV, JSONLines, JSON:
+		return f, nil
+	case "ndjson":
+		return JSONLines, nil
+	}
+	return "", fmt.Errorf("unknown format %q; use csv, jsonl or json", name)
+}
+
+// transferField is a column of imports and exports. Values are text in
+// CSV and JSON strings, numbers or booleans otherwise.
+type transferField[T any] struct {
+	name string
+	// get returns the value to export, or is nil for a field that is only
+	// imported.
+	get func(*T) any
+	// set parses an imported value, or is nil for a field that is only
+	// exported. Empty values are not set.
+	set func(*T, string) error
+	// secret fields are only exported when ExportOptions.IncludeSecrets
+	// is set.
+	secret bool
+}
+
+func stringField[T any](name string, ptr func(*T) *string) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return *ptr(v) },
+		set:  func(v *T, s string) error { *ptr(v) = s; return nil },
+	}
+}
+
+func intField[T any](name string, ptr func(*T) *int) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return *ptr(v) },
+		set: func(v *T, s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return errors.New("must be an integer")
+			}
+			*ptr(v) = n
+			return nil
+		},
+	}
+}
+
+func boolField[T any](name string, ptr func(*T) *bool) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return *ptr(v) },
+		set: func(v *T, s string) error {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return errors.New("must be true or false")
+			}
+			*ptr(v) = b
+			return nil
+		},
+	}
+}
+
+func timeField[T any](name string, ptr func(*T) *time.Time) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return *ptr(v) },
+		set: func(v *T, s string) error {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return errors.New("must be an RFC 3339 time")
+			}
+			*ptr(v) = t.UTC()
+			return nil
+		},
+	}
+}
+
+// currencyField is the currency of a Money. It comes before the Money's
+// moneyField, which needs the currency to parse the amount.
+func currencyField[T any](name string, ptr func(*T) *Money) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return ptr(v).Currency() },
+		set: func(v *T, s string) error {
+			if _, ok := currencyDigits[s]; !ok {
+				return errors.New("must be a supported currency code, such as USD")
+			}
+			*ptr(v) = NewMoney(0, s)
+			return nil
+		},
+	}
+}
+
+// moneyField is the amount of a Money, written as a decimal string.
+func moneyField[T any](name string, ptr func(*T) *Money) transferField[T] {
+	return transferField[T]{
+		name: name,
+		get:  func(v *T) any { return ptr(v).Decimal() },
+		set: func(v *T, s string) error {
+			currency := ptr(v).Currency()
+			if currency == "" {
+				return errors.New("needs a currency")
+			}
+			m, err := ParseMoney(s, currency)
+			if err != nil {
+				return errors.New("must be an amount in " + currency)
+			}
+			*ptr(v) = m
+			return nil
+		},
+	}
+}
+
+func secretField[T any](f transferField[T]) transferField[T] {
+	f.secret = true
+	return f
+}
+
+// transferSpec is how a model is imported and exported.
+type transferSpec[T any] struct {
+	table  string
+	fields []transferField[T]
+	// key is the unique column an upsert matches existing rows by.
+	key string
+	// prepare fills in an imported model's defaults and validates it.
+	prepare func(*T) error
+}
+
+// userTransfer leaves password hashes out of exports unless they are asked
+// for, so a plain export cannot be imported back: every user needs a
+// password or a hash. Imports take either, and hash the password.
+var userTransfer = transferSpec[User]{
+	table: "users",
+	fields: []transferField[User]{
+		intField("id", func(u *User) *int { return &u.ID }),
+		stringField("username", func(u *User) *string { return &u.Username }),
+		stringField("email", func(u *User) *string { return &u.Email }),
+		secretField(stringField("password_hash", func(u *User) *string { return &u.PasswordHash })),
+		{name: "password", set: func(u *User, s string) error {
+			hash, err := hashPassword(s)
+			u.PasswordHash = hash
+			return err
+		}},
+		timeField("created_at", func(u *User) *time.Time { return &u.CreatedAt }),
+		timeField("updated_at", func(u *User) *time.Time { return &u.UpdatedAt }),
+	},
+	key: "email",
+	prepare: func(u *User) error {
+		stampImported(&u.CreatedAt, &u.UpdatedAt)
+		return validateUser(u)
+	},
+}
+
+var productTransfer = transferSpec[Product]{
+	table: "products",
+	fields: []transferField[Product]{
+		intField("id", func(p *Product) *int { return &p.ID }),
+		stringField("name", func(p *Product) *string { return &p.Name }),
+		stringField("description", func(p *Product) *string { return &p.Description }),
+		currencyField("currency", func(p *Product) *Money { return &p.Price }),
+		moneyField("price", func(p *Product) *Money { return &p.Price }),
+		intField("stock", func(p *Product) *int { return &p.Stock }),
+		boolField("active", func(p *Product) *bool { return &p.Active }),
+		timeField("created_at", func(p *Product) *time.Time { return &p.CreatedAt }),
+		timeField("updated_at", func(p *Product) *time.Time { return &p.UpdatedAt }),
+	},
+	key: "id",
+	prepare: func(p *Product) error {
+		stampImported(&p.CreatedAt, &p.UpdatedAt)
+		return validateProduct(p)
+	},
+}
+
+// stampImported keeps an imported row's timestamps, and sets those it
+// lacks to now.
+func stampImported(created, updated *time.Time) {
+	now := time.Now().UTC()
+	if created.IsZero() {
+		*created = now
+	}
+	if updated.IsZero() {
+		*updated = *created
+	}
+}
+
+// imported returns the names of the fields that are imported.
+func (s transferSpec[T]) imported() []string {
+	var names []string
+	for _, f := range s.fields {
+		if f.set != nil {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// exported returns the fields that are exported, with the secret ones
+// only if secrets is set.
+func (s transferSpec[T]) exported(secrets bool) []transferField[T] {
+	var fields []transferField[T]
+	for _, f := range s.fields {
+		if f.get != nil && (secrets || !f.secret) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// decode builds a model from a record, reporting every bad field.
+func (s transferSpec[T]) decode(line int, values map[string]string) (*T, []RowError) {
+	v := new(T)
+	var errs []RowError
+	for _, f := range s.fields {
+		text := values[f.name]
+		if f.set == nil || text == "" {
+			continue
+		}
+		if err := f.set(v, text); err != nil {
+			errs = append(errs, rowError(line, f.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := s.prepare(v); err != nil {
+		return nil, []RowError{rowError(line, "", err)}
+	}
+	return v, nil
+}
+
+type ExportOptions struct {
+	Format Format
+	// IncludeSecrets exports users' password hashes as well, so that the
+	// export can be imported elsewhere with their logins intact.
+	IncludeSecrets bool
+}
+
+// ExportUsers writes every user to w, as they are read. It returns the
+// number written.
+func (db *Database) ExportUsers(ctx context.Context, w io.Writer, opts ExportOptions) (int, error) {
+	return export(ctx, db.Users(), userTransfer, w, opts)
+}
+
+// ExportProducts writes every product to w, as they are read.
+func (db *Database) ExportProducts(ctx context.Context, w io.Writer, opts ExportOptions) (int, error) {
+	return export(ctx, db.Products(), productTransfer, w, opts)
+}
+
+func export[T any](ctx context.Context, r *Repository[T], spec transferSpec[T], w io.Writer, opts ExportOptions) (int, error) {
+	fields := spec.exported(opts.IncludeSecrets)
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.name
+	}
+	out, err := newRecordWriter(w, opts.Format, columns)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := r.query(ctx, r.selectQuery().Sortable("id").OrderBy("id"))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	values := make([]any, len(fields))
+	err = ScanEach(rows, func(v *T) error {
+		for i, f := range fields {
+			values[i] = f.get(v)
+		}
+		n++
+		return out.write(values)
+	})
+	if err != nil {
+		return n, handleDatabaseError(err)
+	}
+	return n, out.close()
+}
+
+// recordWriter writes export rows, one value per column.
+type recordWriter interface {
+	write(values []any) error
+	close() error
+}
+
+func newRecordWriter(w io.Writer, format Format, columns []string) (recordWriter, error) {
+	switch format {
+	case CSV:
+		out := &csvWriter{w: csv.NewWriter(w), record: make([]string, len(columns))}
+		return out, out.w.Write(columns)
+	case JSONLines, JSON:
+		return &jsonWriter{w: bufio.NewWriter(w), columns: columns, array: format == JSON}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q; use csv, jsonl or json", format)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (c *csvWriter) write(values []any) error {
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			c.record[i] = v
+		case time.Time:
+			c.record[i] = v.Format(time.RFC3339Nano)
+		default:
+			c.record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonWriter writes objects with their keys in column order, one per
+// line, inside an array if array is set.
+type jsonWriter struct {
+	w       *bufio.Writer
+	columns []string
+	array   bool
+	n       int
+}
+
+func (j *jsonWriter) write(values []any) error {
+	switch {
+	case j.array && j.n == 0:
+		j.w.WriteString("[\n")
+	case j.array:
+		j.w.WriteString(",\n")
+	}
+	j.n++
+
+	j.w.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(j.columns[i])
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		j.w.Write(key)
+		j.w.WriteByte(':')
+		j.w.Write(value)
+	}
+	j.w.WriteByte('}')
+	if !j.array {
+		j.w.WriteByte('\n')
+	}
+	// bufio.Writer remembers the first failed write; Flush returns it.
+	return nil
+}
+
+func (j *jsonWriter) close() error {
+	switch {
+	case j.array && j.n == 0:
+		j.w.WriteString("[]\n")
+	case j.array:
+		j.w.WriteString("\n]\n")
+	}
+	return j.w.Flush()
+}
+
+// ConflictMode is what an import does with a row that collides with an
+// existing one on a unique column.
+type ConflictMode string
+
+const (
+	// ConflictFail reports the row as an error.
+	ConflictFail ConflictMode = "fail"
+	// ConflictSkip keeps the existing row.
+	ConflictSkip ConflictMode = "skip"
+	// ConflictUpdate overwrites the existing row that has the same key,
+	// users' email or products' ID, keeping its creation time.
+	ConflictUpdate ConflictMode = "update"
+)
+
+// ErrTooManyErrors stops an import that has rejected ImportOptions.MaxErrors
+// rows.
+var ErrTooManyErrors = errors.New("too many invalid rows")
+
+type ImportOptions struct {
+	Format Format
+	// BatchSize is the number of rows written per transaction; zero means
+	// 500. Rows of committed batches stay imported if a later one fails.
+	BatchSize int
+	// DryRun checks and writes every row in one transaction, which it
+	// rolls back at the end, so that the report says what the import would
+	// do, including collisions between rows of different batches. The
+	// transaction holds SQLite's write lock for the whole run.
+	DryRun bool
+	// OnConflict is ConflictFail unless set.
+	OnConflict ConflictMode
+	// MaxErrors stops the import after that many errors, rolling back the
+	// batch in progress; zero means no limit.
+	MaxErrors int
+}
+
+// RowError is a problem with one imported row.
+type RowError struct {
+	Line int `json:"line"`
+	// Field is the column at fault, when there is one.
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (e *RowError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Reason)
+}
+
+// rowError describes err, taking the field from a validation or
+// constraint error when it names one.
+func rowError(line int, field string, err error) RowError {
+	var validation *ValidationError
+	var constraint *ConstraintError
+	switch {
+	case errors.As(err, &validation):
+		return RowError{Line: line, Field: validation.Field, Reason: validation.Reason}
+	case errors.As(err, &constraint):
+		return RowError{Line: line, Field: constraint.Column, Reason: constraint.Error()}
+	}
+	return RowError{Line: line, Field: field, Reason: err.Error()}
+}
+
+// ImportReport is the outcome of an import. In a dry run the counts are
+// what the import would have done.
+type ImportReport struct {
+	// Rows is the number of rows read.
+	Rows int `json:"rows"`
+	// Written counts the rows inserted or updated.
+	Written int `json:"written"`
+	// Skipped counts the rows that collided with existing ones under
+	// ConflictSkip.
+	Skipped int        `json:"skipped"`
+	Errors  []RowError `json:"errors"`
+}
+
+// ImportUsers reads users from r and inserts them in batches.
+func (db *Database) ImportUsers(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	return importRecords(ctx, db, userTransfer, r, opts)
+}
+
+// ImportProducts reads products from r and inserts them in batches.
+func (db *Database) ImportProducts(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	return importRecords(ctx, db, productTransfer, r, opts)
+}
+
+// importRow is a decoded row waiting for its batch to be written.
+type importRow[T any] struct {
+	line  int
+	model *T
+}
+
+// importer writes batches of rows and keeps the report.
+type importer[T any] struct {
+	db   *Database
+	spec transferSpec[T]
+	opts ImportOptions
+	// dryRun is the transaction of a dry run, shared by every batch.
+	dryRun *Tx
+	report ImportReport
+}
+
+// importRecords reads rows as they are needed, checks each, and writes
+// them a batch at a time, each in its own transaction. A row the database
+// rejects is rolled back to a savepoint and reported, and the rest of its
+// batch is still written.
+func importRecords[T any](ctx context.Context, db *Database, spec transferSpec[T], r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = ConflictFail
+	case ConflictFail, ConflictSkip, ConflictUpdate:
+	default:
+		return nil, fmt.Errorf("unknown conflict mode %q; use fail, skip or update", opts.OnConflict)
+	}
+	records, err := newRecordReader(r, opts.Format, spec.imported())
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer[T]{db: db, spec: spec, opts: opts}
+	if opts.DryRun {
+		if im.dryRun, err = db.BeginTx(ctx, nil); err != nil {
+			return nil, handleDatabaseError(err)
+		}
+		defer im.dryRun.Rollback()
+	}
+	batch := make([]importRow[T], 0, opts.BatchSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return &im.report, err
+		}
+		line, values, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		var bad *RowError
+		if errors.As(err, &bad) {
+			im.report.Rows++
+			if err := im.reject(*bad); err != nil {
+				return &im.report, err
+			}
+			continue
+		}
+		if err != nil {
+			return &im.report, err
+		}
+
+		im.report.Rows++
+		model, errs := spec.decode(line, values)
+		if err := im.reject(errs...); err != nil {
+			return &im.report, err
+		}
+		if model == nil {
+			continue
+		}
+		if batch = append(batch, importRow[T]{line, model}); len(batch) == opts.BatchSize {
+			if err := im.write(ctx, batch); err != nil {
+				return &im.report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := im.write(ctx, batch); err != nil {
+			return &im.report, err
+		}
+	}
+	return &im.report, nil
+}
+
+// reject reports errs, and fails once there are too many.
+func (im *importer[T]) reject(errs ...RowError) error {
+	im.report.Errors = append(im.report.Errors, errs...)
+	if n := len(im.report.Errors); len(errs) > 0 && im.opts.MaxErrors > 0 && n >= im.opts.MaxErrors {
+		return fmt.Errorf("%w: stopped after %d errors", ErrTooManyErrors, n)
+	}
+	return nil
+}
+
+func (im *importer[T]) write(ctx context.Context, batch []importRow[T]) error {
+	tx := im.dryRun
+	if tx == nil {
+		var err error
+		if tx, err = im.db.BeginTx(ctx, nil); err != nil {
+			return handleDatabaseError(err)
+		}
+		defer tx.Rollback()
+	}
+
+	var written, skipped int
+	for _, row := range batch {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+			return handleDatabaseError(err)
+		}
+		n, err := insertImported(ctx, tx, im.spec, row.model, im.opts.OnConflict)
+		var constraint *ConstraintError
+		if errors.As(err, &constraint) {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_row"); err != nil {
+				return handleDatabaseError(err)
+			}
+			if err := im.reject(rowError(row.line, "", err)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("line %d: %w", row.line, err)
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT import_row"); err != nil {
+			return handleDatabaseError(err)
+		}
+
+		switch {
+		case constraint != nil:
+		case n == 0:
+			skipped++
+		default:
+			written++
+		}
+	}
+
+	if tx != im.dryRun {
+		if err := tx.Commit(); err != nil {
+			return handleDatabaseError(err)
+		}
+	}
+	im.report.Written += written
+	im.report.Skipped += skipped
+	return nil
+}
+
+// insertImported inserts v, or handles a collision as mode says, and
+// returns the number of rows written. Unlike Insert it keeps a zero ID
+// unread, since skipped rows return none.
+func insertImported[T any](ctx context.Context, q Querier, spec transferSpec[T], v *T, mode ConflictMode) (int64, error) {
+	plan, err := planFor(reflect.TypeFor[T]())
+	if err != nil {
+		return 0, err
+	}
+	value := reflect.ValueOf(v).Elem()
+	var cols, update []string
+	var vals []any
+	for i, f := range plan.fields {
+		field := value.FieldByIndex(f.index)
+		if i == plan.pk && field.IsZero() {
+			continue
+		}
+		cols = append(cols, f.column)
+		vals = append(vals, f.value(value))
+		if i != plan.pk && f.column != spec.key && f.column != "created_at" {
+			update = append(update, f.column)
+		}
+	}
+
+	ib := NewInsert(spec.table).Dialect(q.Dialect()).Columns(cols...).Values(vals...)
+	switch mode {
+	case ConflictSkip:
+		ib.OnConflictDoNothing()
+	case ConflictUpdate:
+		ib.OnConflictUpdate([]string{spec.key}, update...)
+	}
+	query, args, err := ib.Build()
+	if err != nil {
+		return 0, err
+	}
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, handleDatabaseError(err)
+	}
+	return res.RowsAffected()
+}
+
+// recordReader reads import rows as text by column, with the line each
+// starts on. It returns a *RowError for a row it cannot read but can skip,
+// and io.EOF after the last row.
+type recordReader interface {
+	next() (line int, values map[string]string, err error)
+}
+
+func newRecordReader(r io.Reader, format Format, columns []string) (recordReader, error) {
+	switch format {
+	case CSV:
+		return newCSVReader(r, columns)
+	case JSONLines:
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, maxLineSize)
+		return &jsonLinesReader{s: s, columns: columns}, nil
+	case JSON:
+		return newJSONArrayReader(r, columns)
+	}
+	return nil, fmt.Errorf("unknown format %q; use csv, jsonl or json", format)
+}
+
+// maxLineSize caps a JSON Lines row, and the memory one can take.
+const maxLineSize = 1 << 20
+
+type csvReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+// newCSVReader reads the header, which names the columns in any order.
+func newCSVReader(r io.Reader, columns []string) (*csvReader, error) {
+	c := &csvReader{r: csv.NewReader(r)}
+	header, err := c.r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("line 1: missing the CSV header")
+		}
+		return nil, err
+	}
+	// Spreadsheets often start UTF-8 files with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	for _, col := range header {
+		if !slices.Contains(columns, col) {
+			return nil, fmt.Errorf("line 1: unknown column %q; use %s", col, strings.Join(columns, ", "))
+		}
+	}
+	c.header = header
+	return c, nil
+}
+
+func (c *csvReader) next() (int, map[string]string, error) {
+	record, err := c.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.StartLine, nil, &RowError{Line: parseErr.StartLine, Reason: parseErr.Err.Error()}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	line, _ := c.r.FieldPos(0)
+	values := make(map[string]string, len(record))
+	for i, col := range c.header {
+		values[col] = record[i]
+	}
+	return line, values, nil
+}
+
+type jsonLinesReader struct {
+	s       *bufio.Scanner
+	columns []string
+	line    int
+}
+
+func (j *jsonLinesReader) next() (int, map[string]string, error) {
+	for j.s.Scan() {
+		j.line++
+		if len(strings.TrimSpace(j.s.Text())) == 0 {
+			continue
+		}
+		values, err := jsonRecord(j.line, j.s.Bytes(), j.columns)
+		return j.line, values, err
+	}
+	if err := j.s.Err(); err != nil {
+		return 0, nil, fmt.Errorf("line %d: %w", j.line+1, err)
+	}
+	return 0, nil, io.EOF
+}
+
+// jsonArrayReader decodes an array's elements one at a time.
+type jsonArrayReader struct {
+	d       *json.Decoder
+	lines   *lineCounter
+	columns []string
+}
+
+func newJSONArrayReader(r io.Reader, columns []string) (*jsonArrayReader, error) {
+	lines := &lineCounter{r: r}
+	j := &jsonArrayReader{d: json.NewDecoder(lines), lines: lines, columns: columns}
+	if tok, err := j.d.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("line %d: expected a JSON array", lines.lineAt(j.d.InputOffset()))
+	}
+	return j, nil
+}
+
+func (j *jsonArrayReader) next() (int, map[string]string, error) {
+	if !j.d.More() {
+		if _, err := j.d.Token(); err != nil {
+			return 0, nil, fmt.Errorf("line %d: %w", j.lines.lineAt(j.d.InputOffset()), err)
+		}
+		return 0, nil, io.EOF
+	}
+	var raw json.RawMessage
+	if err := j.d.Decode(&raw); err != nil {
+		// The decoder cannot find the next element after a syntax error.
+		offset := j.d.InputOffset()
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			offset = syntaxErr.Offset
+		}
+		return 0, nil, fmt.Errorf("line %d: %w", j.lines.lineAt(offset), err)
+	}
+	line := j.lines.lineAt(j.d.InputOffset() - int64(len(raw)))
+	values, err := jsonRecord(line, raw, j.columns)
+	return line, values, err
+}
+
+// jsonRecord reads a JSON object of scalars as text by key. Nulls are
+// left out, as are empty CSV cells.
+func jsonRecord(line int, data []byte, columns []string) (map[string]string, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return nil, &RowError{Line: line, Reason: "must be a JSON object"}
+	}
+	values := make(map[string]string, len(object))
+	for key, raw := range object {
+		if !slices.Contains(columns, key) {
+			return nil, &RowError{Line: line, Field: key, Reason: "is not a column"}
+		}
+		switch raw[0] {
+		case 'n':
+		case '"':
+			var s string
+			json.Unmarshal(raw, &s)
+			values[key] = s
+		case '{', '[':
+			return nil, &RowError{Line: line, Field: key, Reason: "must be a string, number or boolean"}
+		default:
+			values[key] = string(raw)
+		}
+	}
+	return values, nil
+}
+
+// lineCounter numbers the lines of what is read through it, keeping only
+// the offsets of newlines not yet passed.
+type lineCounter struct {
+	r        io.Reader
+	read     int64
+	newlines []int64
+	passed   int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.read+int64(i))
+		}
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// lineAt returns the line of the byte at offset. Offsets must not
+// decrease from one call to the next.
+func (c *lineCounter) lineAt(offset int64) int {
+	for len(c.newlines) > 0 && c.newlines[0] < offset {
+		c.newlines = c.newlines[1:]
+		c.passed++
+	}
+	return c.passed + 1
+}
+
+// runExport implements the export subcommand:
+//
+//	export [-db URL] [-format F] [-include-secrets] users | products [FILE]
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	databaseURL := databaseFlag(flags)
+	formatName := flags.String("format", "", "csv, jsonl or json (default from FILE's extension, else jsonl)")
+	var opts ExportOptions
+	flags.BoolVar(&opts.IncludeSecrets, "include-secrets", false, "export users' password hashes too")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: export [flags] users | products [FILE]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("export takes a table and an optional file")
+	}
+	format, err := transferFormat(*formatName, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	opts.Format = format
+
+	db, err := NewDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if path := flags.Arg(1); path != "" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	var n int
+	switch table := flags.Arg(0); table {
+	case "users":
+		n, err = db.ExportUsers(ctx, out, opts)
+	case "products":
+		n, err = db.ExportProducts(ctx, out, opts)
+	default:
+		err = fmt.Errorf("cannot export %q; use users or products", table)
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d %s\n", n, flags.Arg(0))
+	return nil
+}
+
+// runImport implements the import subcommand:
+//
+//	import [-db URL] [-format F] [-dry-run] [-on-conflict fail|skip|update]
+//	       [-batch N] [-max-errors N] users | products [FILE]
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	databaseURL := databaseFlag(flags)
+	formatName := flags.String("format", "", "csv, jsonl or json (default from FILE's extension, else jsonl)")
+	var opts ImportOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "check and report every row without importing any")
+	onConflict := flags.String("on-conflict", string(ConflictFail), "what to do with rows that collide with existing ones: fail, skip or update")
+	flags.IntVar(&opts.BatchSize, "batch", 500, "rows per transaction")
+	flags.IntVar(&opts.MaxErrors, "max-errors", 100, "stop after this many errors; 0 for no limit")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: import [flags] users | products [FILE]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("import takes a table and an optional file")
+	}
+	format, err := transferFormat(*formatName, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	opts.Format, opts.OnConflict = format, ConflictMode(*onConflict)
+
+	db, err := NewDatabase(*databaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var r io.Reader = os.Stdin
+	if path := flags.Arg(1); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := context.Background()
+	var report *ImportReport
+	switch table := flags.Arg(0); table {
+	case "users":
+		report, err = db.ImportUsers(ctx, r, opts)
+	case "products":
+		report, err = db.ImportProducts(ctx, r, opts)
+	default:
+		return fmt.Errorf("cannot import %q; use users or products", table)
+	}
+	if report != nil {
+		printImportReport(os.Stderr, report, opts.DryRun)
+	}
+	if err == nil && len(report.Errors) > 0 {
+		err = fmt.Errorf("%d errors", len(report.Errors))
+	}
+	return err
+}
+
+// transferFormat picks the format named by the flag, or else by the
+// file's extension.
+func transferFormat(flagValue, path string) (Format, error) {
+	switch {
+	case flagValue != "":
+		return ParseFormat(flagValue)
+	case filepath.Ext(path) != "":
+		return ParseFormat(path)
+	}
+	return JSONLines, nil
+}
+
+func printImportReport(w io.Writer, report *ImportReport, dryRun bool) {
+	for _, e := range report.Errors {
+		fmt.Fprintln(w, e.Error())
+	}
+	verb := "wrote"
+	if dryRun {
+		verb = "would write"
+	}
+	fmt.Fprintf(w, "read %d rows: %s %d, skipped %d, %d errors\n",
+		report.Rows, verb, report.Written, report.Skipped, len(report.Errors))
+}
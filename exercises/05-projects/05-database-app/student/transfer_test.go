@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormats(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, p := range []*Product{
+		{Name: "Anvil", Description: `Heavy, "solid"`, Price: usd("120"), Stock: 2, Active: true},
+		{Name: "Bolt", Price: usd("0.25"), Stock: 1000},
+	} {
+		if err := db.CreateProduct(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec(db, `UPDATE products SET created_at = ?, updated_at = ?`, at, at)
+
+	tests := map[Format]string{
+		CSV: "id,name,description,currency,price,stock,active,created_at,updated_at\n" +
+			`1,Anvil,"Heavy, ""solid""",USD,120.00,2,true,2024-05-01T12:00:00Z,2024-05-01T12:00:00Z` + "\n" +
+			"2,Bolt,,USD,0.25,1000,false,2024-05-01T12:00:00Z,2024-05-01T12:00:00Z\n",
+		JSONLines: `{"id":1,"name":"Anvil","description":"Heavy, \"solid\"","currency":"USD","price":"120.00","stock":2,"active":true,"created_at":"2024-05-01T12:00:00Z","updated_at":"2024-05-01T12:00:00Z"}` + "\n" +
+			`{"id":2,"name":"Bolt","description":"","currency":"USD","price":"0.25","stock":1000,"active":false,"created_at":"2024-05-01T12:00:00Z","updated_at":"2024-05-01T12:00:00Z"}` + "\n",
+		JSON: "[\n" +
+			`{"id":1,"name":"Anvil","description":"Heavy, \"solid\"","currency":"USD","price":"120.00","stock":2,"active":true,"created_at":"2024-05-01T12:00:00Z","updated_at":"2024-05-01T12:00:00Z"}` + ",\n" +
+			`{"id":2,"name":"Bolt","description":"","currency":"USD","price":"0.25","stock":1000,"active":false,"created_at":"2024-05-01T12:00:00Z","updated_at":"2024-05-01T12:00:00Z"}` + "\n]\n",
+	}
+	for format, want := range tests {
+		var buf bytes.Buffer
+		n, err := db.ExportProducts(ctx, &buf, ExportOptions{Format: format})
+		if err != nil || n != 2 {
+			t.Fatalf("%s: exported %d: %v", format, n, err)
+		}
+		if buf.String() != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", format, want, buf.String())
+		}
+
+		// Every format reads back what it wrote.
+		copy := newMigratedDB(t)
+		report, err := copy.ImportProducts(ctx, &buf, ImportOptions{Format: format})
+		if err != nil || report.Written != 2 || len(report.Errors) > 0 {
+			t.Fatalf("%s: reimport: %+v %v", format, report, err)
+		}
+		for id := 1; id <= 2; id++ {
+			original, _ := db.GetProduct(id)
+			imported, err := copy.GetProduct(id)
+			if err != nil || !reflect.DeepEqual(imported, original) {
+				t.Errorf("%s: expected %+v back, got %+v (%v)", format, original, imported, err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := newMigratedDB(t).ExportUsers(ctx, &buf, ExportOptions{Format: JSON}); err != nil || buf.String() != "[]\n" {
+		t.Errorf("expected an empty array, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestExportUsersLeavesOutHashesUnlessAsked(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+	if err := db.CreateUser(&User{Username: "ann", Email: "ann@example.com", PasswordHash: "secret-hash"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := db.ExportUsers(ctx, &buf, ExportOptions{Format: CSV}); err != nil {
+		t.Fatal(err)
+	}
+	if header, _, _ := strings.Cut(buf.String(), "\n"); header != "id,username,email,created_at,updated_at" {
+		t.Errorf("unexpected header %q", header)
+	}
+	if strings.Contains(buf.String(), "secret-hash") {
+		t.Errorf("export leaked the password hash:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if _, err := db.ExportUsers(ctx, &buf, ExportOptions{Format: CSV, IncludeSecrets: true}); err != nil {
+		t.Fatal(err)
+	}
+	copy := newMigratedDB(t)
+	report, err := copy.ImportUsers(ctx, &buf, ImportOptions{Format: CSV})
+	if err != nil || report.Written != 1 || len(report.Errors) > 0 {
+		t.Fatalf("reimport: %+v %v", report, err)
+	}
+	if user, err := copy.GetUser(1); err != nil || user.PasswordHash != "secret-hash" {
+		t.Errorf("expected the hash to be imported, got %+v (%v)", user, err)
+	}
+}
+
+func TestImportReportsBadRows(t *testing.T) {
+	iterations := passwordIterations
+	passwordIterations = 1000
+	t.Cleanup(func() { passwordIterations = iterations })
+
+	db := newMigratedDB(t)
+	ctx := context.Background()
+	input := strings.Join([]string{
+		"\ufeffusername,email,password,created_at",
+		"ann,ann@example.com,correct horse,2020-01-02T03:04:05Z",
+		"bob,not an email,correct horse,",
+		"cy,cy@example.com,short,yesterday",
+		"dee,ann@example.com,correct horse,",
+		`"eve,eve@example.com,correct horse,`,
+	}, "\n")
+
+	report, err := db.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: CSV, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RowError{
+		{Line: 3, Field: "email", Reason: "must be a valid email address"},
+		{Line: 4, Field: "password", Reason: "must be at least 8 characters"},
+		{Line: 4, Field: "created_at", Reason: "must be an RFC 3339 time"},
+		{Line: 5, Field: "email", Reason: "unique constraint violated on email"},
+		{Line: 6, Reason: `extraneous or missing " in quoted-field`},
+	}
+	if !reflect.DeepEqual(report.Errors, want) {
+		t.Errorf("expected errors\n%+v\ngot\n%+v", want, report.Errors)
+	}
+	if report.Rows != 5 || report.Written != 1 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+	ann, err := db.GetUser(1)
+	if err != nil || !ann.CreatedAt.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) || !strings.HasPrefix(ann.PasswordHash, "pbkdf2-sha256$1000$") {
+		t.Errorf("unexpected import %+v (%v)", ann, err)
+	}
+
+	if _, err := db.ImportUsers(ctx, strings.NewReader("username,admin\n"), ImportOptions{Format: CSV}); err == nil {
+		t.Error("expected an unknown column to fail the import")
+	}
+	// The row that reaches the limit is reported in full.
+	report, err = db.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: CSV, MaxErrors: 2})
+	if !errors.Is(err, ErrTooManyErrors) || report.Rows != 3 || len(report.Errors) != 3 {
+		t.Errorf("expected to stop on line 4, got %v with %+v", err, report)
+	}
+}
+
+func TestImportJSONLineNumbers(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+
+	lines := `{"name":"Anvil","currency":"USD","price":"120","stock":2}
+
+{"name":"Bolt","currency":"USD","price":0.25,"active":true}
+{"name":"Crate","price":{"amount":"15"}}
+{"name":"Drill",
+["not an object"]
+{"name":"Epoxy","colour":"clear"}
+{"name":"Epoxy","price":null}
+{"name":"Fuse","price":"2"}
+{"name":"Glue","currency":"XYZ","price":"2"}
+`
+	report, err := db.ImportProducts(ctx, strings.NewReader(lines), ImportOptions{Format: JSONLines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RowError{
+		{Line: 4, Field: "price", Reason: "must be a string, number or boolean"},
+		{Line: 5, Reason: "must be a JSON object"},
+		{Line: 6, Reason: "must be a JSON object"},
+		{Line: 7, Field: "colour", Reason: "is not a column"},
+		{Line: 9, Field: "price", Reason: "needs a currency"},
+		{Line: 10, Field: "currency", Reason: "must be a supported currency code, such as USD"},
+		{Line: 10, Field: "price", Reason: "needs a currency"},
+	}
+	if !reflect.DeepEqual(report.Errors, want) || report.Written != 3 {
+		t.Errorf("expected errors %+v and 3 written, got %+v", want, report)
+	}
+	if bolt, _ := db.GetProduct(2); bolt.Price != usd("0.25") || !bolt.Active {
+		t.Errorf("unexpected import %+v", bolt)
+	}
+
+	array := `[
+  {
+    "name": "Flux",
+    "currency": "EUR",
+    "price": "3"
+  },
+  {
+    "name": "",
+    "currency": "EUR",
+    "price": "1"
+  }
+]`
+	report, err = db.ImportProducts(ctx, strings.NewReader(array), ImportOptions{Format: JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []RowError{{Line: 7, Field: "name", Reason: "is required"}}; !reflect.DeepEqual(report.Errors, want) || report.Written != 1 {
+		t.Errorf("expected errors %+v and 1 written, got %+v", want, report)
+	}
+
+	_, err = db.ImportProducts(ctx, strings.NewReader("[\n{\"name\": \"Gear\"},\n{\"name\" \"Hinge\"}\n]"), ImportOptions{Format: JSON})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Errorf("expected a syntax error on line 3, got %v", err)
+	}
+}
+
+func TestImportConflictModes(t *testing.T) {
+	db := newMigratedDB(t)
+	ctx := context.Background()
+	seedProducts(t, db)
+	anvil, _ := db.GetProduct(1)
+
+	input := func() *strings.Reader {
+		return strings.NewReader("id,name,currency,price,stock\n1,Anvil,USD,99.50,7\n,Gear,USD,4,10\n")
+	}
+	count := func() int {
+		n, _ := db.Products().Count(ctx)
+		return n
+	}
+
+	report, err := db.ImportProducts(ctx, input(), ImportOptions{Format: CSV, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Written != 1 || len(report.Errors) != 1 || report.Errors[0].Field != "id" || count() != 5 {
+		t.Errorf("expected a dry run to report the clash and write nothing, got %+v and %d products", report, count())
+	}
+
+	// A dry run sees the rows of earlier batches, as the import would.
+	users := "username,email,password_hash\nann,ann@example.com,h\nanne,ann@example.com,h\n"
+	report, err = db.ImportUsers(ctx, strings.NewReader(users), ImportOptions{Format: CSV, BatchSize: 1, DryRun: true})
+	if want := []RowError{{Line: 3, Field: "email", Reason: "unique constraint violated on email"}}; err != nil || report.Written != 1 || !reflect.DeepEqual(report.Errors, want) {
+		t.Errorf("expected the dry run to catch the duplicate across batches, got %+v (%v)", report, err)
+	}
+	if n, _ := db.Users().Count(ctx); n != 0 {
+		t.Errorf("expected the dry run to leave no users, got %d", n)
+	}
+
+	report, err = db.ImportProducts(ctx, input(), ImportOptions{Format: CSV, OnConflict: ConflictSkip})
+	if err != nil || report.Written != 1 || report.Skipped != 1 || len(report.Errors) != 0 {
+		t.Fatalf("skip: %+v %v", report, err)
+	}
+	if got, _ := db.GetProduct(1); got.Price != anvil.Price || count() != 6 {
+		t.Errorf("expected the anvil kept and the gear added, got %+v", got)
+	}
+
+	report, err = db.ImportProducts(ctx, input(), ImportOptions{Format: CSV, OnConflict: ConflictUpdate})
+	if err != nil || report.Written != 2 || len(report.Errors) != 0 {
+		t.Fatalf("update: %+v %v", report, err)
+	}
+	got, _ := db.GetProduct(1)
+	if got.Price != usd("99.50") || got.Stock != 7 || !got.CreatedAt.Equal(anvil.CreatedAt) || count() != 7 {
+		t.Errorf("expected the anvil updated in place, got %+v", got)
+	}
+
+	if _, err := db.ImportProducts(ctx, input(), ImportOptions{Format: CSV, OnConflict: "merge"}); err == nil {
+		t.Error("expected an unknown conflict mode to fail")
+	}
+}
@@ -1,3 +1,8 @@
 module go-playground
 
 go 1.24.5
+
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.52
+)